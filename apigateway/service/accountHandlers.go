@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+func accountError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.Unauthenticated:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": status.Convert(err).Message()})
+	case codes.PermissionDenied:
+		forbidden(c, err)
+	case codes.FailedPrecondition:
+		c.JSON(http.StatusConflict, gin.H{"error": status.Convert(err).Message()})
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func requestEmailVerification(c *gin.Context) {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	if _, err := userClient.RequestEmailVerification(ctx, &user_proto.RequestEmailVerificationRequest{}); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func verifyEmail(c *gin.Context) {
+	var req user_proto.VerifyEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := userClient.VerifyEmail(context.Background(), &req); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func requestPasswordReset(c *gin.Context) {
+	var req user_proto.RequestPasswordResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := userClient.RequestPasswordReset(withClientInfo(context.Background(), c), &req); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+func resetPassword(c *gin.Context) {
+	var req user_proto.ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := userClient.ResetPassword(withClientInfo(context.Background(), c), &req); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func changePassword(c *gin.Context) {
+	var req user_proto.ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	if _, err := userClient.ChangePassword(withClientInfo(ctx, c), &req); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func unlockAccount(c *gin.Context) {
+	var req user_proto.UnlockAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := userClient.UnlockAccount(context.Background(), &req); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func deleteAccount(c *gin.Context) {
+	var req user_proto.DeleteAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.DeleteAccount(ctx, &req)
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusAccepted, gin.H{"purge_after": &CustomTimestamp{res.PurgeAfter}})
+}
+
+func restoreAccount(c *gin.Context) {
+	var req user_proto.CancelAccountDeletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if _, err := userClient.CancelAccountDeletion(context.Background(), &req); err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+func roleJSON(role *user_proto.Role) gin.H {
+	permissions := role.Permissions
+	if permissions == nil {
+		permissions = []string{}
+	}
+	return gin.H{
+		"id":          role.Id,
+		"name":        role.Name,
+		"description": role.Description,
+		"permissions": permissions,
+		"is_hidden":   role.IsHidden,
+	}
+}
+
+func adminError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.PermissionDenied:
+		c.JSON(http.StatusForbidden, gin.H{"error": status.Convert(err).Message()})
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		c.JSON(http.StatusConflict, gin.H{"error": status.Convert(err).Message()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// adminContext forwards the client address, the service writes it to the
+// audit log.
+func adminContext(c *gin.Context) context.Context {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+	return withClientInfo(ctx, c)
+}
+
+func listRoles(c *gin.Context) {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.ListRoles(ctx, &user_proto.ListRolesRequest{})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	roles := []gin.H{}
+	for _, role := range res.Roles {
+		roles = append(roles, roleJSON(role))
+	}
+	c.JSON(http.StatusOK, gin.H{"roles": roles})
+}
+
+func createRole(c *gin.Context) {
+	var request struct {
+		Name        string   `json:"name"`
+		Description string   `json:"description"`
+		Permissions []string `json:"permissions"`
+		IsHidden    bool     `json:"is_hidden"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	role, err := userClient.CreateRole(adminContext(c), &user_proto.CreateRoleRequest{
+		Name:        request.Name,
+		Description: request.Description,
+		Permissions: request.Permissions,
+		IsHidden:    request.IsHidden,
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, roleJSON(role))
+}
+
+func grantRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	_, err = userClient.GrantRole(adminContext(c), &user_proto.GrantRoleRequest{UserId: int32(userID), Role: c.Param("role")})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func revokeRole(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	_, err = userClient.RevokeRole(adminContext(c), &user_proto.RevokeRoleRequest{UserId: int32(userID), Role: c.Param("role")})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func unlockUser(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	_, err = userClient.UnlockUser(adminContext(c), &user_proto.UnlockUserRequest{UserId: int32(userID)})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func getAccountDeletion(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.GetAccountDeletion(ctx, &user_proto.GetAccountDeletionRequest{UserId: int32(userID)})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	steps := []gin.H{}
+	for _, step := range res.Steps {
+		steps = append(steps, gin.H{
+			"name":       step.Name,
+			"status":     step.Status,
+			"attempts":   step.Attempts,
+			"last_error": step.LastError,
+			"not_before": &CustomTimestamp{step.NotBefore},
+			"updated_at": &CustomTimestamp{step.UpdatedAt},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":           res.Id,
+		"user_id":      res.UserId,
+		"status":       res.Status,
+		"requested_at": &CustomTimestamp{res.RequestedAt},
+		"purge_after":  &CustomTimestamp{res.PurgeAfter},
+		"steps":        steps,
+	})
+}
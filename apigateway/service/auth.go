@@ -1,28 +1,22 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"os"
+	"net/http"
 	"strings"
 
 	auth "github.com/Nicvod/SOA/utils/auth"
 	"github.com/gin-gonic/gin"
-	jwtLib "github.com/golang-jwt/jwt/v5"
 )
 
 func NewAuthProvider(cfg *Config) (*auth.TokenKeys, error) {
-	publicKeyData, err := os.ReadFile(cfg.PublicKeyFile)
+	tokenKeys, err := auth.LoadKeyRing(cfg.KeysDir, false)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read public key file: %w", err)
+		return nil, fmt.Errorf("failed to load verification keys: %w", err)
 	}
-
-	publicKey, err := jwtLib.ParseRSAPublicKeyFromPEM(publicKeyData)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
-	}
-
-	return auth.NewTokenKeys(nil, publicKey), nil
+	return tokenKeys, nil
 }
 
 func AuthMiddleware() gin.HandlerFunc {
@@ -34,15 +28,74 @@ func AuthMiddleware() gin.HandlerFunc {
 			c.AbortWithStatusJSON(401, gin.H{"error": "unauthorized"})
 			return
 		}
+		if tokenInfo.FamilyID != "" {
+			active, err := sessionCache.IsActive(c.Request.Context(), tokenInfo.UserID, tokenInfo.FamilyID)
+			if err != nil {
+				log.Println("Session check failed:", tokenInfo.FamilyID, err)
+				c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "failed to check session"})
+				return
+			}
+			if !active {
+				c.AbortWithStatusJSON(401, gin.H{"error": "session revoked"})
+				return
+			}
+		}
+		if tokenInfo.Delegated() && !appRouteAllowed(c, tokenInfo) {
+			return
+		}
+		c.Set(tokenInfoKey, tokenInfo)
 		c.Next()
 	}
 }
 
+// appRouteScopes lists the routes third-party apps may call and the scope each
+// of them needs, tokens of apps are refused on every other route.
+var appRouteScopes = map[string]string{
+	"GET /api/v1/profile":           auth.ScopeProfileRead,
+	"GET /api/v1/users/:user_id":    auth.ScopeProfileRead,
+	"GET /api/v1/oauth/userinfo":    auth.ScopeOpenID,
+	"GET /api/v1/posts":             auth.ScopePostsRead,
+	"GET /api/v1/posts/:post_id":    auth.ScopePostsRead,
+	"POST /api/v1/posts":            auth.ScopePostsWrite,
+	"PUT /api/v1/posts/:post_id":    auth.ScopePostsWrite,
+	"DELETE /api/v1/posts/:post_id": auth.ScopePostsWrite,
+}
+
+func appRouteAllowed(c *gin.Context, tokenInfo *auth.TokenInfo) bool {
+	scope, ok := appRouteScopes[c.Request.Method+" "+c.FullPath()]
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "not available to apps"})
+		return false
+	}
+	if !tokenInfo.HasScope(scope) {
+		c.Header("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope="%s"`, scope))
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "insufficient_scope", "scope": scope})
+		return false
+	}
+	return true
+}
+
+const tokenInfoKey = "tokenInfo"
+
 var (
 	noAuthPaths = []string{
 		"/api/v1/register",
 		"/api/v1/authenticate",
 		"/api/v1/refresh-token",
+		"/api/v1/email/verification/confirm",
+		"/api/v1/password/forgot",
+		"/api/v1/password/reset",
+		"/api/v1/account/unlock",
+		"/api/v1/account/restore",
+		"/api/v1/exports/download",
+		"/api/v1/avatars/",
+		"/api/v1/oidc/",
+		"/api/v1/oauth/.well-known/",
+		"/api/v1/oauth/jwks",
+		"/api/v1/oauth/authorize",
+		"/api/v1/oauth/token",
+		"/api/v1/oauth/introspect",
+		"/api/v1/oauth/revoke",
 		"/api/swagger",
 	}
 )
@@ -80,3 +133,25 @@ func extractToken(c *gin.Context) string {
 
 	return parts[1]
 }
+
+func withClientInfo(ctx context.Context, c *gin.Context) context.Context {
+	return auth.GRPCContextWithClientInfo(ctx, auth.ClientInfo{
+		IP:        c.ClientIP(),
+		UserAgent: c.Request.UserAgent(),
+	})
+}
+
+func RequirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		value, ok := c.Get(tokenInfoKey)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if !value.(*auth.TokenInfo).HasPermission(permission) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
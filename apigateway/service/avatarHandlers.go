@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+const avatarChunkSize = 64 << 10
+
+// avatarJSON maps thumbnail sizes to their URLs, nil without an avatar.
+func avatarJSON(images []*user_proto.AvatarImage) gin.H {
+	if len(images) == 0 {
+		return nil
+	}
+	avatar := gin.H{}
+	for _, image := range images {
+		avatar[image.Size] = image.Url
+	}
+	return avatar
+}
+
+// uploadAvatar streams the "avatar" part of a multipart form to the user
+// service without buffering the whole file.
+func uploadAvatar(c *gin.Context) {
+	token := extractToken(c)
+	ctx, cancel := context.WithCancel(metadata.NewOutgoingContext(
+		c.Request.Context(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	))
+	defer cancel()
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, avatarUploadLimit)
+	form, err := c.Request.MultipartReader()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var part io.Reader
+	for part == nil {
+		p, err := form.NextPart()
+		if errors.Is(err, io.EOF) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "avatar file is required"})
+			return
+		}
+		if err != nil {
+			uploadError(c, err)
+			return
+		}
+		if p.FormName() == "avatar" {
+			part = p
+		}
+	}
+
+	stream, err := userClient.UploadAvatar(ctx)
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	buf := make([]byte, avatarChunkSize)
+	for {
+		n, err := io.ReadFull(part, buf)
+		if n > 0 {
+			// The service closes the stream early on an invalid upload, the
+			// reason comes with CloseAndRecv.
+			if stream.Send(&user_proto.UploadAvatarRequest{Chunk: buf[:n]}) != nil {
+				break
+			}
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			uploadError(c, err)
+			return
+		}
+	}
+
+	res, err := stream.CloseAndRecv()
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"avatar": avatarJSON(res.Images)})
+}
+
+func uploadError(c *gin.Context, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "request body is too large"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+func deleteAvatar(c *gin.Context) {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	if _, err := userClient.DeleteAvatar(ctx, &user_proto.DeleteAvatarRequest{}); err != nil {
+		accountError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// downloadAvatar is public. A new avatar gets a new URL, so images can be
+// cached forever.
+func downloadAvatar(c *gin.Context) {
+	userID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return
+	}
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	stream, err := userClient.DownloadAvatar(ctx, &user_proto.DownloadAvatarRequest{
+		UserId:   int32(userID),
+		AvatarId: c.Param("avatar_id"),
+		Size:     c.Param("size"),
+	})
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	chunk, err := stream.Recv()
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", chunk.ContentType)
+	c.Header("Content-Length", strconv.FormatInt(chunk.SizeBytes, 10))
+	c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Status(http.StatusOK)
+	for {
+		if _, err := c.Writer.Write(chunk.Data); err != nil {
+			return
+		}
+		chunk, err = stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Printf("failed to stream avatar: %v", err)
+			return
+		}
+	}
+}
@@ -3,30 +3,50 @@ package main
 import (
 	"flag"
 	"fmt"
+	"strings"
+	"time"
 )
 
 type Config struct {
 	UserServiceEndpoint string
 	PostServiceEndpoint string
 	RestEndpoint        string
-	PublicKeyFile       string
+	KeysDir             string
+	KeysReload          time.Duration
+	SessionCacheTTL     time.Duration
+	TrustedProxies      []string
+	AvatarUploadLimit   int64
+	PublicURL           string
+	OIDCStateKeyFile    string
 }
 
 func NewConfig() (*Config, error) {
-	var userServiceEndpoint, postServiceEndpoint, publicFile string
+	var userServiceEndpoint, postServiceEndpoint, keysDir string
 	var restEndpoint int
 	flag.StringVar(&userServiceEndpoint, "user_service_endpoint", "user_app:50051", "service port")
 	flag.StringVar(&postServiceEndpoint, "post_service_endpoint", "post_app:50051", "service port")
 	flag.IntVar(&restEndpoint, "rest_endpoint", 80, "service port")
-	flag.StringVar(&publicFile, "public_key", "", "path to JWT public key `file`")
+	flag.StringVar(&keysDir, "keys_dir", "", "path to JWT signing key ring `dir`")
+	keysReload := flag.Duration("keys_reload", time.Minute, "how often to reload the signing key ring")
+	sessionCacheTTL := flag.Duration("session_cache_ttl", 15*time.Second, "how long session revocation checks are cached")
+	trustedProxies := flag.String("trusted_proxies", "10.0.0.0/8,172.16.0.0/12,192.168.0.0/16,127.0.0.1/32", "comma separated proxy CIDRs whose X-Real-IP header is trusted")
+	avatarUploadLimit := flag.Int64("avatar_upload_limit", 6<<20, "maximum size of an avatar upload request body")
+	publicURL := flag.String("public_url", "http://localhost", "base URL the API is reached at, the OAuth issuer is derived from it")
+	oidcStateKeyFile := flag.String("oidc_state_key_file", "", "`path` to the key signing OIDC state cookies, a random key is used if empty")
 	flag.Parse()
-	if publicFile == "" {
-		return nil, fmt.Errorf("public key file is not provided")
+	if keysDir == "" {
+		return nil, fmt.Errorf("keys dir is not provided")
 	}
 	return &Config{
 		UserServiceEndpoint: userServiceEndpoint,
 		PostServiceEndpoint: postServiceEndpoint,
 		RestEndpoint:        fmt.Sprint(restEndpoint),
-		PublicKeyFile:       publicFile,
+		KeysDir:             keysDir,
+		KeysReload:          *keysReload,
+		SessionCacheTTL:     *sessionCacheTTL,
+		TrustedProxies:      strings.Split(*trustedProxies, ","),
+		AvatarUploadLimit:   *avatarUploadLimit,
+		PublicURL:           strings.TrimRight(*publicURL, "/"),
+		OIDCStateKeyFile:    *oidcStateKeyFile,
 	}, nil
 }
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+type DocumentRequest struct {
+	DocName     string `json:"doc_name"`
+	Description string `json:"description"`
+	Series      string `json:"series"`
+	Number      string `json:"number"`
+}
+
+func documentError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.Unauthenticated:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": status.Convert(err).Message()})
+	case codes.PermissionDenied:
+		c.JSON(http.StatusForbidden, gin.H{"error": status.Convert(err).Message()})
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func documentJSON(doc *user_proto.Document) gin.H {
+	return gin.H{
+		"id":          doc.Id,
+		"user_id":     doc.UserId,
+		"doc_name":    doc.DocName,
+		"description": doc.Description,
+		"series":      doc.Series,
+		"number":      doc.Number,
+		"created_at":  &CustomTimestamp{doc.CreatedAt},
+		"updated_at":  &CustomTimestamp{doc.UpdatedAt},
+	}
+}
+
+// documentContext forwards the client address, the service records it in the
+// access log of the documents.
+func documentContext(c *gin.Context) context.Context {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+	return withClientInfo(ctx, c)
+}
+
+func createDocument(c *gin.Context) {
+	var req DocumentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.CreateDocument(documentContext(c), &user_proto.CreateDocumentRequest{
+		DocName:     req.DocName,
+		Description: req.Description,
+		Series:      req.Series,
+		Number:      req.Number,
+	})
+	if err != nil {
+		documentError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, documentJSON(res))
+}
+
+func listDocuments(c *gin.Context) {
+	listUserDocuments(c, 0)
+}
+
+func listUserDocumentsAdmin(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+	listUserDocuments(c, userID)
+}
+
+func listUserDocuments(c *gin.Context, userID int32) {
+	res, err := userClient.ListDocuments(documentContext(c), &user_proto.ListDocumentsRequest{UserId: userID})
+	if err != nil {
+		documentError(c, err)
+		return
+	}
+
+	documents := []gin.H{}
+	for _, doc := range res.Documents {
+		documents = append(documents, documentJSON(doc))
+	}
+	c.JSON(http.StatusOK, gin.H{"documents": documents})
+}
+
+func getDocument(c *gin.Context) {
+	res, err := userClient.GetDocument(documentContext(c), &user_proto.GetDocumentRequest{Id: c.Param("document_id")})
+	if err != nil {
+		documentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, documentJSON(res))
+}
+
+func updateDocument(c *gin.Context) {
+	var req DocumentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.UpdateDocument(documentContext(c), &user_proto.UpdateDocumentRequest{
+		Id:          c.Param("document_id"),
+		DocName:     req.DocName,
+		Description: req.Description,
+		Series:      req.Series,
+		Number:      req.Number,
+	})
+	if err != nil {
+		documentError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, documentJSON(res))
+}
+
+func deleteDocument(c *gin.Context) {
+	_, err := userClient.DeleteDocument(documentContext(c), &user_proto.DeleteDocumentRequest{Id: c.Param("document_id")})
+	if err != nil {
+		documentError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func listDocumentAccessLog(c *gin.Context) {
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "0"))
+
+	res, err := userClient.ListDocumentAccessLog(documentContext(c), &user_proto.ListDocumentAccessLogRequest{
+		DocumentId: c.Query("document_id"),
+		Cursor:     c.Query("cursor"),
+		PageSize:   int32(pageSize),
+	})
+	if err != nil {
+		documentError(c, err)
+		return
+	}
+
+	entries := []gin.H{}
+	for _, entry := range res.Entries {
+		entries = append(entries, gin.H{
+			"id":          entry.Id,
+			"document_id": entry.DocumentId,
+			"actor_id":    entry.ActorId,
+			"actor_login": entry.ActorLogin,
+			"action":      entry.Action,
+			"ip":          entry.Ip,
+			"user_agent":  entry.UserAgent,
+			"accessed_at": &CustomTimestamp{entry.AccessedAt},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "next_cursor": res.NextCursor})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func fieldViolations(err error) []gin.H {
+	var fields []gin.H
+	for _, detail := range status.Convert(err).Details() {
+		badRequest, ok := detail.(*errdetails.BadRequest)
+		if !ok {
+			continue
+		}
+		for _, violation := range badRequest.FieldViolations {
+			fields = append(fields, gin.H{
+				"field":       violation.Field,
+				"description": violation.Description,
+			})
+		}
+	}
+	return fields
+}
+
+// isValidationError reports whether err was produced by request validation
+// in a backend service, as opposed to a plain InvalidArgument.
+func isValidationError(err error) bool {
+	return status.Code(err) == codes.InvalidArgument && len(fieldViolations(err)) > 0
+}
+
+// invalidArgument answers 400 with the status message and, for validation
+// errors, every offending field.
+func invalidArgument(c *gin.Context, err error) {
+	body := gin.H{"error": status.Convert(err).Message()}
+	if fields := fieldViolations(err); len(fields) > 0 {
+		body["fields"] = fields
+	}
+	c.JSON(http.StatusBadRequest, body)
+}
+
+// alreadyExists answers 409 naming the conflicting field when the service
+// reported one.
+func alreadyExists(c *gin.Context, err error) {
+	body := gin.H{"error": status.Convert(err).Message()}
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Metadata["field"] != "" {
+			body["field"] = info.Metadata["field"]
+		}
+	}
+	c.JSON(http.StatusConflict, body)
+}
+
+// forbidden answers 403, telling why and until when the account is
+// restricted when the service refused a suspended or banned user.
+func forbidden(c *gin.Context, err error) {
+	body := gin.H{"error": status.Convert(err).Message()}
+	for _, detail := range status.Convert(err).Details() {
+		info, ok := detail.(*errdetails.ErrorInfo)
+		if !ok || info.Domain != "users" {
+			continue
+		}
+		body["code"] = info.Reason
+		body["reason"] = info.Metadata["reason"]
+		if until := info.Metadata["suspended_until"]; until != "" {
+			body["suspended_until"] = until
+		}
+	}
+	c.JSON(http.StatusForbidden, body)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/metadata"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+func dataExportJSON(export *user_proto.DataExport) gin.H {
+	body := gin.H{
+		"id":          export.Id,
+		"status":      export.Status,
+		"created_at":  &CustomTimestamp{export.CreatedAt},
+		"finished_at": &CustomTimestamp{export.FinishedAt},
+		"expires_at":  &CustomTimestamp{export.ExpiresAt},
+		"size_bytes":  export.SizeBytes,
+	}
+	if export.DownloadToken != "" {
+		body["download_url"] = "/api/v1/exports/download?token=" + url.QueryEscape(export.DownloadToken)
+		body["download_expires_at"] = &CustomTimestamp{export.DownloadExpiresAt}
+	}
+	return body
+}
+
+func requestDataExport(c *gin.Context) {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.RequestDataExport(ctx, &user_proto.RequestDataExportRequest{})
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, dataExportJSON(res))
+}
+
+func getDataExport(c *gin.Context) {
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.GetDataExport(ctx, &user_proto.GetDataExportRequest{Id: c.Param("export_id")})
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, dataExportJSON(res))
+}
+
+// downloadDataExport is public: the token in the link is the authorization.
+// Errors can only be reported before the first chunk is written.
+func downloadDataExport(c *gin.Context) {
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+
+	stream, err := userClient.DownloadDataExport(ctx, &user_proto.DownloadDataExportRequest{Token: c.Query("token")})
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	chunk, err := stream.Recv()
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="data-export.zip"`)
+	c.Header("Cache-Control", "no-store")
+	if chunk.SizeBytes > 0 {
+		c.Header("Content-Length", strconv.FormatInt(chunk.SizeBytes, 10))
+	}
+	c.Status(http.StatusOK)
+	for {
+		if _, err := c.Writer.Write(chunk.Data); err != nil {
+			return
+		}
+		chunk, err = stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Printf("failed to stream data export: %v", err)
+			return
+		}
+	}
+}
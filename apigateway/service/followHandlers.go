@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
+)
+
+var followStatusNames = map[user_proto.FollowStatus]string{
+	user_proto.FollowStatus_FOLLOW_STATUS_ACTIVE:  "active",
+	user_proto.FollowStatus_FOLLOW_STATUS_PENDING: "pending",
+}
+
+func followError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.PermissionDenied:
+		c.JSON(http.StatusForbidden, gin.H{"error": status.Convert(err).Message()})
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// pathUserID answers 400 itself when the parameter is not a user id.
+func pathUserID(c *gin.Context, name string) (int32, bool) {
+	id, err := strconv.ParseInt(c.Param(name), 10, 32)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "bad user id"})
+		return 0, false
+	}
+	return int32(id), true
+}
+
+// requireSelf guards routes under /users/:user_id that only the user
+// themselves may call.
+func requireSelf(c *gin.Context) bool {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return false
+	}
+	value, _ := c.Get(tokenInfoKey)
+	if tokenInfo, ok := value.(*auth.TokenInfo); !ok || tokenInfo.UserID != int(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+		return false
+	}
+	return true
+}
+
+func followsPageJSON(res *user_proto.ListFollowsResponse) gin.H {
+	users := []gin.H{}
+	for _, user := range res.Users {
+		users = append(users, publicProfileJSON(user))
+	}
+	return gin.H{
+		"users":       users,
+		"next_cursor": res.NextCursor,
+	}
+}
+
+func followUser(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.FollowUser(ctx, &user_proto.FollowUserRequest{UserId: userID})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": followStatusNames[res.Status]})
+}
+
+func unfollowUser(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	_, err := userClient.UnfollowUser(ctx, &user_proto.UnfollowUserRequest{UserId: userID})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func listFollowers(c *gin.Context) {
+	listFollows(c, userClient.ListFollowers)
+}
+
+func listFollowing(c *gin.Context) {
+	listFollows(c, userClient.ListFollowing)
+}
+
+func listFollows(c *gin.Context, list func(context.Context, *user_proto.ListFollowsRequest, ...grpc.CallOption) (*user_proto.ListFollowsResponse, error)) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "0"))
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := list(ctx, &user_proto.ListFollowsRequest{
+		UserId:   userID,
+		PageSize: int32(pageSize),
+		Cursor:   c.Query("cursor"),
+	})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, followsPageJSON(res))
+}
+
+func listFollowRequests(c *gin.Context) {
+	if !requireSelf(c) {
+		return
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "0"))
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.ListFollowRequests(ctx, &user_proto.ListFollowRequestsRequest{
+		PageSize: int32(pageSize),
+		Cursor:   c.Query("cursor"),
+	})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, followsPageJSON(res))
+}
+
+func approveFollowRequest(c *gin.Context) {
+	decideFollowRequest(c, userClient.ApproveFollowRequest)
+}
+
+func rejectFollowRequest(c *gin.Context) {
+	decideFollowRequest(c, userClient.RejectFollowRequest)
+}
+
+func decideFollowRequest(c *gin.Context, decide func(context.Context, *user_proto.FollowRequestDecision, ...grpc.CallOption) (*user_proto.FollowRequestDecisionResponse, error)) {
+	if !requireSelf(c) {
+		return
+	}
+	followerID, ok := pathUserID(c, "follower_id")
+	if !ok {
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	_, err := decide(ctx, &user_proto.FollowRequestDecision{FollowerId: followerID})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func setAccountPrivacy(c *gin.Context) {
+	if !requireSelf(c) {
+		return
+	}
+	var request struct {
+		IsPrivate *bool `json:"is_private"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.IsPrivate == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "is_private is required"})
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	_, err := userClient.SetAccountPrivacy(ctx, &user_proto.SetAccountPrivacyRequest{IsPrivate: *request.IsPrivate})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func blockUser(c *gin.Context) {
+	changeRelation(c, userClient.BlockUser)
+}
+
+func unblockUser(c *gin.Context) {
+	changeRelation(c, userClient.UnblockUser)
+}
+
+func muteUser(c *gin.Context) {
+	changeRelation(c, userClient.MuteUser)
+}
+
+func unmuteUser(c *gin.Context) {
+	changeRelation(c, userClient.UnmuteUser)
+}
+
+func changeRelation(c *gin.Context, change func(context.Context, *user_proto.RelationRequest, ...grpc.CallOption) (*user_proto.RelationResponse, error)) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	_, err := change(ctx, &user_proto.RelationRequest{UserId: userID})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func listBlockedUsers(c *gin.Context) {
+	listRelations(c, userClient.ListBlockedUsers)
+}
+
+func listMutedUsers(c *gin.Context) {
+	listRelations(c, userClient.ListMutedUsers)
+}
+
+func listRelations(c *gin.Context, list func(context.Context, *user_proto.ListRelationsRequest, ...grpc.CallOption) (*user_proto.ListFollowsResponse, error)) {
+	if !requireSelf(c) {
+		return
+	}
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "0"))
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := list(ctx, &user_proto.ListRelationsRequest{
+		PageSize: int32(pageSize),
+		Cursor:   c.Query("cursor"),
+	})
+	if err != nil {
+		followError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, followsPageJSON(res))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	post_proto "github.com/Nicvod/SOA/postService/post_proto"
@@ -16,6 +17,11 @@ var (
 	userClient   user_proto.UserServiceClient
 	postClient   post_proto.PostServiceClient
 	authProvider auth.AuthProvider
+	sessionCache *SessionCache
+
+	avatarUploadLimit int64
+	publicURL         string
+	oidcStateKey      []byte
 )
 
 func main() {
@@ -23,10 +29,14 @@ func main() {
 	if err != nil {
 		log.Fatalf("bad config: %v", err)
 	}
-	authProvider, err = NewAuthProvider(cfg)
+	tokenKeys, err := NewAuthProvider(cfg)
 	if err != nil {
 		log.Fatalf("failed to create auth provider: %v", err)
 	}
+	authProvider = tokenKeys
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go auth.WatchKeyRing(ctx, tokenKeys, cfg.KeysDir, false, cfg.KeysReload)
 	log.Println(cfg.UserServiceEndpoint)
 	userConn, err := grpc.NewClient(cfg.UserServiceEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
 	if err != nil {
@@ -42,8 +52,20 @@ func main() {
 
 	userClient = user_proto.NewUserServiceClient(userConn)
 	postClient = post_proto.NewPostServiceClient(postConn)
+	sessionCache = NewSessionCache(cfg.SessionCacheTTL)
+	avatarUploadLimit = cfg.AvatarUploadLimit
+	publicURL = cfg.PublicURL
+	if oidcStateKey, err = loadOIDCStateKey(cfg.OIDCStateKeyFile); err != nil {
+		log.Fatalf("failed to load OIDC state key: %v", err)
+	}
 
 	r := gin.Default()
+	// nginx overwrites X-Real-IP with the peer address, unlike X-Forwarded-For
+	// which clients can prefill
+	r.RemoteIPHeaders = []string{"X-Real-IP"}
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("bad trusted proxies: %v", err)
+	}
 
 	r.Use(MiddlewareWrapper())
 
@@ -52,9 +74,124 @@ func main() {
 		api.Static("/swagger", "/app/apigateway/service/swagger")
 		api.POST("/v1/register", registerUser)
 		api.POST("/v1/authenticate", authenticateUser)
+		api.POST("/v1/authenticate/2fa", verifyTwoFactor)
+		api.POST("/v1/authenticate/passkey/options", startPasskeyLogin)
+		api.POST("/v1/authenticate/passkey", finishPasskeyLogin)
 		api.POST("/v1/refresh-token", refreshToken)
 		api.PUT("/v1/profile", updateProfile)
+		api.PATCH("/v1/profile", patchProfile)
 		api.GET("/v1/profile", getProfile)
+		api.DELETE("/v1/profile", deleteAccount)
+		api.PUT("/v1/profile/visibility", updateProfileVisibility)
+		api.POST("/v1/profile/avatar", uploadAvatar)
+		api.DELETE("/v1/profile/avatar", deleteAvatar)
+		api.GET("/v1/avatars/:user_id/:avatar_id/:size", downloadAvatar)
+		api.POST("/v1/email/verification", requestEmailVerification)
+		api.POST("/v1/email/verification/confirm", verifyEmail)
+		api.PUT("/v1/password", changePassword)
+		api.POST("/v1/password/forgot", requestPasswordReset)
+		api.POST("/v1/password/reset", resetPassword)
+		api.POST("/v1/account/unlock", unlockAccount)
+		api.POST("/v1/account/restore", restoreAccount)
+		api.POST("/v1/exports", requestDataExport)
+		api.GET("/v1/exports/download", downloadDataExport)
+		api.GET("/v1/exports/:export_id", getDataExport)
+		oidc := api.Group("/v1/oidc")
+		{
+			oidc.GET("/providers", listOIDCProviders)
+			oidc.GET("/:provider/login", startOIDCLogin)
+			oidc.GET("/:provider/callback", completeOIDC)
+		}
+		oauth := api.Group("/v1/oauth")
+		{
+			oauth.GET("/.well-known/openid-configuration", oauthDiscovery)
+			oauth.GET("/jwks", oauthJWKS)
+			oauth.GET("/authorize", oauthAuthorize)
+			oauth.GET("/consent", getOAuthConsent)
+			oauth.POST("/consent", approveOAuthConsent)
+			oauth.POST("/token", oauthToken)
+			oauth.POST("/introspect", oauthIntrospect)
+			oauth.POST("/revoke", oauthRevoke)
+			oauth.GET("/userinfo", oauthUserInfo)
+			oauth.POST("/clients", registerOAuthClient)
+			oauth.GET("/clients", listOAuthClients)
+			oauth.DELETE("/clients/:client_id", deleteOAuthClient)
+		}
+		identities := api.Group("/v1/identities")
+		{
+			identities.GET("", listIdentities)
+			identities.POST("/:provider", startOIDCLink)
+			identities.DELETE("/:provider", unlinkIdentity)
+		}
+		documents := api.Group("/v1/documents")
+		{
+			documents.POST("", createDocument)
+			documents.GET("", listDocuments)
+			documents.GET("/access-log", listDocumentAccessLog)
+			documents.GET("/:document_id", getDocument)
+			documents.PUT("/:document_id", updateDocument)
+			documents.DELETE("/:document_id", deleteDocument)
+		}
+		sessions := api.Group("/v1/sessions")
+		{
+			sessions.GET("", listSessions)
+			sessions.DELETE("/current", logout)
+			sessions.DELETE("/:session_id", revokeSession)
+		}
+		twoFactor := api.Group("/v1/2fa")
+		{
+			twoFactor.POST("/totp", enrollTOTP)
+			twoFactor.POST("/totp/confirm", confirmTOTP)
+			twoFactor.DELETE("/totp", disableTOTP)
+			twoFactor.POST("/recovery-codes", generateRecoveryCodes)
+		}
+		passkeys := api.Group("/v1/passkeys")
+		{
+			passkeys.GET("", listPasskeys)
+			passkeys.POST("/options", startPasskeyRegistration)
+			passkeys.POST("", finishPasskeyRegistration)
+			passkeys.DELETE("/:passkey_id", deletePasskey)
+		}
+		admin := api.Group("/v1/admin")
+		{
+			roles := admin.Group("", RequirePermission(auth.PermissionManageRoles))
+			{
+				roles.GET("/roles", listRoles)
+				roles.POST("/roles", createRole)
+				roles.PUT("/users/:user_id/roles/:role", grantRole)
+				roles.DELETE("/users/:user_id/roles/:role", revokeRole)
+			}
+			admin.DELETE("/users/:user_id/lockout", RequirePermission(auth.PermissionManageUsers), unlockUser)
+			admin.GET("/users/:user_id/deletion", RequirePermission(auth.PermissionManageUsers), getAccountDeletion)
+			admin.GET("/users/:user_id/documents", RequirePermission(auth.PermissionReadDocuments), listUserDocumentsAdmin)
+			moderation := admin.Group("", RequirePermission(auth.PermissionManageUsers))
+			{
+				moderation.POST("/users/:user_id/suspend", suspendUser)
+				moderation.POST("/users/:user_id/ban", banUser)
+				moderation.DELETE("/users/:user_id/restriction", liftRestriction)
+				moderation.GET("/audit-log", listAuditLog)
+			}
+			admin.POST("/users/:user_id/impersonate", RequirePermission(auth.PermissionImpersonate), impersonateUser)
+		}
+		api.GET("/v1/users/search", searchUsers)
+		users := api.Group("/v1/users/:user_id")
+		{
+			users.GET("", getPublicProfile)
+			users.POST("/follow", followUser)
+			users.DELETE("/follow", unfollowUser)
+			users.GET("/followers", listFollowers)
+			users.GET("/following", listFollowing)
+			users.GET("/follow-requests", listFollowRequests)
+			users.POST("/follow-requests/:follower_id", approveFollowRequest)
+			users.DELETE("/follow-requests/:follower_id", rejectFollowRequest)
+			users.PUT("/privacy", setAccountPrivacy)
+			users.POST("/block", blockUser)
+			users.DELETE("/block", unblockUser)
+			users.GET("/blocked", listBlockedUsers)
+			users.POST("/mute", muteUser)
+			users.DELETE("/mute", unmuteUser)
+			users.GET("/muted", listMutedUsers)
+		}
 		posts := api.Group("/v1/posts")
 		{
 			posts.POST("", createPost)
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+func restrictionJSON(res *user_proto.AccountRestriction) gin.H {
+	body := gin.H{
+		"user_id": res.UserId,
+		"status":  res.Status,
+		"reason":  res.Reason,
+	}
+	if res.SuspendedUntil != nil {
+		body["suspended_until"] = &CustomTimestamp{res.SuspendedUntil}
+	}
+	return body
+}
+
+func suspendUser(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+	var request struct {
+		DurationSeconds int64  `json:"duration_seconds"`
+		Reason          string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.SuspendUser(adminContext(c), &user_proto.SuspendUserRequest{
+		UserId:          userID,
+		DurationSeconds: request.DurationSeconds,
+		Reason:          request.Reason,
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	sessionCache.RevokeUser(int(userID))
+	c.JSON(http.StatusOK, restrictionJSON(res))
+}
+
+func banUser(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.BanUser(adminContext(c), &user_proto.BanUserRequest{UserId: userID, Reason: request.Reason})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	sessionCache.RevokeUser(int(userID))
+	c.JSON(http.StatusOK, restrictionJSON(res))
+}
+
+func liftRestriction(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+
+	res, err := userClient.LiftRestriction(adminContext(c), &user_proto.LiftRestrictionRequest{
+		UserId: userID,
+		Reason: c.Query("reason"),
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, restrictionJSON(res))
+}
+
+func impersonateUser(c *gin.Context) {
+	userID, ok := pathUserID(c, "user_id")
+	if !ok {
+		return
+	}
+	var request struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.ImpersonateUser(adminContext(c), &user_proto.ImpersonateUserRequest{
+		UserId: userID,
+		Reason: request.Reason,
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"access_token": res.AccessToken,
+		"expires_at":   &CustomTimestamp{res.ExpiresAt},
+		"session_id":   res.SessionId,
+	})
+}
+
+func listAuditLog(c *gin.Context) {
+	actorID, _ := strconv.Atoi(c.DefaultQuery("actor_id", "0"))
+	targetUserID, _ := strconv.Atoi(c.DefaultQuery("target_user_id", "0"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "0"))
+
+	res, err := userClient.ListAuditLog(adminContext(c), &user_proto.ListAuditLogRequest{
+		ActorId:      int32(actorID),
+		TargetUserId: int32(targetUserID),
+		Action:       c.Query("action"),
+		Cursor:       c.Query("cursor"),
+		PageSize:     int32(pageSize),
+	})
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+
+	entries := []gin.H{}
+	for _, entry := range res.Entries {
+		details := entry.Details
+		if details == nil {
+			details = map[string]string{}
+		}
+		entries = append(entries, gin.H{
+			"id":             entry.Id,
+			"actor_id":       entry.ActorId,
+			"actor_login":    entry.ActorLogin,
+			"action":         entry.Action,
+			"target_user_id": entry.TargetUserId,
+			"reason":         entry.Reason,
+			"details":        details,
+			"ip":             entry.Ip,
+			"user_agent":     entry.UserAgent,
+			"created_at":     &CustomTimestamp{entry.CreatedAt},
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries, "next_cursor": res.NextCursor})
+}
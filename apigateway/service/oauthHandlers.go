@@ -0,0 +1,354 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
+)
+
+const consentPage = "/app/apigateway/service/oauth/authorize.html"
+
+func oauthIssuer() string {
+	return publicURL + "/api/v1/oauth"
+}
+
+// oauthTokenError answers in the RFC 6749 format apps expect from the token,
+// introspection and revocation endpoints.
+func oauthTokenError(c *gin.Context, err error) {
+	code := "invalid_request"
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Domain == "oauth" {
+			code = info.Reason
+		}
+	}
+	body := gin.H{"error": code, "error_description": status.Convert(err).Message()}
+	c.Header("Cache-Control", "no-store")
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		c.JSON(http.StatusBadRequest, body)
+	case codes.Unauthenticated:
+		c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		c.JSON(http.StatusUnauthorized, body)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "server_error", "error_description": err.Error()})
+	}
+}
+
+func oauthError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.Unauthenticated:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": status.Convert(err).Message()})
+	case codes.PermissionDenied:
+		c.JSON(http.StatusForbidden, gin.H{"error": status.Convert(err).Message()})
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	case codes.FailedPrecondition:
+		c.JSON(http.StatusConflict, gin.H{"error": status.Convert(err).Message()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// clientCredentials takes the client from HTTP Basic auth, where RFC 6749
+// has both parts form-encoded, or from the form.
+func clientCredentials(c *gin.Context) (string, string) {
+	if id, secret, ok := c.Request.BasicAuth(); ok {
+		if unescaped, err := url.QueryUnescape(id); err == nil {
+			id = unescaped
+		}
+		if unescaped, err := url.QueryUnescape(secret); err == nil {
+			secret = unescaped
+		}
+		return id, secret
+	}
+	return c.PostForm("client_id"), c.PostForm("client_secret")
+}
+
+func oauthContext(c *gin.Context) context.Context {
+	return metadata.NewOutgoingContext(
+		withClientInfo(context.Background(), c),
+		metadata.Pairs("authorization", "Bearer "+extractToken(c)),
+	)
+}
+
+func oauthClientJSON(client *user_proto.OAuthClient) gin.H {
+	return gin.H{
+		"client_id":     client.ClientId,
+		"name":          client.Name,
+		"redirect_uris": client.RedirectUris,
+		"scopes":        client.Scopes,
+		"public":        client.Public,
+		"created_at":    &CustomTimestamp{client.CreatedAt},
+	}
+}
+
+func oauthDiscovery(c *gin.Context) {
+	issuer := oauthIssuer()
+	authMethods := []string{"client_secret_basic", "client_secret_post", "none"}
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                        issuer,
+		"authorization_endpoint":                        issuer + "/authorize",
+		"token_endpoint":                                issuer + "/token",
+		"userinfo_endpoint":                             issuer + "/userinfo",
+		"jwks_uri":                                      issuer + "/jwks",
+		"introspection_endpoint":                        issuer + "/introspect",
+		"revocation_endpoint":                           issuer + "/revoke",
+		"scopes_supported":                              auth.SupportedScopes,
+		"response_types_supported":                      []string{"code"},
+		"grant_types_supported":                         []string{"authorization_code", "refresh_token"},
+		"code_challenge_methods_supported":              []string{"S256"},
+		"token_endpoint_auth_methods_supported":         authMethods,
+		"introspection_endpoint_auth_methods_supported": authMethods,
+		"revocation_endpoint_auth_methods_supported":    authMethods,
+		"subject_types_supported":                       []string{"public"},
+		"id_token_signing_alg_values_supported":         []string{"RS256"},
+		"claims_supported": []string{
+			"iss", "sub", "aud", "exp", "iat", "nonce", "azp",
+			"preferred_username", "name", "email", "email_verified",
+		},
+	})
+}
+
+func oauthJWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, authProvider.JWKS())
+}
+
+// oauthAuthorize serves the consent screen. The page signs in with the token
+// the frontend keeps, so it works only on the same origin and must not be
+// framed by other sites.
+func oauthAuthorize(c *gin.Context) {
+	c.Header("X-Frame-Options", "DENY")
+	c.Header("Content-Security-Policy", "frame-ancestors 'none'")
+	c.Header("Cache-Control", "no-store")
+	c.File(consentPage)
+}
+
+type authorizationParams struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	Approve             bool   `form:"-" json:"approve"`
+}
+
+func (p *authorizationParams) toProto() *user_proto.OAuthAuthorizationRequest {
+	return &user_proto.OAuthAuthorizationRequest{
+		ResponseType:        p.ResponseType,
+		ClientId:            p.ClientID,
+		RedirectUri:         p.RedirectURI,
+		Scope:               p.Scope,
+		State:               p.State,
+		CodeChallenge:       p.CodeChallenge,
+		CodeChallengeMethod: p.CodeChallengeMethod,
+		Nonce:               p.Nonce,
+	}
+}
+
+func getOAuthConsent(c *gin.Context) {
+	var params authorizationParams
+	if err := c.ShouldBindQuery(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.GetOAuthConsent(oauthContext(c), params.toProto())
+	if err != nil {
+		oauthError(c, err)
+		return
+	}
+	if res.ErrorRedirectUri != "" {
+		c.JSON(http.StatusOK, gin.H{"error_redirect_uri": res.ErrorRedirectUri})
+		return
+	}
+
+	scopes := []gin.H{}
+	for _, scope := range res.Scopes {
+		scopes = append(scopes, gin.H{"name": scope.Name, "description": scope.Description})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"client_id":    res.ClientId,
+		"client_name":  res.ClientName,
+		"redirect_uri": res.RedirectUri,
+		"scopes":       scopes,
+	})
+}
+
+func approveOAuthConsent(c *gin.Context) {
+	var params authorizationParams
+	if err := c.ShouldBindJSON(&params); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.ApproveOAuthConsent(oauthContext(c), &user_proto.ApproveOAuthConsentRequest{
+		Authorization: params.toProto(),
+		Approve:       params.Approve,
+	})
+	if err != nil {
+		oauthError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"redirect_uri": res.RedirectUri})
+}
+
+func oauthToken(c *gin.Context) {
+	clientID, clientSecret := clientCredentials(c)
+	res, err := userClient.ExchangeOAuthToken(withClientInfo(context.Background(), c), &user_proto.ExchangeOAuthTokenRequest{
+		GrantType:    c.PostForm("grant_type"),
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Code:         c.PostForm("code"),
+		RedirectUri:  c.PostForm("redirect_uri"),
+		CodeVerifier: c.PostForm("code_verifier"),
+		RefreshToken: c.PostForm("refresh_token"),
+		Scope:        c.PostForm("scope"),
+	})
+	if err != nil {
+		oauthTokenError(c, err)
+		return
+	}
+
+	body := gin.H{
+		"access_token":  res.AccessToken,
+		"token_type":    res.TokenType,
+		"expires_in":    res.ExpiresIn,
+		"refresh_token": res.RefreshToken,
+		"scope":         res.Scope,
+	}
+	if res.IdToken != "" {
+		body["id_token"] = res.IdToken
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, body)
+}
+
+func oauthIntrospect(c *gin.Context) {
+	clientID, clientSecret := clientCredentials(c)
+	res, err := userClient.IntrospectOAuthToken(context.Background(), &user_proto.IntrospectOAuthTokenRequest{
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Token:        c.PostForm("token"),
+	})
+	if err != nil {
+		oauthTokenError(c, err)
+		return
+	}
+
+	c.Header("Cache-Control", "no-store")
+	if !res.Active {
+		c.JSON(http.StatusOK, gin.H{"active": false})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"active":     true,
+		"scope":      res.Scope,
+		"client_id":  res.ClientId,
+		"username":   res.Username,
+		"sub":        strconv.Itoa(int(res.UserId)),
+		"token_type": res.TokenType,
+		"iat":        res.IssuedAt.AsTime().Unix(),
+		"exp":        res.ExpiresAt.AsTime().Unix(),
+		"iss":        oauthIssuer(),
+	})
+}
+
+func oauthRevoke(c *gin.Context) {
+	clientID, clientSecret := clientCredentials(c)
+	_, err := userClient.RevokeOAuthToken(context.Background(), &user_proto.RevokeOAuthTokenRequest{
+		ClientId:     clientID,
+		ClientSecret: clientSecret,
+		Token:        c.PostForm("token"),
+	})
+	if err != nil {
+		oauthTokenError(c, err)
+		return
+	}
+	c.Status(http.StatusOK)
+}
+
+func oauthUserInfo(c *gin.Context) {
+	res, err := userClient.GetOAuthUserInfo(oauthContext(c), &user_proto.GetOAuthUserInfoRequest{})
+	if err != nil {
+		oauthError(c, err)
+		return
+	}
+
+	body := gin.H{"sub": strconv.Itoa(int(res.UserId))}
+	if res.PreferredUsername != "" {
+		body["preferred_username"] = res.PreferredUsername
+		body["name"] = res.Name
+		body["email"] = res.Email
+		body["email_verified"] = res.EmailVerified
+	}
+	c.JSON(http.StatusOK, body)
+}
+
+func registerOAuthClient(c *gin.Context) {
+	var request struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Public       bool     `json:"public"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.RegisterOAuthClient(oauthContext(c), &user_proto.RegisterOAuthClientRequest{
+		Name:         request.Name,
+		RedirectUris: request.RedirectURIs,
+		Scopes:       request.Scopes,
+		Public:       request.Public,
+	})
+	if err != nil {
+		oauthError(c, err)
+		return
+	}
+
+	body := oauthClientJSON(res.Client)
+	if res.ClientSecret != "" {
+		body["client_secret"] = res.ClientSecret
+	}
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusCreated, body)
+}
+
+func listOAuthClients(c *gin.Context) {
+	res, err := userClient.ListOAuthClients(oauthContext(c), &user_proto.ListOAuthClientsRequest{})
+	if err != nil {
+		oauthError(c, err)
+		return
+	}
+
+	clients := []gin.H{}
+	for _, client := range res.Clients {
+		clients = append(clients, oauthClientJSON(client))
+	}
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+func deleteOAuthClient(c *gin.Context) {
+	_, err := userClient.DeleteOAuthClient(oauthContext(c), &user_proto.DeleteOAuthClientRequest{ClientId: c.Param("client_id")})
+	if err != nil {
+		oauthError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+const (
+	oidcStateCookie = "oidc_state"
+	// oidcStateTTL matches how long userService keeps the state.
+	oidcStateTTL       = 10 * time.Minute
+	minOIDCStateKeyLen = 32
+)
+
+// loadOIDCStateKey reads the key of the state cookies. Without a file every
+// start picks a new key, flows begun before a restart then fail.
+func loadOIDCStateKey(path string) ([]byte, error) {
+	if path == "" {
+		key := make([]byte, minOIDCStateKeyLen)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		log.Printf("no OIDC state key file, using a random key")
+		return key, nil
+	}
+	key, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) < minOIDCStateKeyLen {
+		return nil, fmt.Errorf("key in %s is shorter than %d bytes", path, minOIDCStateKeyLen)
+	}
+	return key, nil
+}
+
+func oidcStateMAC(state string) string {
+	mac := hmac.New(sha256.New, oidcStateKey)
+	mac.Write([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func oidcCallbackPath(provider string) string {
+	return "/api/v1/oidc/" + url.PathEscape(provider) + "/callback"
+}
+
+// setOIDCStateCookie binds the state of authorizationURL to the browser that
+// starts the flow. A callback carrying a state issued to another browser, like
+// one an attacker started and planted in a link, is refused by completeOIDC.
+// The cookie holds only a MAC of the state and is sent to the callback only.
+func setOIDCStateCookie(c *gin.Context, provider, authorizationURL string) error {
+	parsed, err := url.Parse(authorizationURL)
+	if err != nil {
+		return err
+	}
+	state := parsed.Query().Get("state")
+	if state == "" {
+		return errors.New("authorization URL has no state")
+	}
+	// Lax lets the cookie come with the redirect back from the provider.
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, oidcStateMAC(state), int(oidcStateTTL.Seconds()), oidcCallbackPath(provider), "",
+		strings.HasPrefix(publicURL, "https://"), true)
+	return nil
+}
+
+// checkOIDCStateCookie tells whether the callback comes to the browser the
+// state was issued to, and clears the cookie, a state is used once.
+func checkOIDCStateCookie(c *gin.Context, provider, state string) bool {
+	cookie, err := c.Cookie(oidcStateCookie)
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(oidcStateCookie, "", -1, oidcCallbackPath(provider), "", strings.HasPrefix(publicURL, "https://"), true)
+	return err == nil && state != "" && hmac.Equal([]byte(cookie), []byte(oidcStateMAC(state)))
+}
+
+func oidcError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.Unauthenticated:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": status.Convert(err).Message()})
+	case codes.PermissionDenied:
+		forbidden(c, err)
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		c.JSON(http.StatusConflict, gin.H{"error": status.Convert(err).Message()})
+	case codes.Unavailable:
+		c.JSON(http.StatusBadGateway, gin.H{"error": status.Convert(err).Message()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func identityJSON(identity *user_proto.Identity) gin.H {
+	body := gin.H{
+		"provider":     identity.Provider,
+		"display_name": identity.DisplayName,
+		"subject":      identity.Subject,
+		"linked_at":    &CustomTimestamp{identity.LinkedAt},
+	}
+	if identity.LastLoginAt != nil {
+		body["last_login_at"] = &CustomTimestamp{identity.LastLoginAt}
+	}
+	return body
+}
+
+func listOIDCProviders(c *gin.Context) {
+	res, err := userClient.ListOIDCProviders(context.Background(), &user_proto.ListOIDCProvidersRequest{})
+	if err != nil {
+		oidcError(c, err)
+		return
+	}
+
+	providers := []gin.H{}
+	for _, provider := range res.Providers {
+		providers = append(providers, gin.H{"name": provider.Name, "display_name": provider.DisplayName})
+	}
+	c.JSON(http.StatusOK, gin.H{"providers": providers})
+}
+
+// startOIDCLogin sends the browser to the provider.
+func startOIDCLogin(c *gin.Context) {
+	res, err := userClient.StartOIDCLogin(withClientInfo(context.Background(), c), &user_proto.StartOIDCLoginRequest{
+		Provider: c.Param("provider"),
+		Device:   c.Query("device"),
+	})
+	if err != nil {
+		oidcError(c, err)
+		return
+	}
+	if err := setOIDCStateCookie(c, c.Param("provider"), res.AuthorizationUrl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Redirect(http.StatusFound, res.AuthorizationUrl)
+}
+
+// completeOIDC is the redirect URI registered at the providers. It answers
+// with tokens like /authenticate, or with the linked identity.
+func completeOIDC(c *gin.Context) {
+	if providerError := c.Query("error"); providerError != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": providerError, "description": c.Query("error_description")})
+		return
+	}
+
+	if !checkOIDCStateCookie(c, c.Param("provider"), c.Query("state")) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "state was not issued to this browser"})
+		return
+	}
+
+	res, err := userClient.CompleteOIDC(withClientInfo(context.Background(), c), &user_proto.CompleteOIDCRequest{
+		Provider: c.Param("provider"),
+		Code:     c.Query("code"),
+		State:    c.Query("state"),
+	})
+	if err != nil {
+		oidcError(c, err)
+		return
+	}
+
+	if res.LinkedIdentity != nil {
+		c.JSON(http.StatusOK, gin.H{"linked_identity": identityJSON(res.LinkedIdentity)})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"access_token":        res.AccessToken,
+		"refresh_token":       res.RefreshToken,
+		"two_factor_required": res.TwoFactorRequired,
+		"challenge_token":     res.ChallengeToken,
+		"two_factor_methods":  res.TwoFactorMethods,
+		"account_created":     res.AccountCreated,
+	})
+}
+
+func identitiesContext(c *gin.Context) context.Context {
+	token := extractToken(c)
+	return metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+}
+
+func listIdentities(c *gin.Context) {
+	res, err := userClient.ListIdentities(identitiesContext(c), &user_proto.ListIdentitiesRequest{})
+	if err != nil {
+		oidcError(c, err)
+		return
+	}
+
+	identities := []gin.H{}
+	for _, identity := range res.Identities {
+		identities = append(identities, identityJSON(identity))
+	}
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+// startOIDCLink answers with the URL instead of redirecting, the browser does
+// not send the access token on a navigation.
+func startOIDCLink(c *gin.Context) {
+	res, err := userClient.StartOIDCLink(identitiesContext(c), &user_proto.StartOIDCLinkRequest{Provider: c.Param("provider")})
+	if err != nil {
+		oidcError(c, err)
+		return
+	}
+	if err := setOIDCStateCookie(c, c.Param("provider"), res.AuthorizationUrl); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"authorization_url": res.AuthorizationUrl})
+}
+
+func unlinkIdentity(c *gin.Context) {
+	_, err := userClient.UnlinkIdentity(identitiesContext(c), &user_proto.UnlinkIdentityRequest{Provider: c.Param("provider")})
+	if err != nil {
+		oidcError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+// base64URL is a binary field of the WebAuthn JSON encoding. Browsers send
+// it without padding, which is accepted either way.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + base64.RawURLEncoding.EncodeToString(b) + `"`), nil
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var value *string
+	if err := json.Unmarshal(data, &value); err != nil || value == nil {
+		return err
+	}
+	decoded, err := decodeBase64URL(*value)
+	if err != nil {
+		return err
+	}
+	*b = decoded
+	return nil
+}
+
+func decodeBase64URL(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+}
+
+func passkeyError(c *gin.Context, err error) {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.Unauthenticated:
+		c.JSON(http.StatusUnauthorized, gin.H{"error": status.Convert(err).Message()})
+	case codes.PermissionDenied:
+		forbidden(c, err)
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": status.Convert(err).Message()})
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		c.JSON(http.StatusConflict, gin.H{"error": status.Convert(err).Message()})
+	case codes.ResourceExhausted:
+		tooManyAttempts(c, err)
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+func passkeysContext(c *gin.Context) context.Context {
+	token := extractToken(c)
+	return metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+}
+
+func credentialDescriptors(descriptors []*user_proto.PasskeyDescriptor) []gin.H {
+	result := []gin.H{}
+	for _, descriptor := range descriptors {
+		credential := gin.H{"type": "public-key", "id": base64URL(descriptor.Id)}
+		if len(descriptor.Transports) > 0 {
+			credential["transports"] = descriptor.Transports
+		}
+		result = append(result, credential)
+	}
+	return result
+}
+
+func passkeyJSON(passkey *user_proto.Passkey) gin.H {
+	body := gin.H{
+		"id":         base64URL(passkey.Id),
+		"name":       passkey.Name,
+		"backed_up":  passkey.BackedUp,
+		"transports": passkey.Transports,
+		"created_at": &CustomTimestamp{passkey.CreatedAt},
+	}
+	if passkey.LastUsedAt != nil {
+		body["last_used_at"] = &CustomTimestamp{passkey.LastUsedAt}
+	}
+	return body
+}
+
+// startPasskeyRegistration returns PublicKeyCredentialCreationOptions in the
+// JSON form of PublicKeyCredential.parseCreationOptionsFromJSON.
+func startPasskeyRegistration(c *gin.Context) {
+	res, err := userClient.StartPasskeyRegistration(passkeysContext(c), &user_proto.StartPasskeyRegistrationRequest{})
+	if err != nil {
+		passkeyError(c, err)
+		return
+	}
+
+	params := []gin.H{}
+	for _, alg := range res.Algorithms {
+		params = append(params, gin.H{"type": "public-key", "alg": alg})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"challenge": base64URL(res.Challenge),
+		"rp":        gin.H{"id": res.RpId, "name": res.RpName},
+		"user": gin.H{
+			"id":          base64URL(res.UserHandle),
+			"name":        res.UserName,
+			"displayName": res.UserDisplayName,
+		},
+		"pubKeyCredParams":   params,
+		"timeout":            res.TimeoutMs,
+		"excludeCredentials": credentialDescriptors(res.ExcludeCredentials),
+		"authenticatorSelection": gin.H{
+			"residentKey":      "preferred",
+			"userVerification": "preferred",
+		},
+		"attestation": "none",
+	})
+}
+
+func finishPasskeyRegistration(c *gin.Context) {
+	var req struct {
+		Name       string `json:"name"`
+		Credential struct {
+			Response struct {
+				ClientDataJSON    base64URL `json:"clientDataJSON"`
+				AttestationObject base64URL `json:"attestationObject"`
+				Transports        []string  `json:"transports"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.FinishPasskeyRegistration(passkeysContext(c), &user_proto.FinishPasskeyRegistrationRequest{
+		Name:              req.Name,
+		ClientDataJson:    req.Credential.Response.ClientDataJSON,
+		AttestationObject: req.Credential.Response.AttestationObject,
+		Transports:        req.Credential.Response.Transports,
+	})
+	if err != nil {
+		passkeyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, passkeyJSON(res))
+}
+
+func listPasskeys(c *gin.Context) {
+	res, err := userClient.ListPasskeys(passkeysContext(c), &user_proto.ListPasskeysRequest{})
+	if err != nil {
+		passkeyError(c, err)
+		return
+	}
+
+	passkeys := []gin.H{}
+	for _, passkey := range res.Passkeys {
+		passkeys = append(passkeys, passkeyJSON(passkey))
+	}
+	c.JSON(http.StatusOK, gin.H{"passkeys": passkeys})
+}
+
+func deletePasskey(c *gin.Context) {
+	id, err := decodeBase64URL(c.Param("passkey_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid passkey id"})
+		return
+	}
+
+	if _, err := userClient.DeletePasskey(passkeysContext(c), &user_proto.DeletePasskeyRequest{Id: id}); err != nil {
+		passkeyError(c, err)
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// startPasskeyLogin returns PublicKeyCredentialRequestOptions in the JSON
+// form of PublicKeyCredential.parseRequestOptionsFromJSON. The challenge token
+// of a password login makes the passkey its second factor.
+func startPasskeyLogin(c *gin.Context) {
+	var req struct {
+		ChallengeToken string `json:"challenge_token"`
+	}
+	// the body is optional for a passwordless login
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.StartPasskeyLogin(withClientInfo(context.Background(), c), &user_proto.StartPasskeyLoginRequest{
+		ChallengeToken: req.ChallengeToken,
+	})
+	if err != nil {
+		passkeyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":        base64URL(res.Challenge),
+		"rpId":             res.RpId,
+		"allowCredentials": credentialDescriptors(res.AllowCredentials),
+		"userVerification": res.UserVerification,
+		"timeout":          res.TimeoutMs,
+	})
+}
+
+func finishPasskeyLogin(c *gin.Context) {
+	var req struct {
+		Device     string `json:"device"`
+		Credential struct {
+			RawID    base64URL `json:"rawId"`
+			Response struct {
+				ClientDataJSON    base64URL `json:"clientDataJSON"`
+				AuthenticatorData base64URL `json:"authenticatorData"`
+				Signature         base64URL `json:"signature"`
+				UserHandle        base64URL `json:"userHandle"`
+			} `json:"response"`
+		} `json:"credential"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	res, err := userClient.FinishPasskeyLogin(withClientInfo(context.Background(), c), &user_proto.FinishPasskeyLoginRequest{
+		CredentialId:      req.Credential.RawID,
+		ClientDataJson:    req.Credential.Response.ClientDataJSON,
+		AuthenticatorData: req.Credential.Response.AuthenticatorData,
+		Signature:         req.Credential.Response.Signature,
+		UserHandle:        req.Credential.Response.UserHandle,
+		Device:            req.Device,
+	})
+	if err != nil {
+		passkeyError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
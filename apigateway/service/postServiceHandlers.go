@@ -2,13 +2,17 @@ package main
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"strconv"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 
 	post_proto "github.com/Nicvod/SOA/postService/post_proto"
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
 )
 
 func createPost(c *gin.Context) {
@@ -43,6 +47,10 @@ func createPost(c *gin.Context) {
 	}
 
 	resp, err := postClient.CreatePost(ctx, grpcReq)
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -79,17 +87,33 @@ func listPosts(c *gin.Context) {
 	}
 
 	resp, err := postClient.ListPosts(ctx, grpcReq)
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
+	if status.Code(err) == codes.Unavailable {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": status.Convert(err).Message()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	creatorIDs := make([]string, 0, len(resp.Posts))
+	for _, p := range resp.Posts {
+		creatorIDs = append(creatorIDs, p.CreatorId)
+	}
+	authors := fetchAuthors(ctx, creatorIDs)
+
 	var posts []gin.H
 	for _, p := range resp.Posts {
 		posts = append(posts, gin.H{
 			"id":          p.Id,
 			"title":       p.Title,
 			"description": p.Description,
+			"creator_id":  p.CreatorId,
+			"author":      authors[p.CreatorId],
 			"is_private":  p.IsPrivate,
 			"tags":        p.Tags,
 			"created_at":  p.CreatedAt.AsTime(),
@@ -123,16 +147,27 @@ func getPost(c *gin.Context) {
 	)
 
 	resp, err := postClient.GetPost(ctx, grpcReq)
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
+	if status.Code(err) == codes.Unavailable {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": status.Convert(err).Message()})
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	authors := fetchAuthors(ctx, []string{resp.CreatorId})
+
 	c.JSON(http.StatusOK, gin.H{
 		"id":          resp.Id,
 		"title":       resp.Title,
 		"description": resp.Description,
 		"creator_id":  resp.CreatorId,
+		"author":      authors[resp.CreatorId],
 		"is_private":  resp.IsPrivate,
 		"tags":        resp.Tags,
 		"created_at":  resp.CreatedAt.AsTime(),
@@ -175,6 +210,10 @@ func updatePost(c *gin.Context) {
 	}
 
 	resp, err := postClient.UpdatePost(ctx, grpcReq)
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -209,6 +248,10 @@ func deletePost(c *gin.Context) {
 	)
 
 	_, err := postClient.DeletePost(ctx, grpcReq)
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -216,3 +259,34 @@ func deletePost(c *gin.Context) {
 
 	c.Status(http.StatusNoContent)
 }
+
+// fetchAuthors loads the public profiles of post creators with a single
+// BatchGetUsers call, keyed by creator_id. Posts are still served if the user
+// service fails, just without authors.
+func fetchAuthors(ctx context.Context, creatorIDs []string) map[string]gin.H {
+	seen := make(map[int32]bool, len(creatorIDs))
+	var ids []int32
+	for _, creatorID := range creatorIDs {
+		id, err := strconv.ParseInt(creatorID, 10, 32)
+		if err != nil || id <= 0 || seen[int32(id)] {
+			continue
+		}
+		seen[int32(id)] = true
+		ids = append(ids, int32(id))
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	resp, err := userClient.BatchGetUsers(ctx, &user_proto.BatchGetUsersRequest{UserIds: ids})
+	if err != nil {
+		log.Printf("failed to get post authors: %v", err)
+		return nil
+	}
+
+	authors := make(map[string]gin.H, len(resp.Users))
+	for _, user := range resp.Users {
+		authors[strconv.Itoa(int(user.Id))] = publicProfileJSON(user)
+	}
+	return authors
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+type sessionCacheEntry struct {
+	userID    int
+	active    bool
+	expiresAt time.Time
+}
+
+type SessionCache struct {
+	mu        sync.Mutex
+	ttl       time.Duration
+	entries   map[string]sessionCacheEntry
+	lastSweep time.Time
+}
+
+func NewSessionCache(ttl time.Duration) *SessionCache {
+	return &SessionCache{
+		ttl:     ttl,
+		entries: make(map[string]sessionCacheEntry),
+	}
+}
+
+func (c *SessionCache) IsActive(ctx context.Context, userID int, sessionID string) (bool, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[sessionID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.active, nil
+	}
+
+	resp, err := userClient.CheckSession(ctx, &user_proto.CheckSessionRequest{SessionId: sessionID})
+	if err != nil {
+		return false, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[sessionID] = sessionCacheEntry{userID: userID, active: resp.Active, expiresAt: now.Add(c.ttl)}
+	if now.Sub(c.lastSweep) > c.ttl {
+		c.evictExpired(now)
+		c.lastSweep = now
+	}
+	return resp.Active, nil
+}
+
+func (c *SessionCache) Revoke(sessionID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[sessionID] = sessionCacheEntry{active: false, expiresAt: time.Now().Add(c.ttl)}
+}
+
+// RevokeUser marks every cached session of the user as revoked, for when
+// userService ended all of them, like on suspension.
+func (c *SessionCache) RevokeUser(userID int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	expiresAt := time.Now().Add(c.ttl)
+	for id, entry := range c.entries {
+		if entry.userID == userID {
+			c.entries[id] = sessionCacheEntry{userID: userID, active: false, expiresAt: expiresAt}
+		}
+	}
+}
+
+func (c *SessionCache) evictExpired(now time.Time) {
+	for id, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+}
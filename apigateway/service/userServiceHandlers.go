@@ -2,15 +2,24 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
 )
 
 type CustomTimestamp struct {
@@ -27,6 +36,14 @@ func (ct *CustomTimestamp) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// Proto returns nil for a field missing from the JSON body.
+func (ct *CustomTimestamp) Proto() *timestamppb.Timestamp {
+	if ct == nil {
+		return nil
+	}
+	return ct.Timestamp
+}
+
 func (ct *CustomTimestamp) MarshalJSON() ([]byte, error) {
 	if ct.Timestamp == nil {
 		return []byte("null"), nil
@@ -43,6 +60,7 @@ type RegisterUserRequest struct {
 	LastName    string           `json:"last_name"`
 	BirthDate   *CustomTimestamp `json:"birth_date"`
 	PhoneNumber string           `json:"phone_number"`
+	Device      string           `json:"device"`
 }
 
 type UpdateProfileRequest struct {
@@ -51,6 +69,16 @@ type UpdateProfileRequest struct {
 	LastName    string           `json:"last_name"`
 	BirthDate   *CustomTimestamp `json:"birth_date"`
 	PhoneNumber string           `json:"phone_number"`
+	Bio         string           `json:"bio"`
+	Location    string           `json:"location"`
+	Website     string           `json:"website"`
+	Pronouns    string           `json:"pronouns"`
+	Links       []ProfileLink    `json:"links"`
+}
+
+type ProfileLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
 }
 
 type GetProfileResponse struct {
@@ -62,6 +90,20 @@ type GetProfileResponse struct {
 	PhoneNumber string           `json:"phone_number"`
 	CreatedAt   *CustomTimestamp `json:"created_at"`
 	UpdatedAt   *CustomTimestamp `json:"updated_at"`
+	Roles       []string         `json:"roles"`
+
+	EmailVerified  bool  `json:"email_verified"`
+	FollowersCount int32 `json:"followers_count"`
+	FollowingCount int32 `json:"following_count"`
+	IsPrivate      bool  `json:"is_private"`
+	Avatar         gin.H `json:"avatar"`
+
+	Bio        string            `json:"bio"`
+	Location   string            `json:"location"`
+	Website    string            `json:"website"`
+	Pronouns   string            `json:"pronouns"`
+	Links      []ProfileLink     `json:"links"`
+	Visibility map[string]string `json:"visibility"`
 }
 
 func registerUser(c *gin.Context) {
@@ -77,11 +119,20 @@ func registerUser(c *gin.Context) {
 		Email:       req.Email,
 		FirstName:   req.FirstName,
 		LastName:    req.LastName,
-		BirthDate:   req.BirthDate.Timestamp,
+		BirthDate:   req.BirthDate.Proto(),
 		PhoneNumber: req.PhoneNumber,
+		Device:      req.Device,
 	}
 
-	res, err := userClient.RegisterUser(context.Background(), grpcReq)
+	res, err := userClient.RegisterUser(withClientInfo(context.Background(), c), grpcReq)
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
+	if status.Code(err) == codes.AlreadyExists {
+		alreadyExists(c, err)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -97,6 +148,42 @@ func updateProfile(c *gin.Context) {
 		return
 	}
 
+	sendProfileUpdate(c, &req, nil)
+}
+
+// patchProfile updates only the fields present in the JSON body.
+func patchProfile(c *gin.Context) {
+	body, err := c.GetRawData()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var present map[string]json.RawMessage
+	if err := json.Unmarshal(body, &present); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var req UpdateProfileRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(present) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "no fields to update"})
+		return
+	}
+
+	paths := make([]string, 0, len(present))
+	for field := range present {
+		paths = append(paths, field)
+	}
+	sort.Strings(paths)
+
+	sendProfileUpdate(c, &req, &fieldmaskpb.FieldMask{Paths: paths})
+}
+
+func sendProfileUpdate(c *gin.Context, req *UpdateProfileRequest, mask *fieldmaskpb.FieldMask) {
 	token := extractToken(c)
 	if token == "" {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
@@ -112,17 +199,31 @@ func updateProfile(c *gin.Context) {
 		Email:       req.Email,
 		FirstName:   req.FirstName,
 		LastName:    req.LastName,
-		BirthDate:   req.BirthDate.Timestamp,
+		BirthDate:   req.BirthDate.Proto(),
 		PhoneNumber: req.PhoneNumber,
+		UpdateMask:  mask,
+		Bio:         req.Bio,
+		Location:    req.Location,
+		Website:     req.Website,
+		Pronouns:    req.Pronouns,
+	}
+	for _, link := range req.Links {
+		grpcReq.Links = append(grpcReq.Links, &user_proto.ProfileLink{Title: link.Title, Url: link.URL})
 	}
 
 	res, err := userClient.UpdateProfile(ctx, grpcReq)
-	if err != nil {
+	switch status.Code(err) {
+	case codes.OK:
+		c.JSON(http.StatusOK, res)
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.AlreadyExists:
+		alreadyExists(c, err)
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+	default:
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
 	}
-
-	c.JSON(http.StatusOK, res)
 }
 
 func getProfile(c *gin.Context) {
@@ -152,6 +253,20 @@ func getProfile(c *gin.Context) {
 		PhoneNumber: res.PhoneNumber,
 		CreatedAt:   &CustomTimestamp{res.CreatedAt},
 		UpdatedAt:   &CustomTimestamp{res.UpdatedAt},
+		Roles:       res.Roles,
+
+		EmailVerified:  res.EmailVerified,
+		FollowersCount: res.FollowersCount,
+		FollowingCount: res.FollowingCount,
+		IsPrivate:      res.IsPrivate,
+		Avatar:         avatarJSON(res.Avatar),
+
+		Bio:        res.Bio,
+		Location:   res.Location,
+		Website:    res.Website,
+		Pronouns:   res.Pronouns,
+		Links:      profileLinksJSON(res.Links),
+		Visibility: visibilityJSON(res.Visibility),
 	}
 
 	c.JSON(http.StatusOK, profileResponse)
@@ -164,7 +279,19 @@ func authenticateUser(c *gin.Context) {
 		return
 	}
 
-	res, err := userClient.AuthenticateUser(context.Background(), &req)
+	res, err := userClient.AuthenticateUser(withClientInfo(context.Background(), c), &req)
+	if status.Code(err) == codes.ResourceExhausted {
+		tooManyAttempts(c, err)
+		return
+	}
+	if isValidationError(err) {
+		invalidArgument(c, err)
+		return
+	}
+	if status.Code(err) == codes.PermissionDenied {
+		forbidden(c, err)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid login or password"})
 		return
@@ -173,6 +300,16 @@ func authenticateUser(c *gin.Context) {
 	c.JSON(http.StatusOK, res)
 }
 
+func tooManyAttempts(c *gin.Context, err error) {
+	for _, detail := range status.Convert(err).Details() {
+		if retry, ok := detail.(*errdetails.RetryInfo); ok {
+			seconds := int(math.Ceil(retry.RetryDelay.AsDuration().Seconds()))
+			c.Header("Retry-After", strconv.Itoa(seconds))
+		}
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": status.Convert(err).Message()})
+}
+
 func refreshToken(c *gin.Context) {
 	var req user_proto.RefreshTokenRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -180,7 +317,11 @@ func refreshToken(c *gin.Context) {
 		return
 	}
 
-	res, err := userClient.RefreshToken(context.Background(), &req)
+	res, err := userClient.RefreshToken(withClientInfo(context.Background(), c), &req)
+	if isValidationError(err) {
+		invalidArgument(c, err)
+		return
+	}
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
 		return
@@ -188,3 +329,252 @@ func refreshToken(c *gin.Context) {
 
 	c.JSON(http.StatusOK, res)
 }
+
+func logout(c *gin.Context) {
+	token := extractToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
+		return
+	}
+
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	_, err := userClient.Logout(ctx, &user_proto.LogoutRequest{})
+	if status.Code(err) == codes.PermissionDenied {
+		forbidden(c, err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if tokenInfo, ok := c.Get(tokenInfoKey); ok {
+		sessionCache.Revoke(tokenInfo.(*auth.TokenInfo).FamilyID)
+	}
+	c.Status(http.StatusNoContent)
+}
+
+func listSessions(c *gin.Context) {
+	token := extractToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
+		return
+	}
+
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.ListSessions(ctx, &user_proto.ListSessionsRequest{})
+	if status.Code(err) == codes.PermissionDenied {
+		forbidden(c, err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	sessions := []gin.H{}
+	for _, s := range res.Sessions {
+		sessions = append(sessions, gin.H{
+			"id":                s.Id,
+			"device":            s.Device,
+			"user_agent":        s.UserAgent,
+			"ip":                s.Ip,
+			"created_at":        s.CreatedAt.AsTime(),
+			"last_refreshed_at": s.LastRefreshedAt.AsTime(),
+			"current":           s.Current,
+		})
+	}
+
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+func revokeSession(c *gin.Context) {
+	sessionID := c.Param("session_id")
+
+	token := extractToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
+		return
+	}
+
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	_, err := userClient.RevokeSession(ctx, &user_proto.RevokeSessionRequest{SessionId: sessionID})
+	if err != nil {
+		switch status.Code(err) {
+		case codes.NotFound:
+			c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		case codes.InvalidArgument:
+			invalidArgument(c, err)
+		case codes.PermissionDenied:
+			forbidden(c, err)
+		default:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		}
+		return
+	}
+
+	sessionCache.Revoke(sessionID)
+	c.Status(http.StatusNoContent)
+}
+
+// getPublicProfile looks the user up by id when the parameter is numeric and
+// by login otherwise.
+func getPublicProfile(c *gin.Context) {
+	token := extractToken(c)
+	if token == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "missing or invalid token"})
+		return
+	}
+
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	req := &user_proto.GetPublicProfileRequest{}
+	param := c.Param("user_id")
+	if id, err := strconv.ParseInt(param, 10, 32); err == nil {
+		req.User = &user_proto.GetPublicProfileRequest_UserId{UserId: int32(id)}
+	} else {
+		req.User = &user_proto.GetPublicProfileRequest_Login{Login: param}
+	}
+
+	res, err := userClient.GetPublicProfile(ctx, req)
+	switch status.Code(err) {
+	case codes.OK:
+		c.JSON(http.StatusOK, publicProfileJSON(res))
+	case codes.InvalidArgument:
+		invalidArgument(c, err)
+	case codes.NotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// publicProfileJSON leaves out the optional fields that are empty, either
+// unset or hidden from the caller.
+func publicProfileJSON(profile *user_proto.PublicProfile) gin.H {
+	body := gin.H{
+		"id":              profile.Id,
+		"login":           profile.Login,
+		"first_name":      profile.FirstName,
+		"last_name":       profile.LastName,
+		"created_at":      &CustomTimestamp{profile.CreatedAt},
+		"followers_count": profile.FollowersCount,
+		"following_count": profile.FollowingCount,
+		"is_private":      profile.IsPrivate,
+		"avatar":          avatarJSON(profile.Avatar),
+	}
+	optional := map[string]string{
+		"email":        profile.Email,
+		"phone_number": profile.PhoneNumber,
+		"bio":          profile.Bio,
+		"location":     profile.Location,
+		"website":      profile.Website,
+		"pronouns":     profile.Pronouns,
+	}
+	for field, value := range optional {
+		if value != "" {
+			body[field] = value
+		}
+	}
+	if profile.BirthDate != nil {
+		body["birth_date"] = &CustomTimestamp{profile.BirthDate}
+	}
+	if len(profile.Links) > 0 {
+		body["links"] = profileLinksJSON(profile.Links)
+	}
+	return body
+}
+
+func profileLinksJSON(links []*user_proto.ProfileLink) []ProfileLink {
+	result := make([]ProfileLink, 0, len(links))
+	for _, link := range links {
+		result = append(result, ProfileLink{Title: link.Title, URL: link.Url})
+	}
+	return result
+}
+
+// visibilityJSON names visibilities public, followers and only_me.
+func visibilityJSON(visibility map[string]user_proto.Visibility) map[string]string {
+	result := make(map[string]string, len(visibility))
+	for field, value := range visibility {
+		result[field] = strings.ToLower(strings.TrimPrefix(value.String(), "VISIBILITY_"))
+	}
+	return result
+}
+
+// updateProfileVisibility takes a JSON object of field names to public,
+// followers or only_me. Fields left out keep their visibility.
+func updateProfileVisibility(c *gin.Context) {
+	var req map[string]string
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	// Unknown names become VISIBILITY_UNSPECIFIED, which the service rejects.
+	grpcReq := &user_proto.UpdateProfileVisibilityRequest{Visibility: map[string]user_proto.Visibility{}}
+	for field, name := range req {
+		grpcReq.Visibility[field] = user_proto.Visibility(user_proto.Visibility_value["VISIBILITY_"+strings.ToUpper(name)])
+	}
+
+	res, err := userClient.UpdateProfileVisibility(ctx, grpcReq)
+	if err != nil {
+		accountError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, visibilityJSON(res.Visibility))
+}
+
+func searchUsers(c *gin.Context) {
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "0"))
+
+	token := extractToken(c)
+	ctx := metadata.NewOutgoingContext(
+		context.Background(),
+		metadata.Pairs("authorization", "Bearer "+token),
+	)
+
+	res, err := userClient.SearchUsers(ctx, &user_proto.SearchUsersRequest{
+		Query:    c.Query("q"),
+		PageSize: int32(pageSize),
+		Cursor:   c.Query("cursor"),
+	})
+	if status.Code(err) == codes.InvalidArgument {
+		invalidArgument(c, err)
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	users := []gin.H{}
+	for _, user := range res.Users {
+		users = append(users, publicProfileJSON(user))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"users":       users,
+		"next_cursor": res.NextCursor,
+	})
+}
@@ -20,7 +20,17 @@ const login = async (credentials) => {
   return response.data;
 };
 
-const logout = () => {
+const logout = async () => {
+  const access_token = localStorage.getItem('access_token');
+  if (access_token) {
+    try {
+      await axios.delete(`${API_URL}/sessions/current`, {
+        headers: { Authorization: `Bearer ${access_token}` },
+      });
+    } catch (e) {
+      // the session is dropped locally even if the server call fails
+    }
+  }
   localStorage.removeItem('access_token');
   localStorage.removeItem('refresh_token');
 };
@@ -30,6 +40,7 @@ const refreshToken = async () => {
   const response = await axios.post(`${API_URL}/refresh-token`, { refresh_token });
   if (response.data.access_token) {
     localStorage.setItem('access_token', response.data.access_token);
+    localStorage.setItem('refresh_token', response.data.refresh_token);
   }
   return response.data;
 };
@@ -9,10 +9,14 @@ import (
 
 	_ "github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	grpcclient "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 
 	authInternal "github.com/Nicvod/SOA/postService/internal/auth"
 	"github.com/Nicvod/SOA/postService/internal/config"
 	"github.com/Nicvod/SOA/postService/internal/transport/grpc"
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
 )
 
 func main() {
@@ -31,10 +35,17 @@ func main() {
 	if err != nil {
 		log.Fatalf("Failed to create authhelper: %v", err)
 	}
-	server := grpc.NewServer(cfg, db, authHelper)
+	userConn, err := grpcclient.NewClient(cfg.UserServiceEndpoint, grpcclient.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("Failed to connect to user service: %v", err)
+	}
+	defer userConn.Close()
+
+	server := grpc.NewServer(cfg, db, authHelper, user_proto.NewUserServiceClient(userConn))
 
-	_, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	go auth.WatchKeyRing(ctx, authHelper, cfg.KeysDir, false, cfg.KeysReload)
 
 	go func() {
 		if err := server.Run(); err != nil {
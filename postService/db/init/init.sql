@@ -6,7 +6,8 @@ CREATE TABLE IF NOT EXISTS posts (
     created_at TIMESTAMP NOT NULL DEFAULT NOW(),
     updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
     is_private BOOLEAN NOT NULL DEFAULT FALSE,
-    tags TEXT[] NOT NULL DEFAULT '{}'
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    author_hidden BOOLEAN NOT NULL DEFAULT FALSE
 );
 
 CREATE INDEX IF NOT EXISTS idx_posts_creator_id ON posts(creator_id);
\ No newline at end of file
@@ -12,9 +12,14 @@ import (
 )
 
 type Config struct {
-	DBConn        DBConnConfig
-	ServicePort   string
-	PublicKeyFile string
+	DBConn      DBConnConfig
+	ServicePort string
+	KeysDir     string
+	KeysReload  time.Duration
+
+	UserServiceEndpoint string
+	ContentFilterTTL    time.Duration
+	SessionCacheTTL     time.Duration
 }
 
 type DBConnConfig struct {
@@ -55,16 +60,20 @@ func NewDB(cfg *Config) (*sqlx.DB, error) {
 }
 
 func NewConfig() (*Config, error) {
-	var publicFile, dbNameEnv, dbUserEnv, dbPasswordEnv, dbName, dbUser, dbPassword string
-	flag.StringVar(&publicFile, "public_key", "", "path to JWT public key `file`")
+	var keysDir, dbNameEnv, dbUserEnv, dbPasswordEnv, dbName, dbUser, dbPassword string
+	flag.StringVar(&keysDir, "keys_dir", "", "path to JWT signing key ring `dir`")
+	keysReload := flag.Duration("keys_reload", time.Minute, "how often to reload the signing key ring")
 	flag.StringVar(&dbNameEnv, "db_name_env", "", "database name env")
 	flag.StringVar(&dbUserEnv, "db_user_env", "", "database user env")
 	flag.StringVar(&dbPasswordEnv, "db_password_env", "", "database password env")
 	dbPort := flag.Int("db_port", 5432, "database port")
 	servicePort := flag.Int("service_port", 50051, "service port")
+	userServiceEndpoint := flag.String("user_service_endpoint", "user_app:50051", "user service address")
+	contentFilterTTL := flag.Duration("content_filter_ttl", 30*time.Second, "how long blocked and muted users of a viewer are cached")
+	sessionCacheTTL := flag.Duration("session_cache_ttl", 15*time.Second, "how long an active session is trusted without asking user service")
 	flag.Parse()
-	if publicFile == "" {
-		return nil, fmt.Errorf("no private key file provided")
+	if keysDir == "" {
+		return nil, fmt.Errorf("no keys dir provided")
 	}
 	if dbNameEnv == "" {
 		return nil, fmt.Errorf("no database name env provided")
@@ -89,7 +98,12 @@ func NewConfig() (*Config, error) {
 			DBPassword: dbPassword,
 			DBName:     dbName,
 		},
-		ServicePort:   fmt.Sprint(*servicePort),
-		PublicKeyFile: publicFile,
+		ServicePort: fmt.Sprint(*servicePort),
+		KeysDir:     keysDir,
+		KeysReload:  *keysReload,
+
+		UserServiceEndpoint: *userServiceEndpoint,
+		ContentFilterTTL:    *contentFilterTTL,
+		SessionCacheTTL:     *sessionCacheTTL,
 	}, nil
 }
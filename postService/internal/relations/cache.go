@@ -0,0 +1,132 @@
+package relations
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
+)
+
+// Filter lists creators whose posts are hidden from one viewer, keyed like
+// posts.creator_id.
+type Filter struct {
+	Blocked map[string]bool
+	Muted   map[string]bool
+}
+
+// IsBlocked reports a block between the viewer and the creator in either
+// direction.
+func (f *Filter) IsBlocked(creatorID string) bool {
+	return f.Blocked[creatorID]
+}
+
+// HiddenFromFeed returns blocked and muted creators.
+func (f *Filter) HiddenFromFeed() []string {
+	hidden := make([]string, 0, len(f.Blocked)+len(f.Muted))
+	for id := range f.Blocked {
+		hidden = append(hidden, id)
+	}
+	for id := range f.Muted {
+		if !f.Blocked[id] {
+			hidden = append(hidden, id)
+		}
+	}
+	return hidden
+}
+
+type cacheEntry struct {
+	filter    *Filter
+	expiresAt time.Time
+}
+
+// Cache keeps content filters fetched from userService for ttl, so blocks
+// and mutes take up to ttl to apply. When userService fails an expired
+// filter is still used rather than showing hidden posts.
+type Cache struct {
+	client       user_proto.UserServiceClient
+	authProvider auth.AuthProvider
+	ttl          time.Duration
+
+	mu        sync.Mutex
+	entries   map[int]cacheEntry
+	lastSweep time.Time
+}
+
+func NewCache(client user_proto.UserServiceClient, authProvider auth.AuthProvider, ttl time.Duration) *Cache {
+	return &Cache{
+		client:       client,
+		authProvider: authProvider,
+		ttl:          ttl,
+		entries:      make(map[int]cacheEntry),
+	}
+}
+
+// Get returns the filter of the user making the incoming call, whose token
+// is passed on to userService.
+func (c *Cache) Get(ctx context.Context, userID int) (*Filter, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[userID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.filter, nil
+	}
+
+	filter, err := c.fetch(ctx)
+	if err != nil {
+		if ok {
+			log.Printf("using stale content filter of user %d: %v", userID, err)
+			return entry.filter, nil
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[userID] = cacheEntry{filter: filter, expiresAt: now.Add(c.ttl)}
+	if now.Sub(c.lastSweep) > c.ttl {
+		c.evictExpired(now)
+		c.lastSweep = now
+	}
+	return filter, nil
+}
+
+func (c *Cache) fetch(ctx context.Context) (*Filter, error) {
+	token, err := c.authProvider.TokenFromGRPCContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.client.GetContentFilter(c.authProvider.GRPCContextWithToken(ctx, token), &user_proto.GetContentFilterRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get content filter: %w", err)
+	}
+
+	filter := &Filter{
+		Blocked: make(map[string]bool, len(resp.BlockedUserIds)),
+		Muted:   make(map[string]bool, len(resp.MutedUserIds)),
+	}
+	for _, id := range resp.BlockedUserIds {
+		filter.Blocked[strconv.Itoa(int(id))] = true
+	}
+	for _, id := range resp.MutedUserIds {
+		filter.Muted[strconv.Itoa(int(id))] = true
+	}
+	return filter, nil
+}
+
+// evictExpired keeps entries for twice the ttl so they can still be used as
+// a fallback.
+func (c *Cache) evictExpired(now time.Time) {
+	for id, entry := range c.entries {
+		if now.Sub(entry.expiresAt) > c.ttl {
+			delete(c.entries, id)
+		}
+	}
+}
@@ -70,7 +70,7 @@ func (r *PostRepository) GetPost(ctx context.Context, postID, userID string) (*p
 	query := `
 		SELECT id, title, description, creator_id, created_at, updated_at, is_private, tags
 		FROM posts
-		WHERE id = $1 AND (is_private = FALSE OR creator_id=$2)
+		WHERE id = $1 AND (is_private = FALSE OR creator_id=$2) AND NOT author_hidden
 	`
 
 	err := r.db.QueryRowContext(ctx, query, postID, userID).Scan(
@@ -96,14 +96,14 @@ func (r *PostRepository) GetPost(ctx context.Context, postID, userID string) (*p
 	return &resp, nil
 }
 
-func (r *PostRepository) UpdatePost(ctx context.Context, post *post_proto.UpdatePostRequest, creatorID string) (*post_proto.PostResponse, error) {
+func (r *PostRepository) UpdatePost(ctx context.Context, post *post_proto.UpdatePostRequest, creatorID string, anyCreator bool) (*post_proto.PostResponse, error) {
 	var resp post_proto.PostResponse
 	var createdAt, updatedAt time.Time
 
 	query := `
 		UPDATE posts
 		SET title = $2, description = $3, is_private = $4, tags = $5, updated_at = NOW()
-		WHERE id = $1 AND creator_id = $6
+		WHERE id = $1 AND (creator_id = $6 OR $7)
 		RETURNING id, title, description, creator_id, created_at, updated_at, is_private, tags
 	`
 
@@ -114,6 +114,7 @@ func (r *PostRepository) UpdatePost(ctx context.Context, post *post_proto.Update
 		post.IsPrivate,
 		pq.Array(post.Tags),
 		creatorID,
+		anyCreator,
 	).Scan(
 		&resp.Id,
 		&resp.Title,
@@ -137,13 +138,13 @@ func (r *PostRepository) UpdatePost(ctx context.Context, post *post_proto.Update
 	return &resp, nil
 }
 
-func (r *PostRepository) DeletePost(ctx context.Context, postID, creatorID string) error {
+func (r *PostRepository) DeletePost(ctx context.Context, postID, creatorID string, anyCreator bool) error {
 	query := `
 		DELETE FROM posts
-		WHERE id = $1 AND creator_id = $2
+		WHERE id = $1 AND (creator_id = $2 OR $3)
 	`
 
-	result, err := r.db.ExecContext(ctx, query, postID, creatorID)
+	result, err := r.db.ExecContext(ctx, query, postID, creatorID, anyCreator)
 	if err != nil {
 		return err
 	}
@@ -160,11 +161,15 @@ func (r *PostRepository) DeletePost(ctx context.Context, postID, creatorID strin
 	return nil
 }
 
-func (r *PostRepository) ListPosts(ctx context.Context, userID string, page, pageSize int32) (*post_proto.ListPostsResponse, error) {
+// ListPosts leaves out posts of hiddenCreators.
+func (r *PostRepository) ListPosts(ctx context.Context, userID string, page, pageSize int32, hiddenCreators []string) (*post_proto.ListPostsResponse, error) {
 	var response post_proto.ListPostsResponse
 	var totalCount int32
 
-	err := r.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM posts WHERE is_private = FALSE OR creator_id = $1", userID).Scan(&totalCount)
+	err := r.db.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM posts WHERE (is_private = FALSE OR creator_id = $1) AND NOT creator_id = ANY($2) AND NOT author_hidden",
+		userID, pq.Array(hiddenCreators),
+	).Scan(&totalCount)
 	if err != nil {
 		return nil, err
 	}
@@ -173,13 +178,14 @@ func (r *PostRepository) ListPosts(ctx context.Context, userID string, page, pag
 	query := `
 		SELECT id, title, description, creator_id, created_at, updated_at, is_private, tags
 		FROM posts
-		WHERE is_private = FALSE
-		OR creator_id = $1
+		WHERE (is_private = FALSE OR creator_id = $1)
+		AND NOT creator_id = ANY($4)
+		AND NOT author_hidden
 		ORDER BY created_at DESC
 		LIMIT $2 OFFSET $3
 	`
 
-	rows, err := r.db.QueryContext(ctx, query, userID, pageSize, offset)
+	rows, err := r.db.QueryContext(ctx, query, userID, pageSize, offset, pq.Array(hiddenCreators))
 	if err != nil {
 		return nil, err
 	}
@@ -214,3 +220,65 @@ func (r *PostRepository) ListPosts(ctx context.Context, userID string, page, pag
 
 	return &response, nil
 }
+
+// SetCreatorPostsHidden hides or shows again all posts of a creator and
+// returns how many were changed.
+func (r *PostRepository) SetCreatorPostsHidden(ctx context.Context, creatorID string, hidden bool) (int64, error) {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE posts SET author_hidden = $2 WHERE creator_id = $1 AND author_hidden <> $2",
+		creatorID, hidden,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *PostRepository) DeleteCreatorPosts(ctx context.Context, creatorID string) (int64, error) {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM posts WHERE creator_id = $1", creatorID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ForEachCreatorPost calls fn for every post of a creator, oldest first,
+// and stops at the first error.
+func (r *PostRepository) ForEachCreatorPost(ctx context.Context, creatorID string, fn func(*post_proto.PostResponse) error) error {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, title, description, creator_id, created_at, updated_at, is_private, tags
+		FROM posts
+		WHERE creator_id = $1
+		ORDER BY created_at, id
+	`, creatorID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var post post_proto.PostResponse
+		var createdAt, updatedAt time.Time
+
+		err := rows.Scan(
+			&post.Id,
+			&post.Title,
+			&post.Description,
+			&post.CreatorId,
+			&createdAt,
+			&updatedAt,
+			&post.IsPrivate,
+			pq.Array(&post.Tags),
+		)
+		if err != nil {
+			return err
+		}
+
+		post.CreatedAt = timestamppb.New(createdAt)
+		post.UpdatedAt = timestamppb.New(updatedAt)
+		if err := fn(&post); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -5,65 +5,136 @@ import (
 	"fmt"
 	"log"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/Nicvod/SOA/postService/internal/models"
+	"github.com/Nicvod/SOA/postService/internal/relations"
 	postgres "github.com/Nicvod/SOA/postService/internal/repository"
 	post_proto "github.com/Nicvod/SOA/postService/post_proto"
 	"github.com/Nicvod/SOA/utils/auth"
 )
 
 type PostService struct {
-	repo       *postgres.PostRepository
-	authHelper auth.AuthProvider
+	repo    *postgres.PostRepository
+	filters *relations.Cache
 }
 
-func NewPostService(repo *postgres.PostRepository, authHelper auth.AuthProvider) *PostService {
+func NewPostService(repo *postgres.PostRepository, filters *relations.Cache) *PostService {
 	return &PostService{
-		repo:       repo,
-		authHelper: authHelper,
+		repo:    repo,
+		filters: filters,
 	}
 }
 
 func (s *PostService) CreatePost(ctx context.Context, req *post_proto.CreatePostRequest) (*post_proto.PostResponse, error) {
-	tokenInfo, err := s.authHelper.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
 	return s.repo.CreatePost(ctx, req, fmt.Sprint(tokenInfo.UserID))
 }
 
 func (s *PostService) GetPost(ctx context.Context, req *post_proto.GetPostRequest) (*post_proto.PostResponse, error) {
-	tokenInfo, err := s.authHelper.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	post, err := s.repo.GetPost(ctx, req.PostId, fmt.Sprint(tokenInfo.UserID))
 	if err != nil {
 		return nil, err
 	}
 
-	return s.repo.GetPost(ctx, req.PostId, fmt.Sprint(tokenInfo.UserID))
+	filter, err := s.contentFilter(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if filter.IsBlocked(post.CreatorId) {
+		return nil, models.ErrPostNotFound
+	}
+	return post, nil
 }
 
 func (s *PostService) UpdatePost(ctx context.Context, req *post_proto.UpdatePostRequest) (*post_proto.PostResponse, error) {
-	tokenInfo, err := s.authHelper.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.Unauthenticated, err.Error())
 	}
 
-	return s.repo.UpdatePost(ctx, req, fmt.Sprint(tokenInfo.UserID))
+	return s.repo.UpdatePost(ctx, req, fmt.Sprint(tokenInfo.UserID), tokenInfo.HasPermission(auth.PermissionEditAnyPost))
 }
 
 func (s *PostService) DeletePost(ctx context.Context, req *post_proto.DeletePostRequest) error {
-	tokenInfo, err := s.authHelper.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
 	if err != nil {
-		return err
+		return status.Error(codes.Unauthenticated, err.Error())
 	}
 	log.Println(tokenInfo, req.PostId)
 
-	return s.repo.DeletePost(ctx, req.PostId, fmt.Sprint(tokenInfo.UserID))
+	return s.repo.DeletePost(ctx, req.PostId, fmt.Sprint(tokenInfo.UserID), tokenInfo.HasPermission(auth.PermissionDeleteAnyPost))
 }
 
 func (s *PostService) ListPosts(ctx context.Context, req *post_proto.ListPostsRequest) (*post_proto.ListPostsResponse, error) {
-	tokenInfo, err := s.authHelper.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
 	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	filter, err := s.contentFilter(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.repo.ListPosts(ctx, fmt.Sprint(tokenInfo.UserID), req.Page, req.PageSize, filter.HiddenFromFeed())
+}
+
+// SetUserPostsHidden is called by userService while an account is scheduled
+// for deletion.
+func (s *PostService) SetUserPostsHidden(ctx context.Context, req *post_proto.SetUserPostsHiddenRequest) (*post_proto.UserPostsResponse, error) {
+	if _, err := auth.RequirePermission(ctx, auth.PermissionManageUserPosts); err != nil {
 		return nil, err
 	}
 
-	return s.repo.ListPosts(ctx, fmt.Sprint(tokenInfo.UserID), req.Page, req.PageSize)
+	affected, err := s.repo.SetCreatorPostsHidden(ctx, req.UserId, req.Hidden)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update posts: %v", err)
+	}
+	return &post_proto.UserPostsResponse{Affected: int32(affected)}, nil
+}
+
+// DeleteUserPosts is called by userService when a deleted account is purged.
+func (s *PostService) DeleteUserPosts(ctx context.Context, req *post_proto.DeleteUserPostsRequest) (*post_proto.UserPostsResponse, error) {
+	if _, err := auth.RequirePermission(ctx, auth.PermissionManageUserPosts); err != nil {
+		return nil, err
+	}
+
+	affected, err := s.repo.DeleteCreatorPosts(ctx, req.UserId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete posts: %v", err)
+	}
+	return &post_proto.UserPostsResponse{Affected: int32(affected)}, nil
+}
+
+// ExportUserPosts is called by userService to build a data export.
+func (s *PostService) ExportUserPosts(req *post_proto.ExportUserPostsRequest, stream post_proto.PostService_ExportUserPostsServer) error {
+	if _, err := auth.RequirePermission(stream.Context(), auth.PermissionExportUserPosts); err != nil {
+		return err
+	}
+
+	err := s.repo.ForEachCreatorPost(stream.Context(), req.UserId, stream.Send)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to export posts: %v", err)
+	}
+	return nil
+}
+
+func (s *PostService) contentFilter(ctx context.Context, userID int) (*relations.Filter, error) {
+	filter, err := s.filters.Get(ctx, userID)
+	if err != nil {
+		log.Printf("failed to get content filter of user %d: %v", userID, err)
+		return nil, status.Error(codes.Unavailable, "failed to check blocked users")
+	}
+	return filter, nil
 }
@@ -0,0 +1,76 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
+)
+
+type checkerEntry struct {
+	active    bool
+	expiresAt time.Time
+}
+
+// Checker asks userService whether the session of a token is still active.
+// An active answer is trusted for ttl, so a logout or a suspension applies to
+// calls made directly to post service within ttl; calls through the gateway
+// are cut at once by its own cache. A revoked session never comes back, so
+// that answer is remembered for as long as tokens issued before the
+// revocation may live.
+type Checker struct {
+	client user_proto.UserServiceClient
+	ttl    time.Duration
+
+	mu        sync.Mutex
+	entries   map[string]checkerEntry
+	lastSweep time.Time
+}
+
+func NewChecker(client user_proto.UserServiceClient, ttl time.Duration) *Checker {
+	return &Checker{
+		client:  client,
+		ttl:     ttl,
+		entries: make(map[string]checkerEntry),
+	}
+}
+
+func (c *Checker) IsSessionActive(ctx context.Context, sessionID string) (bool, error) {
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[sessionID]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.active, nil
+	}
+
+	resp, err := c.client.CheckSession(ctx, &user_proto.CheckSessionRequest{SessionId: sessionID})
+	if err != nil {
+		return false, fmt.Errorf("failed to check session: %w", err)
+	}
+
+	ttl := c.ttl
+	if !resp.Active {
+		ttl = auth.AccessTokenTTL
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[sessionID] = checkerEntry{active: resp.Active, expiresAt: now.Add(ttl)}
+	if now.Sub(c.lastSweep) > c.ttl {
+		c.evictExpired(now)
+		c.lastSweep = now
+	}
+	return resp.Active, nil
+}
+
+func (c *Checker) evictExpired(now time.Time) {
+	for id, entry := range c.entries {
+		if !now.Before(entry.expiresAt) {
+			delete(c.entries, id)
+		}
+	}
+}
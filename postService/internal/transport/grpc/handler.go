@@ -45,3 +45,15 @@ func (h *PostHandler) DeletePost(ctx context.Context, req *post_proto.DeletePost
 func (h *PostHandler) ListPosts(ctx context.Context, req *post_proto.ListPostsRequest) (*post_proto.ListPostsResponse, error) {
 	return h.service.ListPosts(ctx, req)
 }
+
+func (h *PostHandler) SetUserPostsHidden(ctx context.Context, req *post_proto.SetUserPostsHiddenRequest) (*post_proto.UserPostsResponse, error) {
+	return h.service.SetUserPostsHidden(ctx, req)
+}
+
+func (h *PostHandler) DeleteUserPosts(ctx context.Context, req *post_proto.DeleteUserPostsRequest) (*post_proto.UserPostsResponse, error) {
+	return h.service.DeleteUserPosts(ctx, req)
+}
+
+func (h *PostHandler) ExportUserPosts(req *post_proto.ExportUserPostsRequest, stream post_proto.PostService_ExportUserPostsServer) error {
+	return h.service.ExportUserPosts(req, stream)
+}
@@ -8,24 +8,54 @@ import (
 
 	"github.com/Nicvod/SOA/postService/internal/service"
 	post_proto "github.com/Nicvod/SOA/postService/post_proto"
+	user_proto "github.com/Nicvod/SOA/userService/user_proto"
 
 	"github.com/Nicvod/SOA/postService/internal/config"
+	"github.com/Nicvod/SOA/postService/internal/relations"
 	postgres "github.com/Nicvod/SOA/postService/internal/repository"
+	"github.com/Nicvod/SOA/postService/internal/sessions"
 	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/validation"
 	"github.com/jmoiron/sqlx"
 )
 
+// delegatedMethodScopes are the only methods third-party apps may call, with
+// the scope each of them needs. The gateway checks the same scopes per route,
+// but the service is reachable without it.
+var delegatedMethodScopes = map[string]string{
+	post_proto.PostService_GetPost_FullMethodName:    auth.ScopePostsRead,
+	post_proto.PostService_ListPosts_FullMethodName:  auth.ScopePostsRead,
+	post_proto.PostService_CreatePost_FullMethodName: auth.ScopePostsWrite,
+	post_proto.PostService_UpdatePost_FullMethodName: auth.ScopePostsWrite,
+	post_proto.PostService_DeletePost_FullMethodName: auth.ScopePostsWrite,
+}
+
 type Server struct {
 	grpcServer *grpc.Server
 	config     *config.Config
 }
 
-func NewServer(cfg *config.Config, db *sqlx.DB, authHelper auth.AuthProvider) *Server {
+func NewServer(cfg *config.Config, db *sqlx.DB, authHelper auth.AuthProvider, userClient user_proto.UserServiceClient) *Server {
 	postRepo := postgres.NewPostRepository(db)
-	postService := service.NewPostService(postRepo, authHelper)
+	filters := relations.NewCache(userClient, authHelper, cfg.ContentFilterTTL)
+	postService := service.NewPostService(postRepo, filters)
 	postHandler := NewPostHandler(postService)
+	sessionChecker := sessions.NewChecker(userClient, cfg.SessionCacheTTL)
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			auth.UnaryServerInterceptor(authHelper),
+			auth.UnarySessionInterceptor(sessionChecker),
+			auth.UnaryScopeInterceptor(delegatedMethodScopes),
+			validation.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			auth.StreamServerInterceptor(authHelper),
+			auth.StreamSessionInterceptor(sessionChecker),
+			auth.StreamScopeInterceptor(delegatedMethodScopes),
+			validation.StreamServerInterceptor(),
+		),
+	)
 	post_proto.RegisterPostServiceServer(grpcServer, postHandler)
 
 	return &Server{
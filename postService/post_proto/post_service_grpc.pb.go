@@ -20,11 +20,14 @@ import (
 const _ = grpc.SupportPackageIsVersion9
 
 const (
-	PostService_CreatePost_FullMethodName = "/post_proto.PostService/CreatePost"
-	PostService_GetPost_FullMethodName    = "/post_proto.PostService/GetPost"
-	PostService_UpdatePost_FullMethodName = "/post_proto.PostService/UpdatePost"
-	PostService_DeletePost_FullMethodName = "/post_proto.PostService/DeletePost"
-	PostService_ListPosts_FullMethodName  = "/post_proto.PostService/ListPosts"
+	PostService_CreatePost_FullMethodName         = "/post_proto.PostService/CreatePost"
+	PostService_GetPost_FullMethodName            = "/post_proto.PostService/GetPost"
+	PostService_UpdatePost_FullMethodName         = "/post_proto.PostService/UpdatePost"
+	PostService_DeletePost_FullMethodName         = "/post_proto.PostService/DeletePost"
+	PostService_ListPosts_FullMethodName          = "/post_proto.PostService/ListPosts"
+	PostService_SetUserPostsHidden_FullMethodName = "/post_proto.PostService/SetUserPostsHidden"
+	PostService_DeleteUserPosts_FullMethodName    = "/post_proto.PostService/DeleteUserPosts"
+	PostService_ExportUserPosts_FullMethodName    = "/post_proto.PostService/ExportUserPosts"
 )
 
 // PostServiceClient is the client API for PostService service.
@@ -36,6 +39,9 @@ type PostServiceClient interface {
 	UpdatePost(ctx context.Context, in *UpdatePostRequest, opts ...grpc.CallOption) (*PostResponse, error)
 	DeletePost(ctx context.Context, in *DeletePostRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
 	ListPosts(ctx context.Context, in *ListPostsRequest, opts ...grpc.CallOption) (*ListPostsResponse, error)
+	SetUserPostsHidden(ctx context.Context, in *SetUserPostsHiddenRequest, opts ...grpc.CallOption) (*UserPostsResponse, error)
+	DeleteUserPosts(ctx context.Context, in *DeleteUserPostsRequest, opts ...grpc.CallOption) (*UserPostsResponse, error)
+	ExportUserPosts(ctx context.Context, in *ExportUserPostsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PostResponse], error)
 }
 
 type postServiceClient struct {
@@ -96,6 +102,45 @@ func (c *postServiceClient) ListPosts(ctx context.Context, in *ListPostsRequest,
 	return out, nil
 }
 
+func (c *postServiceClient) SetUserPostsHidden(ctx context.Context, in *SetUserPostsHiddenRequest, opts ...grpc.CallOption) (*UserPostsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UserPostsResponse)
+	err := c.cc.Invoke(ctx, PostService_SetUserPostsHidden_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *postServiceClient) DeleteUserPosts(ctx context.Context, in *DeleteUserPostsRequest, opts ...grpc.CallOption) (*UserPostsResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(UserPostsResponse)
+	err := c.cc.Invoke(ctx, PostService_DeleteUserPosts_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *postServiceClient) ExportUserPosts(ctx context.Context, in *ExportUserPostsRequest, opts ...grpc.CallOption) (grpc.ServerStreamingClient[PostResponse], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &PostService_ServiceDesc.Streams[0], PostService_ExportUserPosts_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[ExportUserPostsRequest, PostResponse]{ClientStream: stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PostService_ExportUserPostsClient = grpc.ServerStreamingClient[PostResponse]
+
 // PostServiceServer is the server API for PostService service.
 // All implementations must embed UnimplementedPostServiceServer
 // for forward compatibility.
@@ -105,6 +150,9 @@ type PostServiceServer interface {
 	UpdatePost(context.Context, *UpdatePostRequest) (*PostResponse, error)
 	DeletePost(context.Context, *DeletePostRequest) (*emptypb.Empty, error)
 	ListPosts(context.Context, *ListPostsRequest) (*ListPostsResponse, error)
+	SetUserPostsHidden(context.Context, *SetUserPostsHiddenRequest) (*UserPostsResponse, error)
+	DeleteUserPosts(context.Context, *DeleteUserPostsRequest) (*UserPostsResponse, error)
+	ExportUserPosts(*ExportUserPostsRequest, grpc.ServerStreamingServer[PostResponse]) error
 	mustEmbedUnimplementedPostServiceServer()
 }
 
@@ -130,6 +178,15 @@ func (UnimplementedPostServiceServer) DeletePost(context.Context, *DeletePostReq
 func (UnimplementedPostServiceServer) ListPosts(context.Context, *ListPostsRequest) (*ListPostsResponse, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method ListPosts not implemented")
 }
+func (UnimplementedPostServiceServer) SetUserPostsHidden(context.Context, *SetUserPostsHiddenRequest) (*UserPostsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetUserPostsHidden not implemented")
+}
+func (UnimplementedPostServiceServer) DeleteUserPosts(context.Context, *DeleteUserPostsRequest) (*UserPostsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteUserPosts not implemented")
+}
+func (UnimplementedPostServiceServer) ExportUserPosts(*ExportUserPostsRequest, grpc.ServerStreamingServer[PostResponse]) error {
+	return status.Errorf(codes.Unimplemented, "method ExportUserPosts not implemented")
+}
 func (UnimplementedPostServiceServer) mustEmbedUnimplementedPostServiceServer() {}
 func (UnimplementedPostServiceServer) testEmbeddedByValue()                     {}
 
@@ -241,6 +298,53 @@ func _PostService_ListPosts_Handler(srv interface{}, ctx context.Context, dec fu
 	return interceptor(ctx, in, info, handler)
 }
 
+func _PostService_SetUserPostsHidden_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SetUserPostsHiddenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PostServiceServer).SetUserPostsHidden(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PostService_SetUserPostsHidden_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PostServiceServer).SetUserPostsHidden(ctx, req.(*SetUserPostsHiddenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PostService_DeleteUserPosts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteUserPostsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(PostServiceServer).DeleteUserPosts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: PostService_DeleteUserPosts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(PostServiceServer).DeleteUserPosts(ctx, req.(*DeleteUserPostsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _PostService_ExportUserPosts_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ExportUserPostsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(PostServiceServer).ExportUserPosts(m, &grpc.GenericServerStream[ExportUserPostsRequest, PostResponse]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type PostService_ExportUserPostsServer = grpc.ServerStreamingServer[PostResponse]
+
 // PostService_ServiceDesc is the grpc.ServiceDesc for PostService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -268,7 +372,21 @@ var PostService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "ListPosts",
 			Handler:    _PostService_ListPosts_Handler,
 		},
+		{
+			MethodName: "SetUserPostsHidden",
+			Handler:    _PostService_SetUserPostsHidden_Handler,
+		},
+		{
+			MethodName: "DeleteUserPosts",
+			Handler:    _PostService_DeleteUserPosts_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ExportUserPosts",
+			Handler:       _PostService_ExportUserPosts_Handler,
+			ServerStreams: true,
+		},
 	},
-	Streams:  []grpc.StreamDesc{},
 	Metadata: "post_service.proto",
 }
@@ -0,0 +1,85 @@
+package post_proto
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/Nicvod/SOA/utils/validation"
+)
+
+const (
+	maxTitleLength       = 100
+	maxDescriptionLength = 1000
+	maxTags              = 10
+	maxPageSize          = 100
+)
+
+var tagPattern = regexp.MustCompile(`^[\p{L}\p{N}_-]{1,20}$`)
+
+func validatePost(v *validation.Violations, title, description string, tags []string) {
+	v.Length("title", title, 1, maxTitleLength)
+	v.Length("description", description, 0, maxDescriptionLength)
+	if len(tags) > maxTags {
+		v.Addf("tags", "must contain at most %d tags", maxTags)
+	}
+	seen := make(map[string]bool, len(tags))
+	for i, tag := range tags {
+		field := fmt.Sprintf("tags[%d]", i)
+		if !tagPattern.MatchString(tag) {
+			v.Add(field, "must be 1 to 20 letters, digits, '_' or '-'")
+		} else if seen[tag] {
+			v.Add(field, "is a duplicate")
+		}
+		seen[tag] = true
+	}
+}
+
+func (r *CreatePostRequest) Validate() error {
+	var v validation.Violations
+	validatePost(&v, r.Title, r.Description, r.Tags)
+	return v.Err()
+}
+
+func (r *GetPostRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("post_id", r.PostId)
+	return v.Err()
+}
+
+func (r *UpdatePostRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("post_id", r.PostId)
+	validatePost(&v, r.Title, r.Description, r.Tags)
+	return v.Err()
+}
+
+func (r *DeletePostRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("post_id", r.PostId)
+	return v.Err()
+}
+
+func (r *ListPostsRequest) Validate() error {
+	var v validation.Violations
+	v.Range("page", int64(r.Page), 0, 1<<20)
+	v.Range("page_size", int64(r.PageSize), 1, maxPageSize)
+	return v.Err()
+}
+
+func (r *SetUserPostsHiddenRequest) Validate() error {
+	var v validation.Violations
+	v.Required("user_id", r.UserId)
+	return v.Err()
+}
+
+func (r *DeleteUserPostsRequest) Validate() error {
+	var v validation.Violations
+	v.Required("user_id", r.UserId)
+	return v.Err()
+}
+
+func (r *ExportUserPostsRequest) Validate() error {
+	var v validation.Violations
+	v.Required("user_id", r.UserId)
+	return v.Err()
+}
@@ -1,8 +1,19 @@
 from dotenv import load_dotenv
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+from urllib.parse import parse_qs, urlparse
+import base64
+import grpc
+import hashlib
+import hmac
+import json
 import os
 import pytest
 import requests
-from typing import List, Dict, Any
+import secrets
+import threading
+import time
+import uuid
+from typing import List, Dict, Any, Optional, Tuple
 
 load_dotenv('.test.env')
 
@@ -55,6 +66,24 @@ class TestPostAPI:
         
         created_posts.append(post["id"])
     
+    def test_create_post_invalid(self, auth_token: str):
+        url = f"{self.BASE_URL}/api/v1/posts"
+        headers = {"Authorization": f"Bearer {auth_token}"}
+        post_data = {
+            "title": "",
+            "description": "This post should not be created",
+            "is_private": False,
+            "tags": [f"tag{i}" for i in range(11)] + ["bad tag"]
+        }
+        
+        response = requests.post(url, json=post_data, headers=headers)
+        assert response.status_code == 400, "Невалидный пост должен отклоняться"
+        
+        fields = {violation["field"] for violation in response.json().get("fields", [])}
+        assert "title" in fields, "Нет ошибки для пустого заголовка"
+        assert "tags" in fields, "Нет ошибки для количества тегов"
+        assert "tags[11]" in fields, "Нет ошибки для недопустимого тега"
+    
     def test_list_posts(self, auth_token: str):
         url = f"{self.BASE_URL}/api/v1/posts"
         headers = {"Authorization": f"Bearer {auth_token}"}
@@ -83,6 +112,8 @@ class TestPostAPI:
         assert post["id"] == post_id, "Некорректный ID поста"
         assert "title" in post, "Заголовок поста не возвращен"
         assert "description" in post, "Описание поста не возвращено"
+        assert post["author"]["login"] == self.LOGIN, "Автор поста не возвращен"
+        assert "email" not in post["author"], "Email автора не должен возвращаться"
     
     def test_update_post(self, auth_token: str, created_posts: List[str]):
         if not created_posts:
@@ -123,4 +154,1475 @@ class TestPostAPI:
             
             created_posts.remove(post_id)
         
-        assert len(created_posts) == 0, "Не все посты были удалены"
\ No newline at end of file
+        assert len(created_posts) == 0, "Не все посты были удалены"
+
+class MockOIDCProvider:
+    """OpenID Connect провайдер в процессе тестов: выдаёт код любому, кого
+    задали в user, и подписывает ID токены HS256 секретом клиента."""
+
+    def __init__(self, issuer: str, port: int, client_id: str, client_secret: str):
+        self.issuer = issuer
+        self.client_id = client_id
+        self.client_secret = client_secret
+        self.user: Dict[str, Any] = {}
+        self.nonce_override: Optional[str] = None
+        self.codes: Dict[str, Dict[str, Any]] = {}
+        self.server = ThreadingHTTPServer(("0.0.0.0", port), self._handler())
+        self.thread = threading.Thread(target=self.server.serve_forever, daemon=True)
+
+    def start(self) -> None:
+        self.thread.start()
+
+    def stop(self) -> None:
+        self.server.shutdown()
+        self.server.server_close()
+
+    def authorize(self, authorization_url: str) -> Dict[str, str]:
+        """Отвечает на запрос авторизации как после входа пользователя и
+        возвращает параметры редиректа на callback."""
+        params = {k: v[0] for k, v in parse_qs(urlparse(authorization_url).query).items()}
+        assert params["response_type"] == "code"
+        assert params["client_id"] == self.client_id
+        assert params["code_challenge_method"] == "S256", "Нет PKCE"
+        assert "openid" in params["scope"].split()
+        code = secrets.token_urlsafe(16)
+        self.codes[code] = {
+            "redirect_uri": params["redirect_uri"],
+            "code_challenge": params["code_challenge"],
+            "nonce": params["nonce"],
+            "user": dict(self.user),
+        }
+        return {"code": code, "state": params["state"], "redirect_uri": params["redirect_uri"]}
+
+    def id_token(self, claims: Dict[str, Any]) -> str:
+        def encode(data: Any) -> str:
+            raw = json.dumps(data, separators=(",", ":")).encode()
+            return base64.urlsafe_b64encode(raw).rstrip(b"=").decode()
+
+        signing_input = encode({"alg": "HS256", "typ": "JWT"}) + "." + encode(claims)
+        signature = hmac.new(self.client_secret.encode(), signing_input.encode(), hashlib.sha256).digest()
+        return signing_input + "." + base64.urlsafe_b64encode(signature).rstrip(b"=").decode()
+
+    def token(self, form: Dict[str, str], authorization: str) -> Tuple[int, Dict[str, Any]]:
+        expected = base64.b64encode(f"{self.client_id}:{self.client_secret}".encode()).decode()
+        if authorization != f"Basic {expected}":
+            return 401, {"error": "invalid_client"}
+        grant = self.codes.pop(form.get("code", ""), None)
+        if grant is None or form.get("grant_type") != "authorization_code":
+            return 400, {"error": "invalid_grant"}
+        if form.get("redirect_uri") != grant["redirect_uri"]:
+            return 400, {"error": "invalid_grant", "error_description": "redirect_uri mismatch"}
+        verifier = form.get("code_verifier", "")
+        challenge = base64.urlsafe_b64encode(hashlib.sha256(verifier.encode()).digest()).rstrip(b"=").decode()
+        if challenge != grant["code_challenge"]:
+            return 400, {"error": "invalid_grant", "error_description": "PKCE verification failed"}
+
+        now = int(time.time())
+        claims = {
+            "iss": self.issuer,
+            "aud": self.client_id,
+            "iat": now,
+            "exp": now + 300,
+            "nonce": self.nonce_override or grant["nonce"],
+            **grant["user"],
+        }
+        return 200, {"access_token": secrets.token_urlsafe(16), "token_type": "Bearer", "id_token": self.id_token(claims)}
+
+    def _handler(self):
+        provider = self
+
+        class Handler(BaseHTTPRequestHandler):
+            def log_message(self, format: str, *args: Any) -> None:
+                pass
+
+            def reply(self, code: int, body: Dict[str, Any]) -> None:
+                data = json.dumps(body).encode()
+                self.send_response(code)
+                self.send_header("Content-Type", "application/json")
+                self.send_header("Content-Length", str(len(data)))
+                self.end_headers()
+                self.wfile.write(data)
+
+            def do_GET(self) -> None:
+                if self.path == "/.well-known/openid-configuration":
+                    self.reply(200, {
+                        "issuer": provider.issuer,
+                        "authorization_endpoint": provider.issuer + "/authorize",
+                        "token_endpoint": provider.issuer + "/token",
+                        "jwks_uri": provider.issuer + "/jwks",
+                        "code_challenge_methods_supported": ["S256"],
+                        "id_token_signing_alg_values_supported": ["HS256"],
+                    })
+                elif self.path == "/jwks":
+                    self.reply(200, {"keys": []})
+                else:
+                    self.reply(404, {"error": "not_found"})
+
+            def do_POST(self) -> None:
+                if self.path != "/token":
+                    self.reply(404, {"error": "not_found"})
+                    return
+                length = int(self.headers.get("Content-Length", 0))
+                form = {k: v[0] for k, v in parse_qs(self.rfile.read(length).decode()).items()}
+                self.reply(*provider.token(form, self.headers.get("Authorization", "")))
+
+        return Handler
+
+
+class TestOIDCLogin:
+    """Нужен user_app с провайдером mock из tests/oidc_providers.json, см.
+    tests/docker-compose.oidc.yaml."""
+
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    MOCK_PORT: int = int(os.getenv("TEST_OIDC_MOCK_PORT", "9400"))
+    MOCK_ISSUER: str = os.getenv("TEST_OIDC_MOCK_ISSUER", "http://host.docker.internal:9400")
+    CLIENT_ID: str = os.getenv("TEST_OIDC_CLIENT_ID", "soa-tests")
+    CLIENT_SECRET: str = os.getenv("TEST_OIDC_CLIENT_SECRET", "soa-tests-mock-client-secret")
+
+    @pytest.fixture(scope="class")
+    def provider(self):
+        response = requests.get(f"{self.BASE_URL}/api/v1/oidc/providers")
+        assert response.status_code == 200, "Ошибка получения списка провайдеров"
+        if "mock" not in {p["name"] for p in response.json()["providers"]}:
+            pytest.skip("Провайдер mock не настроен в user_app")
+
+        mock = MockOIDCProvider(self.MOCK_ISSUER, self.MOCK_PORT, self.CLIENT_ID, self.CLIENT_SECRET)
+        mock.start()
+        yield mock
+        mock.stop()
+
+    @pytest.fixture(scope="class")
+    def oidc_account(self) -> Dict[str, Any]:
+        return {}
+
+    def new_user(self, email_verified: bool = True) -> Dict[str, Any]:
+        suffix = uuid.uuid4().hex[:10]
+        return {
+            "sub": f"mock-{suffix}",
+            "email": f"oidc-{suffix}@example.com",
+            "email_verified": email_verified,
+            "given_name": "Mock",
+            "family_name": "User",
+            "preferred_username": f"mock_{suffix}",
+        }
+
+    def callback(self, provider: MockOIDCProvider, authorization_url: str, browser: requests.Session) -> requests.Response:
+        redirect = provider.authorize(authorization_url)
+        path = urlparse(redirect["redirect_uri"]).path
+        assert path == "/api/v1/oidc/mock/callback", "Неверный redirect_uri"
+        return browser.get(f"{self.BASE_URL}{path}", params={"code": redirect["code"], "state": redirect["state"]})
+
+    def start_login(self, browser: requests.Session) -> str:
+        response = browser.get(f"{self.BASE_URL}/api/v1/oidc/mock/login", params={"device": "pytest"}, allow_redirects=False)
+        assert response.status_code == 302, "Нет редиректа на провайдера"
+        return response.headers["Location"]
+
+    def sign_in(self, provider: MockOIDCProvider) -> requests.Response:
+        browser = requests.Session()
+        return self.callback(provider, self.start_login(browser), browser)
+
+    def register(self) -> Tuple[str, str]:
+        suffix = uuid.uuid4().hex[:10]
+        email = f"local-{suffix}@example.com"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": f"local_{suffix}",
+            "password": "Password123",
+            "email": email,
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        return response.json()["access_token"], email
+
+    def profile(self, token: str) -> Dict[str, Any]:
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers={"Authorization": f"Bearer {token}"})
+        assert response.status_code == 200, "Ошибка получения профиля"
+        return response.json()
+
+    def test_first_login_creates_account(self, provider: MockOIDCProvider, oidc_account: Dict[str, Any]):
+        provider.user = self.new_user()
+        response = self.sign_in(provider)
+        assert response.status_code == 200, f"Ошибка входа через провайдера: {response.text}"
+
+        body = response.json()
+        assert body["account_created"], "Аккаунт не создан"
+        assert body["access_token"] and body["refresh_token"], "Токены не выданы"
+        profile = self.profile(body["access_token"])
+        assert profile["email"] == provider.user["email"], "Email не взят у провайдера"
+        assert profile["login"] == provider.user["preferred_username"], "Логин не взят у провайдера"
+
+        oidc_account.update(user=provider.user, login=profile["login"], token=body["access_token"])
+
+    def test_second_login_uses_same_account(self, provider: MockOIDCProvider, oidc_account: Dict[str, Any]):
+        if not oidc_account:
+            pytest.skip("Аккаунт через провайдера не создан")
+        provider.user = oidc_account["user"]
+        response = self.sign_in(provider)
+        assert response.status_code == 200, "Ошибка повторного входа"
+        assert not response.json()["account_created"], "Создан второй аккаунт"
+        assert self.profile(response.json()["access_token"])["login"] == oidc_account["login"], "Вход не в тот аккаунт"
+
+    def test_state_is_single_use(self, provider: MockOIDCProvider):
+        provider.user = self.new_user()
+        browser = requests.Session()
+        redirect = provider.authorize(self.start_login(browser))
+        path = urlparse(redirect["redirect_uri"]).path
+        params = {"code": redirect["code"], "state": redirect["state"]}
+        cookies = browser.cookies.copy()
+        assert browser.get(f"{self.BASE_URL}{path}", params=params).status_code == 200, "Ошибка входа"
+        response = requests.get(f"{self.BASE_URL}{path}", params=params, cookies=cookies)
+        assert response.status_code == 401, "state принят повторно"
+
+    def test_state_bound_to_browser(self, provider: MockOIDCProvider):
+        # злоумышленник начинает вход в своём браузере и подсовывает ссылку
+        # на callback жертве
+        provider.user = self.new_user()
+        redirect = provider.authorize(self.start_login(requests.Session()))
+        path = urlparse(redirect["redirect_uri"]).path
+        response = requests.Session().get(f"{self.BASE_URL}{path}", params={"code": redirect["code"], "state": redirect["state"]})
+        assert response.status_code == 401, "state принят в чужом браузере"
+
+        browser = requests.Session()
+        self.start_login(browser)
+        response = browser.get(f"{self.BASE_URL}{path}", params={"code": redirect["code"], "state": redirect["state"]})
+        assert response.status_code == 401, "state принят с cookie другого входа"
+
+    def test_unknown_state_rejected(self, provider: MockOIDCProvider):
+        response = requests.get(f"{self.BASE_URL}/api/v1/oidc/mock/callback", params={"code": "x", "state": "forged"})
+        assert response.status_code == 401, "Принят поддельный state"
+
+    def test_wrong_nonce_rejected(self, provider: MockOIDCProvider):
+        provider.user = self.new_user()
+        provider.nonce_override = "replayed"
+        try:
+            response = self.sign_in(provider)
+        finally:
+            provider.nonce_override = None
+        assert response.status_code == 401, "Принят ID токен с чужим nonce"
+
+    def test_unverified_account_is_not_taken_over(self, provider: MockOIDCProvider):
+        _, email = self.register()
+        provider.user = {**self.new_user(), "email": email}
+        response = self.sign_in(provider)
+        assert response.status_code == 409, "Провайдер привязан к аккаунту с неподтверждённым email"
+
+    def test_link_and_unlink(self, provider: MockOIDCProvider):
+        token, _ = self.register()
+        headers = {"Authorization": f"Bearer {token}"}
+        login = self.profile(token)["login"]
+
+        browser = requests.Session()
+        response = browser.post(f"{self.BASE_URL}/api/v1/identities/mock", headers=headers)
+        assert response.status_code == 200, "Ошибка начала привязки"
+        provider.user = self.new_user(email_verified=False)
+        response = self.callback(provider, response.json()["authorization_url"], browser)
+        assert response.status_code == 200, f"Ошибка привязки: {response.text}"
+        assert response.json()["linked_identity"]["subject"] == provider.user["sub"], "Привязан не тот аккаунт"
+
+        identities = requests.get(f"{self.BASE_URL}/api/v1/identities", headers=headers).json()["identities"]
+        assert [i["provider"] for i in identities] == ["mock"], "Привязка не видна"
+
+        response = self.sign_in(provider)
+        assert response.status_code == 200, "Ошибка входа через привязанный провайдер"
+        assert self.profile(response.json()["access_token"])["login"] == login, "Вход не в тот аккаунт"
+
+        response = requests.delete(f"{self.BASE_URL}/api/v1/identities/mock", headers=headers)
+        assert response.status_code == 204, "Ошибка отвязки"
+        response = requests.delete(f"{self.BASE_URL}/api/v1/identities/mock", headers=headers)
+        assert response.status_code == 404, "Провайдер отвязан дважды"
+
+    def test_link_state_bound_to_browser(self, provider: MockOIDCProvider):
+        # жертва начинает привязку, а callback со state жертвы и кодом
+        # аккаунта злоумышленника открывается в другом браузере
+        token, _ = self.register()
+        response = requests.Session().post(f"{self.BASE_URL}/api/v1/identities/mock", headers={"Authorization": f"Bearer {token}"})
+        assert response.status_code == 200, "Ошибка начала привязки"
+        provider.user = self.new_user()
+        response = self.callback(provider, response.json()["authorization_url"], requests.Session())
+        assert response.status_code == 401, "Привязка завершена в чужом браузере"
+
+        identities = requests.get(f"{self.BASE_URL}/api/v1/identities", headers={"Authorization": f"Bearer {token}"}).json()["identities"]
+        assert identities == [], "Провайдер привязан без cookie"
+
+    def test_last_identity_without_password_kept(self, provider: MockOIDCProvider, oidc_account: Dict[str, Any]):
+        if not oidc_account:
+            pytest.skip("Аккаунт через провайдера не создан")
+        headers = {"Authorization": f"Bearer {oidc_account['token']}"}
+        response = requests.delete(f"{self.BASE_URL}/api/v1/identities/mock", headers=headers)
+        assert response.status_code == 409, "Отвязан единственный способ входа"
+
+
+def b64url_decode(value: str) -> bytes:
+    return base64.urlsafe_b64decode(value + "=" * (-len(value) % 4))
+
+
+def verify_rs256(token: str, jwks: Dict[str, Any]) -> Dict[str, Any]:
+    """Проверяет подпись RS256 (PKCS#1 v1.5) по JWKS и возвращает claims."""
+    header_b64, payload_b64, signature_b64 = token.split(".")
+    header = json.loads(b64url_decode(header_b64))
+    assert header["alg"] == "RS256", "Неожиданный алгоритм подписи"
+    key = next(k for k in jwks["keys"] if k["kid"] == header["kid"])
+
+    n = int.from_bytes(b64url_decode(key["n"]), "big")
+    e = int.from_bytes(b64url_decode(key["e"]), "big")
+    length = (n.bit_length() + 7) // 8
+    decrypted = pow(int.from_bytes(b64url_decode(signature_b64), "big"), e, n).to_bytes(length, "big")
+    digest_info = bytes.fromhex("3031300d060960864801650304020105000420")
+    digest_info += hashlib.sha256(f"{header_b64}.{payload_b64}".encode()).digest()
+    expected = b"\x00\x01" + b"\xff" * (length - len(digest_info) - 3) + b"\x00" + digest_info
+    assert decrypted == expected, "Неверная подпись токена"
+    return json.loads(b64url_decode(payload_b64))
+
+
+def pb_varint(value: int) -> bytes:
+    out = bytearray()
+    while True:
+        byte = value & 0x7F
+        value >>= 7
+        if value:
+            out.append(byte | 0x80)
+        else:
+            out.append(byte)
+            return bytes(out)
+
+
+def pb_field(number: int, value: Any) -> bytes:
+    """Кодирует поле protobuf: str как length-delimited, int как varint."""
+    if isinstance(value, str):
+        data = value.encode()
+        return pb_varint(number << 3 | 2) + pb_varint(len(data)) + data
+    return pb_varint(number << 3) + pb_varint(value)
+
+
+def call_post_service(method: str, message: bytes, token: str) -> grpc.StatusCode:
+    """Вызывает post service напрямую, минуя gateway, и возвращает код ответа."""
+    address = os.getenv("TEST_POST_SERVICE_ADDRESS", "localhost:50052")
+    with grpc.insecure_channel(address) as channel:
+        call = channel.unary_unary(f"/post_proto.PostService/{method}")
+        try:
+            call(message, metadata=[("authorization", f"Bearer {token}")], timeout=10)
+        except grpc.RpcError as e:
+            return e.code()
+        return grpc.StatusCode.OK
+
+
+class TestOAuthProvider:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    REDIRECT_URI: str = "https://app.example.com/callback"
+
+    @pytest.fixture(scope="class")
+    def user_token(self) -> str:
+        suffix = uuid.uuid4().hex[:10]
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": f"oauth_{suffix}",
+            "password": "Password123",
+            "email": f"oauth-{suffix}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        return response.json()["access_token"]
+
+    @pytest.fixture(scope="class")
+    def client(self, user_token: str) -> Dict[str, Any]:
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/clients", headers=self.auth(user_token), json={
+            "name": "Test App",
+            "redirect_uris": [self.REDIRECT_URI],
+            "scopes": ["openid", "profile:read", "posts:read"],
+        })
+        assert response.status_code == 201, f"Ошибка регистрации приложения: {response.text}"
+        client = response.json()
+        assert client["client_secret"], "Секрет не выдан"
+        return client
+
+    @pytest.fixture(scope="class")
+    def discovery(self) -> Dict[str, Any]:
+        response = requests.get(f"{self.BASE_URL}/api/v1/oauth/.well-known/openid-configuration")
+        assert response.status_code == 200, "Ошибка получения discovery документа"
+        return response.json()
+
+    @pytest.fixture(scope="class")
+    def tokens(self, user_token: str, client: Dict[str, Any]) -> Dict[str, Any]:
+        code, verifier = self.authorize(user_token, client, "openid profile:read posts:read", nonce="n-0S6_WzA2Mj")
+        response = self.exchange(client, code, verifier)
+        assert response.status_code == 200, f"Ошибка обмена кода: {response.text}"
+        return response.json()
+
+    def auth(self, token: str) -> Dict[str, str]:
+        return {"Authorization": f"Bearer {token}"}
+
+    def pkce(self) -> Tuple[str, str]:
+        verifier = secrets.token_urlsafe(48)
+        challenge = base64.urlsafe_b64encode(hashlib.sha256(verifier.encode()).digest()).rstrip(b"=").decode()
+        return verifier, challenge
+
+    def consent_params(self, client: Dict[str, Any], scope: str, challenge: str, **extra: str) -> Dict[str, str]:
+        return {
+            "response_type": "code",
+            "client_id": client["client_id"],
+            "redirect_uri": self.REDIRECT_URI,
+            "scope": scope,
+            "state": "xyz",
+            "code_challenge": challenge,
+            "code_challenge_method": "S256",
+            **extra,
+        }
+
+    def authorize(self, user_token: str, client: Dict[str, Any], scope: str, **extra: str) -> Tuple[str, str]:
+        verifier, challenge = self.pkce()
+        params = self.consent_params(client, scope, challenge, **extra)
+        response = requests.get(f"{self.BASE_URL}/api/v1/oauth/consent", params=params, headers=self.auth(user_token))
+        assert response.status_code == 200, f"Ошибка получения согласия: {response.text}"
+        consent = response.json()
+        assert consent["client_name"] == "Test App", "Неверное имя приложения"
+        assert [s["name"] for s in consent["scopes"]] == scope.split(), "Неверный список прав"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/consent", json={**params, "approve": True}, headers=self.auth(user_token))
+        assert response.status_code == 200, "Ошибка подтверждения согласия"
+        redirect = urlparse(response.json()["redirect_uri"])
+        query = {k: v[0] for k, v in parse_qs(redirect.query).items()}
+        assert f"{redirect.scheme}://{redirect.netloc}{redirect.path}" == self.REDIRECT_URI, "Неверный redirect_uri"
+        assert query["state"] == "xyz", "state не возвращён"
+        return query["code"], verifier
+
+    def exchange(self, client: Dict[str, Any], code: str, verifier: str, secret: Optional[str] = None) -> requests.Response:
+        return requests.post(f"{self.BASE_URL}/api/v1/oauth/token", data={
+            "grant_type": "authorization_code",
+            "code": code,
+            "redirect_uri": self.REDIRECT_URI,
+            "code_verifier": verifier,
+        }, auth=(client["client_id"], secret if secret is not None else client["client_secret"]))
+
+    def test_discovery_and_jwks(self, discovery: Dict[str, Any]):
+        assert discovery["issuer"].endswith("/api/v1/oauth"), "Неверный issuer"
+        assert discovery["code_challenge_methods_supported"] == ["S256"], "PKCE не заявлен"
+        assert {"posts:read", "posts:write", "profile:read"} <= set(discovery["scopes_supported"]), "Нет нужных scope"
+        jwks = requests.get(f"{self.BASE_URL}/api/v1/oauth/jwks").json()
+        assert jwks["keys"] and all(k["kty"] == "RSA" and k["kid"] for k in jwks["keys"]), "Пустой JWKS"
+
+    def test_register_client_rejects_insecure_redirect(self, user_token: str):
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/clients", headers=self.auth(user_token), json={
+            "name": "Bad App",
+            "redirect_uris": ["http://evil.example.com/cb"],
+            "scopes": ["posts:admin"],
+        })
+        assert response.status_code == 400, "Принят http redirect_uri"
+        fields = {violation["field"] for violation in response.json().get("fields", [])}
+        assert {"redirect_uris[0]", "scopes[0]"} <= fields, "Нет ошибок для redirect_uri и scope"
+
+    def test_id_token(self, tokens: Dict[str, Any], client: Dict[str, Any], discovery: Dict[str, Any]):
+        jwks = requests.get(f"{self.BASE_URL}/api/v1/oauth/jwks").json()
+        claims = verify_rs256(tokens["id_token"], jwks)
+        assert claims["iss"] == discovery["issuer"], "Неверный iss"
+        assert claims["aud"] in (client["client_id"], [client["client_id"]]), "Неверный aud"
+        assert claims["nonce"] == "n-0S6_WzA2Mj", "Неверный nonce"
+        assert claims["preferred_username"].startswith("oauth_"), "Нет профиля в ID токене"
+        assert tokens["scope"] == "openid profile:read posts:read", "Неверный scope"
+
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(tokens["id_token"]))
+        assert response.status_code == 401, "ID токен принят как access токен"
+
+    def test_scopes_enforced(self, tokens: Dict[str, Any]):
+        headers = self.auth(tokens["access_token"])
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=headers).status_code == 200, "Нет доступа с profile:read"
+        assert requests.get(f"{self.BASE_URL}/api/v1/posts", headers=headers).status_code == 200, "Нет доступа с posts:read"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/posts", headers=headers, json={"title": "From app"})
+        assert response.status_code == 403, "Пост создан без posts:write"
+        assert response.json()["error"] == "insufficient_scope", "Неверная ошибка"
+        assert "insufficient_scope" in response.headers.get("WWW-Authenticate", ""), "Нет WWW-Authenticate"
+
+        assert requests.get(f"{self.BASE_URL}/api/v1/sessions", headers=headers).status_code == 403, "Приложению доступны сессии"
+        response = requests.get(f"{self.BASE_URL}/api/v1/oauth/userinfo", headers=headers)
+        assert response.status_code == 200 and response.json()["sub"], "Ошибка userinfo"
+
+    def test_scopes_enforced_by_post_service(self, tokens: Dict[str, Any]):
+        token = tokens["access_token"]
+        code = call_post_service("ListPosts", pb_field(1, 0) + pb_field(2, 10), token)
+        assert code == grpc.StatusCode.OK, f"Нет доступа к постам с posts:read: {code}"
+        code = call_post_service("CreatePost", pb_field(1, "From app"), token)
+        assert code == grpc.StatusCode.PERMISSION_DENIED, f"Пост создан в обход gateway без posts:write: {code}"
+        code = call_post_service("DeleteUserPosts", pb_field(1, "1"), token)
+        assert code == grpc.StatusCode.PERMISSION_DENIED, f"Приложению доступен служебный метод: {code}"
+
+    def test_code_is_single_use(self, user_token: str, client: Dict[str, Any]):
+        code, verifier = self.authorize(user_token, client, "posts:read")
+        assert self.exchange(client, code, verifier).status_code == 200, "Ошибка обмена кода"
+        response = self.exchange(client, code, verifier)
+        assert response.status_code == 400 and response.json()["error"] == "invalid_grant", "Код принят повторно"
+
+    def test_pkce_verifier_checked(self, user_token: str, client: Dict[str, Any]):
+        code, _ = self.authorize(user_token, client, "posts:read")
+        response = self.exchange(client, code, "wrong-verifier")
+        assert response.status_code == 400 and response.json()["error"] == "invalid_grant", "Принят чужой code_verifier"
+
+    def test_wrong_secret(self, user_token: str, client: Dict[str, Any]):
+        code, verifier = self.authorize(user_token, client, "posts:read")
+        response = self.exchange(client, code, verifier, secret="wrong")
+        assert response.status_code == 401 and response.json()["error"] == "invalid_client", "Принят неверный секрет"
+
+    def test_bad_requests(self, user_token: str, client: Dict[str, Any]):
+        _, challenge = self.pkce()
+        url = f"{self.BASE_URL}/api/v1/oauth/consent"
+
+        params = self.consent_params(client, "posts:read", challenge, redirect_uri="https://evil.example.com/cb")
+        response = requests.get(url, params=params, headers=self.auth(user_token))
+        assert response.status_code == 400, "Принят незарегистрированный redirect_uri"
+
+        params = self.consent_params(client, "posts:read", challenge, code_challenge_method="plain")
+        response = requests.get(url, params=params, headers=self.auth(user_token))
+        redirect = response.json()["error_redirect_uri"]
+        assert "error=invalid_request" in redirect and "state=xyz" in redirect, "Запрос без S256 не отклонён"
+
+        params = self.consent_params(client, "posts:write", challenge)
+        response = requests.get(url, params=params, headers=self.auth(user_token))
+        assert "error=invalid_scope" in response.json()["error_redirect_uri"], "Выдан не разрешённый приложению scope"
+
+        params = self.consent_params(client, "posts:read", challenge)
+        response = requests.post(url, json={**params, "approve": False}, headers=self.auth(user_token))
+        assert "error=access_denied" in response.json()["redirect_uri"], "Отказ не передан приложению"
+
+    def test_refresh_introspect_revoke(self, user_token: str, client: Dict[str, Any]):
+        code, verifier = self.authorize(user_token, client, "profile:read posts:read")
+        tokens = self.exchange(client, code, verifier).json()
+        credentials = (client["client_id"], client["client_secret"])
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/refresh-token", json={"refresh_token": tokens["refresh_token"]})
+        assert response.status_code == 400, "Токен приложения обновлён как собственный"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/token", auth=credentials, data={
+            "grant_type": "refresh_token", "refresh_token": tokens["refresh_token"], "scope": "posts:read",
+        })
+        assert response.status_code == 200, f"Ошибка обновления токена: {response.text}"
+        refreshed = response.json()
+        assert refreshed["scope"] == "posts:read", "scope не сужен"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/token", auth=credentials, data={
+            "grant_type": "refresh_token", "refresh_token": refreshed["refresh_token"], "scope": "posts:write",
+        })
+        assert response.json()["error"] == "invalid_scope", "scope расширен при обновлении"
+
+        introspection = requests.post(f"{self.BASE_URL}/api/v1/oauth/introspect", auth=credentials, data={"token": refreshed["access_token"]}).json()
+        assert introspection["active"] and introspection["scope"] == "posts:read", "Неверный ответ интроспекции"
+        assert introspection["client_id"] == client["client_id"], "Неверный client_id"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/revoke", auth=credentials, data={"token": refreshed["refresh_token"]})
+        assert response.status_code == 200, "Ошибка отзыва токена"
+        introspection = requests.post(f"{self.BASE_URL}/api/v1/oauth/introspect", auth=credentials, data={"token": refreshed["access_token"]}).json()
+        assert introspection == {"active": False}, "Токен активен после отзыва"
+
+    def test_public_client_and_delete(self, user_token: str):
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/clients", headers=self.auth(user_token), json={
+            "name": "Test App",
+            "redirect_uris": [self.REDIRECT_URI],
+            "scopes": ["posts:read"],
+            "public": True,
+        })
+        assert response.status_code == 201, "Ошибка регистрации публичного приложения"
+        client = response.json()
+        assert client["public"] and "client_secret" not in client, "Публичному приложению выдан секрет"
+
+        code, verifier = self.authorize(user_token, client, "posts:read")
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/token", data={
+            "grant_type": "authorization_code",
+            "client_id": client["client_id"],
+            "code": code,
+            "redirect_uri": self.REDIRECT_URI,
+            "code_verifier": verifier,
+        })
+        assert response.status_code == 200, f"Ошибка обмена кода публичным приложением: {response.text}"
+        access_token = response.json()["access_token"]
+
+        response = requests.delete(f"{self.BASE_URL}/api/v1/oauth/clients/{client['client_id']}", headers=self.auth(user_token))
+        assert response.status_code == 204, "Ошибка удаления приложения"
+        clients = requests.get(f"{self.BASE_URL}/api/v1/oauth/clients", headers=self.auth(user_token)).json()["clients"]
+        assert client["client_id"] not in {c["client_id"] for c in clients}, "Приложение не удалено"
+        response = requests.post(f"{self.BASE_URL}/api/v1/oauth/introspect", data={"client_id": client["client_id"], "token": access_token})
+        assert response.status_code == 401, "Удалённое приложение не отклонено"
+
+
+def b64url(data: bytes) -> str:
+    return base64.urlsafe_b64encode(data).rstrip(b"=").decode()
+
+
+def cbor_encode(value: Any) -> bytes:
+    """CBOR без неопределённых длин: целые, байты, строки, списки и словари."""
+    def head(major: int, arg: int) -> bytes:
+        if arg < 24:
+            return bytes([major << 5 | arg])
+        for info, size in ((24, 1), (25, 2), (26, 4), (27, 8)):
+            if arg < 1 << (8 * size):
+                return bytes([major << 5 | info]) + arg.to_bytes(size, "big")
+        raise ValueError("слишком большое число")
+
+    if isinstance(value, bool):
+        return bytes([0xf5 if value else 0xf4])
+    if isinstance(value, int):
+        return head(0, value) if value >= 0 else head(1, -1 - value)
+    if isinstance(value, bytes):
+        return head(2, len(value)) + value
+    if isinstance(value, str):
+        return head(3, len(value.encode())) + value.encode()
+    if isinstance(value, list):
+        return head(4, len(value)) + b"".join(cbor_encode(item) for item in value)
+    if isinstance(value, dict):
+        return head(5, len(value)) + b"".join(cbor_encode(k) + cbor_encode(v) for k, v in value.items())
+    raise TypeError(f"неподдерживаемый тип {type(value)}")
+
+
+class Ed25519:
+    """Подпись Ed25519 по эталонной реализации из RFC 8032."""
+    P = 2 ** 255 - 19
+    Q = 2 ** 252 + 27742317777372353535851937790883648493
+    D = -121665 * pow(121666, P - 2, P) % P
+    SQRT_M1 = pow(2, (P - 1) // 4, P)
+
+    @classmethod
+    def add(cls, a: Tuple[int, ...], b: Tuple[int, ...]) -> Tuple[int, ...]:
+        p = cls.P
+        x = (a[1] - a[0]) * (b[1] - b[0]) % p
+        y = (a[1] + a[0]) * (b[1] + b[0]) % p
+        z = 2 * a[3] * b[3] * cls.D % p
+        t = 2 * a[2] * b[2] % p
+        e, f, g, h = y - x, t - z, t + z, y + x
+        return e * f % p, g * h % p, f * g % p, e * h % p
+
+    @classmethod
+    def mul(cls, s: int, point: Tuple[int, ...]) -> Tuple[int, ...]:
+        result = (0, 1, 1, 0)
+        while s > 0:
+            if s & 1:
+                result = cls.add(result, point)
+            point = cls.add(point, point)
+            s >>= 1
+        return result
+
+    @classmethod
+    def base(cls) -> Tuple[int, ...]:
+        p = cls.P
+        y = 4 * pow(5, p - 2, p) % p
+        x2 = (y * y - 1) * pow(cls.D * y * y + 1, p - 2, p) % p
+        x = pow(x2, (p + 3) // 8, p)
+        if (x * x - x2) % p != 0:
+            x = x * cls.SQRT_M1 % p
+        if x & 1:
+            x = p - x
+        return x, y, 1, x * y % p
+
+    @classmethod
+    def compress(cls, point: Tuple[int, ...]) -> bytes:
+        p = cls.P
+        z_inv = pow(point[2], p - 2, p)
+        x, y = point[0] * z_inv % p, point[1] * z_inv % p
+        return (y | (x & 1) << 255).to_bytes(32, "little")
+
+    @classmethod
+    def expand(cls, secret: bytes) -> Tuple[int, bytes]:
+        digest = hashlib.sha512(secret).digest()
+        a = int.from_bytes(digest[:32], "little") & ((1 << 254) - 8) | (1 << 254)
+        return a, digest[32:]
+
+    @classmethod
+    def public_key(cls, secret: bytes) -> bytes:
+        return cls.compress(cls.mul(cls.expand(secret)[0], cls.base()))
+
+    @classmethod
+    def sign(cls, secret: bytes, message: bytes) -> bytes:
+        a, prefix = cls.expand(secret)
+        public = cls.compress(cls.mul(a, cls.base()))
+        r = int.from_bytes(hashlib.sha512(prefix + message).digest(), "little") % cls.Q
+        r_point = cls.compress(cls.mul(r, cls.base()))
+        h = int.from_bytes(hashlib.sha512(r_point + public + message).digest(), "little") % cls.Q
+        return r_point + ((r + h * a) % cls.Q).to_bytes(32, "little")
+
+
+class SoftwareAuthenticator:
+    """Программный аутентификатор WebAuthn: ключи Ed25519 (COSE -8),
+    аттестация none, счётчик подписей. Учётные данные обнаруживаемые."""
+
+    def __init__(self, origin: str):
+        self.origin = origin
+        self.credentials: Dict[bytes, Dict[str, Any]] = {}
+
+    def client_data(self, ceremony: str, challenge: str) -> bytes:
+        return json.dumps({
+            "type": ceremony,
+            "challenge": challenge,
+            "origin": self.origin,
+            "crossOrigin": False,
+        }).encode()
+
+    def auth_data(self, rp_id: str, user_verified: bool, counter: int, attested: bytes = b"") -> bytes:
+        flags = 0x01 | (0x04 if user_verified else 0) | (0x40 if attested else 0)
+        return hashlib.sha256(rp_id.encode()).digest() + bytes([flags]) + counter.to_bytes(4, "big") + attested
+
+    def create(self, options: Dict[str, Any], user_verified: bool = True) -> Dict[str, Any]:
+        assert any(param["alg"] == -8 for param in options["pubKeyCredParams"]), "Ed25519 не поддерживается"
+        excluded = {b64url_decode(c["id"]) for c in options["excludeCredentials"]}
+        assert not excluded & set(self.credentials), "Ключ уже зарегистрирован"
+
+        credential_id, secret = secrets.token_bytes(16), secrets.token_bytes(32)
+        cose_key = cbor_encode({1: 1, 3: -8, -1: 6, -2: Ed25519.public_key(secret)})
+        attested = bytes(16) + len(credential_id).to_bytes(2, "big") + credential_id + cose_key
+        auth_data = self.auth_data(options["rp"]["id"], user_verified, 0, attested)
+        self.credentials[credential_id] = {
+            "secret": secret,
+            "rp_id": options["rp"]["id"],
+            "user_handle": b64url_decode(options["user"]["id"]),
+            "counter": 0,
+        }
+        return {
+            "id": b64url(credential_id),
+            "rawId": b64url(credential_id),
+            "type": "public-key",
+            "response": {
+                "clientDataJSON": b64url(self.client_data("webauthn.create", options["challenge"])),
+                "attestationObject": b64url(cbor_encode({"fmt": "none", "attStmt": {}, "authData": auth_data})),
+                "transports": ["internal"],
+            },
+        }
+
+    def get(self, options: Dict[str, Any], user_verified: bool = True, counter: Optional[int] = None) -> Dict[str, Any]:
+        """counter подменяет значение счётчика, не меняя его у ключа."""
+        allowed = [b64url_decode(c["id"]) for c in options["allowCredentials"]]
+        credential_id = next(
+            cid for cid, cred in self.credentials.items()
+            if cred["rp_id"] == options["rpId"] and (not allowed or cid in allowed)
+        )
+        credential = self.credentials[credential_id]
+        if counter is None:
+            credential["counter"] += 1
+            counter = credential["counter"]
+
+        auth_data = self.auth_data(options["rpId"], user_verified, counter)
+        client_data = self.client_data("webauthn.get", options["challenge"])
+        signature = Ed25519.sign(credential["secret"], auth_data + hashlib.sha256(client_data).digest())
+        return {
+            "id": b64url(credential_id),
+            "rawId": b64url(credential_id),
+            "type": "public-key",
+            "response": {
+                "clientDataJSON": b64url(client_data),
+                "authenticatorData": b64url(auth_data),
+                "signature": b64url(signature),
+                "userHandle": b64url(credential["user_handle"]),
+            },
+        }
+
+
+class TestPasskeys:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    # должен совпадать с -public_url сервиса пользователей
+    ORIGIN: str = os.getenv("TEST_WEBAUTHN_ORIGIN", "http://localhost")
+    PASSWORD: str = "Password123"
+
+    def auth(self, token: str) -> Dict[str, str]:
+        return {"Authorization": f"Bearer {token}"}
+
+    def register_user(self) -> Dict[str, Any]:
+        login = f"passkey_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        return {"login": login, "token": response.json()["access_token"]}
+
+    def add_passkey(self, token: str, authenticator: SoftwareAuthenticator, name: str = "Laptop") -> requests.Response:
+        response = requests.post(f"{self.BASE_URL}/api/v1/passkeys/options", headers=self.auth(token))
+        assert response.status_code == 200, f"Ошибка начала регистрации ключа: {response.text}"
+        credential = authenticator.create(response.json())
+        return requests.post(f"{self.BASE_URL}/api/v1/passkeys", headers=self.auth(token), json={
+            "name": name,
+            "credential": credential,
+        })
+
+    def passkey_login(self, authenticator: SoftwareAuthenticator, challenge_token: Optional[str] = None,
+                      user_verified: bool = True, counter: Optional[int] = None) -> requests.Response:
+        body = {"challenge_token": challenge_token} if challenge_token else None
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate/passkey/options", json=body)
+        assert response.status_code == 200, f"Ошибка начала входа: {response.text}"
+        credential = authenticator.get(response.json(), user_verified=user_verified, counter=counter)
+        return requests.post(f"{self.BASE_URL}/api/v1/authenticate/passkey", json={
+            "credential": credential,
+            "device": "pytest",
+        })
+
+    @pytest.fixture(scope="class")
+    def user(self) -> Dict[str, Any]:
+        user = self.register_user()
+        user["authenticator"] = SoftwareAuthenticator(self.ORIGIN)
+        response = self.add_passkey(user["token"], user["authenticator"])
+        assert response.status_code == 201, f"Ошибка регистрации ключа: {response.text}"
+        user["passkey"] = response.json()
+        return user
+
+    def test_registration_options(self, user: Dict[str, Any]):
+        response = requests.post(f"{self.BASE_URL}/api/v1/passkeys/options", headers=self.auth(user["token"]))
+        options = response.json()
+        assert options["rp"]["id"] == urlparse(self.ORIGIN).hostname, "Неверный rp.id"
+        assert options["attestation"] == "none", "Запрошена аттестация"
+        assert options["user"]["name"] == user["login"], "Неверное имя пользователя"
+        assert len(b64url_decode(options["user"]["id"])) == 32, "user.id не случайный идентификатор"
+        assert [c["id"] for c in options["excludeCredentials"]] == [user["passkey"]["id"]], "Нет уже зарегистрированного ключа"
+
+    def test_list_passkeys(self, user: Dict[str, Any]):
+        response = requests.get(f"{self.BASE_URL}/api/v1/passkeys", headers=self.auth(user["token"]))
+        assert response.status_code == 200, "Ошибка получения ключей"
+        passkeys = response.json()["passkeys"]
+        assert [p["id"] for p in passkeys] == [user["passkey"]["id"]], "Ключ не найден"
+        assert passkeys[0]["name"] == "Laptop" and passkeys[0]["transports"] == ["internal"], "Неверные данные ключа"
+
+    def test_registration_checks(self, user: Dict[str, Any]):
+        response = requests.post(f"{self.BASE_URL}/api/v1/passkeys/options", headers=self.auth(user["token"]))
+        credential = SoftwareAuthenticator("https://evil.example.com").create(response.json())
+        response = requests.post(f"{self.BASE_URL}/api/v1/passkeys", headers=self.auth(user["token"]), json={
+            "name": "Phishing", "credential": credential,
+        })
+        assert response.status_code == 400, "Принят ключ с чужого origin"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/passkeys", headers=self.auth(user["token"]), json={
+            "name": "Replay", "credential": credential,
+        })
+        assert response.status_code == 409, "Challenge использован повторно"
+
+    def test_passwordless_login(self, user: Dict[str, Any]):
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate/passkey/options")
+        options = response.json()
+        assert options["userVerification"] == "required" and options["allowCredentials"] == [], "Неверные параметры входа"
+
+        response = self.passkey_login(user["authenticator"])
+        assert response.status_code == 200, f"Ошибка входа по ключу: {response.text}"
+        profile = requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(response.json()["access_token"]))
+        assert profile.json()["login"] == user["login"], "Вход выполнен не в тот аккаунт"
+
+        passkeys = requests.get(f"{self.BASE_URL}/api/v1/passkeys", headers=self.auth(user["token"])).json()["passkeys"]
+        assert passkeys[0].get("last_used_at"), "Время использования не сохранено"
+
+    def test_passwordless_login_requires_user_verification(self, user: Dict[str, Any]):
+        response = self.passkey_login(user["authenticator"], user_verified=False)
+        assert response.status_code == 401, "Вход без проверки пользователя"
+
+    def test_counter_must_increase(self, user: Dict[str, Any]):
+        assert self.passkey_login(user["authenticator"]).status_code == 200, "Ошибка входа по ключу"
+        response = self.passkey_login(user["authenticator"], counter=1)
+        assert response.status_code == 401, "Принят счётчик, который не увеличился"
+
+    def test_passkey_as_second_factor(self, user: Dict[str, Any]):
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={
+            "login": user["login"], "password": self.PASSWORD,
+        })
+        assert response.status_code == 200, "Ошибка входа по паролю"
+        body = response.json()
+        assert body["two_factor_required"] and body["two_factor_methods"] == ["passkey"], "Ключ не запрошен вторым фактором"
+        assert "access_token" not in body, "Токен выдан без второго фактора"
+
+        options = requests.post(f"{self.BASE_URL}/api/v1/authenticate/passkey/options", json={
+            "challenge_token": body["challenge_token"],
+        }).json()
+        assert [c["id"] for c in options["allowCredentials"]] == [user["passkey"]["id"]], "Неверный список ключей"
+
+        # браузер не предложит чужой ключ, поэтому список разрешённых убран
+        other = self.register_user()
+        other_authenticator = SoftwareAuthenticator(self.ORIGIN)
+        assert self.add_passkey(other["token"], other_authenticator).status_code == 201, "Ошибка регистрации ключа"
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate/passkey/options", json={
+            "challenge_token": body["challenge_token"],
+        })
+        credential = other_authenticator.get({**response.json(), "allowCredentials": []})
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate/passkey", json={"credential": credential})
+        assert response.status_code == 401, "Принят ключ другого пользователя"
+
+        response = self.passkey_login(user["authenticator"], challenge_token=body["challenge_token"], user_verified=False)
+        assert response.status_code == 200, f"Ошибка входа со вторым фактором: {response.text}"
+        assert response.json()["access_token"], "Нет токена"
+
+    def test_delete_passkey(self, user: Dict[str, Any]):
+        response = self.add_passkey(user["token"], SoftwareAuthenticator(self.ORIGIN), name="Phone")
+        assert response.status_code == 201, "Ошибка регистрации второго ключа"
+        passkey_id = response.json()["id"]
+
+        response = requests.delete(f"{self.BASE_URL}/api/v1/passkeys/{passkey_id}", headers=self.auth(user["token"]))
+        assert response.status_code == 204, "Ошибка удаления ключа"
+        passkeys = requests.get(f"{self.BASE_URL}/api/v1/passkeys", headers=self.auth(user["token"])).json()["passkeys"]
+        assert passkey_id not in [p["id"] for p in passkeys], "Ключ не удалён"
+
+        response = requests.delete(f"{self.BASE_URL}/api/v1/passkeys/{passkey_id}", headers=self.auth(user["token"]))
+        assert response.status_code == 404, "Удалён несуществующий ключ"
+
+        other = self.register_user()
+        response = requests.delete(f"{self.BASE_URL}/api/v1/passkeys/{user['passkey']['id']}", headers=self.auth(other["token"]))
+        assert response.status_code == 404, "Удалён чужой ключ"
+
+
+class TestLoginThrottle:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    # должен совпадать с -lockout_threshold сервиса пользователей
+    THRESHOLD: int = int(os.getenv("TEST_LOCKOUT_THRESHOLD", "5"))
+
+    def test_login_and_email_share_counter(self):
+        login = f"throttle_{uuid.uuid4().hex[:10]}"
+        email = f"{login}@example.com"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": "Password123",
+            "email": email,
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+
+        spellings = [login, email, email.upper(), f" {email} "]
+        for i in range(self.THRESHOLD):
+            response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={
+                "login": spellings[i % len(spellings)],
+                "password": "WrongPassword1",
+            })
+            assert response.status_code == 401, f"Неверный ответ на неверный пароль: {response.status_code}"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": login, "password": "Password123"})
+        assert response.status_code == 429, "Аккаунт не заблокирован после неудач с разным написанием"
+        assert response.headers.get("Retry-After"), "Нет Retry-After"
+
+
+class TestSuspension:
+    """Нужен администратор с правом users:manage в TEST_ADMIN_LOGIN и TEST_ADMIN_PASSWORD."""
+
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    ADMIN_LOGIN: Optional[str] = os.getenv("TEST_ADMIN_LOGIN")
+    ADMIN_PASSWORD: Optional[str] = os.getenv("TEST_ADMIN_PASSWORD")
+    # должен совпадать с -session_cache_ttl post service
+    POST_SESSION_CACHE_TTL: int = int(os.getenv("TEST_POST_SESSION_CACHE_TTL", "15"))
+
+    @pytest.fixture(scope="class")
+    def admin_token(self) -> str:
+        if not self.ADMIN_LOGIN or not self.ADMIN_PASSWORD:
+            pytest.skip("Не заданы TEST_ADMIN_LOGIN и TEST_ADMIN_PASSWORD")
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={
+            "login": self.ADMIN_LOGIN,
+            "password": self.ADMIN_PASSWORD,
+        })
+        assert response.status_code == 200, "Ошибка аутентификации администратора"
+        return response.json()["access_token"]
+
+    def test_token_rejected_after_suspension(self, admin_token: str):
+        suffix = uuid.uuid4().hex[:10]
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": f"suspended_{suffix}",
+            "password": "Password123",
+            "email": f"suspended-{suffix}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        token = response.json()["access_token"]
+        user_id = json.loads(b64url_decode(token.split(".")[1]))["user_id"]
+        headers = {"Authorization": f"Bearer {token}"}
+
+        list_posts = pb_field(1, 0) + pb_field(2, 10)
+        assert call_post_service("ListPosts", list_posts, token) == grpc.StatusCode.OK, "Токен не работает до блокировки"
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=headers).status_code == 200, "Профиль недоступен до блокировки"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/admin/users/{user_id}/suspend",
+                                 headers={"Authorization": f"Bearer {admin_token}"},
+                                 json={"duration_seconds": 3600, "reason": "pytest"})
+        assert response.status_code == 200, f"Ошибка приостановки: {response.text}"
+
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers=headers)
+        assert response.status_code == 401, "gateway принимает токен после блокировки"
+        # post service доверяет активной сессии не дольше -session_cache_ttl
+        time.sleep(self.POST_SESSION_CACHE_TTL + 1)
+        code = call_post_service("ListPosts", list_posts, token)
+        assert code == grpc.StatusCode.UNAUTHENTICATED, f"post service принимает токен после блокировки: {code}"
+
+    def test_ban_rejects_tokens_and_login(self, admin_token: str):
+        login = f"banned_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": "Password123",
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        tokens = response.json()
+        headers = {"Authorization": f"Bearer {tokens['access_token']}"}
+        user_id = jwt_claims(tokens["access_token"])["user_id"]
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=headers).status_code == 200, "Профиль недоступен до бана"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/admin/users/{user_id}/ban",
+                                 headers={"Authorization": f"Bearer {admin_token}"},
+                                 json={"reason": "pytest"})
+        assert response.status_code == 200, f"Ошибка бана: {response.text}"
+
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=headers).status_code == 401, "gateway принимает токен после бана"
+        response = requests.post(f"{self.BASE_URL}/api/v1/refresh-token", json={"refresh_token": tokens["refresh_token"]})
+        assert response.status_code == 401, "Refresh токен работает после бана"
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": login, "password": "Password123"})
+        assert response.status_code == 403, "Вход после бана не отклонён"
+        assert response.json()["code"] == "ACCOUNT_BANNED", "Нет кода ACCOUNT_BANNED"
+
+        response = requests.get(f"{self.BASE_URL}/api/v1/admin/audit-log", headers={"Authorization": f"Bearer {admin_token}"},
+                                params={"target_user_id": user_id, "action": "ban_user"})
+        assert response.status_code == 200, "Ошибка чтения журнала"
+        assert len(response.json()["entries"]) == 1, "Бан не записан в журнал"
+
+
+def jwt_claims(token: str) -> Dict[str, Any]:
+    return json.loads(b64url_decode(token.split(".")[1]))
+
+
+class TestRefreshTokens:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+
+    def register(self) -> Dict[str, Any]:
+        login = f"refresh_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": "Password123",
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        return response.json()
+
+    def refresh(self, refresh_token: str) -> requests.Response:
+        return requests.post(f"{self.BASE_URL}/api/v1/refresh-token", json={"refresh_token": refresh_token})
+
+    def test_rotation(self):
+        tokens = self.register()
+        response = self.refresh(tokens["refresh_token"])
+        assert response.status_code == 200, "Ошибка обновления токена"
+        rotated = response.json()
+        assert rotated["refresh_token"] != tokens["refresh_token"], "Refresh токен не заменён"
+        assert jwt_claims(rotated["access_token"])["fid"] == jwt_claims(tokens["access_token"])["fid"], "Сменилась сессия"
+
+        response = self.refresh(rotated["refresh_token"])
+        assert response.status_code == 200, "Ошибка повторного обновления"
+
+    def test_reuse_revokes_family(self):
+        tokens = self.register()
+        response = self.refresh(tokens["refresh_token"])
+        assert response.status_code == 200, "Ошибка обновления токена"
+        rotated = response.json()
+
+        assert self.refresh(tokens["refresh_token"]).status_code == 401, "Использованный refresh токен принят повторно"
+        assert self.refresh(rotated["refresh_token"]).status_code == 401, "Семья токенов не отозвана после повторного использования"
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers={"Authorization": f"Bearer {rotated['access_token']}"})
+        assert response.status_code == 401, "Access токен отозванной семьи принимается"
+
+    def test_garbage_rejected(self):
+        assert self.refresh("not-a-token").status_code == 401, "Принят мусорный refresh токен"
+
+
+class TestSessions:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    PASSWORD: str = "Password123"
+
+    def auth(self, token: str) -> Dict[str, str]:
+        return {"Authorization": f"Bearer {token}"}
+
+    @pytest.fixture
+    def login(self) -> str:
+        login = f"sessions_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+            "device": "pytest-register",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        return login
+
+    def sign_in(self, login: str, device: str) -> Dict[str, Any]:
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "device": device,
+        })
+        assert response.status_code == 200, "Ошибка аутентификации"
+        return response.json()
+
+    def test_list_sessions(self, login: str):
+        laptop = self.sign_in(login, "laptop")
+        self.sign_in(login, "phone")
+
+        response = requests.get(f"{self.BASE_URL}/api/v1/sessions", headers=self.auth(laptop["access_token"]))
+        assert response.status_code == 200, "Ошибка получения сессий"
+        sessions = response.json()["sessions"]
+        assert {"laptop", "phone"} <= {s["device"] for s in sessions}, "Не все сессии в списке"
+        current = [s for s in sessions if s["current"]]
+        assert len(current) == 1 and current[0]["id"] == jwt_claims(laptop["access_token"])["fid"], "Неверная текущая сессия"
+
+    def test_revoke_other_session(self, login: str):
+        laptop = self.sign_in(login, "laptop")
+        phone = self.sign_in(login, "phone")
+        phone_session = jwt_claims(phone["access_token"])["fid"]
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(phone["access_token"])).status_code == 200, "Токен не работает"
+
+        response = requests.delete(f"{self.BASE_URL}/api/v1/sessions/{phone_session}", headers=self.auth(laptop["access_token"]))
+        assert response.status_code == 204, "Ошибка отзыва сессии"
+
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(phone["access_token"]))
+        assert response.status_code == 401, "gateway принимает токен отозванной сессии"
+        response = requests.post(f"{self.BASE_URL}/api/v1/refresh-token", json={"refresh_token": phone["refresh_token"]})
+        assert response.status_code == 401, "Отозванная сессия обновляется"
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(laptop["access_token"])).status_code == 200, "Отозвана не та сессия"
+
+    def test_logout(self, login: str):
+        tokens = self.sign_in(login, "laptop")
+        assert requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(tokens["access_token"])).status_code == 200, "Токен не работает"
+
+        response = requests.delete(f"{self.BASE_URL}/api/v1/sessions/current", headers=self.auth(tokens["access_token"]))
+        assert response.status_code == 204, "Ошибка выхода"
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers=self.auth(tokens["access_token"]))
+        assert response.status_code == 401, "gateway принимает токен после выхода"
+
+    def test_revoke_unknown_session(self, login: str):
+        tokens = self.sign_in(login, "laptop")
+        response = requests.delete(f"{self.BASE_URL}/api/v1/sessions/{uuid.uuid4()}", headers=self.auth(tokens["access_token"]))
+        assert response.status_code == 404, "Отозвана несуществующая сессия"
+        response = requests.delete(f"{self.BASE_URL}/api/v1/sessions/not-a-uuid", headers=self.auth(tokens["access_token"]))
+        assert response.status_code == 400, "Неверный id сессии принят"
+
+
+class TestPermissions:
+    """Часть тестов требует администратора с правом roles:manage в TEST_ADMIN_LOGIN и TEST_ADMIN_PASSWORD."""
+
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    ADMIN_LOGIN: Optional[str] = os.getenv("TEST_ADMIN_LOGIN")
+    ADMIN_PASSWORD: Optional[str] = os.getenv("TEST_ADMIN_PASSWORD")
+
+    def auth(self, token: str) -> Dict[str, str]:
+        return {"Authorization": f"Bearer {token}"}
+
+    def register(self) -> Dict[str, Any]:
+        login = f"perm_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": "Password123",
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        return response.json()
+
+    def create_post(self, token: str) -> str:
+        response = requests.post(f"{self.BASE_URL}/api/v1/posts", headers=self.auth(token), json={"title": "Permissions"})
+        assert response.status_code == 201, "Ошибка создания поста"
+        return response.json()["id"]
+
+    @pytest.fixture(scope="class")
+    def admin_token(self) -> str:
+        if not self.ADMIN_LOGIN or not self.ADMIN_PASSWORD:
+            pytest.skip("Не заданы TEST_ADMIN_LOGIN и TEST_ADMIN_PASSWORD")
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={
+            "login": self.ADMIN_LOGIN,
+            "password": self.ADMIN_PASSWORD,
+        })
+        assert response.status_code == 200, "Ошибка аутентификации администратора"
+        return response.json()["access_token"]
+
+    def test_new_user_has_no_permissions(self):
+        token = self.register()["access_token"]
+        assert not jwt_claims(token).get("permissions"), "У нового пользователя есть права"
+
+        headers = self.auth(token)
+        assert requests.get(f"{self.BASE_URL}/api/v1/admin/roles", headers=headers).status_code == 403, "Доступен список ролей"
+        response = requests.put(f"{self.BASE_URL}/api/v1/admin/users/1/roles/admin", headers=headers)
+        assert response.status_code == 403, "Пользователь выдаёт роли"
+        response = requests.post(f"{self.BASE_URL}/api/v1/admin/users/1/suspend", headers=headers, json={"duration_seconds": 60})
+        assert response.status_code == 403, "Пользователь блокирует аккаунты"
+
+    def test_cannot_change_foreign_post(self):
+        author = self.register()["access_token"]
+        other = self.register()["access_token"]
+        post_id = self.create_post(author)
+
+        response = requests.put(f"{self.BASE_URL}/api/v1/posts/{post_id}", headers=self.auth(other), json={"title": "Hijacked"})
+        assert response.status_code != 200, "Изменён чужой пост"
+        response = requests.delete(f"{self.BASE_URL}/api/v1/posts/{post_id}", headers=self.auth(other))
+        assert response.status_code != 204, "Удалён чужой пост"
+        response = requests.get(f"{self.BASE_URL}/api/v1/posts/{post_id}", headers=self.auth(author))
+        assert response.status_code == 200 and response.json()["title"] == "Permissions", "Чужой пост изменён"
+
+    def test_granted_role_applies_after_refresh(self, admin_token: str):
+        author = self.register()["access_token"]
+        moderator = self.register()
+        user_id = jwt_claims(moderator["access_token"])["user_id"]
+        post_id = self.create_post(author)
+
+        response = requests.put(f"{self.BASE_URL}/api/v1/admin/users/{user_id}/roles/moderator", headers=self.auth(admin_token))
+        assert response.status_code == 204, f"Ошибка выдачи роли: {response.text}"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/refresh-token", json={"refresh_token": moderator["refresh_token"]})
+        assert response.status_code == 200, "Ошибка обновления токена"
+        token = response.json()["access_token"]
+        claims = jwt_claims(token)
+        assert "moderator" in claims["roles"], "Роли нет в токене"
+        assert {"posts:edit_any", "posts:delete_any"} <= set(claims["permissions"]), "Прав роли нет в токене"
+
+        response = requests.put(f"{self.BASE_URL}/api/v1/posts/{post_id}", headers=self.auth(token), json={"title": "Moderated"})
+        assert response.status_code == 200, "Модератор не может изменить пост"
+        response = requests.delete(f"{self.BASE_URL}/api/v1/posts/{post_id}", headers=self.auth(token))
+        assert response.status_code == 204, "Модератор не может удалить пост"
+        assert requests.get(f"{self.BASE_URL}/api/v1/admin/roles", headers=self.auth(token)).status_code == 403, "У модератора есть roles:manage"
+
+
+def totp_code(secret: str, at: Optional[float] = None) -> str:
+    key = base64.b32decode(secret + "=" * (-len(secret) % 8))
+    step = int((time.time() if at is None else at) // 30)
+    digest = hmac.new(key, step.to_bytes(8, "big"), hashlib.sha1).digest()
+    offset = digest[-1] & 0x0F
+    value = int.from_bytes(digest[offset:offset + 4], "big") & 0x7FFFFFFF
+    return f"{value % 1_000_000:06d}"
+
+
+class TestTwoFactor:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    PASSWORD: str = "Password123"
+
+    def auth(self, token: str) -> Dict[str, str]:
+        return {"Authorization": f"Bearer {token}"}
+
+    @pytest.fixture
+    def enrolled(self) -> Tuple[str, str, List[str]]:
+        login = f"totp_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        headers = self.auth(response.json()["access_token"])
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/2fa/totp", headers=headers)
+        assert response.status_code == 200, "Ошибка подключения TOTP"
+        secret = response.json()["secret"]
+        assert secret in response.json()["provisioning_uri"], "Секрет не в ссылке otpauth"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/2fa/totp/confirm", headers=headers, json={"code": totp_code(secret)})
+        assert response.status_code == 200, f"Ошибка подтверждения TOTP: {response.text}"
+        recovery_codes = response.json()["recovery_codes"]
+        assert len(recovery_codes) == 10, "Неверное число кодов восстановления"
+        return login, secret, recovery_codes
+
+    def challenge(self, login: str) -> str:
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": login, "password": self.PASSWORD})
+        assert response.status_code == 200, "Ошибка аутентификации"
+        body = response.json()
+        assert body.get("two_factor_required") and not body.get("access_token"), "Токены выданы без второго фактора"
+        assert "totp" in body["two_factor_methods"], "TOTP не предложен вторым фактором"
+        return body["challenge_token"]
+
+    def verify(self, challenge_token: str, code: str) -> requests.Response:
+        return requests.post(f"{self.BASE_URL}/api/v1/authenticate/2fa", json={
+            "challenge_token": challenge_token,
+            "code": code,
+        })
+
+    def test_confirm_rejects_wrong_code(self):
+        login = f"totp_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        headers = self.auth(response.json()["access_token"])
+        secret = requests.post(f"{self.BASE_URL}/api/v1/2fa/totp", headers=headers).json()["secret"]
+
+        wrong = totp_code(secret, time.time() - 600)
+        response = requests.post(f"{self.BASE_URL}/api/v1/2fa/totp/confirm", headers=headers, json={"code": wrong})
+        assert response.status_code == 400, "Подтверждён неверный код"
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": login, "password": self.PASSWORD})
+        assert response.json().get("access_token"), "2FA включена без подтверждения"
+
+    def test_totp_code_single_use(self, enrolled: Tuple[str, str, List[str]]):
+        login, secret, _ = enrolled
+        # код этого шага уже принят при подтверждении
+        response = self.verify(self.challenge(login), totp_code(secret))
+        assert response.status_code == 401, "TOTP код принят повторно"
+
+    def test_recovery_code_single_use(self, enrolled: Tuple[str, str, List[str]]):
+        login, _, recovery_codes = enrolled
+        response = self.verify(self.challenge(login), recovery_codes[0])
+        assert response.status_code == 200, f"Код восстановления не принят: {response.text}"
+        assert response.json()["access_token"], "Нет access токена"
+
+        response = self.verify(self.challenge(login), recovery_codes[0])
+        assert response.status_code == 401, "Код восстановления принят повторно"
+
+    def test_challenge_token_single_use(self, enrolled: Tuple[str, str, List[str]]):
+        login, _, recovery_codes = enrolled
+        challenge_token = self.challenge(login)
+        assert self.verify(challenge_token, recovery_codes[0]).status_code == 200, "Код восстановления не принят"
+
+        response = self.verify(challenge_token, recovery_codes[1])
+        assert response.status_code == 401, "challenge token завершил второй вход"
+
+    def test_disable(self, enrolled: Tuple[str, str, List[str]]):
+        login, _, recovery_codes = enrolled
+        tokens = self.verify(self.challenge(login), recovery_codes[0]).json()
+        response = requests.delete(f"{self.BASE_URL}/api/v1/2fa/totp", headers=self.auth(tokens["access_token"]),
+                                   json={"password": self.PASSWORD, "code": recovery_codes[1]})
+        assert response.status_code == 204, f"Ошибка отключения TOTP: {response.text}"
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": login, "password": self.PASSWORD})
+        assert response.status_code == 200 and response.json().get("access_token"), "Второй фактор требуется после отключения"
+
+
+class TestLockoutTiming:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    # должны совпадать с -lockout_threshold и -lockout_base_delay сервиса пользователей
+    THRESHOLD: int = int(os.getenv("TEST_LOCKOUT_THRESHOLD", "5"))
+    BASE_DELAY: int = int(os.getenv("TEST_LOCKOUT_BASE_DELAY", "60"))
+    PASSWORD: str = "Password123"
+
+    def sign_in(self, login: str, password: str) -> requests.Response:
+        return requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": login, "password": password})
+
+    def lock(self, login: str) -> int:
+        for _ in range(self.THRESHOLD):
+            response = self.sign_in(login, "WrongPassword1")
+            assert response.status_code == 401, f"Неверный ответ на неверный пароль: {response.status_code}"
+
+        response = self.sign_in(login, self.PASSWORD)
+        assert response.status_code == 429, "Верный пароль принят во время блокировки"
+        return int(response.headers["Retry-After"])
+
+    def test_lockout_doubles(self):
+        login = f"lockout_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+
+        retry_after = self.lock(login)
+        assert self.BASE_DELAY - 5 <= retry_after <= self.BASE_DELAY, f"Неверная длительность первой блокировки: {retry_after}"
+
+        # неудачи после окончания блокировки снова получают 401, а не 429,
+        # успешный вход сбросил бы и число блокировок
+        time.sleep(retry_after + 1)
+        retry_after = self.lock(login)
+        assert 2 * self.BASE_DELAY - 5 <= retry_after <= 2 * self.BASE_DELAY, f"Вторая блокировка не вдвое дольше: {retry_after}"
+
+
+class TestPersonalData:
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    PASSWORD: str = "Password123"
+
+    def register(self, login: str, email: str, **fields: Any) -> requests.Response:
+        return requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": self.PASSWORD,
+            "email": email,
+            "birth_date": "1990-01-01T00:00:00Z",
+            **fields,
+        })
+
+    def test_profile_decrypted(self):
+        login = f"pii_{uuid.uuid4().hex[:10]}"
+        response = self.register(login, f"{login}@example.com", phone_number="+79991234567")
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile",
+                                headers={"Authorization": f"Bearer {response.json()['access_token']}"})
+        assert response.status_code == 200, "Ошибка получения профиля"
+        profile = response.json()
+        assert profile["email"] == f"{login}@example.com", "Email не совпадает"
+        assert profile["phone_number"] == "+79991234567", "Телефон не совпадает"
+        assert profile["birth_date"].startswith("1990-01-01"), "Дата рождения не совпадает"
+
+    def test_login_by_email_any_case(self):
+        login = f"pii_{uuid.uuid4().hex[:10]}"
+        email = f"{login}@Example.com"
+        assert self.register(login, email).status_code in (200, 201), "Ошибка регистрации"
+
+        for spelling in [email, email.lower(), email.upper(), f"  {email}  "]:
+            response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={"login": spelling, "password": self.PASSWORD})
+            assert response.status_code == 200, f"Вход по email {spelling!r} не работает"
+            assert jwt_claims(response.json()["access_token"])["user_login"] == login, "Вход не в тот аккаунт"
+
+    def test_email_unique_ignoring_case(self):
+        login = f"pii_{uuid.uuid4().hex[:10]}"
+        email = f"{login}@example.com"
+        assert self.register(login, email).status_code in (200, 201), "Ошибка регистрации"
+
+        other = f"pii_{uuid.uuid4().hex[:10]}"
+        response = self.register(other, email.upper())
+        assert response.status_code == 409, "Зарегистрирован email, отличающийся только регистром"
+
+        response = self.register(other, f"{other}@example.com")
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        response = requests.patch(f"{self.BASE_URL}/api/v1/profile",
+                                  headers={"Authorization": f"Bearer {response.json()['access_token']}"},
+                                  json={"email": email.upper()})
+        assert response.status_code == 409, "Email сменён на чужой в другом регистре"
+
+
+class TestImpersonation:
+    """Нужен администратор с правом users:impersonate в TEST_ADMIN_LOGIN и TEST_ADMIN_PASSWORD."""
+
+    BASE_URL: str = os.getenv("TEST_API_BASE_URL", "http://localhost")
+    ADMIN_LOGIN: Optional[str] = os.getenv("TEST_ADMIN_LOGIN")
+    ADMIN_PASSWORD: Optional[str] = os.getenv("TEST_ADMIN_PASSWORD")
+
+    @pytest.fixture(scope="class")
+    def admin_token(self) -> str:
+        if not self.ADMIN_LOGIN or not self.ADMIN_PASSWORD:
+            pytest.skip("Не заданы TEST_ADMIN_LOGIN и TEST_ADMIN_PASSWORD")
+        response = requests.post(f"{self.BASE_URL}/api/v1/authenticate", json={
+            "login": self.ADMIN_LOGIN,
+            "password": self.ADMIN_PASSWORD,
+        })
+        assert response.status_code == 200, "Ошибка аутентификации администратора"
+        return response.json()["access_token"]
+
+    @pytest.fixture
+    def impersonation(self, admin_token: str) -> Tuple[int, str, str]:
+        login = f"impersonated_{uuid.uuid4().hex[:10]}"
+        response = requests.post(f"{self.BASE_URL}/api/v1/register", json={
+            "login": login,
+            "password": "Password123",
+            "email": f"{login}@example.com",
+            "birth_date": "1990-01-01T00:00:00Z",
+        })
+        assert response.status_code in (200, 201), "Ошибка регистрации"
+        user_token = response.json()["access_token"]
+        user_id = jwt_claims(user_token)["user_id"]
+
+        response = requests.post(f"{self.BASE_URL}/api/v1/admin/users/{user_id}/impersonate",
+                                 headers={"Authorization": f"Bearer {admin_token}"},
+                                 json={"reason": "pytest"})
+        assert response.status_code == 201, f"Ошибка входа от имени пользователя: {response.text}"
+        token = response.json()["access_token"]
+        assert jwt_claims(token)["act"]["user_login"] == self.ADMIN_LOGIN, "В токене нет администратора"
+        return user_id, token, jwt_claims(user_token)["fid"]
+
+    def test_can_read_profile(self, impersonation: Tuple[int, str, str]):
+        _, token, _ = impersonation
+        response = requests.get(f"{self.BASE_URL}/api/v1/profile", headers={"Authorization": f"Bearer {token}"})
+        assert response.status_code == 200, "Профиль недоступен от имени пользователя"
+
+    def test_account_settings_denied(self, impersonation: Tuple[int, str, str]):
+        user_id, token, user_session = impersonation
+        headers = {"Authorization": f"Bearer {token}"}
+        calls = {
+            "видимость полей": lambda: requests.put(f"{self.BASE_URL}/api/v1/profile/visibility", headers=headers,
+                                                    json={"email": "private"}),
+            "приватность": lambda: requests.put(f"{self.BASE_URL}/api/v1/users/{user_id}/privacy", headers=headers,
+                                                json={"is_private": True}),
+            "загрузка аватара": lambda: requests.post(f"{self.BASE_URL}/api/v1/profile/avatar", headers=headers,
+                                                      files={"avatar": ("avatar.png", b"\x89PNG\r\n\x1a\n", "image/png")}),
+            "удаление аватара": lambda: requests.delete(f"{self.BASE_URL}/api/v1/profile/avatar", headers=headers),
+            "список сессий": lambda: requests.get(f"{self.BASE_URL}/api/v1/sessions", headers=headers),
+            "отзыв сессии": lambda: requests.delete(f"{self.BASE_URL}/api/v1/sessions/{user_session}", headers=headers),
+            "выход": lambda: requests.delete(f"{self.BASE_URL}/api/v1/sessions/current", headers=headers),
+        }
+        for name, call in calls.items():
+            response = call()
+            assert response.status_code == 403, f"{name}: от имени пользователя ответ {response.status_code}"
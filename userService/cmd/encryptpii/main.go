@@ -0,0 +1,350 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Nicvod/SOA/userService/pii"
+	"github.com/Nicvod/SOA/utils/secrets"
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+const pgUniqueViolation = "23505"
+
+// The columns of users created before encryption are converted to BYTEA
+// holding the plaintext, rows without email_index are not encrypted yet.
+var schemaMigration = []string{
+	"ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key",
+	"ALTER TABLE users ALTER COLUMN email TYPE BYTEA USING convert_to(email, 'UTF8')",
+	"ALTER TABLE users ALTER COLUMN phone_number TYPE BYTEA USING convert_to(COALESCE(phone_number, ''), 'UTF8')",
+	`ALTER TABLE users ALTER COLUMN birth_date TYPE BYTEA USING convert_to(COALESCE(to_char(birth_date, 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'), ''), 'UTF8')`,
+	"ALTER TABLE users ADD COLUMN email_index BYTEA CONSTRAINT users_email_index_key UNIQUE",
+	"ALTER TABLE action_tokens ADD COLUMN email_index BYTEA",
+}
+
+var finishMigration = []string{
+	"ALTER TABLE users ALTER COLUMN email SET NOT NULL, ALTER COLUMN email_index SET NOT NULL, ALTER COLUMN phone_number SET NOT NULL, ALTER COLUMN birth_date SET NOT NULL",
+	"ALTER TABLE action_tokens DROP COLUMN IF EXISTS email, ALTER COLUMN email_index SET NOT NULL",
+}
+
+type userRow struct {
+	ID int `db:"id"`
+	pii.Sealed
+}
+
+func main() {
+	keysFile := flag.String("master_keys_file", "", "`path` to the master keys")
+	dbHost := flag.String("db_host", "user_db", "database host")
+	dbPort := flag.Int("db_port", 5432, "database port")
+	dbNameEnv := flag.String("db_name_env", "", "database name env")
+	dbUserEnv := flag.String("db_user_env", "", "database user env")
+	dbPasswordEnv := flag.String("db_password_env", "", "database password env")
+	batchSize := flag.Int("batch_size", 500, "rows encrypted per query")
+	flag.Parse()
+	if *keysFile == "" {
+		log.Fatalf("no master keys file provided")
+	}
+
+	keys, err := secrets.LoadMasterKeys(*keysFile)
+	if err != nil {
+		log.Fatalf("failed to load master keys: %v", err)
+	}
+	db, err := sqlx.Connect("postgres", fmt.Sprintf(
+		"host=%s port=%d user=%s password=%s dbname=%s sslmode=disable",
+		*dbHost, *dbPort, os.Getenv(*dbUserEnv), os.Getenv(*dbPasswordEnv), os.Getenv(*dbNameEnv),
+	))
+	if err != nil {
+		log.Fatalf("failed to connect to database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	m := &migration{db: db, cipher: pii.NewCipher(keys), batchSize: *batchSize}
+	if err := m.run(ctx); err != nil {
+		log.Fatalf("failed to encrypt personal data: %v", err)
+	}
+}
+
+type migration struct {
+	db        *sqlx.DB
+	cipher    *pii.Cipher
+	batchSize int
+}
+
+// run can be repeated: it migrates the schema once, encrypts the rows that
+// are still plaintext and encrypts again the ones under a retired key.
+func (m *migration) run(ctx context.Context) error {
+	migrated, err := m.migrateSchema(ctx)
+	if err != nil {
+		return err
+	}
+	if migrated {
+		log.Printf("converted personal columns to BYTEA")
+	}
+
+	encrypted, err := m.encryptPlaintext(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("encrypted %d users", encrypted)
+	tokens, err := m.indexActionTokens(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("indexed emails of %d action tokens", tokens)
+	if err := m.exec(ctx, finishMigration); err != nil {
+		return err
+	}
+
+	reencrypted, err := m.reencryptStale(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("encrypted %d users again with the active master key", reencrypted)
+
+	totpSecrets, err := m.encryptTOTPSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("encrypted %d TOTP secrets", totpSecrets)
+	reencrypted, err = m.reencryptStaleTOTPSecrets(ctx)
+	if err != nil {
+		return err
+	}
+	log.Printf("encrypted %d TOTP secrets again with the active master key", reencrypted)
+	return nil
+}
+
+func (m *migration) migrateSchema(ctx context.Context) (bool, error) {
+	var dataType string
+	err := m.db.GetContext(ctx, &dataType,
+		"SELECT data_type FROM information_schema.columns WHERE table_name = 'users' AND column_name = 'email'",
+	)
+	if err != nil {
+		return false, err
+	}
+	if dataType == "bytea" {
+		return false, nil
+	}
+	return true, m.exec(ctx, schemaMigration)
+}
+
+func (m *migration) exec(ctx context.Context, statements []string) error {
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (m *migration) encryptPlaintext(ctx context.Context) (int, error) {
+	count := 0
+	for {
+		var rows []userRow
+		err := m.db.SelectContext(ctx, &rows, `
+            SELECT id, email, email_index, phone_number, birth_date FROM users
+            WHERE email_index IS NULL ORDER BY id LIMIT $1
+        `, m.batchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(rows) == 0 {
+			return count, nil
+		}
+
+		for _, row := range rows {
+			fields := pii.Fields{Email: string(row.Email), PhoneNumber: string(row.PhoneNumber)}
+			if len(row.BirthDate) > 0 {
+				if fields.BirthDate, err = time.Parse(time.RFC3339Nano, string(row.BirthDate)); err != nil {
+					return count, fmt.Errorf("bad birth date of user %d: %w", row.ID, err)
+				}
+			}
+			sealed, err := m.cipher.Seal(row.ID, fields)
+			if err != nil {
+				return count, err
+			}
+			if err := m.store(ctx, row.ID, sealed, "email_index IS NULL"); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+// reencryptStale walks all users, a value carries the id of its key, so
+// stale rows cannot be selected in SQL.
+func (m *migration) reencryptStale(ctx context.Context) (int, error) {
+	count, lastID := 0, 0
+	for {
+		var rows []userRow
+		err := m.db.SelectContext(ctx, &rows, `
+            SELECT id, email, email_index, phone_number, birth_date FROM users
+            WHERE id > $1 ORDER BY id LIMIT $2
+        `, lastID, m.batchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(rows) == 0 {
+			return count, nil
+		}
+
+		for _, row := range rows {
+			lastID = row.ID
+			if !m.cipher.Stale(&row.Sealed) {
+				continue
+			}
+			fields, err := m.cipher.Open(row.ID, &row.Sealed)
+			if err != nil {
+				return count, err
+			}
+			sealed, err := m.cipher.Seal(row.ID, *fields)
+			if err != nil {
+				return count, err
+			}
+			// A row changed by the service meanwhile is left for the next
+			// run.
+			err = m.store(ctx, row.ID, sealed, "email = $6 AND phone_number = $7 AND birth_date = $8",
+				row.Email, row.PhoneNumber, row.BirthDate)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+}
+
+func (m *migration) store(ctx context.Context, id int, sealed *pii.Sealed, condition string, args ...any) error {
+	args = append([]any{sealed.Email, sealed.EmailIndex, sealed.PhoneNumber, sealed.BirthDate, id}, args...)
+	_, err := m.db.ExecContext(ctx, `
+        UPDATE users SET email = $1, email_index = $2, phone_number = $3, birth_date = $4
+        WHERE id = $5 AND `+condition, args...)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+		return fmt.Errorf("email of user %d differs from another one only in case, change one of them first: %w", id, err)
+	}
+	return err
+}
+
+func (m *migration) indexActionTokens(ctx context.Context) (int, error) {
+	var hasEmail bool
+	err := m.db.GetContext(ctx, &hasEmail, `
+        SELECT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'action_tokens' AND column_name = 'email')
+    `)
+	if err != nil || !hasEmail {
+		return 0, err
+	}
+
+	var tokens []struct {
+		JTI   string `db:"jti"`
+		Email string `db:"email"`
+	}
+	if err := m.db.SelectContext(ctx, &tokens, "SELECT jti, email FROM action_tokens WHERE email_index IS NULL"); err != nil {
+		return 0, err
+	}
+	for _, token := range tokens {
+		index, err := m.cipher.EmailIndex(token.Email)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := m.db.ExecContext(ctx, "UPDATE action_tokens SET email_index = $1 WHERE jti = $2", index, token.JTI); err != nil {
+			return 0, err
+		}
+	}
+	return len(tokens), nil
+}
+
+// encryptTOTPSecrets replaces the TEXT secret column of user_totp by a BYTEA
+// one in a single transaction, so that no plaintext secret is left in BYTEA.
+func (m *migration) encryptTOTPSecrets(ctx context.Context) (int, error) {
+	var dataType string
+	err := m.db.GetContext(ctx, &dataType,
+		"SELECT data_type FROM information_schema.columns WHERE table_name = 'user_totp' AND column_name = 'secret'",
+	)
+	if err != nil || dataType == "bytea" {
+		return 0, err
+	}
+
+	tx, err := m.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var rows []struct {
+		UserID int    `db:"user_id"`
+		Secret string `db:"secret"`
+	}
+	if err := tx.SelectContext(ctx, &rows, "SELECT user_id, secret FROM user_totp FOR UPDATE"); err != nil {
+		return 0, err
+	}
+	if _, err := tx.ExecContext(ctx, "ALTER TABLE user_totp ADD COLUMN sealed_secret BYTEA"); err != nil {
+		return 0, err
+	}
+	for _, row := range rows {
+		sealed, err := m.cipher.SealTOTPSecret(row.UserID, row.Secret)
+		if err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE user_totp SET sealed_secret = $1 WHERE user_id = $2", sealed, row.UserID); err != nil {
+			return 0, err
+		}
+	}
+	for _, statement := range []string{
+		"ALTER TABLE user_totp DROP COLUMN secret",
+		"ALTER TABLE user_totp RENAME COLUMN sealed_secret TO secret",
+		"ALTER TABLE user_totp ALTER COLUMN secret SET NOT NULL",
+	} {
+		if _, err := tx.ExecContext(ctx, statement); err != nil {
+			return 0, fmt.Errorf("%s: %w", statement, err)
+		}
+	}
+	return len(rows), tx.Commit()
+}
+
+func (m *migration) reencryptStaleTOTPSecrets(ctx context.Context) (int, error) {
+	var rows []struct {
+		UserID int    `db:"user_id"`
+		Secret []byte `db:"secret"`
+	}
+	if err := m.db.SelectContext(ctx, &rows, "SELECT user_id, secret FROM user_totp"); err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, row := range rows {
+		if !m.cipher.StaleTOTPSecret(row.Secret) {
+			continue
+		}
+		secret, err := m.cipher.OpenTOTPSecret(row.UserID, row.Secret)
+		if err != nil {
+			return count, err
+		}
+		sealed, err := m.cipher.SealTOTPSecret(row.UserID, secret)
+		if err != nil {
+			return count, err
+		}
+		// a secret enrolled again meanwhile is left for the next run
+		_, err = m.db.ExecContext(ctx,
+			"UPDATE user_totp SET secret = $1 WHERE user_id = $2 AND secret = $3",
+			sealed, row.UserID, row.Secret,
+		)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"time"
+
+	"github.com/Nicvod/SOA/utils/auth"
+)
+
+func main() {
+	keysDir := flag.String("keys_dir", "", "path to JWT signing key ring `dir`")
+	activateAfter := flag.Duration("activate_after", time.Minute, "how long the new key is only published for verification, at least the -keys_reload of every service")
+	retireAfter := flag.Duration("retire_after", auth.RefreshTokenTTL, "how long the previous signing key stays verifiable")
+	flag.Parse()
+	if *keysDir == "" {
+		log.Fatalf("no keys dir provided")
+	}
+	if *retireAfter < auth.RefreshTokenTTL {
+		log.Printf("warning: retire_after %v is shorter than refresh token lifetime %v, outstanding refresh tokens will stop working", *retireAfter, auth.RefreshTokenTTL)
+	}
+
+	kid, activateAt, err := auth.RotateKeyRing(*keysDir, *activateAfter, *retireAfter)
+	if err != nil {
+		log.Fatalf("failed to rotate signing keys: %v", err)
+	}
+	log.Printf("new signing key %s becomes active at %s", kid, activateAt.Format(time.RFC3339))
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"log"
+
+	"github.com/Nicvod/SOA/utils/secrets"
+)
+
+func main() {
+	keysFile := flag.String("master_keys_file", "", "path to the master keys `file`, created if missing")
+	prune := flag.Bool("prune", false, "remove keys retired by earlier rotations, only once nothing is wrapped by them")
+	flag.Parse()
+	if *keysFile == "" {
+		log.Fatalf("no master keys file provided")
+	}
+
+	kid, err := secrets.RotateMasterKeys(*keysFile, *prune)
+	if err != nil {
+		log.Fatalf("failed to rotate master keys: %v", err)
+	}
+	log.Printf("new master key %s is active", kid)
+}
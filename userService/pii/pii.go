@@ -0,0 +1,148 @@
+// Package pii encrypts the personal columns of users: email, phone number and
+// birth date, and their TOTP secrets. It is shared by the service and the
+// encryptpii command.
+package pii
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Nicvod/SOA/utils/secrets"
+)
+
+const emailIndexPurpose = "users.email"
+
+// Fields are the personal columns of a user in plaintext.
+type Fields struct {
+	Email       string
+	PhoneNumber string
+	BirthDate   time.Time
+}
+
+// Sealed are the personal columns as stored. Every value carries the id of its
+// master key, EmailIndex is the blind index of the email.
+type Sealed struct {
+	Email       []byte `db:"email"`
+	EmailIndex  []byte `db:"email_index"`
+	PhoneNumber []byte `db:"phone_number"`
+	BirthDate   []byte `db:"birth_date"`
+}
+
+type Cipher struct {
+	keys *secrets.MasterKeys
+}
+
+func NewCipher(keys *secrets.MasterKeys) *Cipher {
+	return &Cipher{keys: keys}
+}
+
+// EmailIndex ignores case and surrounding spaces, so an address is taken in
+// any spelling.
+func (c *Cipher) EmailIndex(email string) ([]byte, error) {
+	return c.keys.BlindIndex(emailIndexPurpose, []byte(strings.ToLower(strings.TrimSpace(email))))
+}
+
+func (c *Cipher) SealEmail(userID int, email string) (ciphertext, index []byte, err error) {
+	if ciphertext, err = c.seal(userID, "email", email); err != nil {
+		return nil, nil, err
+	}
+	if index, err = c.EmailIndex(email); err != nil {
+		return nil, nil, err
+	}
+	return ciphertext, index, nil
+}
+
+func (c *Cipher) SealPhoneNumber(userID int, phoneNumber string) ([]byte, error) {
+	return c.seal(userID, "phone_number", phoneNumber)
+}
+
+func (c *Cipher) SealBirthDate(userID int, birthDate time.Time) ([]byte, error) {
+	value := ""
+	if !birthDate.IsZero() {
+		value = birthDate.UTC().Format(time.RFC3339Nano)
+	}
+	return c.seal(userID, "birth_date", value)
+}
+
+func (c *Cipher) Seal(userID int, fields Fields) (*Sealed, error) {
+	var sealed Sealed
+	var err error
+	if sealed.Email, sealed.EmailIndex, err = c.SealEmail(userID, fields.Email); err != nil {
+		return nil, err
+	}
+	if sealed.PhoneNumber, err = c.SealPhoneNumber(userID, fields.PhoneNumber); err != nil {
+		return nil, err
+	}
+	if sealed.BirthDate, err = c.SealBirthDate(userID, fields.BirthDate); err != nil {
+		return nil, err
+	}
+	return &sealed, nil
+}
+
+func (c *Cipher) Open(userID int, sealed *Sealed) (*Fields, error) {
+	var fields Fields
+	var err error
+	if fields.Email, err = c.open(userID, "email", sealed.Email); err != nil {
+		return nil, err
+	}
+	if fields.PhoneNumber, err = c.open(userID, "phone_number", sealed.PhoneNumber); err != nil {
+		return nil, err
+	}
+	birthDate, err := c.open(userID, "birth_date", sealed.BirthDate)
+	if err != nil {
+		return nil, err
+	}
+	if birthDate != "" {
+		if fields.BirthDate, err = time.Parse(time.RFC3339Nano, birthDate); err != nil {
+			return nil, fmt.Errorf("bad birth date of user %d: %w", userID, err)
+		}
+	}
+	return &fields, nil
+}
+
+// Stale tells whether a value of sealed is encrypted by another master key
+// than the active one.
+func (c *Cipher) Stale(sealed *Sealed) bool {
+	active := c.keys.ActiveKeyID()
+	for _, value := range [][]byte{sealed.Email, sealed.PhoneNumber, sealed.BirthDate} {
+		if secrets.KeyIDOf(value) != active {
+			return true
+		}
+	}
+	return false
+}
+
+// SealTOTPSecret encrypts the TOTP secret of a user, it lives in user_totp
+// but is bound to the user like the columns of users.
+func (c *Cipher) SealTOTPSecret(userID int, secret string) ([]byte, error) {
+	return c.seal(userID, "totp_secret", secret)
+}
+
+func (c *Cipher) OpenTOTPSecret(userID int, ciphertext []byte) (string, error) {
+	return c.open(userID, "totp_secret", ciphertext)
+}
+
+// StaleTOTPSecret tells whether a sealed TOTP secret is encrypted by another
+// master key than the active one.
+func (c *Cipher) StaleTOTPSecret(ciphertext []byte) bool {
+	return secrets.KeyIDOf(ciphertext) != c.keys.ActiveKeyID()
+}
+
+// The ciphertexts are bound to their user and column, so that they cannot be
+// moved to another one.
+func (c *Cipher) seal(userID int, field, value string) ([]byte, error) {
+	return c.keys.Encrypt([]byte(value), aad(userID, field))
+}
+
+func (c *Cipher) open(userID int, field string, ciphertext []byte) (string, error) {
+	value, err := c.keys.Decrypt(ciphertext, aad(userID, field))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s of user %d: %w", field, userID, err)
+	}
+	return string(value), nil
+}
+
+func aad(userID int, field string) []byte {
+	return fmt.Appendf(nil, "users/%d/%s", userID, field)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *UserService) RequestEmailVerification(ctx context.Context, req *pb.RequestEmailVerificationRequest) (*pb.RequestEmailVerificationResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if user.EmailVerifiedAt != nil {
+		return nil, status.Error(codes.FailedPrecondition, "email is already verified")
+	}
+
+	if err := s.sendEmailVerification(ctx, user); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to send verification email: %v", err)
+	}
+	return &pb.RequestEmailVerificationResponse{}, nil
+}
+
+func (s *UserService) VerifyEmail(ctx context.Context, req *pb.VerifyEmailRequest) (*pb.VerifyEmailResponse, error) {
+	token, err := s.redeemActionToken(ctx, req.Token, auth.EmailVerificationToken, actionPurposeEmailVerification)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.repo.MarkEmailVerified(ctx, token.UserID, token.EmailIndex)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Error(codes.FailedPrecondition, "email was changed after the link was sent")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to verify email: %v", err)
+	}
+	return &pb.VerifyEmailResponse{}, nil
+}
+
+// RequestPasswordReset answers the same way whether or not the address is
+// registered, so it cannot be used to find out which emails have accounts.
+func (s *UserService) RequestPasswordReset(ctx context.Context, req *pb.RequestPasswordResetRequest) (*pb.RequestPasswordResetResponse, error) {
+	user, err := s.repo.GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		return &pb.RequestPasswordResetResponse{}, nil
+	}
+
+	token, err := s.issueActionToken(ctx, user, auth.PasswordResetToken, actionPurposePasswordReset, auth.PasswordResetTokenTTL)
+	if err != nil {
+		log.Printf("failed to issue password reset token for user %d: %v", user.ID, err)
+		return &pb.RequestPasswordResetResponse{}, nil
+	}
+
+	link := s.publicURL + "/reset-password?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Password reset",
+		Body: fmt.Sprintf(
+			"Hello, %s!\n\nTo set a new password open the link below. It is valid for %s and can be used once.\n\n%s\n\nIf you did not ask to reset your password, ignore this email.\n",
+			user.Login, auth.PasswordResetTokenTTL, link,
+		),
+	})
+	if err != nil {
+		log.Printf("failed to send password reset email to user %d: %v", user.ID, err)
+	}
+	return &pb.RequestPasswordResetResponse{}, nil
+}
+
+func (s *UserService) ResetPassword(ctx context.Context, req *pb.ResetPasswordRequest) (*pb.ResetPasswordResponse, error) {
+	token, err := s.redeemActionToken(ctx, req.Token, auth.PasswordResetToken, actionPurposePasswordReset)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByID(ctx, token.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if !bytes.Equal(user.EmailIndex, token.EmailIndex) {
+		return nil, status.Error(codes.FailedPrecondition, "email was changed after the link was sent")
+	}
+
+	if err := s.setPassword(ctx, user.ID, req.NewPassword); err != nil {
+		return nil, err
+	}
+	if err := s.tokens.RevokeAllSessions(ctx, user.ID, "", revokeReasonPasswordReset); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions: %v", err)
+	}
+	return &pb.ResetPasswordResponse{}, nil
+}
+
+func (s *UserService) ChangePassword(ctx context.Context, req *pb.ChangePasswordRequest) (*pb.ChangePasswordResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	ok, _, err := s.verifyPassword(user, req.CurrentPassword)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check password: %v", err)
+	}
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid password")
+	}
+
+	if err := s.setPassword(ctx, user.ID, req.NewPassword); err != nil {
+		return nil, err
+	}
+	if err := s.tokens.RevokeAllSessions(ctx, user.ID, tokenInfo.FamilyID, revokeReasonPasswordChange); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke sessions: %v", err)
+	}
+	return &pb.ChangePasswordResponse{}, nil
+}
+
+func (s *UserService) setPassword(ctx context.Context, userID int, password string) error {
+	hashedPassword, err := s.hasher.Hash(password)
+	if err != nil {
+		return status.Error(codes.Internal, "failed to hash password")
+	}
+	if err := s.repo.UpdatePassword(ctx, userID, hashedPassword); err != nil {
+		return status.Errorf(codes.Internal, "failed to update password: %v", err)
+	}
+	if err := s.actionTokens.ConsumeActionTokens(ctx, userID, actionPurposePasswordReset); err != nil {
+		log.Printf("failed to invalidate password reset links for user %d: %v", userID, err)
+	}
+	return nil
+}
+
+func (s *UserService) sendEmailVerification(ctx context.Context, user *User) error {
+	token, err := s.issueActionToken(ctx, user, auth.EmailVerificationToken, actionPurposeEmailVerification, auth.EmailVerificationTokenTTL)
+	if err != nil {
+		return err
+	}
+
+	link := s.publicURL + "/verify-email?token=" + url.QueryEscape(token)
+	return s.mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Confirm your email",
+		Body: fmt.Sprintf(
+			"Hello, %s!\n\nTo confirm your email open the link below. It is valid for %s.\n\n%s\n",
+			user.Login, auth.EmailVerificationTokenTTL, link,
+		),
+	})
+}
+
+// issueActionToken signs a one-time token for a link sent to the user's
+// current email and records it so it can be redeemed only once. The record
+// keeps the blind index of the email, not the address.
+func (s *UserService) issueActionToken(ctx context.Context, user *User, tokenType auth.TokenType, purpose string, ttl time.Duration) (string, error) {
+	emailIndex, err := s.pii.EmailIndex(user.Email)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	record := &ActionToken{
+		JTI:        uuid.NewString(),
+		UserID:     user.ID,
+		Purpose:    purpose,
+		EmailIndex: emailIndex,
+		ExpiresAt:  now.Add(ttl),
+		CreatedAt:  now,
+	}
+
+	token, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:    user.ID,
+		UserLogin: user.Login,
+		TokenType: tokenType,
+		TokenID:   record.JTI,
+	}, ttl)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+	if err := s.actionTokens.CreateActionToken(ctx, record); err != nil {
+		return "", fmt.Errorf("failed to store token: %w", err)
+	}
+	return token, nil
+}
+
+func (s *UserService) redeemActionToken(ctx context.Context, token string, tokenType auth.TokenType, purpose string) (*ActionToken, error) {
+	tokenInfo, err := s.authProvider.ValidateToken(token, tokenType)
+	if err != nil || tokenInfo.TokenID == "" {
+		return nil, status.Error(codes.InvalidArgument, "invalid or expired token")
+	}
+
+	record, err := s.actionTokens.UseActionToken(ctx, tokenInfo.TokenID, purpose)
+	if errors.Is(err, ErrActionTokenInvalid) {
+		return nil, status.Error(codes.InvalidArgument, "invalid or expired token")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to use token: %v", err)
+	}
+	if record.UserID != tokenInfo.UserID {
+		return nil, status.Error(codes.InvalidArgument, "invalid or expired token")
+	}
+	return record, nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrActionTokenInvalid = errors.New("action token is invalid, expired or already used")
+
+const (
+	actionPurposeEmailVerification = "email_verification"
+	actionPurposePasswordReset     = "password_reset"
+	actionPurposeAccountUnlock     = "account_unlock"
+	actionPurposeAccountRestore    = "account_restore"
+)
+
+type ActionTokenRepository interface {
+	CreateActionToken(ctx context.Context, token *ActionToken) error
+	UseActionToken(ctx context.Context, jti, purpose string) (*ActionToken, error)
+	ConsumeActionTokens(ctx context.Context, userID int, purpose string) error
+}
+
+type ActionTokenRepositorySpec struct {
+	db *sqlx.DB
+}
+
+// ActionToken is the server-side record of a signed one-time link token. The
+// signature proves the token was issued by us, the record makes it single use.
+type ActionToken struct {
+	JTI        string     `db:"jti"`
+	UserID     int        `db:"user_id"`
+	Purpose    string     `db:"purpose"`
+	EmailIndex []byte     `db:"email_index"`
+	ExpiresAt  time.Time  `db:"expires_at"`
+	UsedAt     *time.Time `db:"used_at"`
+	CreatedAt  time.Time  `db:"created_at"`
+}
+
+func NewActionTokenRepository(db *sqlx.DB) ActionTokenRepository {
+	return &ActionTokenRepositorySpec{db: db}
+}
+
+func (r *ActionTokenRepositorySpec) CreateActionToken(ctx context.Context, token *ActionToken) error {
+	_, err := r.db.ExecContext(ctx, `
+        INSERT INTO action_tokens (jti, user_id, purpose, email_index, expires_at, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6)
+    `, token.JTI, token.UserID, token.Purpose, token.EmailIndex, token.ExpiresAt, token.CreatedAt)
+	return err
+}
+
+func (r *ActionTokenRepositorySpec) UseActionToken(ctx context.Context, jti, purpose string) (*ActionToken, error) {
+	var token ActionToken
+	err := r.db.GetContext(ctx, &token, `
+        UPDATE action_tokens
+        SET used_at = $1
+        WHERE jti = $2 AND purpose = $3 AND used_at IS NULL AND expires_at > $1
+        RETURNING jti, user_id, purpose, email_index, expires_at, used_at, created_at
+    `, time.Now(), jti, purpose)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrActionTokenInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
+
+func (r *ActionTokenRepositorySpec) ConsumeActionTokens(ctx context.Context, userID int, purpose string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE action_tokens SET used_at = $1 WHERE user_id = $2 AND purpose = $3 AND used_at IS NULL",
+		time.Now(), userID, purpose,
+	)
+	return err
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/blob"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const avatarChunkSize = 64 << 10
+
+// avatarSizes are the square thumbnails made of every uploaded avatar.
+var avatarSizes = []struct {
+	Name   string
+	Pixels int
+}{
+	{"small", 64},
+	{"medium", 256},
+	{"large", 512},
+}
+
+// UploadAvatar receives an image in chunks and replaces the caller's avatar
+// with thumbnails of it. The original upload is not kept.
+func (s *UserService) UploadAvatar(stream pb.UserService_UploadAvatarServer) error {
+	ctx := stream.Context()
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if len(data)+len(req.Chunk) > s.avatarMaxBytes {
+			return status.Errorf(codes.InvalidArgument, "avatar must not be larger than %d bytes", s.avatarMaxBytes)
+		}
+		data = append(data, req.Chunk...)
+	}
+
+	thumbnails, err := makeThumbnails(data)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	avatarID := uuid.NewString()
+	for i, size := range avatarSizes {
+		_, err := s.blobs.Put(ctx, avatarBlobKey(tokenInfo.UserID, avatarID, size.Name), bytes.NewReader(thumbnails[i]))
+		if err != nil {
+			s.deleteAvatarBlobs(ctx, tokenInfo.UserID, avatarID)
+			return status.Errorf(codes.Internal, "failed to store avatar: %v", err)
+		}
+	}
+
+	previous, err := s.repo.SetAvatar(ctx, tokenInfo.UserID, &avatarID)
+	if err != nil {
+		s.deleteAvatarBlobs(ctx, tokenInfo.UserID, avatarID)
+		if errors.Is(err, ErrUserNotFound) {
+			return status.Errorf(codes.NotFound, "user not found")
+		}
+		return status.Errorf(codes.Internal, "failed to set avatar: %v", err)
+	}
+	if previous != nil {
+		s.deleteAvatarBlobs(ctx, tokenInfo.UserID, *previous)
+	}
+
+	return stream.SendAndClose(&pb.Avatar{Images: s.avatarImages(&User{ID: tokenInfo.UserID, AvatarID: &avatarID})})
+}
+
+func (s *UserService) DeleteAvatar(ctx context.Context, req *pb.DeleteAvatarRequest) (*pb.DeleteAvatarResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	previous, err := s.repo.SetAvatar(ctx, tokenInfo.UserID, nil)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete avatar: %v", err)
+	}
+	if previous == nil {
+		return nil, status.Error(codes.NotFound, "user has no avatar")
+	}
+	s.deleteAvatarBlobs(ctx, tokenInfo.UserID, *previous)
+	return &pb.DeleteAvatarResponse{}, nil
+}
+
+// DownloadAvatar serves only the current avatar of a user who is not
+// deleted, so its URL never changes content and can be cached for good.
+func (s *UserService) DownloadAvatar(req *pb.DownloadAvatarRequest, stream pb.UserService_DownloadAvatarServer) error {
+	ctx := stream.Context()
+	if !validAvatarSize(req.Size) {
+		return status.Error(codes.NotFound, "avatar not found")
+	}
+	user, err := s.repo.GetUserByID(ctx, int(req.UserId))
+	if err != nil || user.AvatarID == nil || *user.AvatarID != req.AvatarId {
+		return status.Error(codes.NotFound, "avatar not found")
+	}
+
+	r, err := s.blobs.Open(ctx, avatarBlobKey(user.ID, req.AvatarId, req.Size))
+	if errors.Is(err, blob.ErrNotFound) {
+		return status.Error(codes.NotFound, "avatar not found")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to open avatar: %v", err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to read avatar: %v", err)
+	}
+
+	chunk := &pb.AvatarChunk{ContentType: "image/jpeg", SizeBytes: int64(len(data))}
+	for len(data) > 0 {
+		n := min(len(data), avatarChunkSize)
+		chunk.Data = data[:n]
+		if err := stream.Send(chunk); err != nil {
+			return err
+		}
+		chunk.ContentType, chunk.SizeBytes = "", 0
+		data = data[n:]
+	}
+	return nil
+}
+
+// makeThumbnails returns the JPEG thumbnails of an image in the order of
+// avatarSizes.
+func makeThumbnails(data []byte) ([][]byte, error) {
+	contentType, err := detectImageType(data)
+	if err != nil {
+		return nil, err
+	}
+	img, err := decodeImage(data, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	thumbnails := make([][]byte, 0, len(avatarSizes))
+	for _, size := range avatarSizes {
+		thumbnail, err := encodeJPEG(squareThumbnail(img, size.Pixels))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode thumbnail: %w", err)
+		}
+		thumbnails = append(thumbnails, thumbnail)
+	}
+	return thumbnails, nil
+}
+
+func (s *UserService) avatarImages(user *User) []*pb.AvatarImage {
+	if user.AvatarID == nil {
+		return nil
+	}
+	images := make([]*pb.AvatarImage, 0, len(avatarSizes))
+	for _, size := range avatarSizes {
+		images = append(images, &pb.AvatarImage{
+			Size:   size.Name,
+			Pixels: int32(size.Pixels),
+			Url:    fmt.Sprintf("%s/api/v1/avatars/%d/%s/%s", s.publicURL, user.ID, *user.AvatarID, size.Name),
+		})
+	}
+	return images
+}
+
+// deleteUserAvatar erases the avatar of a user that is about to be purged.
+func (s *UserService) deleteUserAvatar(ctx context.Context, userID int) error {
+	avatarID, err := s.repo.GetAvatarID(ctx, userID)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil
+	}
+	if err != nil || avatarID == nil {
+		return err
+	}
+	for _, size := range avatarSizes {
+		if err := s.blobs.Delete(ctx, avatarBlobKey(userID, *avatarID, size.Name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteAvatarBlobs is best effort: a blob left behind is never served again.
+func (s *UserService) deleteAvatarBlobs(ctx context.Context, userID int, avatarID string) {
+	for _, size := range avatarSizes {
+		if err := s.blobs.Delete(ctx, avatarBlobKey(userID, avatarID, size.Name)); err != nil {
+			log.Printf("failed to delete avatar %s of user %d: %v", avatarID, userID, err)
+		}
+	}
+}
+
+func validAvatarSize(name string) bool {
+	for _, size := range avatarSizes {
+		if size.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func avatarBlobKey(userID int, avatarID, size string) string {
+	return fmt.Sprintf("avatars/%d/%s/%s.jpg", userID, avatarID, size)
+}
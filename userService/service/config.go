@@ -5,17 +5,52 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/Nicvod/SOA/userService/oidc"
+	"github.com/Nicvod/SOA/utils/auth"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
 )
 
 type Config struct {
-	DBConn         DBConnConfig
-	ServicePort    string
-	PrivateKeyFile string
-	PublicKeyFile  string
+	DBConn      DBConnConfig
+	ServicePort string
+	KeysDir     string
+	KeysReload  time.Duration
+	Argon2      auth.Argon2Params
+	TOTPIssuer  string
+	PublicURL   string
+	Mail        MailConfig
+
+	LoginLockout LockoutPolicy
+	IPLockout    LockoutPolicy
+
+	PostServiceEndpoint  string
+	DeletionGracePeriod  time.Duration
+	DeletionPollInterval time.Duration
+
+	BlobDir            string
+	ExportTTL          time.Duration
+	ExportLinkTTL      time.Duration
+	ExportPollInterval time.Duration
+	AvatarMaxBytes     int
+
+	MasterKeysFile       string
+	MasterKeysReload     time.Duration
+	DocumentKeysInterval time.Duration
+
+	OIDCProviders []oidc.ProviderConfig
+	PasskeyRPName string
+}
+
+type MailConfig struct {
+	From         string
+	SMTPAddr     string
+	SMTPUser     string
+	SMTPPassword string
+	OutboxDir    string
 }
 
 type DBConnConfig struct {
@@ -55,20 +90,48 @@ func NewDB(cfg *Config) (*sqlx.DB, error) {
 }
 
 func NewConfig() (*Config, error) {
-	var privateFile, publicFile, dbNameEnv, dbUserEnv, dbPasswordEnv, dbName, dbUser, dbPassword string
-	flag.StringVar(&privateFile, "private_key", "", "path to JWT private key `file`")
-	flag.StringVar(&publicFile, "public_key", "", "path to JWT public key `file`")
+	var keysDir, dbNameEnv, dbUserEnv, dbPasswordEnv, dbName, dbUser, dbPassword string
+	flag.StringVar(&keysDir, "keys_dir", "", "path to JWT signing key ring `dir`")
+	keysReload := flag.Duration("keys_reload", time.Minute, "how often to reload the signing key ring")
 	flag.StringVar(&dbNameEnv, "db_name_env", "", "database name env")
 	flag.StringVar(&dbUserEnv, "db_user_env", "", "database user env")
 	flag.StringVar(&dbPasswordEnv, "db_password_env", "", "database password env")
 	dbPort := flag.Int("db_port", 5432, "database port")
 	servicePort := flag.Int("service_port", 50051, "service port")
+	argon2Memory := flag.Uint("argon2_memory", uint(auth.DefaultArgon2Params.Memory), "argon2id memory cost in KiB")
+	argon2Iterations := flag.Uint("argon2_iterations", uint(auth.DefaultArgon2Params.Iterations), "argon2id time cost")
+	argon2Parallelism := flag.Uint("argon2_parallelism", uint(auth.DefaultArgon2Params.Parallelism), "argon2id parallelism")
+	totpIssuer := flag.String("totp_issuer", "SOA", "issuer shown in authenticator apps")
+	publicURL := flag.String("public_url", "http://localhost", "base URL used in links sent by email")
+	passkeyRPName := flag.String("passkey_rp_name", "SOA", "site name shown by passkey managers, the host of -public_url is the relying party id")
+	mailFrom := flag.String("mail_from", "no-reply@localhost", "sender address of outgoing mail")
+	smtpAddr := flag.String("smtp_addr", "", "SMTP server `host:port`, mail is written to the outbox when empty")
+	smtpUser := flag.String("smtp_user", "", "SMTP user")
+	smtpPasswordEnv := flag.String("smtp_password_env", "", "SMTP password env")
+	outboxDir := flag.String("mail_outbox_dir", "", "`dir` to write mail to instead of sending it, kept in memory when empty")
+	lockoutThreshold := flag.Int("lockout_threshold", 5, "failed logins for one account before it is locked")
+	ipLockoutThreshold := flag.Int("ip_lockout_threshold", 20, "failed logins from one IP before it is locked")
+	lockoutBaseDelay := flag.Duration("lockout_base_delay", time.Minute, "duration of the first lockout, doubled on each next one")
+	lockoutMaxDelay := flag.Duration("lockout_max_delay", time.Hour, "maximum lockout duration")
+	lockoutWindow := flag.Duration("lockout_window", 15*time.Minute, "failed logins older than this are forgotten")
+	postServiceEndpoint := flag.String("post_service_endpoint", "post_app:50051", "post service endpoint")
+	deletionGracePeriod := flag.Duration("deletion_grace_period", 30*24*time.Hour, "how long a deleted account can be restored before its data is purged")
+	deletionPollInterval := flag.Duration("deletion_poll_interval", time.Minute, "how often to look for due account deletion steps")
+	blobDir := flag.String("blob_dir", "blobs", "`dir` of the local blob store for data export archives and avatars")
+	exportTTL := flag.Duration("export_ttl", 7*24*time.Hour, "how long a data export archive is kept")
+	exportLinkTTL := flag.Duration("export_link_ttl", 15*time.Minute, "how long a data export download link is valid")
+	exportPollInterval := flag.Duration("export_poll_interval", time.Minute, "how often to look for pending data exports")
+	avatarMaxBytes := flag.Int("avatar_max_bytes", 5<<20, "maximum size of an uploaded avatar image")
+	masterKeysFile := flag.String("master_keys_file", "", "`path` to the master keys of encrypted personal data")
+	masterKeysReload := flag.Duration("master_keys_reload", time.Minute, "how often to reload the master keys")
+	documentKeysInterval := flag.Duration("document_keys_interval", 10*time.Minute, "how often to rewrap document keys with the active master key")
+	oidcProvidersFile := flag.String("oidc_providers_file", "", "`path` to the OpenID Connect providers, external login is off when empty")
 	flag.Parse()
-	if privateFile == "" {
-		return nil, fmt.Errorf("no private key file provided")
+	if keysDir == "" {
+		return nil, fmt.Errorf("no keys dir provided")
 	}
-	if publicFile == "" {
-		return nil, fmt.Errorf("no private key file provided")
+	if *masterKeysFile == "" {
+		return nil, fmt.Errorf("no master keys file provided")
 	}
 	if dbNameEnv == "" {
 		return nil, fmt.Errorf("no database name env provided")
@@ -79,6 +142,13 @@ func NewConfig() (*Config, error) {
 	if dbPasswordEnv == "" {
 		return nil, fmt.Errorf("no database password env provided")
 	}
+	var oidcProviders []oidc.ProviderConfig
+	if *oidcProvidersFile != "" {
+		var err error
+		if oidcProviders, err = oidc.LoadProviders(*oidcProvidersFile); err != nil {
+			return nil, fmt.Errorf("failed to load OpenID Connect providers: %v", err)
+		}
+	}
 	dbName = os.Getenv(dbNameEnv)
 	dbUser = os.Getenv(dbUserEnv)
 	dbPassword = os.Getenv(dbPasswordEnv)
@@ -93,8 +163,49 @@ func NewConfig() (*Config, error) {
 			DBPassword: dbPassword,
 			DBName:     dbName,
 		},
-		ServicePort:    fmt.Sprint(*servicePort),
-		PrivateKeyFile: privateFile,
-		PublicKeyFile:  publicFile,
+		ServicePort: fmt.Sprint(*servicePort),
+		KeysDir:     keysDir,
+		KeysReload:  *keysReload,
+		Argon2: auth.Argon2Params{
+			Memory:      uint32(*argon2Memory),
+			Iterations:  uint32(*argon2Iterations),
+			Parallelism: uint8(*argon2Parallelism),
+			SaltLength:  auth.DefaultArgon2Params.SaltLength,
+			KeyLength:   auth.DefaultArgon2Params.KeyLength,
+		},
+		TOTPIssuer: *totpIssuer,
+		PublicURL:  strings.TrimRight(*publicURL, "/"),
+		Mail: MailConfig{
+			From:         *mailFrom,
+			SMTPAddr:     *smtpAddr,
+			SMTPUser:     *smtpUser,
+			SMTPPassword: os.Getenv(*smtpPasswordEnv),
+			OutboxDir:    *outboxDir,
+		},
+		LoginLockout: LockoutPolicy{
+			Threshold: *lockoutThreshold,
+			BaseDelay: *lockoutBaseDelay,
+			MaxDelay:  *lockoutMaxDelay,
+			Window:    *lockoutWindow,
+		},
+		IPLockout: LockoutPolicy{
+			Threshold: *ipLockoutThreshold,
+			BaseDelay: *lockoutBaseDelay,
+			MaxDelay:  *lockoutMaxDelay,
+			Window:    *lockoutWindow,
+		},
+		PostServiceEndpoint:  *postServiceEndpoint,
+		DeletionGracePeriod:  *deletionGracePeriod,
+		DeletionPollInterval: *deletionPollInterval,
+		BlobDir:              *blobDir,
+		ExportTTL:            *exportTTL,
+		ExportLinkTTL:        *exportLinkTTL,
+		ExportPollInterval:   *exportPollInterval,
+		AvatarMaxBytes:       *avatarMaxBytes,
+		MasterKeysFile:       *masterKeysFile,
+		MasterKeysReload:     *masterKeysReload,
+		DocumentKeysInterval: *documentKeysInterval,
+		OIDCProviders:        oidcProviders,
+		PasskeyRPName:        *passkeyRPName,
 	}, nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+const defaultPageSize = 20
+
+// Cursor points at the last row of a page of a list ordered by (Time, ID)
+// descending. Clients only see its opaque encoding.
+type Cursor struct {
+	Time time.Time
+	ID   int
+}
+
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%d:%d", c.Time.UnixNano(), c.ID))
+}
+
+// DecodeCursor returns nil for the first page.
+func DecodeCursor(s string) (*Cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var nanos int64
+	var id int
+	if _, err := fmt.Sscanf(string(data), "%d:%d", &nanos, &id); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &Cursor{Time: time.Unix(0, nanos).UTC(), ID: id}, nil
+}
+
+// ScoreCursor is the Cursor of a list ordered by (Score, ID) descending.
+type ScoreCursor struct {
+	Score float64
+	ID    int
+}
+
+func (c ScoreCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString(fmt.Appendf(nil, "%s:%d", strconv.FormatFloat(c.Score, 'g', -1, 64), c.ID))
+}
+
+func DecodeScoreCursor(s string) (*ScoreCursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	score, id, ok := strings.Cut(string(data), ":")
+	if !ok {
+		return nil, ErrInvalidCursor
+	}
+	cursor := &ScoreCursor{}
+	if cursor.Score, err = strconv.ParseFloat(score, 64); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if cursor.ID, err = strconv.Atoi(id); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return cursor, nil
+}
+
+func pageSize(requested int32) int {
+	if requested <= 0 {
+		return defaultPageSize
+	}
+	return int(requested)
+}
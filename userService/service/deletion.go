@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"time"
+
+	post_proto "github.com/Nicvod/SOA/postService/post_proto"
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Steps of an account deletion, run in this order. Cancelling the deletion
+// replaces the pending ones with stepRestorePosts.
+const (
+	stepRevokeSessions = "revoke_sessions"
+	stepHidePosts      = "hide_posts"
+	stepPurgePosts     = "purge_posts"
+	stepPurgeUser      = "purge_user"
+	stepRestorePosts   = "restore_posts"
+)
+
+const (
+	// A claimed step is not picked again for deletionStepLease, which is
+	// longer than a step may take.
+	deletionStepLease   = time.Minute
+	deletionStepTimeout = 30 * time.Second
+	deletionBatchSize   = 50
+
+	deletionRetryBaseDelay = 30 * time.Second
+	deletionRetryMaxDelay  = time.Hour
+
+	systemTokenTTL = time.Minute
+	systemLogin    = "user_service"
+)
+
+// DeleteAccount asks for the password, and the second factor if it is
+// enabled, before scheduling the deletion of the caller's account.
+func (s *UserService) DeleteAccount(ctx context.Context, req *pb.DeleteAccountRequest) (*pb.DeleteAccountResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	ok, _, err := s.verifyPassword(user, req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check password: %v", err)
+	}
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid password")
+	}
+
+	totp, err := s.twoFactor.GetTOTP(ctx, user.ID)
+	if err != nil && !errors.Is(err, ErrTOTPNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to get two-factor settings: %v", err)
+	}
+	if err == nil && totp.Enabled() {
+		if req.Code == "" {
+			return nil, status.Error(codes.FailedPrecondition, "two-factor code is required")
+		}
+		if err := s.verifySecondFactor(ctx, user.ID, req.Code); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	deletion := &AccountDeletion{
+		ID:          uuid.NewString(),
+		UserID:      user.ID,
+		Status:      deletionStatusScheduled,
+		RequestedAt: now,
+		PurgeAfter:  now.Add(s.deletionGracePeriod),
+	}
+	steps := []DeletionStep{
+		{Name: stepRevokeSessions, NotBefore: now},
+		{Name: stepHidePosts, NotBefore: now},
+		{Name: stepPurgePosts, NotBefore: deletion.PurgeAfter},
+		{Name: stepPurgeUser, NotBefore: deletion.PurgeAfter},
+	}
+	for i := range steps {
+		steps[i].DeletionID = deletion.ID
+		steps[i].UserID = user.ID
+	}
+
+	err = s.deletions.ScheduleDeletion(ctx, deletion, steps)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to schedule deletion: %v", err)
+	}
+	kickWorker(s.deletionKick)
+	s.sendRestoreEmail(ctx, user, deletion.PurgeAfter)
+
+	return &pb.DeleteAccountResponse{PurgeAfter: timestamppb.New(deletion.PurgeAfter)}, nil
+}
+
+func (s *UserService) CancelAccountDeletion(ctx context.Context, req *pb.CancelAccountDeletionRequest) (*pb.CancelAccountDeletionResponse, error) {
+	token, err := s.redeemActionToken(ctx, req.Token, auth.AccountRestoreToken, actionPurposeAccountRestore)
+	if err != nil {
+		return nil, err
+	}
+
+	// Give a step that is still running the time to finish before its
+	// effect is undone.
+	now := time.Now()
+	restore := &DeletionStep{Name: stepRestorePosts, NotBefore: now.Add(deletionStepLease)}
+	err = s.deletions.CancelDeletion(ctx, token.UserID, now, restore)
+	if errors.Is(err, ErrDeletionNotFound) {
+		return nil, status.Error(codes.FailedPrecondition, "account is not scheduled for deletion")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to cancel deletion: %v", err)
+	}
+	return &pb.CancelAccountDeletionResponse{}, nil
+}
+
+func (s *UserService) GetAccountDeletion(ctx context.Context, req *pb.GetAccountDeletionRequest) (*pb.AccountDeletion, error) {
+	if _, err := auth.RequirePermission(ctx, auth.PermissionManageUsers); err != nil {
+		return nil, err
+	}
+
+	deletion, steps, err := s.deletions.GetLatestDeletion(ctx, int(req.UserId))
+	if errors.Is(err, ErrDeletionNotFound) {
+		return nil, status.Error(codes.NotFound, "account deletion not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get deletion: %v", err)
+	}
+
+	resp := &pb.AccountDeletion{
+		Id:          deletion.ID,
+		UserId:      int32(deletion.UserID),
+		Status:      deletion.Status,
+		RequestedAt: timestamppb.New(deletion.RequestedAt),
+		PurgeAfter:  timestamppb.New(deletion.PurgeAfter),
+	}
+	for _, step := range steps {
+		resp.Steps = append(resp.Steps, &pb.AccountDeletionStep{
+			Name:      step.Name,
+			Status:    step.Status,
+			Attempts:  int32(step.Attempts),
+			LastError: step.LastError,
+			NotBefore: timestamppb.New(step.NotBefore),
+			UpdatedAt: timestamppb.New(step.UpdatedAt),
+		})
+	}
+	return resp, nil
+}
+
+func (s *UserService) sendRestoreEmail(ctx context.Context, user *User, purgeAfter time.Time) {
+	token, err := s.issueActionToken(ctx, user, auth.AccountRestoreToken, actionPurposeAccountRestore, time.Until(purgeAfter))
+	if err != nil {
+		log.Printf("failed to issue restore token for user %d: %v", user.ID, err)
+		return
+	}
+
+	link := s.publicURL + "/restore-account?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Your account will be deleted",
+		Body: fmt.Sprintf(
+			"Hello, %s!\n\nYour account was deleted and your posts are hidden. All your data will be erased for good after %s.\n\nIf you change your mind, open the link below before then to restore the account:\n\n%s\n",
+			user.Login, purgeAfter.UTC().Format(time.RFC1123), link,
+		),
+	})
+	if err != nil {
+		log.Printf("failed to send restore email to user %d: %v", user.ID, err)
+	}
+}
+
+// RunDeletionWorker runs due deletion steps every interval, and right away
+// when a deletion is scheduled, until ctx is done.
+func (s *UserService) RunDeletionWorker(ctx context.Context, interval time.Duration) {
+	runWorker(ctx, interval, s.deletionKick, s.runDueDeletionSteps)
+}
+
+func (s *UserService) runDueDeletionSteps(ctx context.Context) {
+	for ctx.Err() == nil {
+		steps, err := s.deletions.ClaimDueSteps(ctx, time.Now(), deletionStepLease, deletionBatchSize)
+		if err != nil {
+			log.Printf("failed to claim deletion steps: %v", err)
+			return
+		}
+		if len(steps) == 0 {
+			return
+		}
+		for i := range steps {
+			s.runDeletionStep(ctx, &steps[i])
+		}
+	}
+}
+
+// runDeletionStep records the outcome of a step. A failed step is retried
+// with exponential backoff and blocks the next steps of its user.
+func (s *UserService) runDeletionStep(ctx context.Context, step *DeletionStep) {
+	stepCtx, cancel := context.WithTimeout(ctx, deletionStepTimeout)
+	err := s.deletionStep(stepCtx, step)
+	cancel()
+
+	if err == nil {
+		err = s.deletions.CompleteStep(ctx, step.ID)
+		if err != nil {
+			log.Printf("failed to complete deletion step %d: %v", step.ID, err)
+		}
+		return
+	}
+
+	log.Printf("deletion step %s of user %d failed (attempt %d): %v", step.Name, step.UserID, step.Attempts, err)
+	nextAttemptAt := time.Now().Add(backoff(step.Attempts, deletionRetryBaseDelay, deletionRetryMaxDelay))
+	if err := s.deletions.FailStep(ctx, step.ID, nextAttemptAt, err.Error()); err != nil {
+		log.Printf("failed to record deletion step %d failure: %v", step.ID, err)
+	}
+}
+
+func (s *UserService) deletionStep(ctx context.Context, step *DeletionStep) error {
+	userID := strconv.Itoa(step.UserID)
+	switch step.Name {
+	case stepRevokeSessions:
+		return s.tokens.RevokeAllSessions(ctx, step.UserID, "", revokeReasonAccountDeleted)
+	case stepHidePosts, stepRestorePosts:
+		ctx, err := s.postServiceContext(ctx, auth.PermissionManageUserPosts)
+		if err != nil {
+			return err
+		}
+		_, err = s.posts.SetUserPostsHidden(ctx, &post_proto.SetUserPostsHiddenRequest{
+			UserId: userID,
+			Hidden: step.Name == stepHidePosts,
+		})
+		return err
+	case stepPurgePosts:
+		ctx, err := s.postServiceContext(ctx, auth.PermissionManageUserPosts)
+		if err != nil {
+			return err
+		}
+		_, err = s.posts.DeleteUserPosts(ctx, &post_proto.DeleteUserPostsRequest{UserId: userID})
+		return err
+	case stepPurgeUser:
+		if err := s.deleteExportArchives(ctx, step.UserID); err != nil {
+			return err
+		}
+		if err := s.deleteUserAvatar(ctx, step.UserID); err != nil {
+			return err
+		}
+		return s.deletions.PurgeUser(ctx, step.DeletionID, step.UserID)
+	}
+	return fmt.Errorf("unknown deletion step %q", step.Name)
+}
+
+// postServiceContext authenticates a call to postService with a short-lived
+// token that has only the given permission.
+func (s *UserService) postServiceContext(ctx context.Context, permission string) (context.Context, error) {
+	token, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserLogin:   systemLogin,
+		TokenType:   auth.AccessToken,
+		Permissions: []string{permission},
+	}, systemTokenTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate token: %w", err)
+	}
+	return s.authProvider.GRPCContextWithToken(ctx, token), nil
+}
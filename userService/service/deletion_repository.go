@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrDeletionNotFound = errors.New("account deletion not found")
+
+const (
+	deletionStatusScheduled = "scheduled"
+	deletionStatusCancelled = "cancelled"
+	deletionStatusPurged    = "purged"
+
+	stepStatusPending   = "pending"
+	stepStatusDone      = "done"
+	stepStatusCancelled = "cancelled"
+)
+
+type AccountDeletion struct {
+	ID          string     `db:"id"`
+	UserID      int        `db:"user_id"`
+	Status      string     `db:"status"`
+	RequestedAt time.Time  `db:"requested_at"`
+	PurgeAfter  time.Time  `db:"purge_after"`
+	FinishedAt  *time.Time `db:"finished_at"`
+}
+
+// DeletionStep is one step of the workflow of an account deletion. Pending
+// steps of a user run one at a time in the order they were added.
+type DeletionStep struct {
+	ID            int64     `db:"id"`
+	DeletionID    string    `db:"deletion_id"`
+	UserID        int       `db:"user_id"`
+	Name          string    `db:"name"`
+	Status        string    `db:"status"`
+	Attempts      int       `db:"attempts"`
+	LastError     string    `db:"last_error"`
+	NotBefore     time.Time `db:"not_before"`
+	NextAttemptAt time.Time `db:"next_attempt_at"`
+	UpdatedAt     time.Time `db:"updated_at"`
+}
+
+type DeletionRepository interface {
+	ScheduleDeletion(ctx context.Context, deletion *AccountDeletion, steps []DeletionStep) error
+	CancelDeletion(ctx context.Context, userID int, now time.Time, restore *DeletionStep) error
+	GetLatestDeletion(ctx context.Context, userID int) (*AccountDeletion, []DeletionStep, error)
+	ClaimDueSteps(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]DeletionStep, error)
+	CompleteStep(ctx context.Context, id int64) error
+	FailStep(ctx context.Context, id int64, nextAttemptAt time.Time, stepErr string) error
+	PurgeUser(ctx context.Context, deletionID string, userID int) error
+}
+
+type DeletionRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewDeletionRepository(db *sqlx.DB) DeletionRepository {
+	return &DeletionRepositorySpec{db: db}
+}
+
+// ScheduleDeletion soft-deletes the user and records the deletion with its
+// steps. A user that is already deleted is not found.
+func (r *DeletionRepositorySpec) ScheduleDeletion(ctx context.Context, deletion *AccountDeletion, steps []DeletionStep) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE users SET deleted_at = $1, updated_at = $1 WHERE id = $2 AND deleted_at IS NULL",
+		deletion.RequestedAt, deletion.UserID,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	_, err = tx.NamedExecContext(ctx, `
+        INSERT INTO account_deletions (id, user_id, status, requested_at, purge_after)
+        VALUES (:id, :user_id, :status, :requested_at, :purge_after)
+    `, deletion)
+	if err != nil {
+		return err
+	}
+	for i := range steps {
+		if err := insertDeletionStep(ctx, tx, &steps[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// CancelDeletion restores a user whose grace period has not ended yet. The
+// pending steps are cancelled and restore is queued instead.
+func (r *DeletionRepositorySpec) CancelDeletion(ctx context.Context, userID int, now time.Time, restore *DeletionStep) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var deletionID string
+	err = tx.GetContext(ctx, &deletionID, `
+        UPDATE account_deletions SET status = $1, finished_at = $2
+        WHERE user_id = $3 AND status = $4 AND purge_after > $2
+        RETURNING id
+    `, deletionStatusCancelled, now, userID, deletionStatusScheduled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrDeletionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE users SET deleted_at = NULL, updated_at = $1 WHERE id = $2",
+		now, userID,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx,
+		"UPDATE account_deletion_steps SET status = $1, updated_at = $2 WHERE deletion_id = $3 AND status = $4",
+		stepStatusCancelled, now, deletionID, stepStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+
+	restore.DeletionID = deletionID
+	restore.UserID = userID
+	if err := insertDeletionStep(ctx, tx, restore); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *DeletionRepositorySpec) GetLatestDeletion(ctx context.Context, userID int) (*AccountDeletion, []DeletionStep, error) {
+	var deletion AccountDeletion
+	err := r.db.GetContext(ctx, &deletion,
+		"SELECT * FROM account_deletions WHERE user_id = $1 ORDER BY requested_at DESC LIMIT 1",
+		userID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil, ErrDeletionNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var steps []DeletionStep
+	err = r.db.SelectContext(ctx, &steps,
+		"SELECT * FROM account_deletion_steps WHERE deletion_id = $1 ORDER BY id",
+		deletion.ID,
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &deletion, steps, nil
+}
+
+// ClaimDueSteps picks the first pending step of each user if it is due and
+// leases it: until the lease ends the step is not picked again, so a worker
+// that died while running it only delays it.
+func (r *DeletionRepositorySpec) ClaimDueSteps(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]DeletionStep, error) {
+	var steps []DeletionStep
+	err := r.db.SelectContext(ctx, &steps, `
+        UPDATE account_deletion_steps s
+        SET attempts = s.attempts + 1, next_attempt_at = $2, updated_at = $1
+        FROM (
+            SELECT id FROM (
+                SELECT DISTINCT ON (user_id) id, not_before, next_attempt_at
+                FROM account_deletion_steps
+                WHERE status = $3
+                ORDER BY user_id, id
+            ) heads
+            WHERE not_before <= $1 AND next_attempt_at <= $1
+            LIMIT $4
+        ) due
+        WHERE s.id = due.id AND s.status = $3 AND s.next_attempt_at <= $1
+        RETURNING s.*
+    `, now, now.Add(lease), stepStatusPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+func (r *DeletionRepositorySpec) CompleteStep(ctx context.Context, id int64) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE account_deletion_steps SET status = $1, last_error = '', updated_at = $2 WHERE id = $3 AND status = $4",
+		stepStatusDone, time.Now(), id, stepStatusPending,
+	)
+	return err
+}
+
+func (r *DeletionRepositorySpec) FailStep(ctx context.Context, id int64, nextAttemptAt time.Time, stepErr string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE account_deletion_steps SET next_attempt_at = $1, last_error = $2, updated_at = $3 WHERE id = $4 AND status = $5",
+		nextAttemptAt, stepErr, time.Now(), id, stepStatusPending,
+	)
+	return err
+}
+
+// PurgeUser deletes the user for good, together with everything that
+// references it. The deletion and its steps are kept.
+func (r *DeletionRepositorySpec) PurgeUser(ctx context.Context, deletionID string, userID int) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE account_deletions SET status = $1, finished_at = $2 WHERE id = $3 AND status = $4",
+		deletionStatusPurged, time.Now(), deletionID, deletionStatusScheduled,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrDeletionNotFound
+	}
+
+	var purgedID int
+	err = tx.GetContext(ctx, &purgedID,
+		"DELETE FROM users WHERE id = $1 AND deleted_at IS NOT NULL RETURNING id",
+		userID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, "DELETE FROM login_throttles WHERE key = $1", userThrottleKey(userID))
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertDeletionStep(ctx context.Context, tx *sqlx.Tx, step *DeletionStep) error {
+	step.Status = stepStatusPending
+	step.NextAttemptAt = step.NotBefore
+	step.UpdatedAt = time.Now()
+	return tx.GetContext(ctx, &step.ID, `
+        INSERT INTO account_deletion_steps (deletion_id, user_id, name, status, not_before, next_attempt_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id
+    `, step.DeletionID, step.UserID, step.Name, step.Status, step.NotBefore, step.NextAttemptAt, step.UpdatedAt)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrDocumentNotFound = errors.New("document not found")
+
+const (
+	documentActionCreate = "create"
+	documentActionRead   = "read"
+	documentActionUpdate = "update"
+	documentActionDelete = "delete"
+)
+
+// PersonalDocument holds series and number encrypted, see sealDocument.
+type PersonalDocument struct {
+	ID          string    `db:"id"`
+	UserID      int       `db:"user_id"`
+	DocName     string    `db:"doc_name"`
+	Description string    `db:"description"`
+	Series      []byte    `db:"series"`
+	Number      []byte    `db:"number"`
+	DataKey     []byte    `db:"data_key"`
+	MasterKeyID string    `db:"master_key_id"`
+	CreatedAt   time.Time `db:"created_at"`
+	UpdatedAt   time.Time `db:"updated_at"`
+}
+
+type DocumentAccess struct {
+	ID         int       `db:"id"`
+	DocumentID string    `db:"document_id"`
+	OwnerID    int       `db:"owner_id"`
+	ActorID    int       `db:"actor_id"`
+	ActorLogin string    `db:"actor_login"`
+	Action     string    `db:"action"`
+	IP         string    `db:"ip"`
+	UserAgent  string    `db:"user_agent"`
+	AccessedAt time.Time `db:"accessed_at"`
+}
+
+// Changes of documents are logged in the same transaction, reads with
+// LogAccess before anything is returned.
+type DocumentRepository interface {
+	CreateDocument(ctx context.Context, doc *PersonalDocument, access *DocumentAccess) error
+	GetDocument(ctx context.Context, id string) (*PersonalDocument, error)
+	ListDocuments(ctx context.Context, userID int) ([]PersonalDocument, error)
+	UpdateDocument(ctx context.Context, doc *PersonalDocument, access *DocumentAccess) error
+	DeleteDocument(ctx context.Context, id string, userID int, access *DocumentAccess) error
+	LogAccess(ctx context.Context, accesses []DocumentAccess) error
+	ListAccessLog(ctx context.Context, ownerID int, documentID string, after *Cursor, limit int) ([]DocumentAccess, error)
+	ListStaleDocumentKeys(ctx context.Context, masterKeyID string, limit int) ([]PersonalDocument, error)
+	RewrapDocumentKey(ctx context.Context, id, oldMasterKeyID string, dataKey []byte, masterKeyID string) error
+}
+
+type DocumentRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewDocumentRepository(db *sqlx.DB) DocumentRepository {
+	return &DocumentRepositorySpec{db: db}
+}
+
+func (r *DocumentRepositorySpec) CreateDocument(ctx context.Context, doc *PersonalDocument, access *DocumentAccess) error {
+	return r.withAccess(ctx, access, func(tx *sqlx.Tx) error {
+		_, err := tx.NamedExecContext(ctx, `
+            INSERT INTO personal_documents (id, user_id, doc_name, description, series, number, data_key, master_key_id, created_at, updated_at)
+            VALUES (:id, :user_id, :doc_name, :description, :series, :number, :data_key, :master_key_id, :created_at, :updated_at)
+        `, doc)
+		return err
+	})
+}
+
+func (r *DocumentRepositorySpec) GetDocument(ctx context.Context, id string) (*PersonalDocument, error) {
+	var doc PersonalDocument
+	err := r.db.GetContext(ctx, &doc, "SELECT * FROM personal_documents WHERE id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDocumentNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func (r *DocumentRepositorySpec) ListDocuments(ctx context.Context, userID int) ([]PersonalDocument, error) {
+	var docs []PersonalDocument
+	err := r.db.SelectContext(ctx, &docs,
+		"SELECT * FROM personal_documents WHERE user_id = $1 ORDER BY created_at, id",
+		userID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// UpdateDocument replaces the fields of a document of doc.UserID and sets
+// doc.CreatedAt.
+func (r *DocumentRepositorySpec) UpdateDocument(ctx context.Context, doc *PersonalDocument, access *DocumentAccess) error {
+	return r.withAccess(ctx, access, func(tx *sqlx.Tx) error {
+		err := tx.GetContext(ctx, &doc.CreatedAt, `
+            UPDATE personal_documents
+            SET doc_name = $1, description = $2, series = $3, number = $4, data_key = $5, master_key_id = $6, updated_at = $7
+            WHERE id = $8 AND user_id = $9
+            RETURNING created_at
+        `, doc.DocName, doc.Description, doc.Series, doc.Number, doc.DataKey, doc.MasterKeyID, doc.UpdatedAt, doc.ID, doc.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrDocumentNotFound
+		}
+		return err
+	})
+}
+
+func (r *DocumentRepositorySpec) DeleteDocument(ctx context.Context, id string, userID int, access *DocumentAccess) error {
+	return r.withAccess(ctx, access, func(tx *sqlx.Tx) error {
+		result, err := tx.ExecContext(ctx, "DELETE FROM personal_documents WHERE id = $1 AND user_id = $2", id, userID)
+		if err != nil {
+			return err
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if rowsAffected == 0 {
+			return ErrDocumentNotFound
+		}
+		return nil
+	})
+}
+
+func (r *DocumentRepositorySpec) LogAccess(ctx context.Context, accesses []DocumentAccess) error {
+	if len(accesses) == 0 {
+		return nil
+	}
+	_, err := r.db.NamedExecContext(ctx, insertDocumentAccess, accesses)
+	return err
+}
+
+// ListAccessLog returns accesses to the documents of owner, newest first,
+// only to documentID unless it is empty.
+func (r *DocumentRepositorySpec) ListAccessLog(ctx context.Context, ownerID int, documentID string, after *Cursor, limit int) ([]DocumentAccess, error) {
+	query := "SELECT * FROM document_access_log WHERE owner_id = $1"
+	args := []any{ownerID}
+	if documentID != "" {
+		args = append(args, documentID)
+		query += fmt.Sprintf(" AND document_id = $%d", len(args))
+	}
+	if after != nil {
+		args = append(args, after.Time, after.ID)
+		query += fmt.Sprintf(" AND (accessed_at, id) < ($%d, $%d)", len(args)-1, len(args))
+	}
+	query += fmt.Sprintf(" ORDER BY accessed_at DESC, id DESC LIMIT %d", limit)
+
+	var accesses []DocumentAccess
+	if err := r.db.SelectContext(ctx, &accesses, query, args...); err != nil {
+		return nil, err
+	}
+	return accesses, nil
+}
+
+// ListStaleDocumentKeys returns documents whose data key is wrapped by
+// another master key than masterKeyID.
+func (r *DocumentRepositorySpec) ListStaleDocumentKeys(ctx context.Context, masterKeyID string, limit int) ([]PersonalDocument, error) {
+	var docs []PersonalDocument
+	err := r.db.SelectContext(ctx, &docs,
+		"SELECT * FROM personal_documents WHERE master_key_id <> $1 LIMIT $2",
+		masterKeyID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// RewrapDocumentKey leaves a document alone if it changed since its key was
+// read.
+func (r *DocumentRepositorySpec) RewrapDocumentKey(ctx context.Context, id, oldMasterKeyID string, dataKey []byte, masterKeyID string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE personal_documents SET data_key = $1, master_key_id = $2 WHERE id = $3 AND master_key_id = $4",
+		dataKey, masterKeyID, id, oldMasterKeyID,
+	)
+	return err
+}
+
+const insertDocumentAccess = `
+    INSERT INTO document_access_log (document_id, owner_id, actor_id, actor_login, action, ip, user_agent, accessed_at)
+    VALUES (:document_id, :owner_id, :actor_id, :actor_login, :action, :ip, :user_agent, :accessed_at)
+`
+
+func (r *DocumentRepositorySpec) withAccess(ctx context.Context, access *DocumentAccess, change func(tx *sqlx.Tx) error) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := change(tx); err != nil {
+		return err
+	}
+	if _, err := tx.NamedExecContext(ctx, insertDocumentAccess, access); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/secrets"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const documentRewrapBatchSize = 100
+
+func (s *UserService) CreateDocument(ctx context.Context, req *pb.CreateDocumentRequest) (*pb.Document, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	now := time.Now()
+	doc := &PersonalDocument{
+		ID:          uuid.NewString(),
+		UserID:      tokenInfo.UserID,
+		DocName:     req.DocName,
+		Description: req.Description,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := s.sealDocument(doc, req.Series, req.Number); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encrypt document: %v", err)
+	}
+
+	access := documentAccess(ctx, tokenInfo, doc, documentActionCreate)
+	if err := s.documents.CreateDocument(ctx, doc, &access); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create document: %v", err)
+	}
+	return documentProto(doc, req.Series, req.Number), nil
+}
+
+func (s *UserService) ListDocuments(ctx context.Context, req *pb.ListDocumentsRequest) (*pb.ListDocumentsResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	userID := int(req.UserId)
+	if userID == 0 {
+		userID = tokenInfo.UserID
+	}
+	if userID != tokenInfo.UserID && !tokenInfo.HasPermission(auth.PermissionReadDocuments) {
+		return nil, status.Errorf(codes.PermissionDenied, "missing permission %s", auth.PermissionReadDocuments)
+	}
+
+	docs, err := s.documents.ListDocuments(ctx, userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list documents: %v", err)
+	}
+	resp := &pb.ListDocumentsResponse{}
+	accesses := make([]DocumentAccess, 0, len(docs))
+	for i := range docs {
+		doc, err := s.openDocument(&docs[i])
+		if err != nil {
+			return nil, err
+		}
+		resp.Documents = append(resp.Documents, doc)
+		accesses = append(accesses, documentAccess(ctx, tokenInfo, &docs[i], documentActionRead))
+	}
+	if err := s.documents.LogAccess(ctx, accesses); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to log document access: %v", err)
+	}
+	return resp, nil
+}
+
+// GetDocument answers NotFound for documents of others unless the caller may
+// read them.
+func (s *UserService) GetDocument(ctx context.Context, req *pb.GetDocumentRequest) (*pb.Document, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	doc, err := s.documents.GetDocument(ctx, req.Id)
+	if err != nil && !errors.Is(err, ErrDocumentNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to get document: %v", err)
+	}
+	if err != nil || (doc.UserID != tokenInfo.UserID && !tokenInfo.HasPermission(auth.PermissionReadDocuments)) {
+		return nil, status.Error(codes.NotFound, "document not found")
+	}
+
+	resp, err := s.openDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	access := documentAccess(ctx, tokenInfo, doc, documentActionRead)
+	if err := s.documents.LogAccess(ctx, []DocumentAccess{access}); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to log document access: %v", err)
+	}
+	return resp, nil
+}
+
+// UpdateDocument encrypts the document again with a new data key.
+func (s *UserService) UpdateDocument(ctx context.Context, req *pb.UpdateDocumentRequest) (*pb.Document, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	doc := &PersonalDocument{
+		ID:          req.Id,
+		UserID:      tokenInfo.UserID,
+		DocName:     req.DocName,
+		Description: req.Description,
+		UpdatedAt:   time.Now(),
+	}
+	if err := s.sealDocument(doc, req.Series, req.Number); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to encrypt document: %v", err)
+	}
+
+	access := documentAccess(ctx, tokenInfo, doc, documentActionUpdate)
+	err = s.documents.UpdateDocument(ctx, doc, &access)
+	if errors.Is(err, ErrDocumentNotFound) {
+		return nil, status.Error(codes.NotFound, "document not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update document: %v", err)
+	}
+	return documentProto(doc, req.Series, req.Number), nil
+}
+
+func (s *UserService) DeleteDocument(ctx context.Context, req *pb.DeleteDocumentRequest) (*pb.DeleteDocumentResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	doc := &PersonalDocument{ID: req.Id, UserID: tokenInfo.UserID}
+	access := documentAccess(ctx, tokenInfo, doc, documentActionDelete)
+	err = s.documents.DeleteDocument(ctx, req.Id, tokenInfo.UserID, &access)
+	if errors.Is(err, ErrDocumentNotFound) {
+		return nil, status.Error(codes.NotFound, "document not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete document: %v", err)
+	}
+	return &pb.DeleteDocumentResponse{}, nil
+}
+
+func (s *UserService) ListDocumentAccessLog(ctx context.Context, req *pb.ListDocumentAccessLogRequest) (*pb.ListDocumentAccessLogResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor")
+	}
+
+	limit := pageSize(req.PageSize)
+	accesses, err := s.documents.ListAccessLog(ctx, tokenInfo.UserID, req.DocumentId, after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list document accesses: %v", err)
+	}
+
+	resp := &pb.ListDocumentAccessLogResponse{}
+	if len(accesses) > limit {
+		accesses = accesses[:limit]
+		last := accesses[limit-1]
+		resp.NextCursor = Cursor{Time: last.AccessedAt, ID: last.ID}.Encode()
+	}
+	for _, access := range accesses {
+		resp.Entries = append(resp.Entries, &pb.DocumentAccess{
+			Id:         int64(access.ID),
+			DocumentId: access.DocumentID,
+			ActorId:    int32(access.ActorID),
+			ActorLogin: access.ActorLogin,
+			Action:     access.Action,
+			Ip:         access.IP,
+			UserAgent:  access.UserAgent,
+			AccessedAt: timestamppb.New(access.AccessedAt),
+		})
+	}
+	return resp, nil
+}
+
+// RunDocumentKeyWorker wraps the data keys of documents with the active
+// master key every interval, so that retired master keys can be dropped
+// after a rotation.
+func (s *UserService) RunDocumentKeyWorker(ctx context.Context, interval time.Duration) {
+	runWorker(ctx, interval, nil, s.rewrapDocumentKeys)
+}
+
+func (s *UserService) rewrapDocumentKeys(ctx context.Context) {
+	active := s.masterKeys.ActiveKeyID()
+	rewrapped := 0
+	for ctx.Err() == nil {
+		docs, err := s.documents.ListStaleDocumentKeys(ctx, active, documentRewrapBatchSize)
+		if err != nil {
+			log.Printf("failed to list document keys: %v", err)
+			return
+		}
+		if len(docs) == 0 {
+			break
+		}
+		for _, doc := range docs {
+			dataKey, kid, err := s.masterKeys.Rewrap(doc.MasterKeyID, doc.DataKey, documentAAD(doc.ID, "data_key"))
+			if err != nil {
+				// Without the old master key the document cannot be read
+				// either, stop instead of retrying it forever.
+				log.Printf("failed to rewrap key of document %s: %v", doc.ID, err)
+				return
+			}
+			if kid != active {
+				// The keys were reloaded meanwhile, the next run picks up.
+				return
+			}
+			if err := s.documents.RewrapDocumentKey(ctx, doc.ID, doc.MasterKeyID, dataKey, kid); err != nil {
+				log.Printf("failed to store key of document %s: %v", doc.ID, err)
+				return
+			}
+			rewrapped++
+		}
+	}
+	if rewrapped > 0 {
+		log.Printf("rewrapped %d document keys with master key %s", rewrapped, active)
+	}
+}
+
+// sealDocument encrypts series and number with a new data key of doc.
+func (s *UserService) sealDocument(doc *PersonalDocument, series, number string) error {
+	dataKey, wrapped, kid, err := s.masterKeys.NewDataKey(documentAAD(doc.ID, "data_key"))
+	if err != nil {
+		return err
+	}
+	if doc.Series, err = secrets.Seal(dataKey, []byte(series), documentAAD(doc.ID, "series")); err != nil {
+		return err
+	}
+	if doc.Number, err = secrets.Seal(dataKey, []byte(number), documentAAD(doc.ID, "number")); err != nil {
+		return err
+	}
+	doc.DataKey, doc.MasterKeyID = wrapped, kid
+	return nil
+}
+
+func (s *UserService) openDocument(doc *PersonalDocument) (*pb.Document, error) {
+	dataKey, err := s.masterKeys.UnwrapDataKey(doc.MasterKeyID, doc.DataKey, documentAAD(doc.ID, "data_key"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decrypt document %s: %v", doc.ID, err)
+	}
+	series, err := secrets.Open(dataKey, doc.Series, documentAAD(doc.ID, "series"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decrypt document %s: %v", doc.ID, err)
+	}
+	number, err := secrets.Open(dataKey, doc.Number, documentAAD(doc.ID, "number"))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to decrypt document %s: %v", doc.ID, err)
+	}
+	return documentProto(doc, string(series), string(number)), nil
+}
+
+// documentAAD binds a ciphertext to its document and field, so that it
+// cannot be moved to another one.
+func documentAAD(id, field string) []byte {
+	return fmt.Appendf(nil, "personal_documents/%s/%s", id, field)
+}
+
+func documentAccess(ctx context.Context, tokenInfo *auth.TokenInfo, doc *PersonalDocument, action string) DocumentAccess {
+	client := auth.ClientInfoFromGRPCContext(ctx)
+	return DocumentAccess{
+		DocumentID: doc.ID,
+		OwnerID:    doc.UserID,
+		ActorID:    tokenInfo.UserID,
+		ActorLogin: tokenInfo.UserLogin,
+		Action:     action,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+		AccessedAt: time.Now(),
+	}
+}
+
+func documentProto(doc *PersonalDocument, series, number string) *pb.Document {
+	return &pb.Document{
+		Id:          doc.ID,
+		UserId:      int32(doc.UserID),
+		DocName:     doc.DocName,
+		Description: doc.Description,
+		Series:      series,
+		Number:      number,
+		CreatedAt:   timestamppb.New(doc.CreatedAt),
+		UpdatedAt:   timestamppb.New(doc.UpdatedAt),
+	}
+}
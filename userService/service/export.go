@@ -0,0 +1,413 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"time"
+
+	post_proto "github.com/Nicvod/SOA/postService/post_proto"
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/blob"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	exportFormatVersion = 1
+
+	exportLease       = 10 * time.Minute
+	exportTimeout     = 5 * time.Minute
+	exportBatchSize   = 10
+	exportMaxAttempts = 5
+
+	exportRetryBaseDelay = time.Minute
+	exportRetryMaxDelay  = time.Hour
+
+	exportChunkSize = 64 << 10
+)
+
+// exportManifest is written to manifest.json of every archive and lists the
+// other files with their checksums.
+type exportManifest struct {
+	FormatVersion int                  `json:"format_version"`
+	UserID        int                  `json:"user_id"`
+	GeneratedAt   time.Time            `json:"generated_at"`
+	Files         []exportManifestFile `json:"files"`
+}
+
+type exportManifestFile struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	SHA256  string `json:"sha256"`
+}
+
+type exportedPost struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	IsPrivate   bool      `json:"is_private"`
+	Tags        []string  `json:"tags"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// RequestDataExport queues an export of the caller's data. While one is
+// pending, the pending one is returned instead of starting another.
+func (s *UserService) RequestDataExport(ctx context.Context, req *pb.RequestDataExportRequest) (*pb.DataExport, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	now := time.Now()
+	export, err := s.exports.CreateExport(ctx, &DataExport{
+		ID:            uuid.NewString(),
+		UserID:        tokenInfo.UserID,
+		Status:        exportStatusPending,
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create export: %v", err)
+	}
+	kickWorker(s.exportKick)
+	return s.dataExportProto(export, tokenInfo)
+}
+
+func (s *UserService) GetDataExport(ctx context.Context, req *pb.GetDataExportRequest) (*pb.DataExport, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	export, err := s.exports.GetExport(ctx, req.Id, tokenInfo.UserID)
+	if errors.Is(err, ErrExportNotFound) {
+		return nil, status.Error(codes.NotFound, "data export not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get export: %v", err)
+	}
+	return s.dataExportProto(export, tokenInfo)
+}
+
+// DownloadDataExport streams the archive to whoever has a download token, so
+// that it can be fetched through a plain link.
+func (s *UserService) DownloadDataExport(req *pb.DownloadDataExportRequest, stream pb.UserService_DownloadDataExportServer) error {
+	ctx := stream.Context()
+	tokenInfo, err := s.authProvider.ValidateToken(req.Token, auth.ExportDownloadToken)
+	if err != nil || tokenInfo.TokenID == "" {
+		return status.Error(codes.InvalidArgument, "invalid or expired token")
+	}
+
+	export, err := s.exports.GetExport(ctx, tokenInfo.TokenID, tokenInfo.UserID)
+	if err != nil && !errors.Is(err, ErrExportNotFound) {
+		return status.Errorf(codes.Internal, "failed to get export: %v", err)
+	}
+	if err != nil || !exportAvailable(export, time.Now()) {
+		return status.Error(codes.NotFound, "data export is not available")
+	}
+	if _, err := s.repo.GetUserByID(ctx, export.UserID); err != nil {
+		return status.Error(codes.NotFound, "data export is not available")
+	}
+
+	archive, err := s.blobs.Open(ctx, export.BlobKey)
+	if errors.Is(err, blob.ErrNotFound) {
+		return status.Error(codes.NotFound, "data export is not available")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to open archive: %v", err)
+	}
+	defer archive.Close()
+
+	buf := make([]byte, exportChunkSize)
+	chunk := &pb.DataExportChunk{SizeBytes: export.SizeBytes}
+	for {
+		n, err := io.ReadFull(archive, buf)
+		if n > 0 {
+			chunk.Data = buf[:n]
+			if err := stream.Send(chunk); err != nil {
+				return err
+			}
+			chunk.SizeBytes = 0
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to read archive: %v", err)
+		}
+	}
+}
+
+func exportAvailable(export *DataExport, now time.Time) bool {
+	return export.Status == exportStatusReady && export.ExpiresAt != nil && export.ExpiresAt.After(now)
+}
+
+// dataExportProto adds a download token to an available export. The token
+// lives for the link TTL, but not longer than the archive.
+func (s *UserService) dataExportProto(export *DataExport, tokenInfo *auth.TokenInfo) (*pb.DataExport, error) {
+	resp := &pb.DataExport{
+		Id:        export.ID,
+		Status:    export.Status,
+		CreatedAt: timestamppb.New(export.CreatedAt),
+		SizeBytes: export.SizeBytes,
+	}
+	if export.FinishedAt != nil {
+		resp.FinishedAt = timestamppb.New(*export.FinishedAt)
+	}
+	if export.ExpiresAt != nil {
+		resp.ExpiresAt = timestamppb.New(*export.ExpiresAt)
+	}
+
+	now := time.Now()
+	if !exportAvailable(export, now) {
+		return resp, nil
+	}
+	ttl := min(s.exportLinkTTL, export.ExpiresAt.Sub(now))
+	token, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:    export.UserID,
+		UserLogin: tokenInfo.UserLogin,
+		TokenType: auth.ExportDownloadToken,
+		TokenID:   export.ID,
+	}, ttl)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	resp.DownloadToken = token
+	resp.DownloadExpiresAt = timestamppb.New(now.Add(ttl))
+	return resp, nil
+}
+
+// RunExportWorker builds pending exports and deletes expired archives every
+// interval, and right away when an export is requested, until ctx is done.
+func (s *UserService) RunExportWorker(ctx context.Context, interval time.Duration) {
+	runWorker(ctx, interval, s.exportKick, func(ctx context.Context) {
+		s.runDueExports(ctx)
+		s.expireExports(ctx)
+	})
+}
+
+func (s *UserService) runDueExports(ctx context.Context) {
+	for ctx.Err() == nil {
+		exports, err := s.exports.ClaimDueExports(ctx, time.Now(), exportLease, exportBatchSize)
+		if err != nil {
+			log.Printf("failed to claim data exports: %v", err)
+			return
+		}
+		if len(exports) == 0 {
+			return
+		}
+		for i := range exports {
+			s.runExport(ctx, &exports[i])
+		}
+	}
+}
+
+func (s *UserService) runExport(ctx context.Context, export *DataExport) {
+	exportCtx, cancel := context.WithTimeout(ctx, exportTimeout)
+	blobKey := fmt.Sprintf("exports/%d/%s.zip", export.UserID, export.ID)
+	size, err := s.buildExport(exportCtx, export, blobKey)
+	cancel()
+
+	if err == nil {
+		err = s.exports.CompleteExport(ctx, export.ID, blobKey, size, time.Now().Add(s.exportTTL))
+		if err != nil {
+			log.Printf("failed to complete data export %s: %v", export.ID, err)
+		}
+		return
+	}
+
+	log.Printf("data export %s of user %d failed (attempt %d): %v", export.ID, export.UserID, export.Attempts, err)
+	if err := s.blobs.Delete(ctx, blobKey); err != nil {
+		log.Printf("failed to delete archive %s: %v", blobKey, err)
+	}
+	final := export.Attempts >= exportMaxAttempts
+	nextAttemptAt := time.Now().Add(backoff(export.Attempts, exportRetryBaseDelay, exportRetryMaxDelay))
+	if err := s.exports.FailExport(ctx, export.ID, nextAttemptAt, err.Error(), final); err != nil {
+		log.Printf("failed to record data export %s failure: %v", export.ID, err)
+	}
+}
+
+// buildExport writes the archive of export to the blob store under blobKey
+// and returns its size.
+func (s *UserService) buildExport(ctx context.Context, export *DataExport, blobKey string) (int64, error) {
+	user, err := s.repo.GetUserByID(ctx, export.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get user: %w", err)
+	}
+	sessions, err := s.exports.ListSessionsForExport(ctx, export.UserID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(s.writeExportArchive(ctx, w, user, sessions))
+	}()
+	size, err := s.blobs.Put(ctx, blobKey, r)
+	r.Close()
+	return size, err
+}
+
+func (s *UserService) writeExportArchive(ctx context.Context, w io.Writer, user *User, sessions []ExportedSession) error {
+	manifest := &exportManifest{
+		FormatVersion: exportFormatVersion,
+		UserID:        user.ID,
+		GeneratedAt:   time.Now().UTC(),
+	}
+	zw := zip.NewWriter(w)
+
+	err := addExportFile(zw, manifest, "user.json", func(w io.Writer) (int, error) {
+		return 1, writeJSON(w, user)
+	})
+	if err != nil {
+		return err
+	}
+	err = addExportFile(zw, manifest, "sessions.json", func(w io.Writer) (int, error) {
+		return len(sessions), writeJSON(w, sessions)
+	})
+	if err != nil {
+		return err
+	}
+	err = addExportFile(zw, manifest, "posts.json", func(w io.Writer) (int, error) {
+		return s.writeExportedPosts(ctx, w, user.ID)
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: "manifest.json", Method: zip.Deflate, Modified: manifest.GeneratedAt})
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(f, manifest); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// addExportFile adds a file written by write to the archive and records it
+// in the manifest. write returns the number of records it wrote.
+func addExportFile(zw *zip.Writer, manifest *exportManifest, name string, write func(io.Writer) (int, error)) error {
+	f, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: manifest.GeneratedAt})
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	records, err := write(io.MultiWriter(f, hash))
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	manifest.Files = append(manifest.Files, exportManifestFile{
+		Name:    name,
+		Records: records,
+		SHA256:  hex.EncodeToString(hash.Sum(nil)),
+	})
+	return nil
+}
+
+// writeExportedPosts streams the user's posts from postService into a JSON
+// array without holding them all in memory.
+func (s *UserService) writeExportedPosts(ctx context.Context, w io.Writer, userID int) (int, error) {
+	ctx, err := s.postServiceContext(ctx, auth.PermissionExportUserPosts)
+	if err != nil {
+		return 0, err
+	}
+	stream, err := s.posts.ExportUserPosts(ctx, &post_proto.ExportUserPostsRequest{UserId: strconv.Itoa(userID)})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return 0, err
+	}
+	count := 0
+	for {
+		post, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if count > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return 0, err
+			}
+		}
+		data, err := json.Marshal(exportedPost{
+			ID:          post.Id,
+			Title:       post.Title,
+			Description: post.Description,
+			IsPrivate:   post.IsPrivate,
+			Tags:        post.Tags,
+			CreatedAt:   post.CreatedAt.AsTime(),
+			UpdatedAt:   post.UpdatedAt.AsTime(),
+		})
+		if err != nil {
+			return 0, err
+		}
+		if _, err := io.WriteString(w, "\n  "); err != nil {
+			return 0, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return 0, err
+		}
+		count++
+	}
+	if _, err := io.WriteString(w, "\n]\n"); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func writeJSON(w io.Writer, v any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func (s *UserService) expireExports(ctx context.Context) {
+	exports, err := s.exports.ListExpiredExports(ctx, time.Now(), exportBatchSize)
+	if err != nil {
+		log.Printf("failed to list expired data exports: %v", err)
+		return
+	}
+	for _, export := range exports {
+		if err := s.blobs.Delete(ctx, export.BlobKey); err != nil {
+			log.Printf("failed to delete archive %s: %v", export.BlobKey, err)
+			continue
+		}
+		if err := s.exports.MarkExportExpired(ctx, export.ID); err != nil {
+			log.Printf("failed to mark data export %s expired: %v", export.ID, err)
+		}
+	}
+}
+
+// deleteExportArchives removes the stored archives of a user before the user
+// is purged.
+func (s *UserService) deleteExportArchives(ctx context.Context, userID int) error {
+	keys, err := s.exports.ListExportBlobKeys(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrExportNotFound = errors.New("data export not found")
+
+const (
+	exportStatusPending = "pending"
+	exportStatusReady   = "ready"
+	exportStatusFailed  = "failed"
+	exportStatusExpired = "expired"
+)
+
+type DataExport struct {
+	ID            string     `db:"id"`
+	UserID        int        `db:"user_id"`
+	Status        string     `db:"status"`
+	BlobKey       string     `db:"blob_key"`
+	SizeBytes     int64      `db:"size_bytes"`
+	Attempts      int        `db:"attempts"`
+	LastError     string     `db:"last_error"`
+	CreatedAt     time.Time  `db:"created_at"`
+	NextAttemptAt time.Time  `db:"next_attempt_at"`
+	FinishedAt    *time.Time `db:"finished_at"`
+	ExpiresAt     *time.Time `db:"expires_at"`
+}
+
+// ExportedSession is a session as it appears in a data export, revoked ones
+// included.
+type ExportedSession struct {
+	ID              string     `json:"id" db:"family_id"`
+	Device          string     `json:"device" db:"device"`
+	UserAgent       string     `json:"user_agent" db:"user_agent"`
+	IP              string     `json:"ip" db:"ip"`
+	CreatedAt       time.Time  `json:"created_at" db:"created_at"`
+	LastRefreshedAt time.Time  `json:"last_refreshed_at" db:"last_refreshed_at"`
+	RevokedAt       *time.Time `json:"revoked_at" db:"revoked_at"`
+	RevokeReason    *string    `json:"revoke_reason" db:"revoke_reason"`
+}
+
+type ExportRepository interface {
+	CreateExport(ctx context.Context, export *DataExport) (*DataExport, error)
+	GetExport(ctx context.Context, id string, userID int) (*DataExport, error)
+	ClaimDueExports(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]DataExport, error)
+	CompleteExport(ctx context.Context, id, blobKey string, size int64, expiresAt time.Time) error
+	FailExport(ctx context.Context, id string, nextAttemptAt time.Time, exportErr string, final bool) error
+	ListExpiredExports(ctx context.Context, now time.Time, limit int) ([]DataExport, error)
+	MarkExportExpired(ctx context.Context, id string) error
+	ListExportBlobKeys(ctx context.Context, userID int) ([]string, error)
+	ListSessionsForExport(ctx context.Context, userID int) ([]ExportedSession, error)
+}
+
+type ExportRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewExportRepository(db *sqlx.DB) ExportRepository {
+	return &ExportRepositorySpec{db: db}
+}
+
+// CreateExport queues export unless the user already has a pending one, and
+// returns the pending export either way.
+func (r *ExportRepositorySpec) CreateExport(ctx context.Context, export *DataExport) (*DataExport, error) {
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO data_exports (id, user_id, status, created_at, next_attempt_at)
+        VALUES (:id, :user_id, :status, :created_at, :next_attempt_at)
+        ON CONFLICT (user_id) WHERE status = 'pending' DO NOTHING
+    `, export)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending DataExport
+	err = r.db.GetContext(ctx, &pending,
+		"SELECT * FROM data_exports WHERE user_id = $1 AND status = $2",
+		export.UserID, exportStatusPending,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &pending, nil
+}
+
+func (r *ExportRepositorySpec) GetExport(ctx context.Context, id string, userID int) (*DataExport, error) {
+	var export DataExport
+	err := r.db.GetContext(ctx, &export,
+		"SELECT * FROM data_exports WHERE id = $1 AND user_id = $2",
+		id, userID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrExportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+// ClaimDueExports leases pending exports the same way ClaimDueSteps leases
+// deletion steps.
+func (r *ExportRepositorySpec) ClaimDueExports(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]DataExport, error) {
+	var exports []DataExport
+	err := r.db.SelectContext(ctx, &exports, `
+        UPDATE data_exports e
+        SET attempts = e.attempts + 1, next_attempt_at = $2
+        FROM (
+            SELECT id FROM data_exports
+            WHERE status = $3 AND next_attempt_at <= $1
+            ORDER BY next_attempt_at
+            LIMIT $4
+            FOR UPDATE SKIP LOCKED
+        ) due
+        WHERE e.id = due.id
+        RETURNING e.*
+    `, now, now.Add(lease), exportStatusPending, limit)
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (r *ExportRepositorySpec) CompleteExport(ctx context.Context, id, blobKey string, size int64, expiresAt time.Time) error {
+	_, err := r.db.ExecContext(ctx, `
+        UPDATE data_exports
+        SET status = $1, blob_key = $2, size_bytes = $3, last_error = '', finished_at = $4, expires_at = $5
+        WHERE id = $6 AND status = $7
+    `, exportStatusReady, blobKey, size, time.Now(), expiresAt, id, exportStatusPending)
+	return err
+}
+
+// FailExport schedules another attempt, or gives up on the export if final.
+func (r *ExportRepositorySpec) FailExport(ctx context.Context, id string, nextAttemptAt time.Time, exportErr string, final bool) error {
+	var err error
+	if final {
+		_, err = r.db.ExecContext(ctx,
+			"UPDATE data_exports SET status = $1, last_error = $2, finished_at = $3 WHERE id = $4 AND status = $5",
+			exportStatusFailed, exportErr, time.Now(), id, exportStatusPending,
+		)
+	} else {
+		_, err = r.db.ExecContext(ctx,
+			"UPDATE data_exports SET next_attempt_at = $1, last_error = $2 WHERE id = $3 AND status = $4",
+			nextAttemptAt, exportErr, id, exportStatusPending,
+		)
+	}
+	return err
+}
+
+func (r *ExportRepositorySpec) ListExpiredExports(ctx context.Context, now time.Time, limit int) ([]DataExport, error) {
+	var exports []DataExport
+	err := r.db.SelectContext(ctx, &exports,
+		"SELECT * FROM data_exports WHERE status = $1 AND expires_at <= $2 ORDER BY expires_at LIMIT $3",
+		exportStatusReady, now, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return exports, nil
+}
+
+func (r *ExportRepositorySpec) MarkExportExpired(ctx context.Context, id string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE data_exports SET status = $1 WHERE id = $2 AND status = $3",
+		exportStatusExpired, id, exportStatusReady,
+	)
+	return err
+}
+
+// ListExportBlobKeys returns the archives of a user that are still stored.
+func (r *ExportRepositorySpec) ListExportBlobKeys(ctx context.Context, userID int) ([]string, error) {
+	var keys []string
+	err := r.db.SelectContext(ctx, &keys,
+		"SELECT blob_key FROM data_exports WHERE user_id = $1 AND status = $2",
+		userID, exportStatusReady,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (r *ExportRepositorySpec) ListSessionsForExport(ctx context.Context, userID int) ([]ExportedSession, error) {
+	sessions := []ExportedSession{}
+	err := r.db.SelectContext(ctx, &sessions, `
+        SELECT s.family_id, s.device, s.user_agent, s.ip, s.created_at, s.last_refreshed_at, f.revoked_at, f.revoke_reason
+        FROM sessions s
+        JOIN token_families f ON f.id = s.family_id
+        WHERE s.user_id = $1
+        ORDER BY s.created_at
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrFollowNotFound = errors.New("follow not found")
+
+const (
+	followStatusActive  = "active"
+	followStatusPending = "pending"
+)
+
+type FollowRepository interface {
+	Follow(ctx context.Context, followerID, followeeID int) (string, error)
+	Unfollow(ctx context.Context, followerID, followeeID int) error
+	GetFollowStatus(ctx context.Context, followerID, followeeID int) (string, error)
+	ListFollowers(ctx context.Context, followeeID int, status string, after *Cursor, limit int) ([]Follow, error)
+	ListFollowing(ctx context.Context, followerID int, after *Cursor, limit int) ([]Follow, error)
+	ApproveRequest(ctx context.Context, followeeID, followerID int) error
+	RejectRequest(ctx context.Context, followeeID, followerID int) error
+	CountFollows(ctx context.Context, userIDs []int) (map[int]FollowCounts, error)
+	FollowingAmong(ctx context.Context, followerID int, followeeIDs []int) (map[int]bool, error)
+}
+
+type FollowRepositorySpec struct {
+	db *sqlx.DB
+}
+
+type Follow struct {
+	FollowerID int        `db:"follower_id"`
+	FolloweeID int        `db:"followee_id"`
+	Status     string     `db:"status"`
+	CreatedAt  time.Time  `db:"created_at"`
+	AcceptedAt *time.Time `db:"accepted_at"`
+}
+
+// Since is the time a list of follows of this status is ordered by.
+func (f *Follow) Since() time.Time {
+	if f.AcceptedAt != nil {
+		return *f.AcceptedAt
+	}
+	return f.CreatedAt
+}
+
+// FollowCounts only counts active follows.
+type FollowCounts struct {
+	Followers int `db:"followers"`
+	Following int `db:"following"`
+}
+
+func NewFollowRepository(db *sqlx.DB) FollowRepository {
+	return &FollowRepositorySpec{db: db}
+}
+
+// Follow starts following followee, or asks to if the account is private,
+// and returns the resulting status. Following again keeps the existing status.
+func (r *FollowRepositorySpec) Follow(ctx context.Context, followerID, followeeID int) (string, error) {
+	var status string
+	err := r.db.QueryRowContext(ctx, `
+        INSERT INTO follows (follower_id, followee_id, status, created_at, accepted_at)
+        SELECT $1, id,
+            CASE WHEN is_private THEN $3 ELSE $4 END,
+            $5,
+            CASE WHEN is_private THEN NULL ELSE $5::timestamp END
+        FROM users WHERE id = $2 AND deleted_at IS NULL
+        ON CONFLICT (follower_id, followee_id) DO UPDATE SET status = follows.status
+        RETURNING status
+    `, followerID, followeeID, followStatusPending, followStatusActive, time.Now(),
+	).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+func (r *FollowRepositorySpec) Unfollow(ctx context.Context, followerID, followeeID int) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM follows WHERE follower_id = $1 AND followee_id = $2",
+		followerID, followeeID,
+	)
+	if err != nil {
+		return err
+	}
+	return followAffected(result)
+}
+
+// GetFollowStatus returns ErrFollowNotFound when follower neither follows
+// followee nor asked to.
+func (r *FollowRepositorySpec) GetFollowStatus(ctx context.Context, followerID, followeeID int) (string, error) {
+	var status string
+	err := r.db.GetContext(ctx, &status,
+		"SELECT status FROM follows WHERE follower_id = $1 AND followee_id = $2",
+		followerID, followeeID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFollowNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	return status, nil
+}
+
+// ListFollowers returns follows of followee with the given status, newest
+// first: active ones by approval time, pending ones by request time.
+func (r *FollowRepositorySpec) ListFollowers(ctx context.Context, followeeID int, status string, after *Cursor, limit int) ([]Follow, error) {
+	sortColumn := "accepted_at"
+	if status == followStatusPending {
+		sortColumn = "created_at"
+	}
+	return r.list(ctx, "followee_id", "follower_id", sortColumn, followeeID, status, after, limit)
+}
+
+func (r *FollowRepositorySpec) ListFollowing(ctx context.Context, followerID int, after *Cursor, limit int) ([]Follow, error) {
+	return r.list(ctx, "follower_id", "followee_id", "accepted_at", followerID, followStatusActive, after, limit)
+}
+
+func (r *FollowRepositorySpec) list(ctx context.Context, ownerColumn, otherColumn, sortColumn string, ownerID int, status string, after *Cursor, limit int) ([]Follow, error) {
+	query := fmt.Sprintf("SELECT * FROM follows WHERE %s = $1 AND status = $2", ownerColumn)
+	args := []any{ownerID, status}
+	if after != nil {
+		query += fmt.Sprintf(" AND (%s, %s) < ($3, $4)", sortColumn, otherColumn)
+		args = append(args, after.Time, after.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY %s DESC, %s DESC LIMIT %d", sortColumn, otherColumn, limit)
+
+	var follows []Follow
+	if err := r.db.SelectContext(ctx, &follows, query, args...); err != nil {
+		return nil, err
+	}
+	return follows, nil
+}
+
+func (r *FollowRepositorySpec) ApproveRequest(ctx context.Context, followeeID, followerID int) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE follows SET status = $1, accepted_at = $2 WHERE followee_id = $3 AND follower_id = $4 AND status = $5",
+		followStatusActive, time.Now(), followeeID, followerID, followStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+	return followAffected(result)
+}
+
+func (r *FollowRepositorySpec) RejectRequest(ctx context.Context, followeeID, followerID int) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM follows WHERE followee_id = $1 AND follower_id = $2 AND status = $3",
+		followeeID, followerID, followStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+	return followAffected(result)
+}
+
+// CountFollows returns counts for every one of userIDs, zero for users
+// without follows.
+func (r *FollowRepositorySpec) CountFollows(ctx context.Context, userIDs []int) (map[int]FollowCounts, error) {
+	counts := make(map[int]FollowCounts, len(userIDs))
+	if len(userIDs) == 0 {
+		return counts, nil
+	}
+
+	query, args, err := sqlx.In(`
+        SELECT u.id,
+            (SELECT COUNT(*) FROM follows f JOIN users o ON o.id = f.follower_id
+                WHERE f.followee_id = u.id AND f.status = ? AND o.deleted_at IS NULL) AS followers,
+            (SELECT COUNT(*) FROM follows f JOIN users o ON o.id = f.followee_id
+                WHERE f.follower_id = u.id AND f.status = ? AND o.deleted_at IS NULL) AS following
+        FROM users u WHERE u.id IN (?)
+    `, followStatusActive, followStatusActive, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var rows []struct {
+		ID int `db:"id"`
+		FollowCounts
+	}
+	if err := r.db.SelectContext(ctx, &rows, r.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		counts[row.ID] = row.FollowCounts
+	}
+	return counts, nil
+}
+
+// FollowingAmong tells which of followeeIDs follower actively follows.
+func (r *FollowRepositorySpec) FollowingAmong(ctx context.Context, followerID int, followeeIDs []int) (map[int]bool, error) {
+	following := make(map[int]bool)
+	if len(followeeIDs) == 0 {
+		return following, nil
+	}
+	query, args, err := sqlx.In(
+		"SELECT followee_id FROM follows WHERE follower_id = ? AND status = ? AND followee_id IN (?)",
+		followerID, followStatusActive, followeeIDs,
+	)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	if err := r.db.SelectContext(ctx, &ids, r.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		following[id] = true
+	}
+	return following, nil
+}
+
+func followAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrFollowNotFound
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var followStatuses = map[string]pb.FollowStatus{
+	followStatusActive:  pb.FollowStatus_FOLLOW_STATUS_ACTIVE,
+	followStatusPending: pb.FollowStatus_FOLLOW_STATUS_PENDING,
+}
+
+func (s *UserService) FollowUser(ctx context.Context, req *pb.FollowUserRequest) (*pb.FollowUserResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	if int(req.UserId) == tokenInfo.UserID {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot follow yourself")
+	}
+
+	blocked, err := s.relations.IsBlocked(ctx, tokenInfo.UserID, int(req.UserId))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check blocks: %v", err)
+	}
+	if blocked {
+		return nil, status.Errorf(codes.PermissionDenied, "cannot follow this user")
+	}
+
+	followStatus, err := s.follows.Follow(ctx, tokenInfo.UserID, int(req.UserId))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to follow: %v", err)
+	}
+	return &pb.FollowUserResponse{Status: followStatuses[followStatus]}, nil
+}
+
+func (s *UserService) UnfollowUser(ctx context.Context, req *pb.UnfollowUserRequest) (*pb.UnfollowUserResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	err = s.follows.Unfollow(ctx, tokenInfo.UserID, int(req.UserId))
+	if errors.Is(err, ErrFollowNotFound) {
+		return nil, status.Errorf(codes.NotFound, "not following this user")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unfollow: %v", err)
+	}
+	return &pb.UnfollowUserResponse{}, nil
+}
+
+func (s *UserService) ListFollowers(ctx context.Context, req *pb.ListFollowsRequest) (*pb.ListFollowsResponse, error) {
+	after, err := s.checkFollowsVisible(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := pageSize(req.PageSize)
+	follows, err := s.follows.ListFollowers(ctx, int(req.UserId), followStatusActive, after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list followers: %v", err)
+	}
+	return s.followsPage(ctx, follows, limit, func(f *Follow) int { return f.FollowerID })
+}
+
+func (s *UserService) ListFollowing(ctx context.Context, req *pb.ListFollowsRequest) (*pb.ListFollowsResponse, error) {
+	after, err := s.checkFollowsVisible(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := pageSize(req.PageSize)
+	follows, err := s.follows.ListFollowing(ctx, int(req.UserId), after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list following: %v", err)
+	}
+	return s.followsPage(ctx, follows, limit, func(f *Follow) int { return f.FolloweeID })
+}
+
+func (s *UserService) ListFollowRequests(ctx context.Context, req *pb.ListFollowRequestsRequest) (*pb.ListFollowsResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor")
+	}
+
+	limit := pageSize(req.PageSize)
+	follows, err := s.follows.ListFollowers(ctx, tokenInfo.UserID, followStatusPending, after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list follow requests: %v", err)
+	}
+	return s.followsPage(ctx, follows, limit, func(f *Follow) int { return f.FollowerID })
+}
+
+func (s *UserService) ApproveFollowRequest(ctx context.Context, req *pb.FollowRequestDecision) (*pb.FollowRequestDecisionResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	err = s.follows.ApproveRequest(ctx, tokenInfo.UserID, int(req.FollowerId))
+	if errors.Is(err, ErrFollowNotFound) {
+		return nil, status.Errorf(codes.NotFound, "follow request not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to approve follow request: %v", err)
+	}
+	return &pb.FollowRequestDecisionResponse{}, nil
+}
+
+func (s *UserService) RejectFollowRequest(ctx context.Context, req *pb.FollowRequestDecision) (*pb.FollowRequestDecisionResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	err = s.follows.RejectRequest(ctx, tokenInfo.UserID, int(req.FollowerId))
+	if errors.Is(err, ErrFollowNotFound) {
+		return nil, status.Errorf(codes.NotFound, "follow request not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to reject follow request: %v", err)
+	}
+	return &pb.FollowRequestDecisionResponse{}, nil
+}
+
+func (s *UserService) SetAccountPrivacy(ctx context.Context, req *pb.SetAccountPrivacyRequest) (*pb.SetAccountPrivacyResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	err = s.repo.SetPrivate(ctx, tokenInfo.UserID, req.IsPrivate)
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update privacy: %v", err)
+	}
+	return &pb.SetAccountPrivacyResponse{}, nil
+}
+
+// checkFollowsVisible allows the followers and following lists of a private
+// account only to its owner and approved followers, and decodes the cursor.
+func (s *UserService) checkFollowsVisible(ctx context.Context, req *pb.ListFollowsRequest) (*Cursor, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor")
+	}
+
+	owner, err := s.repo.GetUserByID(ctx, int(req.UserId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+	if !owner.IsPrivate || owner.ID == tokenInfo.UserID {
+		return after, nil
+	}
+
+	followStatus, err := s.follows.GetFollowStatus(ctx, tokenInfo.UserID, owner.ID)
+	if err != nil && !errors.Is(err, ErrFollowNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to check follow: %v", err)
+	}
+	if followStatus != followStatusActive {
+		return nil, status.Errorf(codes.PermissionDenied, "account is private")
+	}
+	return after, nil
+}
+
+// followsPage turns up to limit+1 follows into a page of profiles of the
+// users picked by other, with a cursor if there are more.
+func (s *UserService) followsPage(ctx context.Context, follows []Follow, limit int, other func(*Follow) int) (*pb.ListFollowsResponse, error) {
+	resp := &pb.ListFollowsResponse{}
+	if len(follows) > limit {
+		follows = follows[:limit]
+		last := &follows[limit-1]
+		resp.NextCursor = Cursor{Time: last.Since(), ID: other(last)}.Encode()
+	}
+
+	ids := make([]int, 0, len(follows))
+	for i := range follows {
+		ids = append(ids, other(&follows[i]))
+	}
+	profiles, err := s.publicProfiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	resp.Users = profiles
+	return resp, nil
+}
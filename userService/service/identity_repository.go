@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrIdentityNotFound = errors.New("identity not found")
+	ErrIdentityLinked   = errors.New("identity is already linked")
+	ErrOIDCStateInvalid = errors.New("login state is invalid, expired or already used")
+)
+
+type Identity struct {
+	Provider    string     `db:"provider"`
+	Subject     string     `db:"subject"`
+	UserID      int        `db:"user_id"`
+	LinkedAt    time.Time  `db:"linked_at"`
+	LastLoginAt *time.Time `db:"last_login_at"`
+}
+
+// OIDCState is a pending authorization request. Only the hash of the state
+// is stored, the state itself travels through the browser.
+type OIDCState struct {
+	StateHash    []byte    `db:"state_hash"`
+	Provider     string    `db:"provider"`
+	CodeVerifier string    `db:"code_verifier"`
+	Nonce        string    `db:"nonce"`
+	UserID       *int      `db:"user_id"`
+	Device       string    `db:"device"`
+	ExpiresAt    time.Time `db:"expires_at"`
+}
+
+type IdentityRepository interface {
+	GetIdentity(ctx context.Context, provider, subject string) (*Identity, error)
+	ListIdentities(ctx context.Context, userID int) ([]Identity, error)
+	LinkIdentity(ctx context.Context, identity *Identity) error
+	UnlinkIdentity(ctx context.Context, userID int, provider string) error
+	TouchIdentity(ctx context.Context, provider, subject string, at time.Time) error
+	CreateState(ctx context.Context, state *OIDCState) error
+	UseState(ctx context.Context, stateHash []byte) (*OIDCState, error)
+}
+
+type IdentityRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewIdentityRepository(db *sqlx.DB) IdentityRepository {
+	return &IdentityRepositorySpec{db: db}
+}
+
+func (r *IdentityRepositorySpec) GetIdentity(ctx context.Context, provider, subject string) (*Identity, error) {
+	var identity Identity
+	err := r.db.GetContext(ctx, &identity,
+		"SELECT * FROM user_identities WHERE provider = $1 AND subject = $2", provider, subject,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrIdentityNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &identity, nil
+}
+
+func (r *IdentityRepositorySpec) ListIdentities(ctx context.Context, userID int) ([]Identity, error) {
+	var identities []Identity
+	err := r.db.SelectContext(ctx, &identities,
+		"SELECT * FROM user_identities WHERE user_id = $1 ORDER BY linked_at", userID,
+	)
+	return identities, err
+}
+
+// LinkIdentity fails with ErrIdentityLinked when the identity belongs to an
+// account already or the user has another identity of the provider.
+func (r *IdentityRepositorySpec) LinkIdentity(ctx context.Context, identity *Identity) error {
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO user_identities (provider, subject, user_id, linked_at, last_login_at)
+        VALUES (:provider, :subject, :user_id, :linked_at, :last_login_at)
+    `, identity)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+		return ErrIdentityLinked
+	}
+	return err
+}
+
+func (r *IdentityRepositorySpec) UnlinkIdentity(ctx context.Context, userID int, provider string) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM user_identities WHERE user_id = $1 AND provider = $2", userID, provider,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
+
+func (r *IdentityRepositorySpec) TouchIdentity(ctx context.Context, provider, subject string, at time.Time) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE user_identities SET last_login_at = $1 WHERE provider = $2 AND subject = $3", at, provider, subject,
+	)
+	return err
+}
+
+// CreateState also drops the expired states, abandoned logins leave them
+// behind.
+func (r *IdentityRepositorySpec) CreateState(ctx context.Context, state *OIDCState) error {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM oidc_login_states WHERE expires_at < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO oidc_login_states (state_hash, provider, code_verifier, nonce, user_id, device, expires_at)
+        VALUES (:state_hash, :provider, :code_verifier, :nonce, :user_id, :device, :expires_at)
+    `, state)
+	return err
+}
+
+// UseState deletes the state, so that it is accepted once.
+func (r *IdentityRepositorySpec) UseState(ctx context.Context, stateHash []byte) (*OIDCState, error) {
+	var state OIDCState
+	err := r.db.GetContext(ctx, &state, `
+        DELETE FROM oidc_login_states WHERE state_hash = $1 AND expires_at > $2
+        RETURNING *
+    `, stateHash, time.Now())
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOIDCStateInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
@@ -1,15 +1,103 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 
+	post_proto "github.com/Nicvod/SOA/postService/post_proto"
+	"github.com/Nicvod/SOA/userService/pii"
 	pb "github.com/Nicvod/SOA/userService/user_proto"
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/blob"
+	"github.com/Nicvod/SOA/utils/secrets"
+	"github.com/Nicvod/SOA/utils/validation"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
 )
 
+var publicMethods = []string{
+	pb.UserService_RegisterUser_FullMethodName,
+	pb.UserService_AuthenticateUser_FullMethodName,
+	pb.UserService_RefreshToken_FullMethodName,
+	pb.UserService_CheckSession_FullMethodName,
+	pb.UserService_VerifyTwoFactor_FullMethodName,
+	pb.UserService_VerifyEmail_FullMethodName,
+	pb.UserService_RequestPasswordReset_FullMethodName,
+	pb.UserService_ResetPassword_FullMethodName,
+	pb.UserService_UnlockAccount_FullMethodName,
+	pb.UserService_CancelAccountDeletion_FullMethodName,
+	pb.UserService_DownloadDataExport_FullMethodName,
+	pb.UserService_DownloadAvatar_FullMethodName,
+	pb.UserService_ListOIDCProviders_FullMethodName,
+	pb.UserService_StartOIDCLogin_FullMethodName,
+	pb.UserService_CompleteOIDC_FullMethodName,
+	pb.UserService_ExchangeOAuthToken_FullMethodName,
+	pb.UserService_IntrospectOAuthToken_FullMethodName,
+	pb.UserService_RevokeOAuthToken_FullMethodName,
+	pb.UserService_StartPasskeyLogin_FullMethodName,
+	pb.UserService_FinishPasskeyLogin_FullMethodName,
+}
+
+// impersonationDeniedMethods could take over the account or expose secrets of
+// the user, or are admin actions that must be recorded under the real admin.
+var impersonationDeniedMethods = []string{
+	pb.UserService_UpdateProfile_FullMethodName,
+	pb.UserService_UpdateProfileVisibility_FullMethodName,
+	pb.UserService_SetAccountPrivacy_FullMethodName,
+	pb.UserService_UploadAvatar_FullMethodName,
+	pb.UserService_DeleteAvatar_FullMethodName,
+	pb.UserService_ChangePassword_FullMethodName,
+	pb.UserService_EnrollTOTP_FullMethodName,
+	pb.UserService_ConfirmTOTP_FullMethodName,
+	pb.UserService_DisableTOTP_FullMethodName,
+	pb.UserService_GenerateRecoveryCodes_FullMethodName,
+	pb.UserService_DeleteAccount_FullMethodName,
+	pb.UserService_ListSessions_FullMethodName,
+	pb.UserService_RevokeSession_FullMethodName,
+	pb.UserService_Logout_FullMethodName,
+	pb.UserService_RequestDataExport_FullMethodName,
+	pb.UserService_GetDataExport_FullMethodName,
+	pb.UserService_CreateDocument_FullMethodName,
+	pb.UserService_ListDocuments_FullMethodName,
+	pb.UserService_GetDocument_FullMethodName,
+	pb.UserService_UpdateDocument_FullMethodName,
+	pb.UserService_DeleteDocument_FullMethodName,
+	pb.UserService_ListDocumentAccessLog_FullMethodName,
+	pb.UserService_StartOIDCLink_FullMethodName,
+	pb.UserService_UnlinkIdentity_FullMethodName,
+	pb.UserService_RegisterOAuthClient_FullMethodName,
+	pb.UserService_DeleteOAuthClient_FullMethodName,
+	pb.UserService_GetOAuthConsent_FullMethodName,
+	pb.UserService_ApproveOAuthConsent_FullMethodName,
+	pb.UserService_StartPasskeyRegistration_FullMethodName,
+	pb.UserService_FinishPasskeyRegistration_FullMethodName,
+	pb.UserService_DeletePasskey_FullMethodName,
+	pb.UserService_CreateRole_FullMethodName,
+	pb.UserService_GrantRole_FullMethodName,
+	pb.UserService_RevokeRole_FullMethodName,
+	pb.UserService_UnlockUser_FullMethodName,
+	pb.UserService_SuspendUser_FullMethodName,
+	pb.UserService_BanUser_FullMethodName,
+	pb.UserService_LiftRestriction_FullMethodName,
+	pb.UserService_ImpersonateUser_FullMethodName,
+	pb.UserService_ListAuditLog_FullMethodName,
+}
+
+// delegatedMethods are the only ones third-party apps may call, the gateway
+// checks the scope of each route.
+var delegatedMethods = []string{
+	pb.UserService_GetProfile_FullMethodName,
+	pb.UserService_GetPublicProfile_FullMethodName,
+	pb.UserService_BatchGetUsers_FullMethodName,
+	pb.UserService_GetOAuthUserInfo_FullMethodName,
+	// post service forwards the caller's token to filter out blocked and
+	// muted authors, including when the caller is an app with posts:read.
+	pb.UserService_GetContentFilter_FullMethodName,
+}
+
 func main() {
 	cfg, err := NewConfig()
 	if err != nil {
@@ -21,14 +109,64 @@ func main() {
 	}
 	defer db.Close()
 
-	repo := NewUserRepository(db)
 	tokenManager, err := NewTokenManager(cfg)
 	if err != nil {
 		log.Fatalf("failed to create token manager: %v", err)
 	}
-	service := NewUserService(repo, tokenManager)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go auth.WatchKeyRing(ctx, tokenManager, cfg.KeysDir, true, cfg.KeysReload)
+
+	mailer, err := NewMailer(cfg)
+	if err != nil {
+		log.Fatalf("failed to create mailer: %v", err)
+	}
+
+	postConn, err := grpc.NewClient(cfg.PostServiceEndpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		log.Fatalf("failed to connect to post service: %v", err)
+	}
+	defer postConn.Close()
+
+	blobs, err := blob.NewFSStore(cfg.BlobDir)
+	if err != nil {
+		log.Fatalf("failed to create blob store: %v", err)
+	}
+
+	masterKeys, err := secrets.LoadMasterKeys(cfg.MasterKeysFile)
+	if err != nil {
+		log.Fatalf("failed to load master keys, create them with rotatemasterkey: %v", err)
+	}
+	go secrets.WatchMasterKeys(ctx, masterKeys, cfg.MasterKeysFile, cfg.MasterKeysReload)
+
+	hasher, err := auth.NewArgon2Hasher(cfg.Argon2)
+	if err != nil {
+		log.Fatalf("invalid argon2 parameters: %v", err)
+	}
+	service, err := NewUserService(NewRepositories(db, pii.NewCipher(masterKeys)), tokenManager, hasher, mailer, post_proto.NewPostServiceClient(postConn), blobs, masterKeys, cfg)
+	if err != nil {
+		log.Fatalf("failed to create user service: %v", err)
+	}
+	go service.RunDeletionWorker(ctx, cfg.DeletionPollInterval)
+	go service.RunExportWorker(ctx, cfg.ExportPollInterval)
+	go service.RunDocumentKeyWorker(ctx, cfg.DocumentKeysInterval)
 
-	grpcServer := grpc.NewServer()
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(
+			auth.UnaryServerInterceptor(tokenManager, publicMethods...),
+			auth.UnarySessionInterceptor(service.tokens),
+			auth.UnaryImpersonationInterceptor(impersonationDeniedMethods...),
+			auth.UnaryDelegationInterceptor(delegatedMethods...),
+			validation.UnaryServerInterceptor(),
+		),
+		grpc.ChainStreamInterceptor(
+			auth.StreamServerInterceptor(tokenManager, publicMethods...),
+			auth.StreamSessionInterceptor(service.tokens),
+			auth.StreamImpersonationInterceptor(impersonationDeniedMethods...),
+			auth.StreamDelegationInterceptor(delegatedMethods...),
+			validation.StreamServerInterceptor(),
+		),
+	)
 	pb.RegisterUserServiceServer(grpcServer, service)
 
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%s", cfg.ServicePort))
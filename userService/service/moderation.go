@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	restrictionNone      = "active"
+	restrictionSuspended = "suspended"
+	restrictionBanned    = "banned"
+)
+
+// restriction tells whether the user may sign in at now.
+func (u *User) restriction(now time.Time) string {
+	switch {
+	case u.BannedAt != nil:
+		return restrictionBanned
+	case u.SuspendedUntil != nil && now.Before(*u.SuspendedUntil):
+		return restrictionSuspended
+	}
+	return restrictionNone
+}
+
+// accountRestrictedError refuses to sign in a suspended or banned user,
+// telling why and, for a suspension, until when in the ErrorInfo details.
+func accountRestrictedError(user *User) error {
+	var st *status.Status
+	info := &errdetails.ErrorInfo{Domain: "users", Metadata: map[string]string{"reason": user.RestrictionReason}}
+	switch user.restriction(time.Now()) {
+	case restrictionBanned:
+		info.Reason = "ACCOUNT_BANNED"
+		st = status.Newf(codes.PermissionDenied, "account is banned: %s", user.RestrictionReason)
+	case restrictionSuspended:
+		until := user.SuspendedUntil.UTC().Format(time.RFC3339)
+		info.Reason = "ACCOUNT_SUSPENDED"
+		info.Metadata["suspended_until"] = until
+		st = status.Newf(codes.PermissionDenied, "account is suspended until %s: %s", until, user.RestrictionReason)
+	default:
+		return nil
+	}
+	if detailed, err := st.WithDetails(info); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+func restrictionToProto(user *User) *pb.AccountRestriction {
+	resp := &pb.AccountRestriction{
+		UserId: int32(user.ID),
+		Status: user.restriction(time.Now()),
+	}
+	if resp.Status != restrictionNone {
+		resp.Reason = user.RestrictionReason
+	}
+	if resp.Status == restrictionSuspended {
+		resp.SuspendedUntil = timestamppb.New(*user.SuspendedUntil)
+	}
+	return resp
+}
+
+func (s *UserService) SuspendUser(ctx context.Context, req *pb.SuspendUserRequest) (*pb.AccountRestriction, error) {
+	admin, user, err := s.restrictionTarget(ctx, int(req.UserId))
+	if err != nil {
+		return nil, err
+	}
+	if user.BannedAt != nil {
+		return nil, status.Error(codes.FailedPrecondition, "user is banned")
+	}
+
+	until := time.Now().Add(time.Duration(req.DurationSeconds) * time.Second)
+	user.SuspendedUntil, user.RestrictionReason = &until, req.Reason
+	audit := newAuditEntry(ctx, admin, auditActionSuspendUser, user.ID, req.Reason, AuditDetails{
+		"suspended_until": until.UTC().Format(time.RFC3339),
+	})
+	if err := s.restrict(ctx, user, revokeReasonSuspended, audit); err != nil {
+		return nil, err
+	}
+	return restrictionToProto(user), nil
+}
+
+// BanUser locks the user out until the ban is lifted, replacing a suspension.
+func (s *UserService) BanUser(ctx context.Context, req *pb.BanUserRequest) (*pb.AccountRestriction, error) {
+	admin, user, err := s.restrictionTarget(ctx, int(req.UserId))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	user.SuspendedUntil, user.BannedAt, user.RestrictionReason = nil, &now, req.Reason
+	audit := newAuditEntry(ctx, admin, auditActionBanUser, user.ID, req.Reason, nil)
+	if err := s.restrict(ctx, user, revokeReasonBanned, audit); err != nil {
+		return nil, err
+	}
+	return restrictionToProto(user), nil
+}
+
+func (s *UserService) LiftRestriction(ctx context.Context, req *pb.LiftRestrictionRequest) (*pb.AccountRestriction, error) {
+	admin, user, err := s.restrictionTarget(ctx, int(req.UserId))
+	if err != nil {
+		return nil, err
+	}
+	previous := user.restriction(time.Now())
+	if previous == restrictionNone {
+		return nil, status.Error(codes.FailedPrecondition, "user is neither suspended nor banned")
+	}
+
+	audit := newAuditEntry(ctx, admin, auditActionLiftRestriction, user.ID, req.Reason, AuditDetails{"previous": previous})
+	if err := s.repo.SetRestriction(ctx, user.ID, nil, nil, "", "", audit); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to lift restriction: %v", err)
+	}
+	user.SuspendedUntil, user.BannedAt, user.RestrictionReason = nil, nil, ""
+	return restrictionToProto(user), nil
+}
+
+// ImpersonateUser issues a short access token for support to act as a user.
+// It carries the admin in the act claim, has no refresh token and shows up in
+// the sessions of the user, who can revoke it. Users with permissions the
+// admin lacks cannot be impersonated.
+func (s *UserService) ImpersonateUser(ctx context.Context, req *pb.ImpersonateUserRequest) (*pb.ImpersonateUserResponse, error) {
+	admin, err := auth.RequirePermission(ctx, auth.PermissionImpersonate)
+	if err != nil {
+		return nil, err
+	}
+	if int(req.UserId) == admin.UserID {
+		return nil, status.Error(codes.FailedPrecondition, "cannot impersonate yourself")
+	}
+	user, err := s.repo.GetUserByID(ctx, int(req.UserId))
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+
+	roles, permissions, err := s.userGrants(ctx, user.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load roles: %v", err)
+	}
+	for _, permission := range permissions {
+		if !slices.Contains(admin.Permissions, permission) {
+			return nil, status.Errorf(codes.PermissionDenied, "user has permission %s you do not have", permission)
+		}
+	}
+
+	// The family is needed for the session checks, its refresh token is never
+	// handed out. It is stored with the audit entry, before the token exists.
+	record := newRefreshTokenRecord(uuid.NewString())
+	record.ExpiresAt = record.IssuedAt.Add(auth.ImpersonationTokenTTL)
+	client := auth.ClientInfoFromGRPCContext(ctx)
+	session := &Session{
+		FamilyID:        record.FamilyID,
+		UserID:          user.ID,
+		Device:          fmt.Sprintf("impersonation by %s", admin.UserLogin),
+		UserAgent:       client.UserAgent,
+		IP:              client.IP,
+		CreatedAt:       record.IssuedAt,
+		LastRefreshedAt: record.IssuedAt,
+	}
+	audit := newAuditEntry(ctx, admin, auditActionImpersonateUser, user.ID, req.Reason, AuditDetails{
+		"session_id": record.FamilyID,
+		"expires_at": record.ExpiresAt.UTC().Format(time.RFC3339),
+	})
+	if err := s.tokens.CreateFamily(ctx, session, record, audit); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store session: %v", err)
+	}
+
+	token, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:      user.ID,
+		UserLogin:   user.Login,
+		TokenType:   auth.AccessToken,
+		FamilyID:    record.FamilyID,
+		Roles:       roles,
+		Permissions: permissions,
+		Actor:       &auth.Actor{UserID: admin.UserID, UserLogin: admin.UserLogin},
+	}, auth.ImpersonationTokenTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	return &pb.ImpersonateUserResponse{
+		AccessToken: token,
+		ExpiresAt:   timestamppb.New(record.ExpiresAt),
+		SessionId:   record.FamilyID,
+	}, nil
+}
+
+func (s *UserService) ListAuditLog(ctx context.Context, req *pb.ListAuditLogRequest) (*pb.ListAuditLogResponse, error) {
+	if _, err := auth.RequirePermission(ctx, auth.PermissionManageUsers); err != nil {
+		return nil, err
+	}
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor")
+	}
+
+	limit := pageSize(req.PageSize)
+	filter := AuditFilter{ActorID: int(req.ActorId), TargetUserID: int(req.TargetUserId), Action: req.Action}
+	entries, err := s.audits.ListAuditLog(ctx, filter, after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list audit log: %v", err)
+	}
+
+	resp := &pb.ListAuditLogResponse{}
+	if len(entries) > limit {
+		entries = entries[:limit]
+		last := entries[limit-1]
+		resp.NextCursor = Cursor{Time: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	for _, entry := range entries {
+		item := &pb.AuditEntry{
+			Id:         int64(entry.ID),
+			ActorId:    int32(entry.ActorID),
+			ActorLogin: entry.ActorLogin,
+			Action:     entry.Action,
+			Reason:     entry.Reason,
+			Details:    entry.Details,
+			Ip:         entry.IP,
+			UserAgent:  entry.UserAgent,
+			CreatedAt:  timestamppb.New(entry.CreatedAt),
+		}
+		if entry.TargetUserID != nil {
+			item.TargetUserId = int32(*entry.TargetUserID)
+		}
+		resp.Entries = append(resp.Entries, item)
+	}
+	return resp, nil
+}
+
+// restrictionTarget checks that the caller may suspend and ban users and
+// returns them with the user to restrict.
+func (s *UserService) restrictionTarget(ctx context.Context, userID int) (*auth.TokenInfo, *User, error) {
+	admin, err := auth.RequirePermission(ctx, auth.PermissionManageUsers)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userID == admin.UserID {
+		return nil, nil, status.Error(codes.FailedPrecondition, "cannot restrict your own account")
+	}
+	user, err := s.repo.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, nil, status.Error(codes.NotFound, "user not found")
+	}
+	return admin, user, nil
+}
+
+// restrict stores the restriction of user, ends all of their sessions and
+// writes audit, all or nothing. Services check the session of every token, so
+// their tokens stop working at once.
+func (s *UserService) restrict(ctx context.Context, user *User, revokeReason string, audit *AuditEntry) error {
+	err := s.repo.SetRestriction(ctx, user.ID, user.SuspendedUntil, user.BannedAt, user.RestrictionReason, revokeReason, audit)
+	if errors.Is(err, ErrUserNotFound) {
+		return status.Error(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to restrict user: %v", err)
+	}
+	return nil
+}
+
+// newAuditEntry describes an admin action for the audit log. The repository
+// doing the action writes it in the same transaction, so a failed write
+// fails the action.
+func newAuditEntry(ctx context.Context, admin *auth.TokenInfo, action string, targetUserID int, reason string, details AuditDetails) *AuditEntry {
+	client := auth.ClientInfoFromGRPCContext(ctx)
+	entry := &AuditEntry{
+		ActorID:    admin.UserID,
+		ActorLogin: admin.UserLogin,
+		Action:     action,
+		Reason:     reason,
+		Details:    details,
+		IP:         client.IP,
+		UserAgent:  client.UserAgent,
+		CreatedAt:  time.Now(),
+	}
+	if targetUserID != 0 {
+		entry.TargetUserID = &targetUserID
+	}
+	return entry
+}
@@ -0,0 +1,554 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Nicvod/SOA/userService/oidc"
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	oauthCodeTTL    = 5 * time.Minute
+	maxOAuthClients = 20
+
+	revokeReasonApp = "revoked by app"
+)
+
+var oauthScopeDescriptions = map[string]string{
+	auth.ScopeOpenID:      "Sign you in with your account",
+	auth.ScopeProfileRead: "Read your profile, including your email and phone number",
+	auth.ScopePostsRead:   "Read posts you can see",
+	auth.ScopePostsWrite:  "Create, edit and delete your posts",
+}
+
+// oauthError fails a token endpoint call, reason is the RFC 6749 error code
+// the gateway answers with.
+func oauthError(code codes.Code, reason, format string, args ...any) error {
+	st := status.Newf(code, format, args...)
+	if detailed, err := st.WithDetails(&errdetails.ErrorInfo{Domain: "oauth", Reason: reason}); err == nil {
+		st = detailed
+	}
+	return st.Err()
+}
+
+func (s *UserService) RegisterOAuthClient(ctx context.Context, req *pb.RegisterOAuthClientRequest) (*pb.RegisterOAuthClientResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	count, err := s.oauth.CountClients(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count apps: %v", err)
+	}
+	if count >= maxOAuthClients {
+		return nil, status.Errorf(codes.FailedPrecondition, "at most %d apps can be registered", maxOAuthClients)
+	}
+
+	client := &OAuthClient{
+		ID:           uuid.NewString(),
+		OwnerID:      tokenInfo.UserID,
+		Name:         req.Name,
+		RedirectURIs: uniqueStrings(req.RedirectUris),
+		Scopes:       uniqueStrings(req.Scopes),
+		CreatedAt:    time.Now(),
+	}
+	var secret string
+	if !req.Public {
+		if secret, err = oidc.RandomString(); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to generate secret: %v", err)
+		}
+		client.SecretHash = hashOAuthSecret(secret)
+	}
+	if err := s.oauth.CreateClient(ctx, client); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to register app: %v", err)
+	}
+	return &pb.RegisterOAuthClientResponse{Client: oauthClientToProto(client), ClientSecret: secret}, nil
+}
+
+func (s *UserService) ListOAuthClients(ctx context.Context, req *pb.ListOAuthClientsRequest) (*pb.ListOAuthClientsResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	clients, err := s.oauth.ListClients(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list apps: %v", err)
+	}
+
+	resp := &pb.ListOAuthClientsResponse{}
+	for i := range clients {
+		resp.Clients = append(resp.Clients, oauthClientToProto(&clients[i]))
+	}
+	return resp, nil
+}
+
+// DeleteOAuthClient also ends every session the app holds.
+func (s *UserService) DeleteOAuthClient(ctx context.Context, req *pb.DeleteOAuthClientRequest) (*pb.DeleteOAuthClientResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	err = s.oauth.DeleteClient(ctx, tokenInfo.UserID, req.ClientId)
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, status.Error(codes.NotFound, "app not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete app: %v", err)
+	}
+	return &pb.DeleteOAuthClientResponse{}, nil
+}
+
+// GetOAuthConsent tells the consent screen which app asks for what.
+func (s *UserService) GetOAuthConsent(ctx context.Context, req *pb.OAuthAuthorizationRequest) (*pb.OAuthConsent, error) {
+	if _, err := auth.TokenInfoFromContext(ctx); err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	client, err := s.authorizationClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	scopes, errorRedirect := checkAuthorization(client, req)
+	if errorRedirect != "" {
+		return &pb.OAuthConsent{ErrorRedirectUri: errorRedirect}, nil
+	}
+
+	resp := &pb.OAuthConsent{ClientId: client.ID, ClientName: client.Name, RedirectUri: req.RedirectUri}
+	for _, scope := range scopes {
+		resp.Scopes = append(resp.Scopes, &pb.OAuthScope{Name: scope, Description: oauthScopeDescriptions[scope]})
+	}
+	return resp, nil
+}
+
+// ApproveOAuthConsent issues the authorization code when the user allowed the
+// app, and answers where to send the browser either way.
+func (s *UserService) ApproveOAuthConsent(ctx context.Context, req *pb.ApproveOAuthConsentRequest) (*pb.ApproveOAuthConsentResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	authorization := req.Authorization
+	client, err := s.authorizationClient(ctx, authorization)
+	if err != nil {
+		return nil, err
+	}
+	scopes, errorRedirect := checkAuthorization(client, authorization)
+	if errorRedirect != "" {
+		return &pb.ApproveOAuthConsentResponse{RedirectUri: errorRedirect}, nil
+	}
+	if !req.Approve {
+		return &pb.ApproveOAuthConsentResponse{
+			RedirectUri: authorizationErrorRedirect(authorization, "access_denied", "the user declined"),
+		}, nil
+	}
+
+	code, err := oidc.RandomString()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate code: %v", err)
+	}
+	err = s.oauth.CreateCode(ctx, &OAuthCode{
+		CodeHash:      hashOAuthSecret(code),
+		ClientID:      client.ID,
+		UserID:        tokenInfo.UserID,
+		RedirectURI:   authorization.RedirectUri,
+		Scopes:        scopes,
+		CodeChallenge: authorization.CodeChallenge,
+		Nonce:         authorization.Nonce,
+		ExpiresAt:     time.Now().Add(oauthCodeTTL),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store code: %v", err)
+	}
+
+	params := url.Values{"code": {code}}
+	if authorization.State != "" {
+		params.Set("state", authorization.State)
+	}
+	return &pb.ApproveOAuthConsentResponse{RedirectUri: withQuery(authorization.RedirectUri, params)}, nil
+}
+
+func (s *UserService) ExchangeOAuthToken(ctx context.Context, req *pb.ExchangeOAuthTokenRequest) (*pb.OAuthTokenResponse, error) {
+	client, err := s.authenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	switch req.GrantType {
+	case "authorization_code":
+		return s.exchangeCode(ctx, client, req)
+	case "refresh_token":
+		return s.refreshOAuthToken(ctx, client, req)
+	}
+	return nil, oauthError(codes.InvalidArgument, "unsupported_grant_type", "grant type %q is not supported", req.GrantType)
+}
+
+func (s *UserService) exchangeCode(ctx context.Context, client *OAuthClient, req *pb.ExchangeOAuthTokenRequest) (*pb.OAuthTokenResponse, error) {
+	code, err := s.oauth.UseCode(ctx, hashOAuthSecret(req.Code))
+	if errors.Is(err, ErrOAuthCodeInvalid) {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "%v", err)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to use code: %v", err)
+	}
+	if code.ClientID != client.ID || code.RedirectURI != req.RedirectUri {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "code was issued to another client or redirect_uri")
+	}
+	if !verifyCodeChallenge(code.CodeChallenge, req.CodeVerifier) {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "code_verifier does not match the code_challenge")
+	}
+
+	user, err := s.repo.GetUserByID(ctx, code.UserID)
+	if err != nil {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "user not found")
+	}
+	if user.restriction(time.Now()) != restrictionNone {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "account is suspended or banned")
+	}
+
+	pair, err := s.startAppSession(ctx, client, user, code.Scopes)
+	if err != nil {
+		return nil, err
+	}
+	resp := oauthTokenResponse(pair, code.Scopes)
+	if slices.Contains(code.Scopes, auth.ScopeOpenID) {
+		if resp.IdToken, err = s.idToken(client, user, code.Scopes, code.Nonce); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to generate ID token: %v", err)
+		}
+	}
+	return resp, nil
+}
+
+// refreshOAuthToken rotates the refresh token of an app like RefreshToken
+// does for first-party sessions, optionally narrowing the scopes.
+func (s *UserService) refreshOAuthToken(ctx context.Context, client *OAuthClient, req *pb.ExchangeOAuthTokenRequest) (*pb.OAuthTokenResponse, error) {
+	refresh, err := s.authProvider.ValidateToken(req.RefreshToken, auth.RefreshToken)
+	if err != nil || refresh.ClientID != client.ID {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "invalid refresh token")
+	}
+	if req.Scope != "" {
+		scopes := uniqueStrings(strings.Fields(req.Scope))
+		for _, scope := range scopes {
+			if !refresh.HasScope(scope) {
+				return nil, oauthError(codes.InvalidArgument, "invalid_scope", "scope %q was not granted", scope)
+			}
+		}
+		refresh.Scopes = scopes
+	}
+
+	pair, err := s.rotateSession(ctx, refresh)
+	if status.Code(err) == codes.Unauthenticated {
+		return nil, oauthError(codes.InvalidArgument, "invalid_grant", "%s", status.Convert(err).Message())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return oauthTokenResponse(pair, refresh.Scopes), nil
+}
+
+// IntrospectOAuthToken tells an app whether a token it holds is still good.
+// Tokens of other apps are reported inactive.
+func (s *UserService) IntrospectOAuthToken(ctx context.Context, req *pb.IntrospectOAuthTokenRequest) (*pb.IntrospectOAuthTokenResponse, error) {
+	client, err := s.authenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	info, tokenType := s.appToken(req.Token)
+	if info == nil || info.ClientID != client.ID {
+		return &pb.IntrospectOAuthTokenResponse{}, nil
+	}
+	active, err := s.tokens.IsSessionActive(ctx, info.FamilyID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check session: %v", err)
+	}
+	if !active {
+		return &pb.IntrospectOAuthTokenResponse{}, nil
+	}
+
+	return &pb.IntrospectOAuthTokenResponse{
+		Active:    true,
+		Scope:     strings.Join(info.Scopes, " "),
+		ClientId:  info.ClientID,
+		Username:  info.UserLogin,
+		UserId:    int32(info.UserID),
+		TokenType: tokenType,
+		IssuedAt:  timestamppb.New(info.IssuedAt),
+		ExpiresAt: timestamppb.New(info.ExpiresAt),
+	}, nil
+}
+
+// RevokeOAuthToken ends the session of the token. Like RFC 7009 asks, unknown
+// tokens and tokens of other apps are ignored.
+func (s *UserService) RevokeOAuthToken(ctx context.Context, req *pb.RevokeOAuthTokenRequest) (*pb.RevokeOAuthTokenResponse, error) {
+	client, err := s.authenticateClient(ctx, req.ClientId, req.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+	info, _ := s.appToken(req.Token)
+	if info == nil || info.ClientID != client.ID {
+		return &pb.RevokeOAuthTokenResponse{}, nil
+	}
+	err = s.tokens.RevokeSession(ctx, info.UserID, info.FamilyID, revokeReasonApp)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+	return &pb.RevokeOAuthTokenResponse{}, nil
+}
+
+func (s *UserService) GetOAuthUserInfo(ctx context.Context, req *pb.GetOAuthUserInfoRequest) (*pb.OAuthUserInfo, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	if tokenInfo.Delegated() && !tokenInfo.HasScope(auth.ScopeOpenID) {
+		return nil, status.Errorf(codes.PermissionDenied, "missing scope %s", auth.ScopeOpenID)
+	}
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "user not found")
+	}
+
+	resp := &pb.OAuthUserInfo{UserId: int32(user.ID)}
+	if !tokenInfo.Delegated() || tokenInfo.HasScope(auth.ScopeProfileRead) {
+		resp.PreferredUsername = user.Login
+		resp.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		resp.Email = user.Email
+		resp.EmailVerified = user.EmailVerifiedAt != nil
+	}
+	return resp, nil
+}
+
+// authorizationClient checks the client and redirect URI of an authorization
+// request. Its errors are shown to the user, as the redirect URI cannot be
+// trusted yet.
+func (s *UserService) authorizationClient(ctx context.Context, req *pb.OAuthAuthorizationRequest) (*OAuthClient, error) {
+	client, err := s.oauth.GetClient(ctx, req.ClientId)
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, status.Error(codes.InvalidArgument, "unknown client_id")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get app: %v", err)
+	}
+	if !slices.Contains(client.RedirectURIs, req.RedirectUri) {
+		return nil, status.Error(codes.InvalidArgument, "redirect_uri is not registered for the app")
+	}
+	return client, nil
+}
+
+// checkAuthorization returns the requested scopes, or the redirect that
+// reports what is wrong with the request to the app.
+func checkAuthorization(client *OAuthClient, req *pb.OAuthAuthorizationRequest) ([]string, string) {
+	if req.ResponseType != "code" {
+		return nil, authorizationErrorRedirect(req, "unsupported_response_type", "only the code response type is supported")
+	}
+	if req.CodeChallengeMethod != "S256" || len(req.CodeChallenge) != base64.RawURLEncoding.EncodedLen(sha256.Size) {
+		return nil, authorizationErrorRedirect(req, "invalid_request", "PKCE with the S256 method is required")
+	}
+	scopes := uniqueStrings(strings.Fields(req.Scope))
+	if len(scopes) == 0 {
+		return nil, authorizationErrorRedirect(req, "invalid_scope", "scope is required")
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return nil, authorizationErrorRedirect(req, "invalid_scope", "scope "+scope+" is not allowed for the app")
+		}
+	}
+	return scopes, ""
+}
+
+func authorizationErrorRedirect(req *pb.OAuthAuthorizationRequest, code, description string) string {
+	params := url.Values{"error": {code}, "error_description": {description}}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	return withQuery(req.RedirectUri, params)
+}
+
+// withQuery adds params to the query the redirect URI was registered with.
+func withQuery(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	query := u.Query()
+	for key, values := range params {
+		query[key] = values
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// authenticateClient checks the secret of a confidential client. Public
+// clients send none and rely on PKCE.
+func (s *UserService) authenticateClient(ctx context.Context, clientID, secret string) (*OAuthClient, error) {
+	client, err := s.oauth.GetClient(ctx, clientID)
+	if errors.Is(err, ErrOAuthClientNotFound) {
+		return nil, oauthError(codes.Unauthenticated, "invalid_client", "unknown client")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get app: %v", err)
+	}
+	if client.Public() {
+		if secret != "" {
+			return nil, oauthError(codes.Unauthenticated, "invalid_client", "public clients have no secret")
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare(hashOAuthSecret(secret), client.SecretHash) != 1 {
+		return nil, oauthError(codes.Unauthenticated, "invalid_client", "bad client secret")
+	}
+	return client, nil
+}
+
+// appToken reads an access or refresh token issued to an app.
+func (s *UserService) appToken(token string) (*auth.TokenInfo, string) {
+	if info, err := s.authProvider.ValidateToken(token, auth.AccessToken); err == nil && info.Delegated() {
+		return info, "access_token"
+	}
+	if info, err := s.authProvider.ValidateToken(token, auth.RefreshToken); err == nil && info.Delegated() {
+		return info, "refresh_token"
+	}
+	return nil, ""
+}
+
+// startAppSession opens a session for the app, listed among the sessions of
+// the user so they can end it.
+func (s *UserService) startAppSession(ctx context.Context, client *OAuthClient, user *User, scopes []string) (*tokenPair, error) {
+	record := newRefreshTokenRecord(uuid.NewString())
+	pair, err := s.appTokenPair(user.ID, user.Login, client.ID, scopes, record)
+	if err != nil {
+		return nil, err
+	}
+
+	info := auth.ClientInfoFromGRPCContext(ctx)
+	session := &Session{
+		FamilyID:        record.FamilyID,
+		UserID:          user.ID,
+		Device:          client.Name,
+		UserAgent:       info.UserAgent,
+		IP:              info.IP,
+		ClientID:        &client.ID,
+		CreatedAt:       record.IssuedAt,
+		LastRefreshedAt: record.IssuedAt,
+	}
+	if err := s.tokens.CreateFamily(ctx, session, record, nil); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store refresh token: %v", err)
+	}
+	return pair, nil
+}
+
+// appTokenPair issues tokens that carry the granted scopes and none of the
+// roles of the user.
+func (s *UserService) appTokenPair(userID int, login, clientID string, scopes []string, refresh *RefreshTokenRecord) (*tokenPair, error) {
+	accessToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:    userID,
+		UserLogin: login,
+		TokenType: auth.AccessToken,
+		FamilyID:  refresh.FamilyID,
+		ClientID:  clientID,
+		Scopes:    scopes,
+	}, auth.AccessTokenTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	refreshToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:    userID,
+		UserLogin: login,
+		TokenType: auth.RefreshToken,
+		TokenID:   refresh.JTI,
+		FamilyID:  refresh.FamilyID,
+		ClientID:  clientID,
+		Scopes:    scopes,
+	}, refresh.ExpiresAt.Sub(refresh.IssuedAt))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	return &tokenPair{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
+
+func (s *UserService) idToken(client *OAuthClient, user *User, scopes []string, nonce string) (string, error) {
+	now := time.Now()
+	claims := auth.IDTokenClaims{
+		Nonce:           nonce,
+		AuthorizedParty: client.ID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.oauthIssuer(),
+			Subject:   strconv.Itoa(user.ID),
+			Audience:  jwt.ClaimStrings{client.ID},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(auth.AccessTokenTTL)),
+		},
+	}
+	if slices.Contains(scopes, auth.ScopeProfileRead) {
+		verified := user.EmailVerifiedAt != nil
+		claims.PreferredUsername = user.Login
+		claims.Name = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims.Email = user.Email
+		claims.EmailVerified = &verified
+	}
+	return s.authProvider.GenerateIDToken(claims)
+}
+
+// oauthIssuer matches the discovery document the gateway serves.
+func (s *UserService) oauthIssuer() string {
+	return s.publicURL + "/api/v1/oauth"
+}
+
+func oauthTokenResponse(pair *tokenPair, scopes []string) *pb.OAuthTokenResponse {
+	return &pb.OAuthTokenResponse{
+		AccessToken:  pair.AccessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int32(auth.AccessTokenTTL.Seconds()),
+		RefreshToken: pair.RefreshToken,
+		Scope:        strings.Join(scopes, " "),
+	}
+}
+
+func oauthClientToProto(client *OAuthClient) *pb.OAuthClient {
+	return &pb.OAuthClient{
+		ClientId:     client.ID,
+		Name:         client.Name,
+		RedirectUris: client.RedirectURIs,
+		Scopes:       client.Scopes,
+		Public:       client.Public(),
+		CreatedAt:    timestamppb.New(client.CreatedAt),
+	}
+}
+
+// uniqueStrings keeps the first occurrence of each value.
+func uniqueStrings(scopes []string) []string {
+	var unique []string
+	for _, scope := range scopes {
+		if !slices.Contains(unique, scope) {
+			unique = append(unique, scope)
+		}
+	}
+	return unique
+}
+
+func verifyCodeChallenge(challenge, verifier string) bool {
+	sum := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
+
+// hashOAuthSecret hashes client secrets and codes, which are random enough
+// not to need a password hash.
+func hashOAuthSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
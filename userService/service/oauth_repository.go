@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrOAuthClientNotFound = errors.New("oauth client not found")
+	ErrOAuthCodeInvalid    = errors.New("authorization code is invalid, expired or already used")
+)
+
+const revokeReasonClientDeleted = "app deleted"
+
+// StringList is stored as a JSON array.
+type StringList []string
+
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(l))
+	return string(data), err
+}
+
+func (l *StringList) Scan(src any) error {
+	return scanJSON(src, (*[]string)(l))
+}
+
+// OAuthClient is a third-party app. Only the hash of its secret is stored,
+// public clients have none.
+type OAuthClient struct {
+	ID           string     `db:"id"`
+	OwnerID      int        `db:"owner_id"`
+	Name         string     `db:"name"`
+	SecretHash   []byte     `db:"secret_hash"`
+	RedirectURIs StringList `db:"redirect_uris"`
+	Scopes       StringList `db:"scopes"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+func (c *OAuthClient) Public() bool {
+	return c.SecretHash == nil
+}
+
+type OAuthCode struct {
+	CodeHash      []byte     `db:"code_hash"`
+	ClientID      string     `db:"client_id"`
+	UserID        int        `db:"user_id"`
+	RedirectURI   string     `db:"redirect_uri"`
+	Scopes        StringList `db:"scopes"`
+	CodeChallenge string     `db:"code_challenge"`
+	Nonce         string     `db:"nonce"`
+	ExpiresAt     time.Time  `db:"expires_at"`
+}
+
+type OAuthRepository interface {
+	CreateClient(ctx context.Context, client *OAuthClient) error
+	GetClient(ctx context.Context, clientID string) (*OAuthClient, error)
+	ListClients(ctx context.Context, ownerID int) ([]OAuthClient, error)
+	CountClients(ctx context.Context, ownerID int) (int, error)
+	DeleteClient(ctx context.Context, ownerID int, clientID string) error
+	CreateCode(ctx context.Context, code *OAuthCode) error
+	UseCode(ctx context.Context, codeHash []byte) (*OAuthCode, error)
+}
+
+type OAuthRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewOAuthRepository(db *sqlx.DB) OAuthRepository {
+	return &OAuthRepositorySpec{db: db}
+}
+
+func (r *OAuthRepositorySpec) CreateClient(ctx context.Context, client *OAuthClient) error {
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO oauth_clients (id, owner_id, name, secret_hash, redirect_uris, scopes, created_at)
+        VALUES (:id, :owner_id, :name, :secret_hash, :redirect_uris, :scopes, :created_at)
+    `, client)
+	return err
+}
+
+func (r *OAuthRepositorySpec) GetClient(ctx context.Context, clientID string) (*OAuthClient, error) {
+	var client OAuthClient
+	err := r.db.GetContext(ctx, &client, "SELECT * FROM oauth_clients WHERE id = $1", clientID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOAuthClientNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &client, nil
+}
+
+func (r *OAuthRepositorySpec) ListClients(ctx context.Context, ownerID int) ([]OAuthClient, error) {
+	var clients []OAuthClient
+	err := r.db.SelectContext(ctx, &clients,
+		"SELECT * FROM oauth_clients WHERE owner_id = $1 ORDER BY created_at", ownerID,
+	)
+	return clients, err
+}
+
+func (r *OAuthRepositorySpec) CountClients(ctx context.Context, ownerID int) (int, error) {
+	var count int
+	err := r.db.GetContext(ctx, &count, "SELECT COUNT(*) FROM oauth_clients WHERE owner_id = $1", ownerID)
+	return count, err
+}
+
+// DeleteClient revokes the sessions of the app before deleting it, so that its
+// tokens stop working and the reason stays recorded.
+func (r *OAuthRepositorySpec) DeleteClient(ctx context.Context, ownerID int, clientID string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+        UPDATE token_families
+        SET revoked_at = $1, revoke_reason = $2
+        WHERE revoked_at IS NULL AND id IN (SELECT family_id FROM sessions WHERE client_id = $3)
+    `, time.Now(), revokeReasonClientDeleted, clientID)
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, "DELETE FROM oauth_clients WHERE id = $1 AND owner_id = $2", clientID, ownerID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrOAuthClientNotFound
+	}
+	return tx.Commit()
+}
+
+// CreateCode also drops expired codes, which are never used.
+func (r *OAuthRepositorySpec) CreateCode(ctx context.Context, code *OAuthCode) error {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM oauth_codes WHERE expires_at < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO oauth_codes (code_hash, client_id, user_id, redirect_uri, scopes, code_challenge, nonce, expires_at)
+        VALUES (:code_hash, :client_id, :user_id, :redirect_uri, :scopes, :code_challenge, :nonce, :expires_at)
+    `, code)
+	return err
+}
+
+// UseCode deletes the code as it reads it, so that it works only once.
+func (r *OAuthRepositorySpec) UseCode(ctx context.Context, codeHash []byte) (*OAuthCode, error) {
+	var code OAuthCode
+	err := r.db.GetContext(ctx, &code,
+		"DELETE FROM oauth_codes WHERE code_hash = $1 AND expires_at > $2 RETURNING *", codeHash, time.Now(),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrOAuthCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &code, nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/Nicvod/SOA/userService/oidc"
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	oidcStateTTL       = 10 * time.Minute
+	oidcRequestTimeout = 10 * time.Second
+	oidcLoginMaxLength = 24
+	oidcLoginAttempts  = 5
+)
+
+func (s *UserService) ListOIDCProviders(ctx context.Context, req *pb.ListOIDCProvidersRequest) (*pb.ListOIDCProvidersResponse, error) {
+	resp := &pb.ListOIDCProvidersResponse{}
+	for _, provider := range s.oidcProviders {
+		resp.Providers = append(resp.Providers, &pb.OIDCProvider{Name: provider.Name(), DisplayName: provider.DisplayName()})
+	}
+	return resp, nil
+}
+
+func (s *UserService) StartOIDCLogin(ctx context.Context, req *pb.StartOIDCLoginRequest) (*pb.StartOIDCResponse, error) {
+	return s.startOIDC(ctx, req.Provider, nil, req.Device)
+}
+
+// StartOIDCLink starts a flow that links the provider to the caller's account
+// instead of signing in.
+func (s *UserService) StartOIDCLink(ctx context.Context, req *pb.StartOIDCLinkRequest) (*pb.StartOIDCResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	return s.startOIDC(ctx, req.Provider, &tokenInfo.UserID, "")
+}
+
+func (s *UserService) startOIDC(ctx context.Context, name string, userID *int, device string) (*pb.StartOIDCResponse, error) {
+	provider, err := s.oidcProvider(name)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := oidc.RandomString()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate state: %v", err)
+	}
+	nonce, err := oidc.RandomString()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate nonce: %v", err)
+	}
+	verifier, challenge, err := oidc.NewPKCE()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate code verifier: %v", err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, s.oidcRedirectURI(name), state, nonce, challenge)
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "identity provider is unavailable: %v", err)
+	}
+	err = s.identities.CreateState(ctx, &OIDCState{
+		StateHash:    hashOIDCState(state),
+		Provider:     name,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		UserID:       userID,
+		Device:       device,
+		ExpiresAt:    time.Now().Add(oidcStateTTL),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store login state: %v", err)
+	}
+	return &pb.StartOIDCResponse{AuthorizationUrl: authURL}, nil
+}
+
+// CompleteOIDC handles the redirect back from the provider. The state tells
+// whether the flow signs in or links the provider to an account.
+func (s *UserService) CompleteOIDC(ctx context.Context, req *pb.CompleteOIDCRequest) (*pb.CompleteOIDCResponse, error) {
+	provider, err := s.oidcProvider(req.Provider)
+	if err != nil {
+		return nil, err
+	}
+	state, err := s.identities.UseState(ctx, hashOIDCState(req.State))
+	if errors.Is(err, ErrOIDCStateInvalid) || (err == nil && state.Provider != req.Provider) {
+		return nil, status.Error(codes.Unauthenticated, ErrOIDCStateInvalid.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get login state: %v", err)
+	}
+
+	claims, err := provider.Exchange(ctx, s.oidcRedirectURI(req.Provider), req.Code, state.CodeVerifier, state.Nonce)
+	if errors.Is(err, oidc.ErrInvalidIDToken) || errors.Is(err, oidc.ErrCodeRejected) {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "identity provider is unavailable: %v", err)
+	}
+
+	if state.UserID != nil {
+		identity, err := s.linkIdentity(ctx, *state.UserID, req.Provider, claims)
+		if err != nil {
+			return nil, err
+		}
+		return &pb.CompleteOIDCResponse{LinkedIdentity: s.identityToProto(identity)}, nil
+	}
+	return s.oidcSignIn(ctx, req.Provider, claims, state.Device)
+}
+
+func (s *UserService) oidcSignIn(ctx context.Context, provider string, claims *oidc.Claims, device string) (*pb.CompleteOIDCResponse, error) {
+	var user *User
+	created := false
+	identity, err := s.identities.GetIdentity(ctx, provider, claims.Subject)
+	switch {
+	case err == nil:
+		if user, err = s.repo.GetUserByID(ctx, identity.UserID); err != nil {
+			return nil, status.Error(codes.NotFound, "user not found")
+		}
+	case errors.Is(err, ErrIdentityNotFound):
+		if user, created, err = s.oidcAccount(ctx, provider, claims); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, status.Errorf(codes.Internal, "failed to get identity: %v", err)
+	}
+
+	if err := accountRestrictedError(user); err != nil {
+		return nil, err
+	}
+	if err := s.identities.TouchIdentity(ctx, provider, claims.Subject, time.Now()); err != nil {
+		log.Printf("failed to record login of user %d with %s: %v", user.ID, provider, err)
+	}
+
+	challenge, methods, err := s.twoFactorChallenge(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if challenge != "" {
+		return &pb.CompleteOIDCResponse{TwoFactorRequired: true, ChallengeToken: challenge, TwoFactorMethods: methods}, nil
+	}
+	tokens, err := s.startSession(ctx, user.ID, user.Login, device)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.CompleteOIDCResponse{
+		AccessToken:    tokens.AccessToken,
+		RefreshToken:   tokens.RefreshToken,
+		AccountCreated: created,
+	}, nil
+}
+
+// oidcAccount links the identity to the account with the same email when the
+// provider and the account have both verified it, or creates a new account
+// without a password. An account with an unverified email is never taken
+// over.
+func (s *UserService) oidcAccount(ctx context.Context, provider string, claims *oidc.Claims) (*User, bool, error) {
+	if claims.Email == "" {
+		return nil, false, status.Errorf(codes.FailedPrecondition, "%s did not share an email address", provider)
+	}
+
+	user, err := s.repo.GetUserByEmail(ctx, claims.Email)
+	switch {
+	case err == nil:
+		if !claims.EmailVerified || user.EmailVerifiedAt == nil {
+			return nil, false, status.Errorf(codes.FailedPrecondition,
+				"an account with this email exists, sign in with the password and link %s to it", provider)
+		}
+		if _, err := s.linkIdentity(ctx, user.ID, provider, claims); err != nil {
+			return nil, false, err
+		}
+		return user, false, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, false, status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+
+	user, err = s.createOIDCUser(ctx, claims)
+	if errors.Is(err, ErrEmailTaken) {
+		return nil, false, alreadyExistsError(err)
+	}
+	if err != nil {
+		return nil, false, status.Errorf(codes.Internal, "failed to create user: %v", err)
+	}
+	if _, err := s.linkIdentity(ctx, user.ID, provider, claims); err != nil {
+		return nil, false, err
+	}
+	return user, true, nil
+}
+
+func (s *UserService) createOIDCUser(ctx context.Context, claims *oidc.Claims) (*User, error) {
+	now := time.Now()
+	user := &User{
+		Email:     claims.Email,
+		FirstName: claims.GivenName,
+		LastName:  claims.FamilyName,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	base := oidcLogin(claims)
+	for attempt := 0; ; attempt++ {
+		user.Login = base
+		if attempt > 0 {
+			suffix, err := rand.Int(rand.Reader, big.NewInt(10000))
+			if err != nil {
+				return nil, err
+			}
+			user.Login = fmt.Sprintf("%s_%04d", base, suffix)
+		}
+		id, err := s.repo.CreateUser(ctx, user)
+		if errors.Is(err, ErrLoginTaken) && attempt < oidcLoginAttempts {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		user.ID = id
+		break
+	}
+
+	if claims.EmailVerified {
+		emailIndex, err := s.pii.EmailIndex(user.Email)
+		if err == nil {
+			err = s.repo.MarkEmailVerified(ctx, user.ID, emailIndex)
+		}
+		if err != nil {
+			log.Printf("failed to mark email of user %d verified: %v", user.ID, err)
+		}
+		user.EmailVerifiedAt = &now
+	} else if err := s.sendEmailVerification(ctx, user); err != nil {
+		log.Printf("failed to send verification email to user %d: %v", user.ID, err)
+	}
+	return user, nil
+}
+
+// oidcLogin derives a login from the preferred username or the email, keeping
+// the characters logins allow.
+func oidcLogin(claims *oidc.Claims) string {
+	candidate := claims.PreferredUsername
+	if candidate == "" || strings.Contains(candidate, "@") {
+		candidate, _, _ = strings.Cut(claims.Email, "@")
+	}
+	login := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '.', r == '-':
+			return r
+		}
+		return -1
+	}, candidate)
+	if len(login) > oidcLoginMaxLength {
+		login = login[:oidcLoginMaxLength]
+	}
+	if len(login) < 3 {
+		login = "user" + login
+	}
+	return login
+}
+
+// linkIdentity is idempotent for an identity already linked to the user.
+func (s *UserService) linkIdentity(ctx context.Context, userID int, provider string, claims *oidc.Claims) (*Identity, error) {
+	identity := &Identity{Provider: provider, Subject: claims.Subject, UserID: userID, LinkedAt: time.Now()}
+	err := s.identities.LinkIdentity(ctx, identity)
+	if errors.Is(err, ErrIdentityLinked) {
+		existing, getErr := s.identities.GetIdentity(ctx, provider, claims.Subject)
+		if getErr == nil && existing.UserID == userID {
+			return existing, nil
+		}
+		return nil, status.Errorf(codes.AlreadyExists,
+			"this %s account is linked to another user, or another %s account is linked to yours", provider, provider)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to link identity: %v", err)
+	}
+	return identity, nil
+}
+
+func (s *UserService) ListIdentities(ctx context.Context, req *pb.ListIdentitiesRequest) (*pb.ListIdentitiesResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	identities, err := s.identities.ListIdentities(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list identities: %v", err)
+	}
+	resp := &pb.ListIdentitiesResponse{}
+	for i := range identities {
+		resp.Identities = append(resp.Identities, s.identityToProto(&identities[i]))
+	}
+	return resp, nil
+}
+
+// UnlinkIdentity keeps at least one way to sign in: an account without a
+// password cannot unlink its last identity.
+func (s *UserService) UnlinkIdentity(ctx context.Context, req *pb.UnlinkIdentityRequest) (*pb.UnlinkIdentityResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err := s.keepSignInMethod(ctx, user, 1, 0); err != nil {
+		return nil, err
+	}
+
+	err = s.identities.UnlinkIdentity(ctx, user.ID, req.Provider)
+	if errors.Is(err, ErrIdentityNotFound) {
+		return nil, status.Errorf(codes.NotFound, "%s is not linked", req.Provider)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unlink identity: %v", err)
+	}
+	return &pb.UnlinkIdentityResponse{}, nil
+}
+
+func (s *UserService) oidcProvider(name string) (*oidc.Provider, error) {
+	for _, provider := range s.oidcProviders {
+		if provider.Name() == name {
+			return provider, nil
+		}
+	}
+	return nil, status.Errorf(codes.NotFound, "identity provider %s is not configured", name)
+}
+
+// oidcRedirectURI is the callback of the gateway registered at the provider.
+func (s *UserService) oidcRedirectURI(provider string) string {
+	return fmt.Sprintf("%s/api/v1/oidc/%s/callback", s.publicURL, provider)
+}
+
+func (s *UserService) identityToProto(identity *Identity) *pb.Identity {
+	resp := &pb.Identity{
+		Provider:    identity.Provider,
+		DisplayName: identity.Provider,
+		Subject:     identity.Subject,
+		LinkedAt:    timestamppb.New(identity.LinkedAt),
+	}
+	if provider, err := s.oidcProvider(identity.Provider); err == nil {
+		resp.DisplayName = provider.DisplayName()
+	}
+	if identity.LastLoginAt != nil {
+		resp.LastLoginAt = timestamppb.New(*identity.LastLoginAt)
+	}
+	return resp
+}
+
+func hashOIDCState(state string) []byte {
+	sum := sha256.Sum256([]byte(state))
+	return sum[:]
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrPasskeyNotFound         = errors.New("passkey not found")
+	ErrPasskeyExists           = errors.New("passkey is already registered")
+	ErrPasskeyChanged          = errors.New("passkey was used concurrently")
+	ErrPasskeyChallengeInvalid = errors.New("passkey challenge is invalid, expired or already used")
+)
+
+const (
+	passkeyPurposeRegistration = "registration"
+	passkeyPurposeLogin        = "login"
+	passkeyPurposeSecondFactor = "second_factor"
+)
+
+type Passkey struct {
+	ID             []byte     `db:"id"`
+	UserID         int        `db:"user_id"`
+	Name           string     `db:"name"`
+	PublicKey      []byte     `db:"public_key"`
+	Algorithm      int64      `db:"algorithm"`
+	SignCount      int64      `db:"sign_count"`
+	AAGUID         []byte     `db:"aaguid"`
+	Transports     StringList `db:"transports"`
+	BackupEligible bool       `db:"backup_eligible"`
+	BackedUp       bool       `db:"backed_up"`
+	CreatedAt      time.Time  `db:"created_at"`
+	LastUsedAt     *time.Time `db:"last_used_at"`
+
+	// UserHandle is only filled by GetPasskey.
+	UserHandle []byte `db:"user_handle"`
+}
+
+// PasskeyChallenge is a pending ceremony. Only the hash of the challenge is
+// stored, the challenge comes back signed in the client data. A second factor
+// ceremony keeps the id of the challenge token it answers.
+type PasskeyChallenge struct {
+	ChallengeHash    []byte    `db:"challenge_hash"`
+	Purpose          string    `db:"purpose"`
+	UserID           *int      `db:"user_id"`
+	ChallengeTokenID *string   `db:"challenge_token_id"`
+	ExpiresAt        time.Time `db:"expires_at"`
+}
+
+type PasskeyRepository interface {
+	UserHandle(ctx context.Context, userID int, newHandle []byte) ([]byte, error)
+	CreatePasskey(ctx context.Context, passkey *Passkey) error
+	GetPasskey(ctx context.Context, id []byte) (*Passkey, error)
+	ListPasskeys(ctx context.Context, userID int) ([]Passkey, error)
+	UsePasskey(ctx context.Context, passkey *Passkey, signCount int64, backedUp bool) error
+	DeletePasskey(ctx context.Context, userID int, id []byte) error
+	CreateChallenge(ctx context.Context, challenge *PasskeyChallenge) error
+	UseChallenge(ctx context.Context, challengeHash []byte) (*PasskeyChallenge, error)
+}
+
+type PasskeyRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewPasskeyRepository(db *sqlx.DB) PasskeyRepository {
+	return &PasskeyRepositorySpec{db: db}
+}
+
+// UserHandle returns the handle of the user, storing newHandle if the user
+// has none yet.
+func (r *PasskeyRepositorySpec) UserHandle(ctx context.Context, userID int, newHandle []byte) ([]byte, error) {
+	var handle []byte
+	err := r.db.GetContext(ctx, &handle, `
+        INSERT INTO passkey_user_handles (user_id, handle) VALUES ($1, $2)
+        ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+        RETURNING handle
+    `, userID, newHandle)
+	return handle, err
+}
+
+func (r *PasskeyRepositorySpec) CreatePasskey(ctx context.Context, passkey *Passkey) error {
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO passkeys (id, user_id, name, public_key, algorithm, sign_count, aaguid, transports,
+                              backup_eligible, backed_up, created_at)
+        VALUES (:id, :user_id, :name, :public_key, :algorithm, :sign_count, :aaguid, :transports,
+                :backup_eligible, :backed_up, :created_at)
+    `, passkey)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+		return ErrPasskeyExists
+	}
+	return err
+}
+
+func (r *PasskeyRepositorySpec) GetPasskey(ctx context.Context, id []byte) (*Passkey, error) {
+	var passkey Passkey
+	err := r.db.GetContext(ctx, &passkey, `
+        SELECT p.*, h.handle AS user_handle
+        FROM passkeys p
+        JOIN passkey_user_handles h ON h.user_id = p.user_id
+        WHERE p.id = $1
+    `, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPasskeyNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &passkey, nil
+}
+
+func (r *PasskeyRepositorySpec) ListPasskeys(ctx context.Context, userID int) ([]Passkey, error) {
+	var passkeys []Passkey
+	err := r.db.SelectContext(ctx, &passkeys,
+		"SELECT * FROM passkeys WHERE user_id = $1 ORDER BY created_at", userID,
+	)
+	return passkeys, err
+}
+
+// UsePasskey stores the new counter only if nobody else has used the passkey
+// since it was read.
+func (r *PasskeyRepositorySpec) UsePasskey(ctx context.Context, passkey *Passkey, signCount int64, backedUp bool) error {
+	result, err := r.db.ExecContext(ctx, `
+        UPDATE passkeys SET sign_count = $1, backed_up = $2, last_used_at = $3
+        WHERE id = $4 AND sign_count = $5
+    `, signCount, backedUp, time.Now(), passkey.ID, passkey.SignCount)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrPasskeyChanged
+	}
+	return nil
+}
+
+func (r *PasskeyRepositorySpec) DeletePasskey(ctx context.Context, userID int, id []byte) error {
+	result, err := r.db.ExecContext(ctx, "DELETE FROM passkeys WHERE user_id = $1 AND id = $2", userID, id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrPasskeyNotFound
+	}
+	return nil
+}
+
+// CreateChallenge also drops expired challenges of abandoned ceremonies.
+func (r *PasskeyRepositorySpec) CreateChallenge(ctx context.Context, challenge *PasskeyChallenge) error {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM passkey_challenges WHERE expires_at < $1", time.Now()); err != nil {
+		return err
+	}
+	_, err := r.db.NamedExecContext(ctx, `
+        INSERT INTO passkey_challenges (challenge_hash, purpose, user_id, challenge_token_id, expires_at)
+        VALUES (:challenge_hash, :purpose, :user_id, :challenge_token_id, :expires_at)
+    `, challenge)
+	return err
+}
+
+// UseChallenge deletes the challenge, so that each one is answered once.
+func (r *PasskeyRepositorySpec) UseChallenge(ctx context.Context, challengeHash []byte) (*PasskeyChallenge, error) {
+	var challenge PasskeyChallenge
+	err := r.db.GetContext(ctx, &challenge,
+		"DELETE FROM passkey_challenges WHERE challenge_hash = $1 AND expires_at > $2 RETURNING *",
+		challengeHash, time.Now(),
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrPasskeyChallengeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &challenge, nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/userService/webauthn"
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	passkeyCeremonyTTL    = 5 * time.Minute
+	passkeyUserHandleSize = 32
+	maxPasskeys           = 10
+
+	userVerificationRequired    = "required"
+	userVerificationDiscouraged = "discouraged"
+)
+
+func (s *UserService) StartPasskeyRegistration(ctx context.Context, req *pb.StartPasskeyRegistrationRequest) (*pb.PasskeyRegistrationOptions, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	passkeys, err := s.passkeys.ListPasskeys(ctx, user.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list passkeys: %v", err)
+	}
+	if len(passkeys) >= maxPasskeys {
+		return nil, status.Errorf(codes.FailedPrecondition, "at most %d passkeys can be registered", maxPasskeys)
+	}
+
+	newHandle := make([]byte, passkeyUserHandleSize)
+	if _, err := rand.Read(newHandle); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate user handle: %v", err)
+	}
+	handle, err := s.passkeys.UserHandle(ctx, user.ID, newHandle)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store user handle: %v", err)
+	}
+	challenge, err := s.newPasskeyChallenge(ctx, passkeyPurposeRegistration, &user.ID, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	displayName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if displayName == "" {
+		displayName = user.Login
+	}
+	return &pb.PasskeyRegistrationOptions{
+		Challenge:          challenge,
+		RpId:               s.relyingParty.ID,
+		RpName:             s.relyingParty.Name,
+		UserHandle:         handle,
+		UserName:           user.Login,
+		UserDisplayName:    displayName,
+		Algorithms:         webauthn.SupportedAlgorithms,
+		ExcludeCredentials: passkeyDescriptors(passkeys),
+		TimeoutMs:          passkeyCeremonyTTL.Milliseconds(),
+	}, nil
+}
+
+func (s *UserService) FinishPasskeyRegistration(ctx context.Context, req *pb.FinishPasskeyRegistrationRequest) (*pb.Passkey, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	clientData, err := webauthn.ParseClientData(req.ClientDataJson)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	challenge, err := s.usePasskeyChallenge(ctx, clientData)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil || challenge.Purpose != passkeyPurposeRegistration ||
+		challenge.UserID == nil || *challenge.UserID != tokenInfo.UserID {
+		return nil, status.Error(codes.FailedPrecondition, "passkey registration was not started or has expired")
+	}
+
+	credential, err := s.relyingParty.VerifyRegistration(clientData, req.AttestationObject, false)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	passkey := &Passkey{
+		ID:             credential.ID,
+		UserID:         tokenInfo.UserID,
+		Name:           req.Name,
+		PublicKey:      credential.PublicKey,
+		Algorithm:      credential.Algorithm,
+		SignCount:      int64(credential.SignCount),
+		AAGUID:         credential.AAGUID,
+		Transports:     req.Transports,
+		BackupEligible: credential.BackupEligible,
+		BackedUp:       credential.BackedUp,
+		CreatedAt:      time.Now(),
+	}
+	err = s.passkeys.CreatePasskey(ctx, passkey)
+	if errors.Is(err, ErrPasskeyExists) {
+		return nil, status.Error(codes.AlreadyExists, "passkey is already registered")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store passkey: %v", err)
+	}
+	return passkeyToProto(passkey), nil
+}
+
+func (s *UserService) ListPasskeys(ctx context.Context, req *pb.ListPasskeysRequest) (*pb.ListPasskeysResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	passkeys, err := s.passkeys.ListPasskeys(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list passkeys: %v", err)
+	}
+	resp := &pb.ListPasskeysResponse{}
+	for i := range passkeys {
+		resp.Passkeys = append(resp.Passkeys, passkeyToProto(&passkeys[i]))
+	}
+	return resp, nil
+}
+
+func (s *UserService) DeletePasskey(ctx context.Context, req *pb.DeletePasskeyRequest) (*pb.DeletePasskeyResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	passkey, err := s.passkeys.GetPasskey(ctx, req.Id)
+	if errors.Is(err, ErrPasskeyNotFound) || (err == nil && passkey.UserID != tokenInfo.UserID) {
+		return nil, status.Error(codes.NotFound, "passkey not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get passkey: %v", err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err := s.keepSignInMethod(ctx, user, 0, 1); err != nil {
+		return nil, err
+	}
+
+	err = s.passkeys.DeletePasskey(ctx, user.ID, req.Id)
+	if errors.Is(err, ErrPasskeyNotFound) {
+		return nil, status.Error(codes.NotFound, "passkey not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to delete passkey: %v", err)
+	}
+	return &pb.DeletePasskeyResponse{}, nil
+}
+
+// StartPasskeyLogin starts a passwordless login, where any passkey of the
+// site may answer and must verify the user, or with a challenge token the
+// second factor of a login, where only the passkeys of that user may answer.
+func (s *UserService) StartPasskeyLogin(ctx context.Context, req *pb.StartPasskeyLoginRequest) (*pb.PasskeyLoginOptions, error) {
+	purpose := passkeyPurposeLogin
+	userVerification := userVerificationRequired
+	var userID *int
+	var challengeTokenID *string
+	var allowCredentials []*pb.PasskeyDescriptor
+
+	if req.ChallengeToken != "" {
+		challenge, err := s.authProvider.ValidateToken(req.ChallengeToken, auth.ChallengeToken)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid challenge token: %v", err)
+		}
+		passkeys, err := s.passkeys.ListPasskeys(ctx, challenge.UserID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to list passkeys: %v", err)
+		}
+		if len(passkeys) == 0 {
+			return nil, status.Error(codes.FailedPrecondition, "no passkeys are registered")
+		}
+		purpose = passkeyPurposeSecondFactor
+		userVerification = userVerificationDiscouraged
+		userID = &challenge.UserID
+		challengeTokenID = &challenge.TokenID
+		allowCredentials = passkeyDescriptors(passkeys)
+	}
+
+	challenge, err := s.newPasskeyChallenge(ctx, purpose, userID, challengeTokenID)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.PasskeyLoginOptions{
+		Challenge:        challenge,
+		RpId:             s.relyingParty.ID,
+		AllowCredentials: allowCredentials,
+		UserVerification: userVerification,
+		TimeoutMs:        passkeyCeremonyTTL.Milliseconds(),
+	}, nil
+}
+
+func (s *UserService) FinishPasskeyLogin(ctx context.Context, req *pb.FinishPasskeyLoginRequest) (*pb.AuthenticateUserResponse, error) {
+	clientData, err := webauthn.ParseClientData(req.ClientDataJson)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	challenge, err := s.usePasskeyChallenge(ctx, clientData)
+	if err != nil {
+		return nil, err
+	}
+	if challenge == nil || (challenge.Purpose != passkeyPurposeLogin && challenge.Purpose != passkeyPurposeSecondFactor) {
+		return nil, status.Error(codes.Unauthenticated, "passkey login was not started or has expired")
+	}
+	secondFactor := challenge.Purpose == passkeyPurposeSecondFactor
+
+	passkey, err := s.passkeys.GetPasskey(ctx, req.CredentialId)
+	if errors.Is(err, ErrPasskeyNotFound) {
+		return nil, status.Error(codes.Unauthenticated, "unknown passkey")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get passkey: %v", err)
+	}
+	if secondFactor && *challenge.UserID != passkey.UserID {
+		return nil, status.Error(codes.Unauthenticated, "unknown passkey")
+	}
+	// the user handle is what a discoverable credential says it belongs to
+	if (!secondFactor || len(req.UserHandle) > 0) && !bytes.Equal(req.UserHandle, passkey.UserHandle) {
+		return nil, status.Error(codes.Unauthenticated, "passkey does not belong to the user")
+	}
+
+	user, err := s.repo.GetUserByID(ctx, passkey.UserID)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "user not found")
+	}
+	ip := auth.ClientInfoFromGRPCContext(ctx).IP
+	if secondFactor {
+		if err := s.checkThrottle(ctx, userThrottleKey(user.ID), ip); err != nil {
+			return nil, err
+		}
+	}
+
+	assertion, err := s.relyingParty.VerifyAssertion(
+		clientData, req.AuthenticatorData, req.Signature, passkey.PublicKey, uint32(passkey.SignCount), !secondFactor,
+	)
+	if errors.Is(err, webauthn.ErrSignCount) {
+		log.Printf("passkey of user %d sent a signature counter not above %d, it may be cloned", user.ID, passkey.SignCount)
+	}
+	if err != nil {
+		if secondFactor {
+			s.recordAuthFailure(ctx, userThrottleKey(user.ID), ip, nil)
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "invalid passkey: %v", err)
+	}
+	if secondFactor {
+		s.resetAccountThrottle(ctx, userThrottleKey(user.ID))
+	}
+
+	err = s.passkeys.UsePasskey(ctx, passkey, int64(assertion.SignCount), assertion.BackedUp)
+	if errors.Is(err, ErrPasskeyChanged) {
+		return nil, status.Error(codes.Unauthenticated, "passkey was used by another login, try again")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store passkey use: %v", err)
+	}
+	if err := accountRestrictedError(user); err != nil {
+		return nil, err
+	}
+	// the challenge token may have been answered with another passkey ceremony
+	// or a TOTP code meanwhile
+	if secondFactor {
+		if err := s.useChallengeToken(ctx, *challenge.ChallengeTokenID, time.Now().Add(auth.ChallengeTokenTTL)); err != nil {
+			return nil, err
+		}
+	}
+
+	tokens, err := s.startSession(ctx, user.ID, user.Login, req.Device)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AuthenticateUserResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	}, nil
+}
+
+func (s *UserService) newPasskeyChallenge(ctx context.Context, purpose string, userID *int, challengeTokenID *string) ([]byte, error) {
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate challenge: %v", err)
+	}
+	hash := sha256.Sum256(challenge)
+	err = s.passkeys.CreateChallenge(ctx, &PasskeyChallenge{
+		ChallengeHash:    hash[:],
+		Purpose:          purpose,
+		UserID:           userID,
+		ChallengeTokenID: challengeTokenID,
+		ExpiresAt:        time.Now().Add(passkeyCeremonyTTL),
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store challenge: %v", err)
+	}
+	return challenge, nil
+}
+
+// usePasskeyChallenge returns nil when the challenge of the client data was
+// not issued, has expired or was answered already.
+func (s *UserService) usePasskeyChallenge(ctx context.Context, clientData *webauthn.ClientData) (*PasskeyChallenge, error) {
+	hash := sha256.Sum256(clientData.Challenge)
+	challenge, err := s.passkeys.UseChallenge(ctx, hash[:])
+	if errors.Is(err, ErrPasskeyChallengeInvalid) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to use challenge: %v", err)
+	}
+	return challenge, nil
+}
+
+// keepSignInMethod refuses to remove the identities and passkeys of a user
+// without a password when none would be left to sign in with.
+func (s *UserService) keepSignInMethod(ctx context.Context, user *User, removedIdentities, removedPasskeys int) error {
+	if user.Password != "" {
+		return nil
+	}
+	identities, err := s.identities.ListIdentities(ctx, user.ID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list identities: %v", err)
+	}
+	passkeys, err := s.passkeys.ListPasskeys(ctx, user.ID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to list passkeys: %v", err)
+	}
+	if len(identities)-removedIdentities+len(passkeys)-removedPasskeys <= 0 {
+		return status.Error(codes.FailedPrecondition, "set a password before removing the last way to sign in")
+	}
+	return nil
+}
+
+func passkeyDescriptors(passkeys []Passkey) []*pb.PasskeyDescriptor {
+	descriptors := make([]*pb.PasskeyDescriptor, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		descriptors = append(descriptors, &pb.PasskeyDescriptor{Id: passkey.ID, Transports: passkey.Transports})
+	}
+	return descriptors
+}
+
+func passkeyToProto(passkey *Passkey) *pb.Passkey {
+	resp := &pb.Passkey{
+		Id:         passkey.ID,
+		Name:       passkey.Name,
+		BackedUp:   passkey.BackedUp,
+		Transports: passkey.Transports,
+		CreatedAt:  timestamppb.New(passkey.CreatedAt),
+	}
+	if passkey.LastUsedAt != nil {
+		resp.LastUsedAt = timestamppb.New(*passkey.LastUsedAt)
+	}
+	return resp
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+)
+
+const (
+	visibilityPublic    = "public"
+	visibilityFollowers = "followers"
+	visibilityOnlyMe    = "only_me"
+)
+
+// defaultVisibility applies to fields the user never set. Contact details and
+// birth date are only shared when the user asks for it.
+var defaultVisibility = map[string]string{
+	"email":        visibilityOnlyMe,
+	"phone_number": visibilityOnlyMe,
+	"birth_date":   visibilityOnlyMe,
+	"bio":          visibilityPublic,
+	"location":     visibilityPublic,
+	"website":      visibilityPublic,
+	"pronouns":     visibilityPublic,
+	"links":        visibilityPublic,
+}
+
+// visibilityRank orders visibilities from the widest audience.
+var visibilityRank = map[string]int{
+	visibilityPublic:    0,
+	visibilityFollowers: 1,
+	visibilityOnlyMe:    2,
+}
+
+var visibilityProto = map[string]pb.Visibility{
+	visibilityPublic:    pb.Visibility_VISIBILITY_PUBLIC,
+	visibilityFollowers: pb.Visibility_VISIBILITY_FOLLOWERS,
+	visibilityOnlyMe:    pb.Visibility_VISIBILITY_ONLY_ME,
+}
+
+type ProfileLink struct {
+	Title string `json:"title"`
+	URL   string `json:"url"`
+}
+
+// ProfileLinks are stored as a JSON array.
+type ProfileLinks []ProfileLink
+
+func (l ProfileLinks) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal(l)
+	return string(data), err
+}
+
+func (l *ProfileLinks) Scan(src any) error {
+	return scanJSON(src, l)
+}
+
+func (l ProfileLinks) Proto() []*pb.ProfileLink {
+	links := make([]*pb.ProfileLink, 0, len(l))
+	for _, link := range l {
+		links = append(links, &pb.ProfileLink{Title: link.Title, Url: link.URL})
+	}
+	return links
+}
+
+func profileLinksFromProto(links []*pb.ProfileLink) ProfileLinks {
+	result := make(ProfileLinks, 0, len(links))
+	for _, link := range links {
+		result = append(result, ProfileLink{Title: link.Title, URL: link.Url})
+	}
+	return result
+}
+
+// FieldVisibility maps profile fields to who can see them, stored as a JSON
+// object with only the fields the user changed.
+type FieldVisibility map[string]string
+
+func (v FieldVisibility) Value() (driver.Value, error) {
+	if v == nil {
+		return "{}", nil
+	}
+	data, err := json.Marshal(v)
+	return string(data), err
+}
+
+func (v *FieldVisibility) Scan(src any) error {
+	return scanJSON(src, v)
+}
+
+// Of returns the visibility of field, its default if the user never set it.
+func (v FieldVisibility) Of(field string) string {
+	if visibility, ok := v[field]; ok {
+		return visibility
+	}
+	return defaultVisibility[field]
+}
+
+// Shows tells whether field is visible to a viewer with the given audience.
+func (v FieldVisibility) Shows(field, audience string) bool {
+	return visibilityRank[v.Of(field)] <= visibilityRank[audience]
+}
+
+// Proto returns the visibility of every field that has one.
+func (v FieldVisibility) Proto() map[string]pb.Visibility {
+	result := make(map[string]pb.Visibility, len(pb.VisibilityFields))
+	for _, field := range pb.VisibilityFields {
+		result[field] = visibilityProto[v.Of(field)]
+	}
+	return result
+}
+
+func fieldVisibilityFromProto(visibility map[string]pb.Visibility) FieldVisibility {
+	result := make(FieldVisibility, len(visibility))
+	for field, value := range visibility {
+		for name, proto := range visibilityProto {
+			if proto == value {
+				result[field] = name
+			}
+		}
+	}
+	return result
+}
+
+// audienceOf is the narrowest visibility of the fields a viewer may see on a
+// profile: everything on their own, followers-only fields on the ones they
+// follow.
+func audienceOf(viewerID, userID int, following bool) string {
+	switch {
+	case viewerID == userID:
+		return visibilityOnlyMe
+	case following:
+		return visibilityFollowers
+	}
+	return visibilityPublic
+}
+
+func scanJSON(src any, dst any) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, dst)
+	case string:
+		return json.Unmarshal([]byte(src), dst)
+	case nil:
+		return nil
+	}
+	return fmt.Errorf("cannot scan %T as JSON", src)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *UserService) GetPublicProfile(ctx context.Context, req *pb.GetPublicProfileRequest) (*pb.PublicProfile, error) {
+	var user *User
+	var err error
+	switch {
+	case req.GetLogin() != "":
+		user, err = s.repo.GetUserByLogin(ctx, req.GetLogin())
+	default:
+		user, err = s.repo.GetUserByID(ctx, int(req.GetUserId()))
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+
+	counts, err := s.follows.CountFollows(ctx, []int{user.ID})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count follows: %v", err)
+	}
+	audiences, err := s.audiences(ctx, []int{user.ID})
+	if err != nil {
+		return nil, err
+	}
+	return s.publicProfile(user, counts[user.ID], audiences[user.ID]), nil
+}
+
+func (s *UserService) BatchGetUsers(ctx context.Context, req *pb.BatchGetUsersRequest) (*pb.BatchGetUsersResponse, error) {
+	ids := make([]int, 0, len(req.UserIds))
+	for _, id := range req.UserIds {
+		ids = append(ids, int(id))
+	}
+
+	profiles, err := s.publicProfiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.BatchGetUsersResponse{Users: profiles}, nil
+}
+
+// publicProfiles answers in the order of ids, without duplicates and
+// unknown users.
+func (s *UserService) publicProfiles(ctx context.Context, ids []int) ([]*pb.PublicProfile, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	users, err := s.repo.GetUsersByIDs(ctx, ids)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get users: %v", err)
+	}
+	counts, err := s.follows.CountFollows(ctx, ids)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count follows: %v", err)
+	}
+	audiences, err := s.audiences(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]*User, len(users))
+	for i := range users {
+		byID[users[i].ID] = &users[i]
+	}
+
+	profiles := make([]*pb.PublicProfile, 0, len(users))
+	for _, id := range ids {
+		user, ok := byID[id]
+		if !ok {
+			continue
+		}
+		delete(byID, id)
+		profiles = append(profiles, s.publicProfile(user, counts[id], audiences[id]))
+	}
+	return profiles, nil
+}
+
+// audiences returns what the caller may see of the profiles of userIDs, see
+// audienceOf. Callers without a user, such as other services, see public
+// fields only.
+func (s *UserService) audiences(ctx context.Context, userIDs []int) (map[int]string, error) {
+	viewerID := 0
+	if tokenInfo, err := auth.TokenInfoFromContext(ctx); err == nil {
+		viewerID = tokenInfo.UserID
+	}
+
+	following := map[int]bool{}
+	if viewerID != 0 {
+		var err error
+		following, err = s.follows.FollowingAmong(ctx, viewerID, userIDs)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to check follows: %v", err)
+		}
+	}
+
+	audiences := make(map[int]string, len(userIDs))
+	for _, id := range userIDs {
+		audiences[id] = audienceOf(viewerID, id, following[id])
+	}
+	return audiences, nil
+}
+
+// publicProfile fills in the optional fields the user shows to audience.
+// Login, names and avatar are always public.
+func (s *UserService) publicProfile(user *User, counts FollowCounts, audience string) *pb.PublicProfile {
+	profile := &pb.PublicProfile{
+		Id:             int32(user.ID),
+		Login:          user.Login,
+		FirstName:      user.FirstName,
+		LastName:       user.LastName,
+		CreatedAt:      timestamppb.New(user.CreatedAt),
+		FollowersCount: int32(counts.Followers),
+		FollowingCount: int32(counts.Following),
+		IsPrivate:      user.IsPrivate,
+		Avatar:         s.avatarImages(user),
+	}
+
+	shows := func(field string) bool {
+		return user.FieldVisibility.Shows(field, audience)
+	}
+	if shows("email") {
+		profile.Email = user.Email
+	}
+	if shows("phone_number") {
+		profile.PhoneNumber = user.PhoneNumber
+	}
+	if shows("birth_date") {
+		profile.BirthDate = timestamppb.New(user.BirthDate)
+	}
+	if shows("bio") {
+		profile.Bio = user.Bio
+	}
+	if shows("location") {
+		profile.Location = user.Location
+	}
+	if shows("website") {
+		profile.Website = user.Website
+	}
+	if shows("pronouns") {
+		profile.Pronouns = user.Pronouns
+	}
+	if shows("links") {
+		profile.Links = user.Links.Proto()
+	}
+	return profile
+}
+
+func (s *UserService) UpdateProfileVisibility(ctx context.Context, req *pb.UpdateProfileVisibilityRequest) (*pb.ProfileVisibility, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	visibility, err := s.repo.UpdateFieldVisibility(ctx, tokenInfo.UserID, fieldVisibilityFromProto(req.Visibility))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to update visibility: %v", err)
+	}
+	return &pb.ProfileVisibility{Visibility: visibility.Proto()}, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var ErrRelationNotFound = errors.New("relation not found")
+
+// Relation is a block or a mute of TargetID by the user the list belongs to.
+type Relation struct {
+	TargetID  int       `db:"target_id"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// ContentFilter lists users whose content is hidden from a user.
+type ContentFilter struct {
+	Blocked []int
+	Muted   []int
+}
+
+type RelationRepository interface {
+	Block(ctx context.Context, blockerID, blockedID int) error
+	Unblock(ctx context.Context, blockerID, blockedID int) error
+	IsBlocked(ctx context.Context, userID, otherID int) (bool, error)
+	ListBlocked(ctx context.Context, blockerID int, after *Cursor, limit int) ([]Relation, error)
+	Mute(ctx context.Context, muterID, mutedID int) error
+	Unmute(ctx context.Context, muterID, mutedID int) error
+	ListMuted(ctx context.Context, muterID int, after *Cursor, limit int) ([]Relation, error)
+	GetContentFilter(ctx context.Context, userID int) (*ContentFilter, error)
+}
+
+type RelationRepositorySpec struct {
+	db *sqlx.DB
+}
+
+func NewRelationRepository(db *sqlx.DB) RelationRepository {
+	return &RelationRepositorySpec{db: db}
+}
+
+// Block also drops follows and follow requests between the two users.
+// Blocking again is a no-op.
+func (r *RelationRepositorySpec) Block(ctx context.Context, blockerID, blockedID int) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO blocks (blocker_id, blocked_id, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		blockerID, blockedID, time.Now(),
+	)
+	if err != nil {
+		return relationUserNotFound(err)
+	}
+	_, err = tx.ExecContext(ctx,
+		"DELETE FROM follows WHERE (follower_id = $1 AND followee_id = $2) OR (follower_id = $2 AND followee_id = $1)",
+		blockerID, blockedID,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *RelationRepositorySpec) Unblock(ctx context.Context, blockerID, blockedID int) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM blocks WHERE blocker_id = $1 AND blocked_id = $2",
+		blockerID, blockedID,
+	)
+	if err != nil {
+		return err
+	}
+	return relationAffected(result)
+}
+
+// IsBlocked reports a block in either direction.
+func (r *RelationRepositorySpec) IsBlocked(ctx context.Context, userID, otherID int) (bool, error) {
+	var blocked bool
+	err := r.db.GetContext(ctx, &blocked, `
+        SELECT EXISTS (
+            SELECT 1 FROM blocks
+            WHERE (blocker_id = $1 AND blocked_id = $2) OR (blocker_id = $2 AND blocked_id = $1)
+        )
+    `, userID, otherID)
+	return blocked, err
+}
+
+func (r *RelationRepositorySpec) ListBlocked(ctx context.Context, blockerID int, after *Cursor, limit int) ([]Relation, error) {
+	return r.list(ctx, "blocks", "blocker_id", "blocked_id", blockerID, after, limit)
+}
+
+func (r *RelationRepositorySpec) Mute(ctx context.Context, muterID, mutedID int) error {
+	_, err := r.db.ExecContext(ctx,
+		"INSERT INTO mutes (muter_id, muted_id, created_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING",
+		muterID, mutedID, time.Now(),
+	)
+	return relationUserNotFound(err)
+}
+
+func (r *RelationRepositorySpec) Unmute(ctx context.Context, muterID, mutedID int) error {
+	result, err := r.db.ExecContext(ctx,
+		"DELETE FROM mutes WHERE muter_id = $1 AND muted_id = $2",
+		muterID, mutedID,
+	)
+	if err != nil {
+		return err
+	}
+	return relationAffected(result)
+}
+
+func (r *RelationRepositorySpec) ListMuted(ctx context.Context, muterID int, after *Cursor, limit int) ([]Relation, error) {
+	return r.list(ctx, "mutes", "muter_id", "muted_id", muterID, after, limit)
+}
+
+// list pages through one user's rows of a relation table, newest first.
+func (r *RelationRepositorySpec) list(ctx context.Context, table, ownerColumn, targetColumn string, ownerID int, after *Cursor, limit int) ([]Relation, error) {
+	query := fmt.Sprintf("SELECT %s AS target_id, created_at FROM %s WHERE %s = $1", targetColumn, table, ownerColumn)
+	args := []any{ownerID}
+	if after != nil {
+		query += fmt.Sprintf(" AND (created_at, %s) < ($2, $3)", targetColumn)
+		args = append(args, after.Time, after.ID)
+	}
+	query += fmt.Sprintf(" ORDER BY created_at DESC, %s DESC LIMIT %d", targetColumn, limit)
+
+	var relations []Relation
+	if err := r.db.SelectContext(ctx, &relations, query, args...); err != nil {
+		return nil, err
+	}
+	return relations, nil
+}
+
+func (r *RelationRepositorySpec) GetContentFilter(ctx context.Context, userID int) (*ContentFilter, error) {
+	filter := &ContentFilter{}
+	err := r.db.SelectContext(ctx, &filter.Blocked, `
+        SELECT blocked_id FROM blocks WHERE blocker_id = $1
+        UNION
+        SELECT blocker_id FROM blocks WHERE blocked_id = $1
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	err = r.db.SelectContext(ctx, &filter.Muted, "SELECT muted_id FROM mutes WHERE muter_id = $1", userID)
+	if err != nil {
+		return nil, err
+	}
+	return filter, nil
+}
+
+func relationAffected(result sql.Result) error {
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRelationNotFound
+	}
+	return nil
+}
+
+func relationUserNotFound(err error) error {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		return ErrUserNotFound
+	}
+	return err
+}
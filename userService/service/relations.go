@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *UserService) BlockUser(ctx context.Context, req *pb.RelationRequest) (*pb.RelationResponse, error) {
+	return s.changeRelation(ctx, req, "block", s.relations.Block)
+}
+
+func (s *UserService) UnblockUser(ctx context.Context, req *pb.RelationRequest) (*pb.RelationResponse, error) {
+	return s.changeRelation(ctx, req, "unblock", s.relations.Unblock)
+}
+
+func (s *UserService) MuteUser(ctx context.Context, req *pb.RelationRequest) (*pb.RelationResponse, error) {
+	return s.changeRelation(ctx, req, "mute", s.relations.Mute)
+}
+
+func (s *UserService) UnmuteUser(ctx context.Context, req *pb.RelationRequest) (*pb.RelationResponse, error) {
+	return s.changeRelation(ctx, req, "unmute", s.relations.Unmute)
+}
+
+func (s *UserService) ListBlockedUsers(ctx context.Context, req *pb.ListRelationsRequest) (*pb.ListFollowsResponse, error) {
+	return s.listRelations(ctx, req, s.relations.ListBlocked)
+}
+
+func (s *UserService) ListMutedUsers(ctx context.Context, req *pb.ListRelationsRequest) (*pb.ListFollowsResponse, error) {
+	return s.listRelations(ctx, req, s.relations.ListMuted)
+}
+
+// GetContentFilter is used by postService to hide posts of blocked and muted
+// users from the caller.
+func (s *UserService) GetContentFilter(ctx context.Context, req *pb.GetContentFilterRequest) (*pb.GetContentFilterResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	filter, err := s.relations.GetContentFilter(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get content filter: %v", err)
+	}
+
+	resp := &pb.GetContentFilterResponse{}
+	for _, id := range filter.Blocked {
+		resp.BlockedUserIds = append(resp.BlockedUserIds, int32(id))
+	}
+	for _, id := range filter.Muted {
+		resp.MutedUserIds = append(resp.MutedUserIds, int32(id))
+	}
+	return resp, nil
+}
+
+func (s *UserService) changeRelation(ctx context.Context, req *pb.RelationRequest, action string, change func(ctx context.Context, userID, targetID int) error) (*pb.RelationResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	if int(req.UserId) == tokenInfo.UserID {
+		return nil, status.Errorf(codes.InvalidArgument, "cannot %s yourself", action)
+	}
+
+	err = change(ctx, tokenInfo.UserID, int(req.UserId))
+	if errors.Is(err, ErrUserNotFound) {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if errors.Is(err, ErrRelationNotFound) {
+		return nil, status.Errorf(codes.NotFound, "nothing to %s", action)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to %s: %v", action, err)
+	}
+	return &pb.RelationResponse{}, nil
+}
+
+func (s *UserService) listRelations(ctx context.Context, req *pb.ListRelationsRequest, list func(ctx context.Context, userID int, after *Cursor, limit int) ([]Relation, error)) (*pb.ListFollowsResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	after, err := DecodeCursor(req.Cursor)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor")
+	}
+
+	limit := pageSize(req.PageSize)
+	relations, err := list(ctx, tokenInfo.UserID, after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list users: %v", err)
+	}
+
+	resp := &pb.ListFollowsResponse{}
+	if len(relations) > limit {
+		relations = relations[:limit]
+		last := relations[limit-1]
+		resp.NextCursor = Cursor{Time: last.CreatedAt, ID: last.TargetID}.Encode()
+	}
+	ids := make([]int, 0, len(relations))
+	for _, relation := range relations {
+		ids = append(ids, relation.TargetID)
+	}
+	resp.Users, err = s.publicProfiles(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -2,81 +2,405 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
+	"github.com/Nicvod/SOA/userService/pii"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrEmailTaken   = errors.New("email is already taken")
+	ErrLoginTaken   = errors.New("login is already taken")
+)
+
+// userColumns maps profile fields that can be updated to their columns.
+var userColumns = map[string]string{
+	"email":        "email",
+	"first_name":   "first_name",
+	"last_name":    "last_name",
+	"birth_date":   "birth_date",
+	"phone_number": "phone_number",
+	"bio":          "bio",
+	"location":     "location",
+	"website":      "website",
+	"pronouns":     "pronouns",
+	"links":        "links",
+}
+
 type UserRepository interface {
 	CreateUser(ctx context.Context, user *User) (int, error)
 	GetUserByLogin(ctx context.Context, login string) (*User, error)
-	UpdateUser(ctx context.Context, user *User) error
+	UpdateUser(ctx context.Context, user *User, fields []string) error
+	UpdatePassword(ctx context.Context, id int, hashedPassword string) error
 	GetUserByID(ctx context.Context, id int) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUsersByIDs(ctx context.Context, ids []int) ([]User, error)
+	MarkEmailVerified(ctx context.Context, id int, emailIndex []byte) error
+	SetPrivate(ctx context.Context, id int, private bool) error
+	SetAvatar(ctx context.Context, id int, avatarID *string) (*string, error)
+	GetAvatarID(ctx context.Context, id int) (*string, error)
+	UpdateFieldVisibility(ctx context.Context, id int, changes FieldVisibility) (FieldVisibility, error)
+	SetRestriction(ctx context.Context, id int, suspendedUntil, bannedAt *time.Time, reason, revokeReason string, audit *AuditEntry) error
 }
 
+// UserRepositorySpec encrypts email, phone number and birth date on writes
+// and decrypts them on reads, see pii.Cipher.
 type UserRepositorySpec struct {
-	db *sqlx.DB
+	db  *sqlx.DB
+	pii *pii.Cipher
 }
 
 type User struct {
 	ID          int       `json:"id" db:"id"`
 	Login       string    `json:"login" db:"login"`
 	Password    string    `json:"-" db:"password"`
-	Email       string    `json:"email" db:"email"`
+	Email       string    `json:"email" db:"-"`
 	FirstName   string    `json:"first_name" db:"first_name"`
 	LastName    string    `json:"last_name" db:"last_name"`
-	BirthDate   time.Time `json:"birth_date" db:"birth_date"`
-	PhoneNumber string    `json:"phone_number" db:"phone_number"`
+	BirthDate   time.Time `json:"birth_date" db:"-"`
+	PhoneNumber string    `json:"phone_number" db:"-"`
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+
+	pii.Sealed `json:"-"`
+
+	EmailVerifiedAt *time.Time `json:"email_verified_at" db:"email_verified_at"`
+	IsPrivate       bool       `json:"is_private" db:"is_private"`
+	AvatarID        *string    `json:"avatar_id" db:"avatar_id"`
+	DeletedAt       *time.Time `json:"deleted_at" db:"deleted_at"`
+
+	Bio             string          `json:"bio" db:"bio"`
+	Location        string          `json:"location" db:"location"`
+	Website         string          `json:"website" db:"website"`
+	Pronouns        string          `json:"pronouns" db:"pronouns"`
+	Links           ProfileLinks    `json:"links" db:"links"`
+	FieldVisibility FieldVisibility `json:"field_visibility" db:"field_visibility"`
+
+	SuspendedUntil    *time.Time `json:"suspended_until" db:"suspended_until"`
+	BannedAt          *time.Time `json:"banned_at" db:"banned_at"`
+	RestrictionReason string     `json:"restriction_reason" db:"restriction_reason"`
 }
 
-func NewUserRepository(db *sqlx.DB) UserRepository {
-	return &UserRepositorySpec{db: db}
+func NewUserRepository(db *sqlx.DB, cipher *pii.Cipher) UserRepository {
+	return &UserRepositorySpec{db: db, pii: cipher}
 }
 
+// CreateUser takes the id from the sequence first, as the encrypted columns
+// are bound to it.
 func (r *UserRepositorySpec) CreateUser(ctx context.Context, user *User) (int, error) {
-	query := `
-        INSERT INTO users (login, password, email, first_name, last_name, birth_date, phone_number, created_at, updated_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
-        RETURNING id
-    `
 	var id int
-	err := r.db.QueryRowContext(ctx, query,
-		user.Login, user.Password, user.Email, user.FirstName, user.LastName, user.BirthDate, user.PhoneNumber, user.CreatedAt, user.UpdatedAt,
-	).Scan(&id)
+	if err := r.db.GetContext(ctx, &id, "SELECT nextval(pg_get_serial_sequence('users', 'id'))"); err != nil {
+		return 0, err
+	}
+	sealed, err := r.pii.Seal(id, pii.Fields{Email: user.Email, PhoneNumber: user.PhoneNumber, BirthDate: user.BirthDate})
 	if err != nil {
 		return 0, err
 	}
+
+	query := `
+        INSERT INTO users (id, login, password, email, email_index, first_name, last_name, birth_date, phone_number, created_at, updated_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+    `
+	_, err = r.db.ExecContext(ctx, query,
+		id, user.Login, user.Password, sealed.Email, sealed.EmailIndex, user.FirstName, user.LastName, sealed.BirthDate, sealed.PhoneNumber, user.CreatedAt, user.UpdatedAt,
+	)
+	if err != nil {
+		return 0, uniqueViolation(err)
+	}
 	return id, nil
 }
 
 func (r *UserRepositorySpec) GetUserByLogin(ctx context.Context, login string) (*User, error) {
-	var user User
-	err := r.db.GetContext(ctx, &user, "SELECT * FROM users WHERE login = $1", login)
+	return r.getUser(ctx, "SELECT * FROM users WHERE login = $1 AND deleted_at IS NULL", login)
+}
+
+// UpdateUser writes only the given profile fields of user. Changing the email
+// drops its verification.
+func (r *UserRepositorySpec) UpdateUser(ctx context.Context, user *User, fields []string) error {
+	email, emailIndex, err := r.pii.SealEmail(user.ID, user.Email)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return &user, nil
+	phoneNumber, err := r.pii.SealPhoneNumber(user.ID, user.PhoneNumber)
+	if err != nil {
+		return err
+	}
+	birthDate, err := r.pii.SealBirthDate(user.ID, user.BirthDate)
+	if err != nil {
+		return err
+	}
+	values := map[string]any{
+		"email":        email,
+		"first_name":   user.FirstName,
+		"last_name":    user.LastName,
+		"birth_date":   birthDate,
+		"phone_number": phoneNumber,
+		"bio":          user.Bio,
+		"location":     user.Location,
+		"website":      user.Website,
+		"pronouns":     user.Pronouns,
+		"links":        user.Links,
+	}
+
+	set := []string{"updated_at = $1"}
+	args := []any{user.UpdatedAt}
+	for _, field := range fields {
+		column, ok := userColumns[field]
+		if !ok {
+			return fmt.Errorf("unknown user field %q", field)
+		}
+		args = append(args, values[field])
+		set = append(set, fmt.Sprintf("%s = $%d", column, len(args)))
+		if field == "email" {
+			args = append(args, emailIndex)
+			set = append(set,
+				fmt.Sprintf("email_index = $%d", len(args)),
+				fmt.Sprintf("email_verified_at = CASE WHEN email_index = $%d THEN email_verified_at END", len(args)),
+			)
+		}
+	}
+	args = append(args, user.ID)
+
+	query := fmt.Sprintf("UPDATE users SET %s WHERE id = $%d AND deleted_at IS NULL", strings.Join(set, ", "), len(args))
+	result, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return uniqueViolation(err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
 }
 
-func (r *UserRepositorySpec) UpdateUser(ctx context.Context, user *User) error {
-	query := `
-        UPDATE users
-        SET email = $1, first_name = $2, last_name = $3, birth_date = $4, phone_number = $5, updated_at = $6
-        WHERE id = $7
-    `
-	_, err := r.db.ExecContext(ctx, query,
-		user.Email, user.FirstName, user.LastName, user.BirthDate, user.PhoneNumber, user.UpdatedAt, user.ID,
+func (r *UserRepositorySpec) UpdatePassword(ctx context.Context, id int, hashedPassword string) error {
+	_, err := r.db.ExecContext(ctx,
+		"UPDATE users SET password = $1, updated_at = $2 WHERE id = $3",
+		hashedPassword, time.Now(), id,
 	)
 	return err
 }
 
 func (r *UserRepositorySpec) GetUserByID(ctx context.Context, id int) (*User, error) {
-	var user User
-	err := r.db.GetContext(ctx, &user, "SELECT * FROM users WHERE id = $1", id)
+	return r.getUser(ctx, "SELECT * FROM users WHERE id = $1 AND deleted_at IS NULL", id)
+}
+
+// GetUserByEmail finds the user by the blind index of email.
+func (r *UserRepositorySpec) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	emailIndex, err := r.pii.EmailIndex(email)
 	if err != nil {
 		return nil, err
 	}
+	return r.getUser(ctx, "SELECT * FROM users WHERE email_index = $1 AND deleted_at IS NULL", emailIndex)
+}
+
+func (r *UserRepositorySpec) getUser(ctx context.Context, query string, args ...any) (*User, error) {
+	var user User
+	if err := r.db.GetContext(ctx, &user, query, args...); err != nil {
+		return nil, err
+	}
+	if err := openUser(r.pii, &user); err != nil {
+		return nil, err
+	}
 	return &user, nil
 }
+
+// GetUsersByIDs returns the existing users among ids in no particular order.
+func (r *UserRepositorySpec) GetUsersByIDs(ctx context.Context, ids []int) ([]User, error) {
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?) AND deleted_at IS NULL", ids)
+	if err != nil {
+		return nil, err
+	}
+	var users []User
+	if err := r.db.SelectContext(ctx, &users, r.db.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if err := openUser(r.pii, &users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// MarkEmailVerified only succeeds while the user still has the address the
+// verification link was sent to.
+func (r *UserRepositorySpec) MarkEmailVerified(ctx context.Context, id int, emailIndex []byte) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE users SET email_verified_at = COALESCE(email_verified_at, $1) WHERE id = $2 AND email_index = $3",
+		time.Now(), id, emailIndex,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	return nil
+}
+
+// SetPrivate switches the account privacy. Pending follow requests are
+// approved when the account becomes public.
+func (r *UserRepositorySpec) SetPrivate(ctx context.Context, id int, private bool) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	result, err := tx.ExecContext(ctx,
+		"UPDATE users SET is_private = $1, updated_at = $2 WHERE id = $3 AND deleted_at IS NULL",
+		private, now, id,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	if !private {
+		_, err = tx.ExecContext(ctx,
+			"UPDATE follows SET status = $1, accepted_at = $2 WHERE followee_id = $3 AND status = $4",
+			followStatusActive, now, id, followStatusPending,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// uniqueViolation turns a unique constraint error on users into the error
+// naming the taken field.
+func uniqueViolation(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != pgUniqueViolation {
+		return err
+	}
+	switch pqErr.Constraint {
+	case "users_email_index_key":
+		return ErrEmailTaken
+	case "users_login_key":
+		return ErrLoginTaken
+	}
+	return err
+}
+
+// SetAvatar replaces the avatar of a user, nil removing it, and returns the
+// previous one.
+func (r *UserRepositorySpec) SetAvatar(ctx context.Context, id int, avatarID *string) (*string, error) {
+	var previous *string
+	err := r.db.GetContext(ctx, &previous, `
+        UPDATE users u
+        SET avatar_id = $1, updated_at = $2
+        FROM (SELECT id, avatar_id FROM users WHERE id = $3 AND deleted_at IS NULL FOR UPDATE) old
+        WHERE u.id = old.id
+        RETURNING old.avatar_id
+    `, avatarID, time.Now(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// GetAvatarID also sees users that are deleted, so that their avatar can be
+// erased before they are purged.
+func (r *UserRepositorySpec) GetAvatarID(ctx context.Context, id int) (*string, error) {
+	var avatarID *string
+	err := r.db.GetContext(ctx, &avatarID, "SELECT avatar_id FROM users WHERE id = $1", id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return avatarID, nil
+}
+
+// UpdateFieldVisibility merges changes into the visibility settings of a user
+// and returns the result.
+func (r *UserRepositorySpec) UpdateFieldVisibility(ctx context.Context, id int, changes FieldVisibility) (FieldVisibility, error) {
+	var visibility FieldVisibility
+	err := r.db.GetContext(ctx, &visibility, `
+        UPDATE users
+        SET field_visibility = field_visibility || $1::jsonb, updated_at = $2
+        WHERE id = $3 AND deleted_at IS NULL
+        RETURNING field_visibility
+    `, changes, time.Now(), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrUserNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return visibility, nil
+}
+
+// SetRestriction replaces the suspension and ban of a user, nil lifting them.
+// Unless revokeReason is empty, all sessions of the user are revoked with it
+// in the same transaction.
+func (r *UserRepositorySpec) SetRestriction(ctx context.Context, id int, suspendedUntil, bannedAt *time.Time, reason, revokeReason string, audit *AuditEntry) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+        UPDATE users SET suspended_until = $1, banned_at = $2, restriction_reason = $3, updated_at = $4
+        WHERE id = $5 AND deleted_at IS NULL
+    `, suspendedUntil, bannedAt, reason, time.Now(), id)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrUserNotFound
+	}
+	if revokeReason != "" {
+		if err := revokeAllSessions(ctx, tx, id, "", revokeReason); err != nil {
+			return err
+		}
+	}
+	if err := insertAuditEntry(ctx, tx, audit); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// openUser decrypts the personal fields of a user read from the database.
+func openUser(cipher *pii.Cipher, user *User) error {
+	fields, err := cipher.Open(user.ID, &user.Sealed)
+	if err != nil {
+		return err
+	}
+	user.Email, user.PhoneNumber, user.BirthDate = fields.Email, fields.PhoneNumber, fields.BirthDate
+	return nil
+}
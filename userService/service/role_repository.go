@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrRoleNotFound   = errors.New("role not found")
+	ErrRoleExists     = errors.New("role already exists")
+	ErrRoleNotGranted = errors.New("role not granted")
+)
+
+const (
+	pgUniqueViolation     = "23505"
+	pgForeignKeyViolation = "23503"
+)
+
+type RoleRepository interface {
+	CreateRole(ctx context.Context, role *Role, audit *AuditEntry) (int, error)
+	ListRoles(ctx context.Context, includeHidden bool) ([]*Role, error)
+	GrantRole(ctx context.Context, userID int, roleName string, audit *AuditEntry) error
+	RevokeRole(ctx context.Context, userID int, roleName string, audit *AuditEntry) error
+	GetUserRoles(ctx context.Context, userID int) ([]*Role, error)
+}
+
+type RoleRepositorySpec struct {
+	db *sqlx.DB
+}
+
+type Permissions []string
+
+func (p Permissions) Value() (driver.Value, error) {
+	if p == nil {
+		return "[]", nil
+	}
+	data, err := json.Marshal([]string(p))
+	if err != nil {
+		return nil, err
+	}
+	return string(data), nil
+}
+
+func (p *Permissions) Scan(src interface{}) error {
+	var data []byte
+	switch v := src.(type) {
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	case nil:
+		*p = nil
+		return nil
+	default:
+		return fmt.Errorf("unsupported permissions type %T", src)
+	}
+	return json.Unmarshal(data, (*[]string)(p))
+}
+
+type Role struct {
+	ID          int         `db:"id"`
+	Name        string      `db:"name"`
+	Description string      `db:"description"`
+	Permissions Permissions `db:"permissions"`
+	IsHidden    bool        `db:"is_hidden"`
+}
+
+func NewRoleRepository(db *sqlx.DB) RoleRepository {
+	return &RoleRepositorySpec{db: db}
+}
+
+func (r *RoleRepositorySpec) CreateRole(ctx context.Context, role *Role, audit *AuditEntry) (int, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO roles (name, description, permissions, is_hidden) VALUES ($1, $2, $3, $4) RETURNING id",
+		role.Name, role.Description, role.Permissions, role.IsHidden,
+	).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgUniqueViolation {
+		return 0, ErrRoleExists
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := insertAuditEntry(ctx, tx, audit); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+func (r *RoleRepositorySpec) ListRoles(ctx context.Context, includeHidden bool) ([]*Role, error) {
+	var roles []*Role
+	err := r.db.SelectContext(ctx, &roles,
+		"SELECT id, name, description, permissions, is_hidden FROM roles WHERE $1 OR NOT is_hidden ORDER BY id",
+		includeHidden,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
+
+func (r *RoleRepositorySpec) GrantRole(ctx context.Context, userID int, roleName string, audit *AuditEntry) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+        INSERT INTO user_roles (user_id, role_id)
+        SELECT $1, id FROM roles WHERE name = $2
+        ON CONFLICT (user_id, role_id) DO NOTHING
+    `, userID, roleName)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == pgForeignKeyViolation {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		var exists bool
+		if err := tx.GetContext(ctx, &exists, "SELECT EXISTS (SELECT 1 FROM roles WHERE name = $1)", roleName); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrRoleNotFound
+		}
+	}
+	if err := insertAuditEntry(ctx, tx, audit); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *RoleRepositorySpec) RevokeRole(ctx context.Context, userID int, roleName string, audit *AuditEntry) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+        DELETE FROM user_roles
+        WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)
+    `, userID, roleName)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRoleNotGranted
+	}
+	if err := insertAuditEntry(ctx, tx, audit); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *RoleRepositorySpec) GetUserRoles(ctx context.Context, userID int) ([]*Role, error) {
+	var roles []*Role
+	err := r.db.SelectContext(ctx, &roles, `
+        SELECT r.id, r.name, r.description, r.permissions, r.is_hidden
+        FROM roles r
+        JOIN user_roles ur ON ur.role_id = r.id
+        WHERE ur.user_id = $1
+        ORDER BY r.id
+    `, userID)
+	if err != nil {
+		return nil, err
+	}
+	return roles, nil
+}
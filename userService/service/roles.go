@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func roleToProto(role *Role) *pb.Role {
+	return &pb.Role{
+		Id:          int32(role.ID),
+		Name:        role.Name,
+		Description: role.Description,
+		Permissions: role.Permissions,
+		IsHidden:    role.IsHidden,
+	}
+}
+
+func (s *UserService) CreateRole(ctx context.Context, req *pb.CreateRoleRequest) (*pb.Role, error) {
+	admin, err := auth.RequirePermission(ctx, auth.PermissionManageRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	role := &Role{
+		Name:        req.Name,
+		Description: req.Description,
+		Permissions: req.Permissions,
+		IsHidden:    req.IsHidden,
+	}
+	audit := newAuditEntry(ctx, admin, auditActionCreateRole, 0, "", AuditDetails{
+		"role":        role.Name,
+		"permissions": strings.Join(role.Permissions, ","),
+	})
+	id, err := s.roles.CreateRole(ctx, role, audit)
+	if errors.Is(err, ErrRoleExists) {
+		return nil, status.Errorf(codes.AlreadyExists, "role %s already exists", req.Name)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create role: %v", err)
+	}
+	role.ID = id
+	return roleToProto(role), nil
+}
+
+func (s *UserService) ListRoles(ctx context.Context, req *pb.ListRolesRequest) (*pb.ListRolesResponse, error) {
+	if _, err := auth.RequirePermission(ctx, auth.PermissionManageRoles); err != nil {
+		return nil, err
+	}
+
+	roles, err := s.roles.ListRoles(ctx, true)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list roles: %v", err)
+	}
+
+	resp := &pb.ListRolesResponse{}
+	for _, role := range roles {
+		resp.Roles = append(resp.Roles, roleToProto(role))
+	}
+	return resp, nil
+}
+
+func (s *UserService) GrantRole(ctx context.Context, req *pb.GrantRoleRequest) (*pb.GrantRoleResponse, error) {
+	admin, err := auth.RequirePermission(ctx, auth.PermissionManageRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := newAuditEntry(ctx, admin, auditActionGrantRole, int(req.UserId), "", AuditDetails{"role": req.Role})
+	err = s.roles.GrantRole(ctx, int(req.UserId), req.Role, audit)
+	switch {
+	case errors.Is(err, ErrRoleNotFound):
+		return nil, status.Errorf(codes.NotFound, "role %s not found", req.Role)
+	case errors.Is(err, ErrUserNotFound):
+		return nil, status.Error(codes.NotFound, "user not found")
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to grant role: %v", err)
+	}
+	return &pb.GrantRoleResponse{}, nil
+}
+
+func (s *UserService) RevokeRole(ctx context.Context, req *pb.RevokeRoleRequest) (*pb.RevokeRoleResponse, error) {
+	admin, err := auth.RequirePermission(ctx, auth.PermissionManageRoles)
+	if err != nil {
+		return nil, err
+	}
+
+	audit := newAuditEntry(ctx, admin, auditActionRevokeRole, int(req.UserId), "", AuditDetails{"role": req.Role})
+	err = s.roles.RevokeRole(ctx, int(req.UserId), req.Role, audit)
+	if errors.Is(err, ErrRoleNotGranted) {
+		return nil, status.Errorf(codes.NotFound, "user has no role %s", req.Role)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke role: %v", err)
+	}
+	return &pb.RevokeRoleResponse{}, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s *UserService) SearchUsers(ctx context.Context, req *pb.SearchUsersRequest) (*pb.SearchUsersResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	after, err := DecodeScoreCursor(req.Cursor)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid cursor")
+	}
+
+	limit := pageSize(req.PageSize)
+	results, err := s.search.SearchUsers(ctx, req.Query, tokenInfo.UserID, after, limit+1)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to search users: %v", err)
+	}
+
+	resp := &pb.SearchUsersResponse{}
+	if len(results) > limit {
+		results = results[:limit]
+		last := results[limit-1]
+		resp.NextCursor = ScoreCursor{Score: last.Score, ID: last.ID}.Encode()
+	}
+
+	ids := make([]int, 0, len(results))
+	for _, result := range results {
+		ids = append(ids, result.ID)
+	}
+	counts, err := s.follows.CountFollows(ctx, ids)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count follows: %v", err)
+	}
+	audiences, err := s.audiences(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range results {
+		resp.Users = append(resp.Users, s.publicProfile(&results[i].User, counts[results[i].ID], audiences[results[i].ID]))
+	}
+	return resp, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Nicvod/SOA/userService/pii"
+	"github.com/jmoiron/sqlx"
+)
+
+// Scores added to the trigram similarity of a result whose login or one of
+// whose names starts with the query.
+const (
+	loginPrefixBoost = 1.0
+	namePrefixBoost  = 0.5
+)
+
+// nameExpr must match the expression of idx_users_name_trgm.
+const nameExpr = "lower(coalesce(u.first_name, '') || ' ' || coalesce(u.last_name, ''))"
+
+type SearchResult struct {
+	User
+	Score float64 `db:"score"`
+}
+
+type SearchRepository interface {
+	SearchUsers(ctx context.Context, query string, viewerID int, after *ScoreCursor, limit int) ([]SearchResult, error)
+}
+
+type SearchRepositorySpec struct {
+	db  *sqlx.DB
+	pii *pii.Cipher
+}
+
+func NewSearchRepository(db *sqlx.DB, cipher *pii.Cipher) SearchRepository {
+	return &SearchRepositorySpec{db: db, pii: cipher}
+}
+
+// SearchUsers finds users whose login or name is similar to query, best
+// matches first. Names of private accounts are not searched, and users
+// blocked by or blocking the viewer are left out.
+func (r *SearchRepositorySpec) SearchUsers(ctx context.Context, query string, viewerID int, after *ScoreCursor, limit int) ([]SearchResult, error) {
+	query = strings.ToLower(strings.TrimSpace(query))
+	prefix := escapeLike(query) + "%"
+
+	sql := fmt.Sprintf(`
+        SELECT * FROM (
+            SELECT u.*, (
+                GREATEST(
+                    similarity(lower(u.login), $1),
+                    CASE WHEN u.is_private THEN 0 ELSE word_similarity($1, %[1]s) END
+                )
+                + CASE WHEN lower(u.login) LIKE $2 THEN $4::float8 ELSE 0 END
+                + CASE WHEN NOT u.is_private AND ' ' || %[1]s LIKE '%% ' || $2 THEN $5::float8 ELSE 0 END
+            )::float8 AS score
+            FROM users u
+            WHERE u.deleted_at IS NULL AND (
+                lower(u.login) %% $1
+                OR lower(u.login) LIKE $2
+                OR (NOT u.is_private AND ($1 <%% %[1]s OR ' ' || %[1]s LIKE '%% ' || $2))
+            )
+            AND NOT EXISTS (
+                SELECT 1 FROM blocks b
+                WHERE (b.blocker_id = u.id AND b.blocked_id = $3) OR (b.blocker_id = $3 AND b.blocked_id = u.id)
+            )
+        ) results`, nameExpr)
+	args := []any{query, prefix, viewerID, loginPrefixBoost, namePrefixBoost}
+	if after != nil {
+		sql += " WHERE (score, id) < ($6, $7)"
+		args = append(args, after.Score, after.ID)
+	}
+	sql += fmt.Sprintf(" ORDER BY score DESC, id DESC LIMIT %d", limit)
+
+	var results []SearchResult
+	if err := r.db.SelectContext(ctx, &results, sql, args...); err != nil {
+		return nil, err
+	}
+	for i := range results {
+		if err := openUser(r.pii, &results[i].User); err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
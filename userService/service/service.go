@@ -2,12 +2,25 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"strings"
 	"time"
 
+	post_proto "github.com/Nicvod/SOA/postService/post_proto"
 	pb "github.com/Nicvod/SOA/userService/user_proto"
 
+	"github.com/Nicvod/SOA/userService/oidc"
+	"github.com/Nicvod/SOA/userService/pii"
+	"github.com/Nicvod/SOA/userService/webauthn"
 	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/blob"
+	"github.com/Nicvod/SOA/utils/secrets"
+	"github.com/jmoiron/sqlx"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -15,16 +28,143 @@ import (
 
 type UserService struct {
 	repo         UserRepository
+	tokens       TokenRepository
+	roles        RoleRepository
+	twoFactor    TwoFactorRepository
+	actionTokens ActionTokenRepository
 	authProvider auth.AuthProvider
+	hasher       auth.PasswordHasher
+	throttles    ThrottleRepository
+	follows      FollowRepository
+	relations    RelationRepository
+	search       SearchRepository
+	deletions    DeletionRepository
+	exports      ExportRepository
+	documents    DocumentRepository
+	audits       AuditRepository
+	identities   IdentityRepository
+	oauth        OAuthRepository
+	passkeys     PasskeyRepository
+	pii          *pii.Cipher
+	posts        post_proto.PostServiceClient
+	blobs        blob.Store
+	mailer       Mailer
+	totpIssuer   string
+	publicURL    string
+	loginLockout LockoutPolicy
+	ipLockout    LockoutPolicy
+	dummyHash    string
+
+	deletionGracePeriod time.Duration
+	deletionKick        chan struct{}
+	exportTTL           time.Duration
+	exportLinkTTL       time.Duration
+	exportKick          chan struct{}
+	avatarMaxBytes      int
+	masterKeys          *secrets.MasterKeys
+	oidcProviders       []*oidc.Provider
+	relyingParty        *webauthn.RelyingParty
 	pb.UnimplementedUserServiceServer
 }
 
-func NewUserService(repo UserRepository, tokenManager auth.AuthProvider) *UserService {
-	return &UserService{repo: repo, authProvider: tokenManager}
+type Repositories struct {
+	Users        UserRepository
+	Tokens       TokenRepository
+	Roles        RoleRepository
+	TwoFactor    TwoFactorRepository
+	ActionTokens ActionTokenRepository
+	Throttles    ThrottleRepository
+	Follows      FollowRepository
+	Relations    RelationRepository
+	Search       SearchRepository
+	Deletions    DeletionRepository
+	Exports      ExportRepository
+	Documents    DocumentRepository
+	Audits       AuditRepository
+	Identities   IdentityRepository
+	OAuth        OAuthRepository
+	Passkeys     PasskeyRepository
+}
+
+func NewRepositories(db *sqlx.DB, cipher *pii.Cipher) Repositories {
+	return Repositories{
+		Users:        NewUserRepository(db, cipher),
+		Tokens:       NewTokenRepository(db),
+		Roles:        NewRoleRepository(db),
+		TwoFactor:    NewTwoFactorRepository(db, cipher),
+		ActionTokens: NewActionTokenRepository(db),
+		Throttles:    NewThrottleRepository(db),
+		Follows:      NewFollowRepository(db),
+		Relations:    NewRelationRepository(db),
+		Search:       NewSearchRepository(db, cipher),
+		Deletions:    NewDeletionRepository(db),
+		Exports:      NewExportRepository(db),
+		Documents:    NewDocumentRepository(db),
+		Audits:       NewAuditRepository(db),
+		Identities:   NewIdentityRepository(db),
+		OAuth:        NewOAuthRepository(db),
+		Passkeys:     NewPasskeyRepository(db),
+	}
+}
+
+func NewUserService(repos Repositories, tokenManager auth.AuthProvider, hasher auth.PasswordHasher, mailer Mailer, posts post_proto.PostServiceClient, blobs blob.Store, masterKeys *secrets.MasterKeys, cfg *Config) (*UserService, error) {
+	dummyHash, err := newDummyPasswordHash(hasher)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := &http.Client{Timeout: oidcRequestTimeout}
+	var oidcProviders []*oidc.Provider
+	for _, providerCfg := range cfg.OIDCProviders {
+		oidcProviders = append(oidcProviders, oidc.NewProvider(providerCfg, httpClient))
+	}
+	relyingParty, err := webauthn.NewRelyingParty(cfg.PublicURL, cfg.PasskeyRPName)
+	if err != nil {
+		return nil, fmt.Errorf("bad public url: %w", err)
+	}
+
+	return &UserService{
+		repo:         repos.Users,
+		tokens:       repos.Tokens,
+		roles:        repos.Roles,
+		twoFactor:    repos.TwoFactor,
+		actionTokens: repos.ActionTokens,
+		authProvider: tokenManager,
+		throttles:    repos.Throttles,
+		follows:      repos.Follows,
+		relations:    repos.Relations,
+		search:       repos.Search,
+		deletions:    repos.Deletions,
+		exports:      repos.Exports,
+		documents:    repos.Documents,
+		audits:       repos.Audits,
+		identities:   repos.Identities,
+		oauth:        repos.OAuth,
+		passkeys:     repos.Passkeys,
+		pii:          pii.NewCipher(masterKeys),
+		posts:        posts,
+		blobs:        blobs,
+		hasher:       hasher,
+		mailer:       mailer,
+		totpIssuer:   cfg.TOTPIssuer,
+		publicURL:    cfg.PublicURL,
+		loginLockout: cfg.LoginLockout,
+		ipLockout:    cfg.IPLockout,
+		dummyHash:    dummyHash,
+
+		deletionGracePeriod: cfg.DeletionGracePeriod,
+		deletionKick:        make(chan struct{}, 1),
+		exportTTL:           cfg.ExportTTL,
+		exportLinkTTL:       cfg.ExportLinkTTL,
+		exportKick:          make(chan struct{}, 1),
+		avatarMaxBytes:      cfg.AvatarMaxBytes,
+		masterKeys:          masterKeys,
+		oidcProviders:       oidcProviders,
+		relyingParty:        relyingParty,
+	}, nil
 }
 
 func (s *UserService) RegisterUser(ctx context.Context, req *pb.RegisterUserRequest) (*pb.RegisterUserResponse, error) {
-	hashedPassword, err := s.authProvider.HashPassword(req.Password)
+	hashedPassword, err := s.hasher.Hash(req.Password)
 	if err != nil {
 		return nil, status.Error(codes.Internal, "failed to hash password")
 	}
@@ -42,79 +182,109 @@ func (s *UserService) RegisterUser(ctx context.Context, req *pb.RegisterUserRequ
 	}
 
 	id, err := s.repo.CreateUser(ctx, user)
+	if errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrLoginTaken) {
+		return nil, alreadyExistsError(err)
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to create user: %v", err)
 	}
 
-	accessToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
-		UserID:    id,
-		UserLogin: req.Login,
-		TokenType: auth.AccessToken,
-	}, time.Hour)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	user.ID = id
+	if err := s.sendEmailVerification(ctx, user); err != nil {
+		log.Printf("failed to send verification email to user %d: %v", id, err)
 	}
-	refreshToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
-		UserID:    id,
-		UserLogin: req.Login,
-		TokenType: auth.RefreshToken,
-	}, time.Hour*24*7)
+
+	tokens, err := s.startSession(ctx, id, req.Login, req.Device)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+		return nil, err
 	}
 
 	return &pb.RegisterUserResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
 	}, nil
 }
 
 func (s *UserService) AuthenticateUser(ctx context.Context, req *pb.AuthenticateUserRequest) (*pb.AuthenticateUserResponse, error) {
-	user, err := s.repo.GetUserByLogin(ctx, req.Login)
-	if err != nil {
-		return nil, status.Errorf(codes.NotFound, "user not found")
+	user, err := s.userByLoginOrEmail(ctx, req.Login)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, status.Errorf(codes.Internal, "failed to get user: %v", err)
+	}
+
+	ip := auth.ClientInfoFromGRPCContext(ctx).IP
+	throttleKey := accountThrottleKey(user, req.Login)
+	if err := s.checkThrottle(ctx, throttleKey, ip); err != nil {
+		return nil, err
+	}
+	if user == nil {
+		// spend the same time on hashing as for an existing login
+		s.hasher.Verify(req.Password, s.dummyHash)
+		s.recordAuthFailure(ctx, throttleKey, ip, nil)
+		return nil, invalidCredentialsError()
 	}
 
-	if !s.authProvider.CheckPassword(req.Password, user.Password) {
-		return nil, status.Errorf(codes.Unauthenticated, "invalid password")
+	ok, needsRehash, err := s.verifyPassword(user, req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check password: %v", err)
+	}
+	if !ok {
+		s.recordAuthFailure(ctx, throttleKey, ip, user)
+		return nil, invalidCredentialsError()
+	}
+	s.resetAccountThrottle(ctx, throttleKey)
+	if err := accountRestrictedError(user); err != nil {
+		return nil, err
+	}
+	if needsRehash {
+		s.rehashPassword(ctx, user.ID, req.Password)
 	}
 
-	accessToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
-		UserID:    user.ID,
-		UserLogin: user.Login,
-		TokenType: auth.AccessToken,
-	}, time.Hour)
+	challenge, methods, err := s.twoFactorChallenge(ctx, user)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+		return nil, err
+	}
+	if challenge != "" {
+		return &pb.AuthenticateUserResponse{
+			TwoFactorRequired: true,
+			ChallengeToken:    challenge,
+			TwoFactorMethods:  methods,
+		}, nil
 	}
-	refreshToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
-		UserID:    user.ID,
-		UserLogin: user.Login,
-		TokenType: auth.RefreshToken,
-	}, time.Hour*24*7)
+
+	tokens, err := s.startSession(ctx, user.ID, user.Login, req.Device)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+		return nil, err
 	}
 
 	return &pb.AuthenticateUserResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
 	}, nil
 }
 
+// userByLoginOrEmail lets users sign in with their email too, logins never
+// contain '@'.
+func (s *UserService) userByLoginOrEmail(ctx context.Context, login string) (*User, error) {
+	if strings.Contains(login, "@") {
+		return s.repo.GetUserByEmail(ctx, login)
+	}
+	return s.repo.GetUserByLogin(ctx, login)
+}
+
 func (s *UserService) GetProfile(ctx context.Context, req *pb.GetProfileRequest) (*pb.GetProfileResponse, error) {
-	tokenInfo, err := s.authProvider.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
 	if err != nil {
-		return nil, status.Errorf(codes.PermissionDenied, "failed to get token: %v", err)
-	}
-	if tokenInfo.TokenType != auth.AccessToken {
-		return nil, status.Errorf(codes.PermissionDenied, "bad token type")
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
 	}
 
 	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
 	if err != nil {
 		return nil, status.Errorf(codes.NotFound, "user not found")
 	}
+	counts, err := s.follows.CountFollows(ctx, []int{user.ID})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to count follows: %v", err)
+	}
 
 	return &pb.GetProfileResponse{
 		Login:       user.Login,
@@ -125,31 +295,55 @@ func (s *UserService) GetProfile(ctx context.Context, req *pb.GetProfileRequest)
 		PhoneNumber: user.PhoneNumber,
 		CreatedAt:   timestamppb.New(user.CreatedAt),
 		UpdatedAt:   timestamppb.New(user.UpdatedAt),
+		Roles:       tokenInfo.Roles,
+
+		EmailVerified:  user.EmailVerifiedAt != nil,
+		FollowersCount: int32(counts[user.ID].Followers),
+		FollowingCount: int32(counts[user.ID].Following),
+		IsPrivate:      user.IsPrivate,
+		Avatar:         s.avatarImages(user),
+
+		Bio:        user.Bio,
+		Location:   user.Location,
+		Website:    user.Website,
+		Pronouns:   user.Pronouns,
+		Links:      user.Links.Proto(),
+		Visibility: user.FieldVisibility.Proto(),
 	}, nil
 }
 
 func (s *UserService) UpdateProfile(ctx context.Context, req *pb.UpdateProfileRequest) (*pb.UpdateProfileResponse, error) {
-	tokenInfo, err := s.authProvider.TokenInfoFromContext(ctx)
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
 	if err != nil {
-		return nil, status.Errorf(codes.PermissionDenied, "failed to get token: %v", err)
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	fields := req.Fields()
+	user := &User{
+		ID:          tokenInfo.UserID,
+		Email:       req.Email,
+		FirstName:   req.FirstName,
+		LastName:    req.LastName,
+		PhoneNumber: req.PhoneNumber,
+		UpdatedAt:   time.Now(),
+		Bio:         req.Bio,
+		Location:    req.Location,
+		Website:     req.Website,
+		Pronouns:    req.Pronouns,
+		Links:       profileLinksFromProto(req.Links),
 	}
-	if tokenInfo.TokenType != auth.AccessToken {
-		return nil, status.Errorf(codes.PermissionDenied, "bad token type")
+	if req.BirthDate != nil {
+		user.BirthDate = req.BirthDate.AsTime()
 	}
 
-	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
-	if err != nil {
+	err = s.repo.UpdateUser(ctx, user, fields)
+	if errors.Is(err, ErrUserNotFound) {
 		return nil, status.Errorf(codes.NotFound, "user not found")
 	}
-
-	user.Email = req.Email
-	user.FirstName = req.FirstName
-	user.LastName = req.LastName
-	user.BirthDate = req.BirthDate.AsTime()
-	user.PhoneNumber = req.PhoneNumber
-	user.UpdatedAt = time.Now()
-
-	if err := s.repo.UpdateUser(ctx, user); err != nil {
+	if errors.Is(err, ErrEmailTaken) || errors.Is(err, ErrLoginTaken) {
+		return nil, alreadyExistsError(err)
+	}
+	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to update user: %v", err)
 	}
 
@@ -157,21 +351,54 @@ func (s *UserService) UpdateProfile(ctx context.Context, req *pb.UpdateProfileRe
 }
 
 func (s *UserService) RefreshToken(ctx context.Context, req *pb.RefreshTokenRequest) (*pb.RefreshTokenResponse, error) {
-	tokenInfo, err := s.authProvider.GetTokenInfo(req.RefreshToken)
+	tokenInfo, err := s.authProvider.ValidateToken(req.RefreshToken, auth.RefreshToken)
+	if errors.Is(err, auth.ErrInvalidTokenType) {
+		return nil, status.Error(codes.InvalidArgument, "bad token type")
+	}
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, "failed to get info from token: %v", err)
 	}
-	log.Println(tokenInfo)
-	if tokenInfo.TokenType != auth.RefreshToken {
-		return nil, status.Error(codes.InvalidArgument, "bad token type")
+	if tokenInfo.Delegated() {
+		return nil, status.Error(codes.InvalidArgument, "tokens of apps are refreshed at the token endpoint")
 	}
-	newAccessToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
-		UserID:    tokenInfo.UserID,
-		UserLogin: tokenInfo.UserLogin,
-		TokenType: auth.AccessToken,
-	}, time.Hour)
+
+	tokens, err := s.rotateSession(ctx, tokenInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.RefreshTokenResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	}, nil
+}
+
+func (s *UserService) rehashPassword(ctx context.Context, userID int, password string) {
+	hashedPassword, err := s.hasher.Hash(password)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to generate new access token: %v", err)
+		log.Printf("failed to rehash password for user %d: %v", userID, err)
+		return
+	}
+	if err := s.repo.UpdatePassword(ctx, userID, hashedPassword); err != nil {
+		log.Printf("failed to store rehashed password for user %d: %v", userID, err)
+	}
+}
+
+// alreadyExistsError reports a taken login or email, naming the field in an
+// ErrorInfo detail so clients can highlight it.
+func alreadyExistsError(err error) error {
+	field := "email"
+	if errors.Is(err, ErrLoginTaken) {
+		field = "login"
+	}
+
+	st := status.New(codes.AlreadyExists, err.Error())
+	detailed, detailErr := st.WithDetails(&errdetails.ErrorInfo{
+		Reason:   "ALREADY_EXISTS",
+		Domain:   "user_service",
+		Metadata: map[string]string{"field": field},
+	})
+	if detailErr != nil {
+		return st.Err()
 	}
-	return &pb.RefreshTokenResponse{AccessToken: newAccessToken}, nil
+	return detailed.Err()
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func (s *UserService) Logout(ctx context.Context, req *pb.LogoutRequest) (*pb.LogoutResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	if tokenInfo.FamilyID == "" {
+		return nil, status.Error(codes.FailedPrecondition, "token is not bound to a session")
+	}
+
+	err = s.tokens.RevokeSession(ctx, tokenInfo.UserID, tokenInfo.FamilyID, revokeReasonLogout)
+	if err != nil && !errors.Is(err, ErrSessionNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+	return &pb.LogoutResponse{}, nil
+}
+
+func (s *UserService) ListSessions(ctx context.Context, req *pb.ListSessionsRequest) (*pb.ListSessionsResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	sessions, err := s.tokens.ListSessions(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list sessions: %v", err)
+	}
+
+	resp := &pb.ListSessionsResponse{}
+	for _, session := range sessions {
+		resp.Sessions = append(resp.Sessions, &pb.Session{
+			Id:              session.FamilyID,
+			Device:          session.Device,
+			UserAgent:       session.UserAgent,
+			Ip:              session.IP,
+			CreatedAt:       timestamppb.New(session.CreatedAt),
+			LastRefreshedAt: timestamppb.New(session.LastRefreshedAt),
+			Current:         session.FamilyID == tokenInfo.FamilyID,
+		})
+	}
+	return resp, nil
+}
+
+func (s *UserService) RevokeSession(ctx context.Context, req *pb.RevokeSessionRequest) (*pb.RevokeSessionResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	if _, err := uuid.Parse(req.SessionId); err != nil {
+		return nil, status.Error(codes.InvalidArgument, "bad session id")
+	}
+
+	err = s.tokens.RevokeSession(ctx, tokenInfo.UserID, req.SessionId, revokeReasonUser)
+	if errors.Is(err, ErrSessionNotFound) {
+		return nil, status.Error(codes.NotFound, "session not found")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to revoke session: %v", err)
+	}
+	return &pb.RevokeSessionResponse{}, nil
+}
+
+func (s *UserService) CheckSession(ctx context.Context, req *pb.CheckSessionRequest) (*pb.CheckSessionResponse, error) {
+	if _, err := uuid.Parse(req.SessionId); err != nil {
+		return &pb.CheckSessionResponse{Active: false}, nil
+	}
+
+	active, err := s.tokens.IsSessionActive(ctx, req.SessionId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check session: %v", err)
+	}
+	return &pb.CheckSessionResponse{Active: active}, nil
+}
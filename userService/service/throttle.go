@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// LockoutPolicy locks a throttle key for BaseDelay after Threshold failures,
+// doubling the delay with each further lockout up to MaxDelay. Counters are
+// forgotten after Window without failures.
+type LockoutPolicy struct {
+	Threshold int
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	Window    time.Duration
+}
+
+func (p LockoutPolicy) delay(lockouts int) time.Duration {
+	delay := p.BaseDelay
+	for i := 0; i < lockouts && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+func (p LockoutPolicy) apply(state *ThrottleState, now time.Time) {
+	if state.LastFailureAt != nil {
+		quiet := now.Sub(*state.LastFailureAt)
+		if quiet > p.Window {
+			state.Failures = 0
+		}
+		if state.Lockouts > 0 && quiet > p.delay(state.Lockouts-1)+p.Window {
+			state.Lockouts = 0
+		}
+	}
+
+	state.Failures++
+	state.LastFailureAt = &now
+	state.Locked = false
+	if p.Threshold > 0 && state.Failures >= p.Threshold {
+		lockedUntil := now.Add(p.delay(state.Lockouts))
+		state.LockedUntil = &lockedUntil
+		state.Lockouts++
+		state.Failures = 0
+		state.Locked = true
+	}
+}
+
+// accountThrottleKey counts failures per account, so every spelling of the
+// login or email that resolves to it shares one counter. Unknown logins are
+// counted by their normalized spelling. user is nil for unknown logins.
+func accountThrottleKey(user *User, login string) string {
+	if user != nil {
+		return userThrottleKey(user.ID)
+	}
+	return loginThrottleKey(login)
+}
+
+func userThrottleKey(userID int) string {
+	return "user:" + strconv.Itoa(userID)
+}
+
+func loginThrottleKey(login string) string {
+	return "login:" + strings.ToLower(strings.TrimSpace(login))
+}
+
+func ipThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+func throttleKeys(accountKey, ip string) []string {
+	keys := []string{accountKey}
+	if ip != "" {
+		keys = append(keys, ipThrottleKey(ip))
+	}
+	return keys
+}
+
+func lockedOutError(until time.Time) error {
+	st := status.New(codes.ResourceExhausted, "too many failed attempts, try again later")
+	detailed, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(time.Until(until).Round(time.Second))})
+	if err != nil {
+		return st.Err()
+	}
+	return detailed.Err()
+}
+
+func invalidCredentialsError() error {
+	return status.Error(codes.Unauthenticated, "invalid login or password")
+}
+
+func (s *UserService) checkThrottle(ctx context.Context, accountKey, ip string) error {
+	lockedUntil, err := s.throttles.LockedUntil(ctx, throttleKeys(accountKey, ip)...)
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to check login attempts: %v", err)
+	}
+	if !lockedUntil.IsZero() {
+		return lockedOutError(lockedUntil)
+	}
+	return nil
+}
+
+// recordAuthFailure counts a failed attempt against the account, whether or
+// not it exists, and against the client IP. user is nil when no unlock email
+// should be sent.
+func (s *UserService) recordAuthFailure(ctx context.Context, accountKey, ip string, user *User) {
+	now := time.Now()
+	state, err := s.throttles.RecordFailure(ctx, accountKey, s.loginLockout, now)
+	if err != nil {
+		log.Printf("failed to record failed login for %q: %v", accountKey, err)
+	} else if state.Locked && user != nil {
+		go s.sendUnlockEmail(context.WithoutCancel(ctx), user, *state.LockedUntil)
+	}
+
+	if ip == "" {
+		return
+	}
+	if _, err := s.throttles.RecordFailure(ctx, ipThrottleKey(ip), s.ipLockout, now); err != nil {
+		log.Printf("failed to record failed login from %s: %v", ip, err)
+	}
+}
+
+func (s *UserService) resetAccountThrottle(ctx context.Context, accountKey string) {
+	if err := s.throttles.Reset(ctx, accountKey, nil); err != nil {
+		log.Printf("failed to reset login attempts for %q: %v", accountKey, err)
+	}
+}
+
+func (s *UserService) sendUnlockEmail(ctx context.Context, user *User, lockedUntil time.Time) {
+	token, err := s.issueActionToken(ctx, user, auth.AccountUnlockToken, actionPurposeAccountUnlock, auth.AccountUnlockTokenTTL)
+	if err != nil {
+		log.Printf("failed to issue unlock token for user %d: %v", user.ID, err)
+		return
+	}
+
+	link := s.publicURL + "/unlock-account?token=" + url.QueryEscape(token)
+	err = s.mailer.Send(ctx, Message{
+		To:      user.Email,
+		Subject: "Your account was locked",
+		Body: fmt.Sprintf(
+			"Hello, %s!\n\nThere were too many failed attempts to sign in to your account, so signing in is blocked until %s.\n\nIf it was you, open the link below to unlock the account now:\n\n%s\n\nIf it was not you, consider changing your password.\n",
+			user.Login, lockedUntil.UTC().Format(time.RFC1123), link,
+		),
+	})
+	if err != nil {
+		log.Printf("failed to send unlock email to user %d: %v", user.ID, err)
+	}
+}
+
+func (s *UserService) UnlockAccount(ctx context.Context, req *pb.UnlockAccountRequest) (*pb.UnlockAccountResponse, error) {
+	token, err := s.redeemActionToken(ctx, req.Token, auth.AccountUnlockToken, actionPurposeAccountUnlock)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByID(ctx, token.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	if err := s.throttles.Reset(ctx, userThrottleKey(user.ID), nil); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unlock account: %v", err)
+	}
+	return &pb.UnlockAccountResponse{}, nil
+}
+
+func (s *UserService) UnlockUser(ctx context.Context, req *pb.UnlockUserRequest) (*pb.UnlockUserResponse, error) {
+	admin, err := auth.RequirePermission(ctx, auth.PermissionManageUsers)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := s.repo.GetUserByID(ctx, int(req.UserId))
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	audit := newAuditEntry(ctx, admin, auditActionUnlockUser, user.ID, "", nil)
+	if err := s.throttles.Reset(ctx, userThrottleKey(user.ID), audit); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unlock account: %v", err)
+	}
+	return &pb.UnlockUserResponse{}, nil
+}
+
+// verifyPassword rejects every password of accounts created through an
+// identity provider until a password is set with a reset link.
+func (s *UserService) verifyPassword(user *User, password string) (bool, bool, error) {
+	if user.Password == "" {
+		s.hasher.Verify(password, s.dummyHash)
+		return false, false, nil
+	}
+	return s.hasher.Verify(password, user.Password)
+}
+
+// newDummyPasswordHash returns a hash of a random password. Unknown logins are
+// checked against it so they take as long as a wrong password.
+func newDummyPasswordHash(hasher auth.PasswordHasher) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	hash, err := hasher.Hash(hex.EncodeToString(buf))
+	if err != nil {
+		return "", fmt.Errorf("failed to hash dummy password: %w", err)
+	}
+	return hash, nil
+}
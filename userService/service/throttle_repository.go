@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+type ThrottleRepository interface {
+	LockedUntil(ctx context.Context, keys ...string) (time.Time, error)
+	RecordFailure(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (*ThrottleState, error)
+	Reset(ctx context.Context, key string, audit *AuditEntry) error
+}
+
+type ThrottleRepositorySpec struct {
+	db *sqlx.DB
+}
+
+type ThrottleState struct {
+	Key           string     `db:"key"`
+	Failures      int        `db:"failures"`
+	Lockouts      int        `db:"lockouts"`
+	LockedUntil   *time.Time `db:"locked_until"`
+	LastFailureAt *time.Time `db:"last_failure_at"`
+
+	// Locked is set when the failure just recorded caused a new lockout.
+	Locked bool `db:"-"`
+}
+
+func NewThrottleRepository(db *sqlx.DB) ThrottleRepository {
+	return &ThrottleRepositorySpec{db: db}
+}
+
+// LockedUntil returns the latest lock expiry among keys, or the zero time
+// when none of them is locked.
+func (r *ThrottleRepositorySpec) LockedUntil(ctx context.Context, keys ...string) (time.Time, error) {
+	var lockedUntil *time.Time
+	query, args, err := sqlx.In("SELECT MAX(locked_until) FROM login_throttles WHERE key IN (?) AND locked_until > ?", keys, time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := r.db.GetContext(ctx, &lockedUntil, r.db.Rebind(query), args...); err != nil {
+		return time.Time{}, err
+	}
+	if lockedUntil == nil {
+		return time.Time{}, nil
+	}
+	return *lockedUntil, nil
+}
+
+func (r *ThrottleRepositorySpec) RecordFailure(ctx context.Context, key string, policy LockoutPolicy, now time.Time) (*ThrottleState, error) {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO login_throttles (key) VALUES ($1) ON CONFLICT (key) DO NOTHING", key); err != nil {
+		return nil, err
+	}
+
+	var state ThrottleState
+	err = tx.GetContext(ctx, &state,
+		"SELECT key, failures, lockouts, locked_until, last_failure_at FROM login_throttles WHERE key = $1 FOR UPDATE",
+		key,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.apply(&state, now)
+
+	_, err = tx.ExecContext(ctx,
+		"UPDATE login_throttles SET failures = $1, lockouts = $2, locked_until = $3, last_failure_at = $4 WHERE key = $5",
+		state.Failures, state.Lockouts, state.LockedUntil, state.LastFailureAt, key,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+func (r *ThrottleRepositorySpec) Reset(ctx context.Context, key string, audit *AuditEntry) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM login_throttles WHERE key = $1", key); err != nil {
+		return err
+	}
+	if err := insertAuditEntry(ctx, tx, audit); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenReused   = errors.New("refresh token reused")
+	ErrTokenFamilyRevoked   = errors.New("token family revoked")
+	ErrSessionNotFound      = errors.New("session not found")
+)
+
+const (
+	revokeReasonReuse  = "refresh token reuse"
+	revokeReasonLogout = "logout"
+	revokeReasonUser   = "revoked by user"
+
+	revokeReasonPasswordReset  = "password reset"
+	revokeReasonPasswordChange = "password change"
+	revokeReasonAccountDeleted = "account deleted"
+	revokeReasonSuspended      = "account suspended"
+	revokeReasonBanned         = "account banned"
+)
+
+type TokenRepository interface {
+	CreateFamily(ctx context.Context, session *Session, first *RefreshTokenRecord, audit *AuditEntry) error
+	RotateRefreshToken(ctx context.Context, jti string, next *RefreshTokenRecord, client auth.ClientInfo) error
+	ListSessions(ctx context.Context, userID int) ([]*Session, error)
+	RevokeSession(ctx context.Context, userID int, familyID, reason string) error
+	RevokeAllSessions(ctx context.Context, userID int, exceptFamilyID, reason string) error
+	IsSessionActive(ctx context.Context, familyID string) (bool, error)
+}
+
+type TokenRepositorySpec struct {
+	db *sqlx.DB
+}
+
+type RefreshTokenRecord struct {
+	JTI       string     `db:"jti"`
+	FamilyID  string     `db:"family_id"`
+	IssuedAt  time.Time  `db:"issued_at"`
+	ExpiresAt time.Time  `db:"expires_at"`
+	UsedAt    *time.Time `db:"used_at"`
+}
+
+type Session struct {
+	FamilyID        string    `db:"family_id"`
+	UserID          int       `db:"user_id"`
+	Device          string    `db:"device"`
+	UserAgent       string    `db:"user_agent"`
+	IP              string    `db:"ip"`
+	ClientID        *string   `db:"client_id"`
+	CreatedAt       time.Time `db:"created_at"`
+	LastRefreshedAt time.Time `db:"last_refreshed_at"`
+}
+
+func NewTokenRepository(db *sqlx.DB) TokenRepository {
+	return &TokenRepositorySpec{db: db}
+}
+
+func (r *TokenRepositorySpec) CreateFamily(ctx context.Context, session *Session, first *RefreshTokenRecord, audit *AuditEntry) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx,
+		"INSERT INTO token_families (id, user_id, created_at) VALUES ($1, $2, $3)",
+		session.FamilyID, session.UserID, session.CreatedAt,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO sessions (family_id, user_id, device, user_agent, ip, client_id, created_at, last_refreshed_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+    `,
+		session.FamilyID, session.UserID, session.Device, session.UserAgent, session.IP, session.ClientID, session.CreatedAt, session.LastRefreshedAt,
+	)
+	if err != nil {
+		return err
+	}
+	if err := insertRefreshToken(ctx, tx, first); err != nil {
+		return err
+	}
+	if err := insertAuditEntry(ctx, tx, audit); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// RotateRefreshToken marks the presented token as used and stores its successor.
+// Presenting a token that was already used revokes the whole family, since it
+// means a copy of the token is in someone else's hands.
+func (r *TokenRepositorySpec) RotateRefreshToken(ctx context.Context, jti string, next *RefreshTokenRecord, client auth.ClientInfo) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current struct {
+		FamilyID  string     `db:"family_id"`
+		UsedAt    *time.Time `db:"used_at"`
+		RevokedAt *time.Time `db:"revoked_at"`
+	}
+	err = tx.GetContext(ctx, &current, `
+        SELECT t.family_id, t.used_at, f.revoked_at
+        FROM refresh_tokens t
+        JOIN token_families f ON f.id = t.family_id
+        WHERE t.jti = $1
+        FOR UPDATE
+    `, jti)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if current.RevokedAt != nil {
+		return ErrTokenFamilyRevoked
+	}
+	if current.UsedAt != nil {
+		if err := revokeFamily(ctx, tx, current.FamilyID, revokeReasonReuse); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return ErrRefreshTokenReused
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE refresh_tokens SET used_at = $1 WHERE jti = $2", next.IssuedAt, jti); err != nil {
+		return err
+	}
+	next.FamilyID = current.FamilyID
+	if err := insertRefreshToken(ctx, tx, next); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+        UPDATE sessions
+        SET last_refreshed_at = $1,
+            ip = COALESCE(NULLIF($2, ''), ip),
+            user_agent = COALESCE(NULLIF($3, ''), user_agent)
+        WHERE family_id = $4
+    `, next.IssuedAt, client.IP, client.UserAgent, current.FamilyID)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *TokenRepositorySpec) ListSessions(ctx context.Context, userID int) ([]*Session, error) {
+	var sessions []*Session
+	err := r.db.SelectContext(ctx, &sessions, `
+        SELECT s.family_id, s.user_id, s.device, s.user_agent, s.ip, s.created_at, s.last_refreshed_at
+        FROM sessions s
+        JOIN token_families f ON f.id = s.family_id
+        WHERE s.user_id = $1 AND f.revoked_at IS NULL AND s.last_refreshed_at > $2
+        ORDER BY s.last_refreshed_at DESC
+    `, userID, time.Now().Add(-auth.RefreshTokenTTL))
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (r *TokenRepositorySpec) RevokeSession(ctx context.Context, userID int, familyID, reason string) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE token_families SET revoked_at = $1, revoke_reason = $2 WHERE id = $3 AND user_id = $4 AND revoked_at IS NULL",
+		time.Now(), reason, familyID, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// RevokeAllSessions revokes every session of the user except exceptFamilyID,
+// which may be empty to revoke them all.
+func (r *TokenRepositorySpec) RevokeAllSessions(ctx context.Context, userID int, exceptFamilyID, reason string) error {
+	return revokeAllSessions(ctx, r.db, userID, exceptFamilyID, reason)
+}
+
+func (r *TokenRepositorySpec) IsSessionActive(ctx context.Context, familyID string) (bool, error) {
+	var active bool
+	err := r.db.GetContext(ctx, &active, `
+        SELECT f.revoked_at IS NULL AND s.last_refreshed_at > $2
+        FROM token_families f
+        JOIN sessions s ON s.family_id = f.id
+        WHERE f.id = $1
+    `, familyID, time.Now().Add(-auth.RefreshTokenTTL))
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return active, nil
+}
+
+func insertRefreshToken(ctx context.Context, db sqlx.ExecerContext, token *RefreshTokenRecord) error {
+	_, err := db.ExecContext(ctx,
+		"INSERT INTO refresh_tokens (jti, family_id, issued_at, expires_at) VALUES ($1, $2, $3, $4)",
+		token.JTI, token.FamilyID, token.IssuedAt, token.ExpiresAt,
+	)
+	return err
+}
+
+func revokeAllSessions(ctx context.Context, db sqlx.ExecerContext, userID int, exceptFamilyID, reason string) error {
+	_, err := db.ExecContext(ctx, `
+        UPDATE token_families
+        SET revoked_at = $1, revoke_reason = $2
+        WHERE user_id = $3 AND revoked_at IS NULL AND id::text <> $4
+    `, time.Now(), reason, userID, exceptFamilyID)
+	return err
+}
+
+func revokeFamily(ctx context.Context, db sqlx.ExecerContext, familyID, reason string) error {
+	_, err := db.ExecContext(ctx,
+		"UPDATE token_families SET revoked_at = $1, revoke_reason = $2 WHERE id = $3 AND revoked_at IS NULL",
+		time.Now(), reason, familyID,
+	)
+	return err
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/google/uuid"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type tokenPair struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+func newRefreshTokenRecord(familyID string) *RefreshTokenRecord {
+	now := time.Now()
+	return &RefreshTokenRecord{
+		JTI:       uuid.NewString(),
+		FamilyID:  familyID,
+		IssuedAt:  now,
+		ExpiresAt: now.Add(auth.RefreshTokenTTL),
+	}
+}
+
+func (s *UserService) startSession(ctx context.Context, userID int, login, device string) (*tokenPair, error) {
+	familyID := uuid.NewString()
+	record := newRefreshTokenRecord(familyID)
+
+	pair, err := s.generateTokenPair(ctx, userID, login, record)
+	if err != nil {
+		return nil, err
+	}
+
+	client := auth.ClientInfoFromGRPCContext(ctx)
+	session := &Session{
+		FamilyID:        familyID,
+		UserID:          userID,
+		Device:          device,
+		UserAgent:       client.UserAgent,
+		IP:              client.IP,
+		CreatedAt:       record.IssuedAt,
+		LastRefreshedAt: record.IssuedAt,
+	}
+	if err := s.tokens.CreateFamily(ctx, session, record, nil); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store refresh token: %v", err)
+	}
+	return pair, nil
+}
+
+func (s *UserService) rotateSession(ctx context.Context, refresh *auth.TokenInfo) (*tokenPair, error) {
+	if refresh.TokenID == "" || refresh.FamilyID == "" {
+		return nil, status.Error(codes.Unauthenticated, "refresh token is no longer accepted, please log in again")
+	}
+
+	record := newRefreshTokenRecord(refresh.FamilyID)
+	var pair *tokenPair
+	var err error
+	if refresh.Delegated() {
+		pair, err = s.appTokenPair(refresh.UserID, refresh.UserLogin, refresh.ClientID, refresh.Scopes, record)
+	} else {
+		pair, err = s.generateTokenPair(ctx, refresh.UserID, refresh.UserLogin, record)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.tokens.RotateRefreshToken(ctx, refresh.TokenID, record, auth.ClientInfoFromGRPCContext(ctx))
+	switch {
+	case errors.Is(err, ErrRefreshTokenReused):
+		return nil, status.Error(codes.Unauthenticated, "refresh token was already used, session revoked")
+	case errors.Is(err, ErrRefreshTokenNotFound), errors.Is(err, ErrTokenFamilyRevoked):
+		return nil, status.Error(codes.Unauthenticated, "refresh token revoked")
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "failed to rotate refresh token: %v", err)
+	}
+	return pair, nil
+}
+
+// userGrants collects role names and the union of their permissions, which are
+// embedded into access tokens so other services can authorize without a lookup.
+func (s *UserService) userGrants(ctx context.Context, userID int) ([]string, []string, error) {
+	userRoles, err := s.roles.GetUserRoles(ctx, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var roles, permissions []string
+	seen := make(map[string]bool)
+	for _, role := range userRoles {
+		roles = append(roles, role.Name)
+		for _, permission := range role.Permissions {
+			if !seen[permission] {
+				seen[permission] = true
+				permissions = append(permissions, permission)
+			}
+		}
+	}
+	return roles, permissions, nil
+}
+
+func (s *UserService) generateTokenPair(ctx context.Context, userID int, login string, refresh *RefreshTokenRecord) (*tokenPair, error) {
+	roles, permissions, err := s.userGrants(ctx, userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to load roles: %v", err)
+	}
+
+	accessToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:      userID,
+		UserLogin:   login,
+		TokenType:   auth.AccessToken,
+		FamilyID:    refresh.FamilyID,
+		Roles:       roles,
+		Permissions: permissions,
+	}, auth.AccessTokenTTL)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	refreshToken, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:    userID,
+		UserLogin: login,
+		TokenType: auth.RefreshToken,
+		TokenID:   refresh.JTI,
+		FamilyID:  refresh.FamilyID,
+	}, refresh.ExpiresAt.Sub(refresh.IssuedAt))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	return &tokenPair{AccessToken: accessToken, RefreshToken: refreshToken}, nil
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"time"
+
+	pb "github.com/Nicvod/SOA/userService/user_proto"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	recoveryCodeCount = 10
+	recoveryCodeSize  = 5
+
+	twoFactorMethodTOTP    = "totp"
+	twoFactorMethodPasskey = "passkey"
+)
+
+func (s *UserService) EnrollTOTP(ctx context.Context, req *pb.EnrollTOTPRequest) (*pb.EnrollTOTPResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	secret, err := newTOTPSecret()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate secret: %v", err)
+	}
+
+	err = s.twoFactor.SavePendingTOTP(ctx, tokenInfo.UserID, secret)
+	if errors.Is(err, ErrTOTPAlreadyEnabled) {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is already enabled")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store secret: %v", err)
+	}
+
+	return &pb.EnrollTOTPResponse{
+		Secret:          secret,
+		ProvisioningUri: totpProvisioningURI(s.totpIssuer, tokenInfo.UserLogin, secret),
+	}, nil
+}
+
+func (s *UserService) ConfirmTOTP(ctx context.Context, req *pb.ConfirmTOTPRequest) (*pb.ConfirmTOTPResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	totp, err := s.twoFactor.GetTOTP(ctx, tokenInfo.UserID)
+	if errors.Is(err, ErrTOTPNotFound) {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor enrollment was not started")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to get secret: %v", err)
+	}
+	if totp.Enabled() {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is already enabled")
+	}
+
+	step, ok := validateTOTP(totp.Secret, req.Code, time.Now())
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "invalid two-factor code")
+	}
+
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate recovery codes: %v", err)
+	}
+
+	err = s.twoFactor.ConfirmTOTP(ctx, tokenInfo.UserID, step, hashes)
+	if errors.Is(err, ErrTOTPAlreadyEnabled) {
+		return nil, status.Error(codes.FailedPrecondition, "two-factor authentication is already enabled")
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to enable two-factor authentication: %v", err)
+	}
+	return &pb.ConfirmTOTPResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (s *UserService) DisableTOTP(ctx context.Context, req *pb.DisableTOTPRequest) (*pb.DisableTOTPResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	user, err := s.repo.GetUserByID(ctx, tokenInfo.UserID)
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "user not found")
+	}
+	ok, _, err := s.verifyPassword(user, req.Password)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to check password: %v", err)
+	}
+	if !ok {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid password")
+	}
+
+	if err := s.verifySecondFactor(ctx, tokenInfo.UserID, req.Code); err != nil {
+		return nil, err
+	}
+	if err := s.twoFactor.DeleteTOTP(ctx, tokenInfo.UserID); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to disable two-factor authentication: %v", err)
+	}
+	return &pb.DisableTOTPResponse{}, nil
+}
+
+func (s *UserService) GenerateRecoveryCodes(ctx context.Context, req *pb.GenerateRecoveryCodesRequest) (*pb.GenerateRecoveryCodesResponse, error) {
+	tokenInfo, err := auth.TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+
+	if err := s.verifySecondFactor(ctx, tokenInfo.UserID, req.Code); err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to generate recovery codes: %v", err)
+	}
+	if err := s.twoFactor.ReplaceRecoveryCodes(ctx, tokenInfo.UserID, hashes); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to store recovery codes: %v", err)
+	}
+	return &pb.GenerateRecoveryCodesResponse{RecoveryCodes: recoveryCodes}, nil
+}
+
+func (s *UserService) VerifyTwoFactor(ctx context.Context, req *pb.VerifyTwoFactorRequest) (*pb.AuthenticateUserResponse, error) {
+	challenge, err := s.authProvider.ValidateToken(req.ChallengeToken, auth.ChallengeToken)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "invalid challenge token: %v", err)
+	}
+
+	ip := auth.ClientInfoFromGRPCContext(ctx).IP
+	throttleKey := userThrottleKey(challenge.UserID)
+	if err := s.checkThrottle(ctx, throttleKey, ip); err != nil {
+		return nil, err
+	}
+	if err := s.verifySecondFactor(ctx, challenge.UserID, req.Code); err != nil {
+		if status.Code(err) == codes.Unauthenticated {
+			s.recordAuthFailure(ctx, throttleKey, ip, nil)
+		}
+		return nil, err
+	}
+	s.resetAccountThrottle(ctx, throttleKey)
+
+	// the account may have been restricted since the password was checked
+	user, err := s.repo.GetUserByID(ctx, challenge.UserID)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "user not found")
+	}
+	if err := accountRestrictedError(user); err != nil {
+		return nil, err
+	}
+	if err := s.useChallengeToken(ctx, challenge.TokenID, challenge.ExpiresAt); err != nil {
+		return nil, err
+	}
+
+	tokens, err := s.startSession(ctx, challenge.UserID, challenge.UserLogin, req.Device)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.AuthenticateUserResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+	}, nil
+}
+
+// twoFactorChallenge returns a challenge token and the methods that can
+// answer it when the user has confirmed TOTP or registered a passkey, or an
+// empty string when the first factor alone is enough.
+func (s *UserService) twoFactorChallenge(ctx context.Context, user *User) (string, []string, error) {
+	methods, err := s.twoFactorMethods(ctx, user.ID)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(methods) == 0 {
+		return "", nil, nil
+	}
+
+	challenge, err := s.authProvider.GenerateToken(auth.TokenInfo{
+		UserID:    user.ID,
+		UserLogin: user.Login,
+		TokenType: auth.ChallengeToken,
+	}, auth.ChallengeTokenTTL)
+	if err != nil {
+		return "", nil, status.Errorf(codes.Internal, "failed to generate token: %v", err)
+	}
+	return challenge, methods, nil
+}
+
+// useChallengeToken lets a challenge token complete a single login, the
+// second factor it was answered with is used up as well.
+func (s *UserService) useChallengeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	err := s.twoFactor.UseChallengeToken(ctx, jti, expiresAt)
+	if errors.Is(err, ErrChallengeTokenUsed) {
+		return status.Error(codes.Unauthenticated, "challenge token was already used")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to store challenge token use: %v", err)
+	}
+	return nil
+}
+
+func (s *UserService) twoFactorMethods(ctx context.Context, userID int) ([]string, error) {
+	var methods []string
+	totp, err := s.twoFactor.GetTOTP(ctx, userID)
+	if err != nil && !errors.Is(err, ErrTOTPNotFound) {
+		return nil, status.Errorf(codes.Internal, "failed to get two-factor settings: %v", err)
+	}
+	if err == nil && totp.Enabled() {
+		methods = append(methods, twoFactorMethodTOTP)
+	}
+
+	passkeys, err := s.passkeys.ListPasskeys(ctx, userID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to list passkeys: %v", err)
+	}
+	if len(passkeys) > 0 {
+		methods = append(methods, twoFactorMethodPasskey)
+	}
+	return methods, nil
+}
+
+// verifySecondFactor accepts either a current TOTP code or an unused recovery
+// code. Each TOTP time step and each recovery code can be used only once.
+func (s *UserService) verifySecondFactor(ctx context.Context, userID int, code string) error {
+	totp, err := s.twoFactor.GetTOTP(ctx, userID)
+	if errors.Is(err, ErrTOTPNotFound) || (err == nil && !totp.Enabled()) {
+		return status.Error(codes.FailedPrecondition, "two-factor authentication is not enabled")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to get two-factor settings: %v", err)
+	}
+
+	if len(code) == totpDigits {
+		step, ok := validateTOTP(totp.Secret, code, time.Now())
+		if !ok {
+			return status.Error(codes.Unauthenticated, "invalid two-factor code")
+		}
+		err = s.twoFactor.UseTOTPStep(ctx, userID, step)
+		if errors.Is(err, ErrTOTPCodeReused) {
+			return status.Error(codes.Unauthenticated, "two-factor code was already used")
+		}
+		if err != nil {
+			return status.Errorf(codes.Internal, "failed to store two-factor code use: %v", err)
+		}
+		return nil
+	}
+
+	err = s.twoFactor.UseRecoveryCode(ctx, userID, hashRecoveryCode(code))
+	if errors.Is(err, ErrRecoveryCodeNotFound) {
+		return status.Error(codes.Unauthenticated, "invalid two-factor code")
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "failed to use recovery code: %v", err)
+	}
+	return nil
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+	buf := make([]byte, recoveryCodeSize*2)
+	for i := 0; i < recoveryCodeCount; i++ {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, nil, err
+		}
+		encoded := hex.EncodeToString(buf)
+		code := encoded[:len(encoded)/2] + "-" + encoded[len(encoded)/2:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
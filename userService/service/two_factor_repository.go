@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/Nicvod/SOA/userService/pii"
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	ErrTOTPNotFound         = errors.New("totp not enrolled")
+	ErrTOTPAlreadyEnabled   = errors.New("totp already enabled")
+	ErrTOTPCodeReused       = errors.New("totp code already used")
+	ErrRecoveryCodeNotFound = errors.New("recovery code not found")
+	ErrChallengeTokenUsed   = errors.New("challenge token already used")
+)
+
+type TwoFactorRepository interface {
+	SavePendingTOTP(ctx context.Context, userID int, secret string) error
+	GetTOTP(ctx context.Context, userID int) (*TOTPSecret, error)
+	ConfirmTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) error
+	ReplaceRecoveryCodes(ctx context.Context, userID int, recoveryCodeHashes []string) error
+	UseRecoveryCode(ctx context.Context, userID int, codeHash string) error
+	DeleteTOTP(ctx context.Context, userID int) error
+	UseChallengeToken(ctx context.Context, jti string, expiresAt time.Time) error
+}
+
+// TwoFactorRepositorySpec encrypts TOTP secrets on writes and decrypts them
+// on reads, see pii.Cipher.
+type TwoFactorRepositorySpec struct {
+	db  *sqlx.DB
+	pii *pii.Cipher
+}
+
+type TOTPSecret struct {
+	UserID       int        `db:"user_id"`
+	Secret       string     `db:"-"`
+	SealedSecret []byte     `db:"secret"`
+	ConfirmedAt  *time.Time `db:"confirmed_at"`
+	LastUsedStep int64      `db:"last_used_step"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+func (t *TOTPSecret) Enabled() bool {
+	return t != nil && t.ConfirmedAt != nil
+}
+
+func NewTwoFactorRepository(db *sqlx.DB, cipher *pii.Cipher) TwoFactorRepository {
+	return &TwoFactorRepositorySpec{db: db, pii: cipher}
+}
+
+func (r *TwoFactorRepositorySpec) SavePendingTOTP(ctx context.Context, userID int, secret string) error {
+	sealed, err := r.pii.SealTOTPSecret(userID, secret)
+	if err != nil {
+		return err
+	}
+
+	result, err := r.db.ExecContext(ctx, `
+        INSERT INTO user_totp (user_id, secret, created_at)
+        VALUES ($1, $2, $3)
+        ON CONFLICT (user_id) DO UPDATE
+        SET secret = EXCLUDED.secret, created_at = EXCLUDED.created_at, last_used_step = 0
+        WHERE user_totp.confirmed_at IS NULL
+    `, userID, sealed, time.Now())
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+	return nil
+}
+
+func (r *TwoFactorRepositorySpec) GetTOTP(ctx context.Context, userID int) (*TOTPSecret, error) {
+	var secret TOTPSecret
+	err := r.db.GetContext(ctx, &secret,
+		"SELECT user_id, secret, confirmed_at, last_used_step, created_at FROM user_totp WHERE user_id = $1",
+		userID,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTOTPNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if secret.Secret, err = r.pii.OpenTOTPSecret(userID, secret.SealedSecret); err != nil {
+		return nil, err
+	}
+	return &secret, nil
+}
+
+func (r *TwoFactorRepositorySpec) ConfirmTOTP(ctx context.Context, userID int, step int64, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE user_totp SET confirmed_at = $1, last_used_step = $2 WHERE user_id = $3 AND confirmed_at IS NULL",
+		time.Now(), step, userID,
+	)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *TwoFactorRepositorySpec) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE user_totp SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1",
+		step, userID,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTOTPCodeReused
+	}
+	return nil
+}
+
+func (r *TwoFactorRepositorySpec) ReplaceRecoveryCodes(ctx context.Context, userID int, recoveryCodeHashes []string) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *TwoFactorRepositorySpec) UseRecoveryCode(ctx context.Context, userID int, codeHash string) error {
+	result, err := r.db.ExecContext(ctx,
+		"UPDATE recovery_codes SET used_at = $1 WHERE user_id = $2 AND code_hash = $3 AND used_at IS NULL",
+		time.Now(), userID, codeHash,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRecoveryCodeNotFound
+	}
+	return nil
+}
+
+func (r *TwoFactorRepositorySpec) DeleteTOTP(ctx context.Context, userID int) error {
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM user_totp WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseChallengeToken records a challenge token that completed a login, so that
+// it cannot complete another one before it expires.
+func (r *TwoFactorRepositorySpec) UseChallengeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	if _, err := r.db.ExecContext(ctx, "DELETE FROM used_challenge_tokens WHERE expires_at < $1", time.Now()); err != nil {
+		return err
+	}
+	result, err := r.db.ExecContext(ctx,
+		"INSERT INTO used_challenge_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrChallengeTokenUsed
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userID int, recoveryCodeHashes []string) error {
+	if _, err := tx.ExecContext(ctx, "DELETE FROM recovery_codes WHERE user_id = $1", userID); err != nil {
+		return err
+	}
+	for _, codeHash := range recoveryCodeHashes {
+		_, err := tx.ExecContext(ctx,
+			"INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)",
+			userID, codeHash,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// runWorker calls run every interval, and right away when kicked, until ctx
+// is done.
+func runWorker(ctx context.Context, interval time.Duration, kick <-chan struct{}, run func(context.Context)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		run(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-kick:
+		}
+	}
+}
+
+// kickWorker wakes up a worker without waiting for it. Kicks that arrive
+// while one is already queued are merged.
+func kickWorker(kick chan<- struct{}) {
+	select {
+	case kick <- struct{}{}:
+	default:
+	}
+}
+
+// backoff returns the delay before the next of attempts, doubling from base
+// up to max.
+func backoff(attempts int, base, max time.Duration) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	return min(delay, max)
+}
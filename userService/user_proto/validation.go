@@ -0,0 +1,661 @@
+package user_proto
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/Nicvod/SOA/utils/auth"
+	"github.com/Nicvod/SOA/utils/validation"
+)
+
+// MaxBatchUsers limits the ids in one BatchGetUsers call, matching the
+// largest page of posts.
+const MaxBatchUsers = 100
+
+// MaxPageSize limits cursor paginated lists, a zero page size means the
+// default one.
+const MaxPageSize = 100
+
+const (
+	maxSearchQueryLength = 100
+	maxNameLength        = 100
+	maxDeviceLength      = 100
+	maxDescriptionLength = 200
+	maxBioLength         = 500
+	maxLocationLength    = 100
+	maxPronounsLength    = 40
+	maxLinkTitleLength   = 50
+	maxDocNameLength     = 100
+	maxDocSeriesLength   = 20
+	maxDocNumberLength   = 40
+	maxReasonLength      = 500
+	maxActionLength      = 50
+	maxProviderLength    = 50
+	maxOIDCParamLength   = 2048
+	maxClientIDLength    = 64
+	maxOAuthTokenLength  = 4096
+	maxCredentialIDSize  = 1023
+	maxUserHandleSize    = 64
+	maxWebAuthnDataSize  = 16 << 10
+	maxTransportLength   = 32
+	maxTransports        = 8
+)
+
+// MaxRedirectURIs limits the redirect URIs of an OAuth client.
+const MaxRedirectURIs = 10
+
+// MaxSuspension limits how long SuspendUser locks an account out, longer
+// ones are bans.
+const MaxSuspension = 365 * 24 * time.Hour
+
+// MaxProfileLinks limits the custom links of a profile.
+const MaxProfileLinks = 5
+
+var (
+	totpCodePattern   = regexp.MustCompile(`^[0-9]{6}$`)
+	roleNamePattern   = regexp.MustCompile(`^[a-z][a-z0-9_-]{1,31}$`)
+	permissionPattern = regexp.MustCompile(`^[a-z_]+:[a-z_]+$`)
+)
+
+func (r *RegisterUserRequest) Validate() error {
+	var v validation.Violations
+	v.Login("login", r.Login)
+	v.Password("password", r.Password)
+	v.Email("email", r.Email)
+	v.Length("first_name", r.FirstName, 0, maxNameLength)
+	v.Length("last_name", r.LastName, 0, maxNameLength)
+	v.BirthDate("birth_date", r.BirthDate)
+	v.Phone("phone_number", r.PhoneNumber)
+	v.Length("device", r.Device, 0, maxDeviceLength)
+	return v.Err()
+}
+
+func (r *AuthenticateUserRequest) Validate() error {
+	var v validation.Violations
+	v.Required("login", r.Login)
+	v.Required("password", r.Password)
+	v.Length("device", r.Device, 0, maxDeviceLength)
+	return v.Err()
+}
+
+func (r *RefreshTokenRequest) Validate() error {
+	var v validation.Violations
+	v.Required("refresh_token", r.RefreshToken)
+	return v.Err()
+}
+
+// ProfileFields are the update_mask paths accepted by UpdateProfile.
+var ProfileFields = []string{
+	"email", "first_name", "last_name", "birth_date", "phone_number",
+	"bio", "location", "website", "pronouns", "links",
+}
+
+// VisibilityFields are the profile fields whose visibility the user sets.
+// Login, names and avatar are always public.
+var VisibilityFields = []string{"email", "phone_number", "birth_date", "bio", "location", "website", "pronouns", "links"}
+
+// Fields returns the paths to update: the mask paths, or every profile field
+// when the mask is empty.
+func (r *UpdateProfileRequest) Fields() []string {
+	if len(r.GetUpdateMask().GetPaths()) == 0 {
+		return ProfileFields
+	}
+	return r.UpdateMask.Paths
+}
+
+func (r *UpdateProfileRequest) Validate() error {
+	var v validation.Violations
+	for _, field := range r.Fields() {
+		switch field {
+		case "email":
+			v.Email("email", r.Email)
+		case "first_name":
+			v.Length("first_name", r.FirstName, 0, maxNameLength)
+		case "last_name":
+			v.Length("last_name", r.LastName, 0, maxNameLength)
+		case "birth_date":
+			v.BirthDate("birth_date", r.BirthDate)
+		case "phone_number":
+			v.Phone("phone_number", r.PhoneNumber)
+		case "bio":
+			v.Length("bio", r.Bio, 0, maxBioLength)
+		case "location":
+			v.Length("location", r.Location, 0, maxLocationLength)
+		case "website":
+			v.URL("website", r.Website)
+		case "pronouns":
+			v.Length("pronouns", r.Pronouns, 0, maxPronounsLength)
+		case "links":
+			if len(r.Links) > MaxProfileLinks {
+				v.Addf("links", "must have at most %d links", MaxProfileLinks)
+			}
+			for i, link := range r.Links {
+				v.Length(fmt.Sprintf("links[%d].title", i), link.GetTitle(), 1, maxLinkTitleLength)
+				if v.Required(fmt.Sprintf("links[%d].url", i), link.GetUrl()) {
+					v.URL(fmt.Sprintf("links[%d].url", i), link.GetUrl())
+				}
+			}
+		default:
+			v.Addf("update_mask", "unknown field %q", field)
+		}
+	}
+	return v.Err()
+}
+
+func (r *RevokeSessionRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("session_id", r.SessionId)
+	return v.Err()
+}
+
+func (r *CheckSessionRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("session_id", r.SessionId)
+	return v.Err()
+}
+
+func (r *CreateRoleRequest) Validate() error {
+	var v validation.Violations
+	if v.Required("name", r.Name) && !roleNamePattern.MatchString(r.Name) {
+		v.Add("name", "must be 2 to 32 characters: lowercase latin letters, digits, '_' or '-', starting with a letter")
+	}
+	v.Length("description", r.Description, 0, maxDescriptionLength)
+	for i, permission := range r.Permissions {
+		if !permissionPattern.MatchString(permission) {
+			v.Add(fmt.Sprintf("permissions[%d]", i), "must look like resource:action")
+		}
+	}
+	return v.Err()
+}
+
+func (r *GrantRoleRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Required("role", r.Role)
+	return v.Err()
+}
+
+func (r *RevokeRoleRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Required("role", r.Role)
+	return v.Err()
+}
+
+func (r *ConfirmTOTPRequest) Validate() error {
+	var v validation.Violations
+	if v.Required("code", r.Code) && !totpCodePattern.MatchString(r.Code) {
+		v.Add("code", "must be 6 digits")
+	}
+	return v.Err()
+}
+
+func (r *DisableTOTPRequest) Validate() error {
+	var v validation.Violations
+	v.Required("password", r.Password)
+	v.Required("code", r.Code)
+	return v.Err()
+}
+
+func (r *GenerateRecoveryCodesRequest) Validate() error {
+	var v validation.Violations
+	v.Required("code", r.Code)
+	return v.Err()
+}
+
+func (r *VerifyTwoFactorRequest) Validate() error {
+	var v validation.Violations
+	v.Required("challenge_token", r.ChallengeToken)
+	v.Required("code", r.Code)
+	v.Length("device", r.Device, 0, maxDeviceLength)
+	return v.Err()
+}
+
+func (r *VerifyEmailRequest) Validate() error {
+	var v validation.Violations
+	v.Required("token", r.Token)
+	return v.Err()
+}
+
+func (r *RequestPasswordResetRequest) Validate() error {
+	var v validation.Violations
+	v.Email("email", r.Email)
+	return v.Err()
+}
+
+func (r *ResetPasswordRequest) Validate() error {
+	var v validation.Violations
+	v.Required("token", r.Token)
+	v.Password("new_password", r.NewPassword)
+	return v.Err()
+}
+
+func (r *ChangePasswordRequest) Validate() error {
+	var v validation.Violations
+	v.Required("current_password", r.CurrentPassword)
+	v.Password("new_password", r.NewPassword)
+	if r.NewPassword != "" && r.NewPassword == r.CurrentPassword {
+		v.Add("new_password", "must differ from the current password")
+	}
+	return v.Err()
+}
+
+func (r *UnlockAccountRequest) Validate() error {
+	var v validation.Violations
+	v.Required("token", r.Token)
+	return v.Err()
+}
+
+func (r *UnlockUserRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	return v.Err()
+}
+
+func (r *GetPublicProfileRequest) Validate() error {
+	var v validation.Violations
+	switch user := r.User.(type) {
+	case *GetPublicProfileRequest_UserId:
+		v.Positive("user_id", int64(user.UserId))
+	case *GetPublicProfileRequest_Login:
+		v.Required("login", user.Login)
+	default:
+		v.Add("user", "user_id or login is required")
+	}
+	return v.Err()
+}
+
+func (r *BatchGetUsersRequest) Validate() error {
+	var v validation.Violations
+	if len(r.UserIds) == 0 {
+		v.Add("user_ids", "is required")
+	}
+	if len(r.UserIds) > MaxBatchUsers {
+		v.Addf("user_ids", "must contain at most %d ids", MaxBatchUsers)
+	}
+	for i, id := range r.UserIds {
+		v.Positive(fmt.Sprintf("user_ids[%d]", i), int64(id))
+	}
+	return v.Err()
+}
+
+func (r *FollowUserRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	return v.Err()
+}
+
+func (r *UnfollowUserRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	return v.Err()
+}
+
+func (r *ListFollowsRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Range("page_size", int64(r.PageSize), 0, MaxPageSize)
+	return v.Err()
+}
+
+func (r *ListFollowRequestsRequest) Validate() error {
+	var v validation.Violations
+	v.Range("page_size", int64(r.PageSize), 0, MaxPageSize)
+	return v.Err()
+}
+
+func (r *FollowRequestDecision) Validate() error {
+	var v validation.Violations
+	v.Positive("follower_id", int64(r.FollowerId))
+	return v.Err()
+}
+
+func (r *RelationRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	return v.Err()
+}
+
+func (r *ListRelationsRequest) Validate() error {
+	var v validation.Violations
+	v.Range("page_size", int64(r.PageSize), 0, MaxPageSize)
+	return v.Err()
+}
+
+func (r *SearchUsersRequest) Validate() error {
+	var v validation.Violations
+	if v.Required("query", strings.TrimSpace(r.Query)) {
+		v.Length("query", r.Query, 1, maxSearchQueryLength)
+	}
+	v.Range("page_size", int64(r.PageSize), 0, MaxPageSize)
+	return v.Err()
+}
+
+func (r *DeleteAccountRequest) Validate() error {
+	var v validation.Violations
+	v.Required("password", r.Password)
+	return v.Err()
+}
+
+func (r *CancelAccountDeletionRequest) Validate() error {
+	var v validation.Violations
+	v.Required("token", r.Token)
+	return v.Err()
+}
+
+func (r *GetAccountDeletionRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	return v.Err()
+}
+
+func (r *GetDataExportRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("id", r.Id)
+	return v.Err()
+}
+
+func (r *DownloadDataExportRequest) Validate() error {
+	var v validation.Violations
+	v.Required("token", r.Token)
+	return v.Err()
+}
+
+func (r *DownloadAvatarRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.UUID("avatar_id", r.AvatarId)
+	v.Required("size", r.Size)
+	return v.Err()
+}
+
+func (r *UpdateProfileVisibilityRequest) Validate() error {
+	var v validation.Violations
+	if len(r.Visibility) == 0 {
+		v.Add("visibility", "is required")
+	}
+	for _, field := range slices.Sorted(maps.Keys(r.Visibility)) {
+		visibility := r.Visibility[field]
+		if !slices.Contains(VisibilityFields, field) {
+			v.Addf("visibility", "unknown field %q", field)
+			continue
+		}
+		if _, ok := Visibility_name[int32(visibility)]; !ok || visibility == Visibility_VISIBILITY_UNSPECIFIED {
+			v.Add("visibility."+field, "must be one of public, followers or only_me")
+		}
+	}
+	return v.Err()
+}
+
+func (r *CreateDocumentRequest) Validate() error {
+	var v validation.Violations
+	validateDocument(&v, r.DocName, r.Description, r.Series, r.Number)
+	return v.Err()
+}
+
+func (r *ListDocumentsRequest) Validate() error {
+	var v validation.Violations
+	v.Range("user_id", int64(r.UserId), 0, math.MaxInt32)
+	return v.Err()
+}
+
+func (r *GetDocumentRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("id", r.Id)
+	return v.Err()
+}
+
+func (r *UpdateDocumentRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("id", r.Id)
+	validateDocument(&v, r.DocName, r.Description, r.Series, r.Number)
+	return v.Err()
+}
+
+func (r *DeleteDocumentRequest) Validate() error {
+	var v validation.Violations
+	v.UUID("id", r.Id)
+	return v.Err()
+}
+
+func (r *ListDocumentAccessLogRequest) Validate() error {
+	var v validation.Violations
+	if r.DocumentId != "" {
+		v.UUID("document_id", r.DocumentId)
+	}
+	v.Range("page_size", int64(r.PageSize), 0, MaxPageSize)
+	return v.Err()
+}
+
+func validateDocument(v *validation.Violations, name, description, series, number string) {
+	v.Length("doc_name", name, 1, maxDocNameLength)
+	v.Length("description", description, 0, maxDescriptionLength)
+	v.Length("series", series, 0, maxDocSeriesLength)
+	v.Length("number", number, 1, maxDocNumberLength)
+}
+
+func (r *SuspendUserRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Range("duration_seconds", r.DurationSeconds, 60, int64(MaxSuspension/time.Second))
+	v.Length("reason", r.Reason, 1, maxReasonLength)
+	return v.Err()
+}
+
+func (r *BanUserRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Length("reason", r.Reason, 1, maxReasonLength)
+	return v.Err()
+}
+
+func (r *LiftRestrictionRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Length("reason", r.Reason, 0, maxReasonLength)
+	return v.Err()
+}
+
+func (r *ImpersonateUserRequest) Validate() error {
+	var v validation.Violations
+	v.Positive("user_id", int64(r.UserId))
+	v.Length("reason", r.Reason, 1, maxReasonLength)
+	return v.Err()
+}
+
+func (r *ListAuditLogRequest) Validate() error {
+	var v validation.Violations
+	v.Range("actor_id", int64(r.ActorId), 0, math.MaxInt32)
+	v.Range("target_user_id", int64(r.TargetUserId), 0, math.MaxInt32)
+	v.Length("action", r.Action, 0, maxActionLength)
+	v.Range("page_size", int64(r.PageSize), 0, MaxPageSize)
+	return v.Err()
+}
+
+func (r *StartOIDCLoginRequest) Validate() error {
+	var v validation.Violations
+	v.Length("provider", r.Provider, 1, maxProviderLength)
+	v.Length("device", r.Device, 0, maxDeviceLength)
+	return v.Err()
+}
+
+func (r *StartOIDCLinkRequest) Validate() error {
+	var v validation.Violations
+	v.Length("provider", r.Provider, 1, maxProviderLength)
+	return v.Err()
+}
+
+func (r *CompleteOIDCRequest) Validate() error {
+	var v validation.Violations
+	v.Length("provider", r.Provider, 1, maxProviderLength)
+	v.Length("code", r.Code, 1, maxOIDCParamLength)
+	v.Length("state", r.State, 1, maxOIDCParamLength)
+	return v.Err()
+}
+
+func (r *UnlinkIdentityRequest) Validate() error {
+	var v validation.Violations
+	v.Length("provider", r.Provider, 1, maxProviderLength)
+	return v.Err()
+}
+
+// redirectURI requires https, or http on the loopback for apps running on the
+// user's machine, and no fragment as the code is added to the query.
+func redirectURI(v *validation.Violations, field, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if len(value) > validation.MaxURLLength {
+		v.Addf(field, "must be at most %d characters long", validation.MaxURLLength)
+		return
+	}
+	u, err := url.Parse(value)
+	switch {
+	case err != nil || u.Host == "" || u.User != nil:
+		v.Add(field, "must be an absolute URL")
+	case u.Scheme == "http" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" && u.Hostname() != "::1":
+		v.Add(field, "must use https, http is only allowed for localhost")
+	case u.Scheme != "https" && u.Scheme != "http":
+		v.Add(field, "must be an http or https URL")
+	case u.Fragment != "" || strings.HasSuffix(value, "#"):
+		v.Add(field, "must not have a fragment")
+	}
+}
+
+func (r *RegisterOAuthClientRequest) Validate() error {
+	var v validation.Violations
+	v.Length("name", r.Name, 1, maxNameLength)
+	if len(r.RedirectUris) == 0 || len(r.RedirectUris) > MaxRedirectURIs {
+		v.Addf("redirect_uris", "must have from 1 to %d URIs", MaxRedirectURIs)
+	}
+	for i, uri := range r.RedirectUris {
+		redirectURI(&v, fmt.Sprintf("redirect_uris[%d]", i), uri)
+	}
+	if len(r.Scopes) == 0 {
+		v.Add("scopes", "must not be empty")
+	}
+	for i, scope := range r.Scopes {
+		if !slices.Contains(auth.SupportedScopes, scope) {
+			v.Addf(fmt.Sprintf("scopes[%d]", i), "must be one of %s", strings.Join(auth.SupportedScopes, ", "))
+		}
+	}
+	return v.Err()
+}
+
+func (r *DeleteOAuthClientRequest) Validate() error {
+	var v validation.Violations
+	v.Length("client_id", r.ClientId, 1, maxClientIDLength)
+	return v.Err()
+}
+
+// Validate only bounds the fields, the service checks them against the client
+// to tell whether the error may be sent to the redirect URI.
+func (r *OAuthAuthorizationRequest) Validate() error {
+	var v validation.Violations
+	r.validate(&v, "")
+	return v.Err()
+}
+
+func (r *OAuthAuthorizationRequest) validate(v *validation.Violations, prefix string) {
+	v.Length(prefix+"client_id", r.ClientId, 1, maxClientIDLength)
+	v.Length(prefix+"redirect_uri", r.RedirectUri, 0, validation.MaxURLLength)
+	v.Length(prefix+"response_type", r.ResponseType, 0, maxActionLength)
+	v.Length(prefix+"scope", r.Scope, 0, maxOIDCParamLength)
+	v.Length(prefix+"state", r.State, 0, maxOIDCParamLength)
+	v.Length(prefix+"code_challenge", r.CodeChallenge, 0, maxOIDCParamLength)
+	v.Length(prefix+"code_challenge_method", r.CodeChallengeMethod, 0, maxActionLength)
+	v.Length(prefix+"nonce", r.Nonce, 0, maxOIDCParamLength)
+}
+
+func (r *ApproveOAuthConsentRequest) Validate() error {
+	var v validation.Violations
+	if r.Authorization == nil {
+		v.Add("authorization", "is required")
+	} else {
+		r.Authorization.validate(&v, "authorization.")
+	}
+	return v.Err()
+}
+
+func (r *ExchangeOAuthTokenRequest) Validate() error {
+	var v validation.Violations
+	v.Length("grant_type", r.GrantType, 1, maxActionLength)
+	v.Length("client_id", r.ClientId, 1, maxClientIDLength)
+	v.Length("client_secret", r.ClientSecret, 0, maxOIDCParamLength)
+	v.Length("code", r.Code, 0, maxOIDCParamLength)
+	v.Length("redirect_uri", r.RedirectUri, 0, validation.MaxURLLength)
+	v.Length("code_verifier", r.CodeVerifier, 0, maxOIDCParamLength)
+	v.Length("refresh_token", r.RefreshToken, 0, maxOAuthTokenLength)
+	v.Length("scope", r.Scope, 0, maxOIDCParamLength)
+	return v.Err()
+}
+
+func (r *IntrospectOAuthTokenRequest) Validate() error {
+	var v validation.Violations
+	v.Length("client_id", r.ClientId, 1, maxClientIDLength)
+	v.Length("client_secret", r.ClientSecret, 0, maxOIDCParamLength)
+	v.Length("token", r.Token, 1, maxOAuthTokenLength)
+	return v.Err()
+}
+
+func (r *RevokeOAuthTokenRequest) Validate() error {
+	var v validation.Violations
+	v.Length("client_id", r.ClientId, 1, maxClientIDLength)
+	v.Length("client_secret", r.ClientSecret, 0, maxOIDCParamLength)
+	v.Length("token", r.Token, 1, maxOAuthTokenLength)
+	return v.Err()
+}
+
+// dataSize checks the size of a binary field, WebAuthn responses carry them.
+func dataSize(v *validation.Violations, field string, data []byte, min, max int) {
+	if len(data) < min || len(data) > max {
+		v.Addf(field, "must be from %d to %d bytes", min, max)
+	}
+}
+
+func transports(v *validation.Violations, field string, values []string) {
+	if len(values) > maxTransports {
+		v.Addf(field, "must have at most %d transports", maxTransports)
+	}
+	for i, transport := range values {
+		v.Length(fmt.Sprintf("%s[%d]", field, i), transport, 1, maxTransportLength)
+	}
+}
+
+func (r *FinishPasskeyRegistrationRequest) Validate() error {
+	var v validation.Violations
+	v.Length("name", r.Name, 1, maxNameLength)
+	dataSize(&v, "client_data_json", r.ClientDataJson, 1, maxWebAuthnDataSize)
+	dataSize(&v, "attestation_object", r.AttestationObject, 1, maxWebAuthnDataSize)
+	transports(&v, "transports", r.Transports)
+	return v.Err()
+}
+
+func (r *DeletePasskeyRequest) Validate() error {
+	var v validation.Violations
+	dataSize(&v, "id", r.Id, 1, maxCredentialIDSize)
+	return v.Err()
+}
+
+func (r *StartPasskeyLoginRequest) Validate() error {
+	var v validation.Violations
+	v.Length("challenge_token", r.ChallengeToken, 0, maxOAuthTokenLength)
+	return v.Err()
+}
+
+func (r *FinishPasskeyLoginRequest) Validate() error {
+	var v validation.Violations
+	dataSize(&v, "credential_id", r.CredentialId, 1, maxCredentialIDSize)
+	dataSize(&v, "client_data_json", r.ClientDataJson, 1, maxWebAuthnDataSize)
+	dataSize(&v, "authenticator_data", r.AuthenticatorData, 1, maxWebAuthnDataSize)
+	dataSize(&v, "signature", r.Signature, 1, maxWebAuthnDataSize)
+	dataSize(&v, "user_handle", r.UserHandle, 0, maxUserHandleSize)
+	v.Length("device", r.Device, 0, maxDeviceLength)
+	return v.Err()
+}
@@ -0,0 +1,305 @@
+// Package webauthn checks the responses of WebAuthn ceremonies for passkeys.
+// Attestation is not used to trust authenticators, so only the "none" format
+// and self attestation in the "packed" format are accepted.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+const (
+	ChallengeSize = 32
+
+	TypeCreate = "webauthn.create"
+	TypeGet    = "webauthn.get"
+
+	maxCredentialIDLength = 1023
+	authDataMinLength     = 37
+
+	flagUserPresent    = 0x01
+	flagUserVerified   = 0x04
+	flagBackupEligible = 0x08
+	flagBackedUp       = 0x10
+	flagAttestedData   = 0x40
+	flagExtensions     = 0x80
+)
+
+var (
+	ErrInvalidResponse = errors.New("invalid webauthn response")
+	ErrSignCount       = errors.New("signature counter did not increase, the authenticator may be cloned")
+)
+
+func invalid(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrInvalidResponse, fmt.Sprintf(format, args...))
+}
+
+// RelyingParty is the site credentials are scoped to. Its ID is the host of
+// the public URL and only that origin is accepted.
+type RelyingParty struct {
+	ID     string
+	Name   string
+	Origin string
+}
+
+func NewRelyingParty(publicURL, name string) (*RelyingParty, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("no host in %q", publicURL)
+	}
+	return &RelyingParty{ID: u.Hostname(), Name: name, Origin: u.Scheme + "://" + u.Host}, nil
+}
+
+func NewChallenge() ([]byte, error) {
+	challenge := make([]byte, ChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// ClientData is the parsed clientDataJSON. The caller looks the challenge up
+// among the ones it issued, the relying party checks the rest.
+type ClientData struct {
+	Type        string
+	Challenge   []byte
+	Origin      string
+	CrossOrigin bool
+
+	raw []byte
+}
+
+func ParseClientData(raw []byte) (*ClientData, error) {
+	var data struct {
+		Type        string `json:"type"`
+		Challenge   string `json:"challenge"`
+		Origin      string `json:"origin"`
+		CrossOrigin bool   `json:"crossOrigin"`
+	}
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return nil, invalid("client data: %v", err)
+	}
+	challenge, err := base64.RawURLEncoding.DecodeString(data.Challenge)
+	if err != nil || len(challenge) == 0 {
+		return nil, invalid("client data has no challenge")
+	}
+	return &ClientData{
+		Type:        data.Type,
+		Challenge:   challenge,
+		Origin:      data.Origin,
+		CrossOrigin: data.CrossOrigin,
+		raw:         raw,
+	}, nil
+}
+
+func (rp *RelyingParty) checkClientData(clientData *ClientData, ceremonyType string) error {
+	if clientData.Type != ceremonyType {
+		return invalid("client data type is %q, want %q", clientData.Type, ceremonyType)
+	}
+	if clientData.Origin != rp.Origin {
+		return invalid("origin %q is not allowed", clientData.Origin)
+	}
+	if clientData.CrossOrigin {
+		return invalid("cross-origin ceremonies are not allowed")
+	}
+	return nil
+}
+
+type authenticatorData struct {
+	rpIDHash      []byte
+	flags         byte
+	signCount     uint32
+	aaguid        []byte
+	credentialID  []byte
+	credentialKey []byte
+}
+
+func parseAuthenticatorData(data []byte) (*authenticatorData, error) {
+	if len(data) < authDataMinLength {
+		return nil, invalid("authenticator data is too short")
+	}
+	authData := &authenticatorData{
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+
+	rest := data[authDataMinLength:]
+	if authData.flags&flagAttestedData != 0 {
+		if len(rest) < 18 {
+			return nil, invalid("attested credential data is too short")
+		}
+		authData.aaguid = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+		if idLength == 0 || idLength > maxCredentialIDLength || len(rest) < idLength {
+			return nil, invalid("bad credential id length")
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, invalid("credential key: %v", err)
+		}
+		authData.credentialKey = rest[:len(rest)-len(after)]
+		rest = after
+	}
+	if authData.flags&flagExtensions != 0 {
+		_, after, err := decodeCBOR(rest)
+		if err != nil {
+			return nil, invalid("extensions: %v", err)
+		}
+		rest = after
+	}
+	if len(rest) != 0 {
+		return nil, invalid("trailing authenticator data")
+	}
+	return authData, nil
+}
+
+func (rp *RelyingParty) checkAuthenticatorData(authData *authenticatorData, requireUserVerification bool) error {
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return invalid("credential is for another relying party")
+	}
+	if authData.flags&flagUserPresent == 0 {
+		return invalid("user was not present")
+	}
+	if requireUserVerification && authData.flags&flagUserVerified == 0 {
+		return invalid("user was not verified")
+	}
+	return nil
+}
+
+// Credential is a registered passkey. PublicKey is the COSE_Key as the
+// authenticator encoded it.
+type Credential struct {
+	ID             []byte
+	PublicKey      []byte
+	Algorithm      int64
+	SignCount      uint32
+	AAGUID         []byte
+	BackupEligible bool
+	BackedUp       bool
+}
+
+// VerifyRegistration checks the response of navigator.credentials.create.
+func (rp *RelyingParty) VerifyRegistration(clientData *ClientData, attestationObject []byte, requireUserVerification bool) (*Credential, error) {
+	if err := rp.checkClientData(clientData, TypeCreate); err != nil {
+		return nil, err
+	}
+
+	value, rest, err := decodeCBOR(attestationObject)
+	if err != nil {
+		return nil, invalid("attestation object: %v", err)
+	}
+	object, ok := value.(map[any]any)
+	if !ok || len(rest) != 0 {
+		return nil, invalid("attestation object is not a map")
+	}
+	format, _ := object["fmt"].(string)
+	statement, _ := object["attStmt"].(map[any]any)
+	rawAuthData, _ := object["authData"].([]byte)
+	if statement == nil {
+		return nil, invalid("attestation object has no statement")
+	}
+
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthenticatorData(authData, requireUserVerification); err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, invalid("no attested credential data")
+	}
+	key, err := parsePublicKey(authData.credentialKey)
+	if err != nil {
+		return nil, invalid("%v", err)
+	}
+
+	switch format {
+	case "none":
+		if len(statement) != 0 {
+			return nil, invalid("none attestation has a statement")
+		}
+	case "packed":
+		alg, _ := statement["alg"].(int64)
+		sig, _ := statement["sig"].([]byte)
+		if _, ok := statement["x5c"]; ok {
+			return nil, invalid("only self attestation is accepted")
+		}
+		if alg != key.algorithm {
+			return nil, invalid("attestation algorithm does not match the credential key")
+		}
+		clientDataHash := sha256.Sum256(clientData.raw)
+		if !key.verify(append(bytes.Clone(rawAuthData), clientDataHash[:]...), sig) {
+			return nil, invalid("bad attestation signature")
+		}
+	default:
+		return nil, invalid("attestation format %q is not supported", format)
+	}
+
+	return &Credential{
+		ID:             bytes.Clone(authData.credentialID),
+		PublicKey:      bytes.Clone(authData.credentialKey),
+		Algorithm:      key.algorithm,
+		SignCount:      authData.signCount,
+		AAGUID:         bytes.Clone(authData.aaguid),
+		BackupEligible: authData.flags&flagBackupEligible != 0,
+		BackedUp:       authData.flags&flagBackedUp != 0,
+	}, nil
+}
+
+// Assertion is what a successful navigator.credentials.get changes in the
+// stored credential.
+type Assertion struct {
+	SignCount uint32
+	BackedUp  bool
+}
+
+// VerifyAssertion checks the response of navigator.credentials.get against
+// the stored credential key. ErrSignCount means the counter went back, so a
+// copy of the credential may exist.
+func (rp *RelyingParty) VerifyAssertion(clientData *ClientData, rawAuthData, signature, credentialKey []byte, storedSignCount uint32, requireUserVerification bool) (*Assertion, error) {
+	if err := rp.checkClientData(clientData, TypeGet); err != nil {
+		return nil, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.checkAuthenticatorData(authData, requireUserVerification); err != nil {
+		return nil, err
+	}
+
+	key, err := parsePublicKey(credentialKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(clientData.raw)
+	if !key.verify(append(bytes.Clone(rawAuthData), clientDataHash[:]...), signature) {
+		return nil, invalid("bad signature")
+	}
+
+	// authenticators without a counter always send zero
+	if (authData.signCount != 0 || storedSignCount != 0) && authData.signCount <= storedSignCount {
+		return nil, ErrSignCount
+	}
+	return &Assertion{
+		SignCount: authData.signCount,
+		BackedUp:  authData.flags&flagBackedUp != 0,
+	}, nil
+}
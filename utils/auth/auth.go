@@ -5,10 +5,12 @@ import (
 	"crypto/rsa"
 	"errors"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -17,6 +19,13 @@ type TokenType int
 const (
 	AccessToken TokenType = iota
 	RefreshToken
+	ChallengeToken
+	EmailVerificationToken
+	PasswordResetToken
+	AccountUnlockToken
+	AccountRestoreToken
+	ExportDownloadToken
+	IDToken
 )
 
 var (
@@ -25,75 +34,228 @@ var (
 	ErrInvalidSigningKey = errors.New("invalid signing key")
 	ErrNoTokenInContext  = errors.New("no token in context")
 	ErrNoAuthInContext   = errors.New("no auth identity in context")
+	ErrUnknownSigningKey = errors.New("unknown signing key")
+	ErrRetiredSigningKey = errors.New("retired signing key")
+)
+
+const (
+	AccessTokenTTL            = time.Hour
+	RefreshTokenTTL           = 7 * 24 * time.Hour
+	ChallengeTokenTTL         = 5 * time.Minute
+	EmailVerificationTokenTTL = 24 * time.Hour
+	PasswordResetTokenTTL     = time.Hour
+	AccountUnlockTokenTTL     = 24 * time.Hour
+	ImpersonationTokenTTL     = 15 * time.Minute
 )
 
 type AuthProvider interface {
 	GenerateToken(info TokenInfo, expiresIn time.Duration) (string, error)
 	ValidateToken(tokenString string, expectedType TokenType) (*TokenInfo, error)
 	GetTokenInfo(tokenString string) (*TokenInfo, error)
-	HashPassword(password string) (string, error)
-	CheckPassword(password, hashedPassword string) bool
-	TokenInfoFromContext(ctx context.Context) (*TokenInfo, error)
 	TokenFromGRPCContext(ctx context.Context) (string, error)
 	GRPCContextWithToken(ctx context.Context, token string) context.Context
+	GenerateIDToken(claims IDTokenClaims) (string, error)
+	JWKS() JSONWebKeySet
+}
+
+type SigningKey struct {
+	ID         string
+	PrivateKey *rsa.PrivateKey
+	PublicKey  *rsa.PublicKey
+	RetireAt   time.Time
+}
+
+func (k *SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
 }
 
 type TokenKeys struct {
-	privateKey *rsa.PrivateKey
-	publicKey  *rsa.PublicKey
+	mu       sync.RWMutex
+	activeID string
+	keys     map[string]*SigningKey
+}
+
+func NewTokenKeys(activeID string, keys ...*SigningKey) *TokenKeys {
+	tk := &TokenKeys{}
+	tk.SetKeys(activeID, keys...)
+	return tk
 }
 
-func NewTokenKeys(privateKey *rsa.PrivateKey, publicKey *rsa.PublicKey) *TokenKeys {
-	return &TokenKeys{
-		privateKey: privateKey,
-		publicKey:  publicKey,
+func (tk *TokenKeys) SetKeys(activeID string, keys ...*SigningKey) {
+	keyMap := make(map[string]*SigningKey, len(keys))
+	for _, key := range keys {
+		keyMap[key.ID] = key
+	}
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+	tk.activeID = activeID
+	tk.keys = keyMap
+}
+
+func (tk *TokenKeys) ActiveKeyID() string {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+	return tk.activeID
+}
+
+func (tk *TokenKeys) signingKey() (*SigningKey, error) {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	key, ok := tk.keys[tk.activeID]
+	if !ok || key.PrivateKey == nil {
+		return nil, ErrInvalidSigningKey
+	}
+	if key.retired(time.Now()) {
+		return nil, ErrRetiredSigningKey
 	}
+	return key, nil
+}
+
+func (tk *TokenKeys) verificationKeys() []*SigningKey {
+	tk.mu.RLock()
+	defer tk.mu.RUnlock()
+
+	now := time.Now()
+	keys := make([]*SigningKey, 0, len(tk.keys))
+	for _, key := range tk.keys {
+		if key.PublicKey != nil && !key.retired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (tk *TokenKeys) keyFunc(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+
+	keys := tk.verificationKeys()
+	if len(keys) == 0 {
+		return nil, ErrInvalidSigningKey
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		// tokens issued before key rotation carry no kid, so try every live key
+		set := jwt.VerificationKeySet{}
+		for _, key := range keys {
+			set.Keys = append(set.Keys, key.PublicKey)
+		}
+		return set, nil
+	}
+
+	for _, key := range keys {
+		if key.ID == kid {
+			return key.PublicKey, nil
+		}
+	}
+
+	tk.mu.RLock()
+	_, known := tk.keys[kid]
+	tk.mu.RUnlock()
+	if known {
+		return nil, ErrRetiredSigningKey
+	}
+	return nil, ErrUnknownSigningKey
 }
 
 type TokenInfo struct {
-	UserID    int
-	UserLogin string
-	TokenType TokenType
+	UserID      int
+	UserLogin   string
+	TokenType   TokenType
+	TokenID     string
+	FamilyID    string
+	Roles       []string
+	Permissions []string
+	// Actor is set on tokens issued for impersonation.
+	Actor *Actor
+	// ClientID and Scopes are set on tokens issued to third-party apps.
+	ClientID  string
+	Scopes    []string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+}
+
+// Actor is the user who really holds a token issued for impersonation,
+// carried in the act claim like in RFC 8693.
+type Actor struct {
+	UserID    int    `json:"user_id"`
+	UserLogin string `json:"user_login"`
 }
 
 type TokenClaims struct {
-	UserID    int       `json:"user_id"`
-	UserLogin string    `json:"user_login"`
-	TokenType TokenType `json:"token_type"`
+	UserID      int       `json:"user_id"`
+	UserLogin   string    `json:"user_login"`
+	TokenType   TokenType `json:"token_type"`
+	FamilyID    string    `json:"fid,omitempty"`
+	Roles       []string  `json:"roles,omitempty"`
+	Permissions []string  `json:"permissions,omitempty"`
+	Actor       *Actor    `json:"act,omitempty"`
+	ClientID    string    `json:"client_id,omitempty"`
+	Scope       string    `json:"scope,omitempty"`
 	jwt.RegisteredClaims
 }
 
+func (c *TokenClaims) tokenInfo() *TokenInfo {
+	info := &TokenInfo{
+		UserID:      c.UserID,
+		UserLogin:   c.UserLogin,
+		TokenType:   c.TokenType,
+		TokenID:     c.ID,
+		FamilyID:    c.FamilyID,
+		Roles:       c.Roles,
+		Permissions: c.Permissions,
+		Actor:       c.Actor,
+		ClientID:    c.ClientID,
+		Scopes:      strings.Fields(c.Scope),
+	}
+	if c.IssuedAt != nil {
+		info.IssuedAt = c.IssuedAt.Time
+	}
+	if c.ExpiresAt != nil {
+		info.ExpiresAt = c.ExpiresAt.Time
+	}
+	return info
+}
+
 func (tk *TokenKeys) GenerateToken(info TokenInfo, expiresIn time.Duration) (string, error) {
-	if tk.privateKey == nil {
-		return "", ErrInvalidSigningKey
+	key, err := tk.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	tokenID := info.TokenID
+	if tokenID == "" {
+		tokenID = uuid.NewString()
 	}
 
 	claims := TokenClaims{
-		UserID:    info.UserID,
-		UserLogin: info.UserLogin,
-		TokenType: info.TokenType,
+		UserID:      info.UserID,
+		UserLogin:   info.UserLogin,
+		TokenType:   info.TokenType,
+		FamilyID:    info.FamilyID,
+		Roles:       info.Roles,
+		Permissions: info.Permissions,
+		Actor:       info.Actor,
+		ClientID:    info.ClientID,
+		Scope:       strings.Join(info.Scopes, " "),
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        tokenID,
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiresIn)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(tk.privateKey)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
 }
 
 func (tk *TokenKeys) ValidateToken(tokenString string, expectedType TokenType) (*TokenInfo, error) {
-	if tk.publicKey == nil {
-		return nil, ErrInvalidSigningKey
-	}
-
-	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return tk.publicKey, nil
-	})
-
+	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, tk.keyFunc)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
 	}
@@ -107,25 +269,11 @@ func (tk *TokenKeys) ValidateToken(tokenString string, expectedType TokenType) (
 		return nil, ErrInvalidTokenType
 	}
 
-	return &TokenInfo{
-		UserID:    claims.UserID,
-		UserLogin: claims.UserLogin,
-		TokenType: claims.TokenType,
-	}, nil
+	return claims.tokenInfo(), nil
 }
 
 func (tk *TokenKeys) GetTokenInfo(tokenString string) (*TokenInfo, error) {
-	if tk.publicKey == nil {
-		return nil, ErrInvalidSigningKey
-	}
-
-	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return tk.publicKey, nil
-	})
-
+	token, err := jwt.ParseWithClaims(tokenString, &TokenClaims{}, tk.keyFunc)
 	if err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
 	}
@@ -135,11 +283,7 @@ func (tk *TokenKeys) GetTokenInfo(tokenString string) (*TokenInfo, error) {
 		return nil, ErrInvalidToken
 	}
 
-	return &TokenInfo{
-		UserID:    claims.UserID,
-		UserLogin: claims.UserLogin,
-		TokenType: claims.TokenType,
-	}, nil
+	return claims.tokenInfo(), nil
 }
 
 const (
@@ -147,14 +291,6 @@ const (
 	tokenPrefix         = "Bearer "
 )
 
-func (tk *TokenKeys) TokenInfoFromContext(ctx context.Context) (*TokenInfo, error) {
-	token, err := tk.TokenFromGRPCContext(ctx)
-	if err != nil {
-		return nil, err
-	}
-	return tk.GetTokenInfo(token)
-}
-
 func (tk *TokenKeys) TokenFromGRPCContext(ctx context.Context) (string, error) {
 	md, ok := metadata.FromIncomingContext(ctx)
 	if !ok {
@@ -178,16 +314,3 @@ func (tk *TokenKeys) GRPCContextWithToken(ctx context.Context, token string) con
 	md := metadata.Pairs(authorizationHeader, tokenPrefix+token)
 	return metadata.NewOutgoingContext(ctx, md)
 }
-
-func (tk *TokenKeys) HashPassword(password string) (string, error) {
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-	if err != nil {
-		return "", err
-	}
-	return string(hashedPassword), nil
-}
-
-func (tk *TokenKeys) CheckPassword(password, hashedPassword string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
-	return err == nil
-}
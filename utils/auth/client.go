@@ -0,0 +1,40 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	clientIPHeader        = "x-client-ip"
+	clientUserAgentHeader = "x-client-user-agent"
+)
+
+type ClientInfo struct {
+	IP        string
+	UserAgent string
+}
+
+func GRPCContextWithClientInfo(ctx context.Context, info ClientInfo) context.Context {
+	return metadata.AppendToOutgoingContext(ctx,
+		clientIPHeader, info.IP,
+		clientUserAgentHeader, info.UserAgent,
+	)
+}
+
+func ClientInfoFromGRPCContext(ctx context.Context) ClientInfo {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ClientInfo{}
+	}
+
+	var info ClientInfo
+	if values := md.Get(clientIPHeader); len(values) > 0 {
+		info.IP = values[0]
+	}
+	if values := md.Get(clientUserAgentHeader); len(values) > 0 {
+		info.UserAgent = values[0]
+	}
+	return info
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type tokenInfoContextKey struct{}
+
+func ContextWithTokenInfo(ctx context.Context, info *TokenInfo) context.Context {
+	return context.WithValue(ctx, tokenInfoContextKey{}, info)
+}
+
+func TokenInfoFromContext(ctx context.Context) (*TokenInfo, error) {
+	info, ok := ctx.Value(tokenInfoContextKey{}).(*TokenInfo)
+	if !ok || info == nil {
+		return nil, ErrNoAuthInContext
+	}
+	return info, nil
+}
+
+// authenticate checks the bearer access token of an incoming call. Methods in
+// publicMethods are let through without a token, but still get the caller
+// attached when a valid access token is sent.
+func authenticate(ctx context.Context, provider AuthProvider, fullMethod string, publicMethods map[string]bool) (context.Context, error) {
+	public := publicMethods[fullMethod]
+
+	token, err := provider.TokenFromGRPCContext(ctx)
+	if err != nil {
+		if public {
+			return ctx, nil
+		}
+		if errors.Is(err, ErrNoTokenInContext) {
+			return nil, status.Error(codes.Unauthenticated, "missing access token")
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "bad authorization header: %v", err)
+	}
+
+	info, err := provider.ValidateToken(token, AccessToken)
+	if err != nil {
+		if public {
+			return ctx, nil
+		}
+		return nil, status.Errorf(codes.Unauthenticated, "invalid access token: %v", err)
+	}
+	return ContextWithTokenInfo(ctx, info), nil
+}
+
+func methodSet(methods []string) map[string]bool {
+	set := make(map[string]bool, len(methods))
+	for _, method := range methods {
+		set[method] = true
+	}
+	return set
+}
+
+func UnaryServerInterceptor(provider AuthProvider, publicMethods ...string) grpc.UnaryServerInterceptor {
+	public := methodSet(publicMethods)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, err := authenticate(ctx, provider, info.FullMethod, public)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedStream) Context() context.Context {
+	return s.ctx
+}
+
+func StreamServerInterceptor(provider AuthProvider, publicMethods ...string) grpc.StreamServerInterceptor {
+	public := methodSet(publicMethods)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := authenticate(ss.Context(), provider, info.FullMethod, public)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// denyImpersonated refuses tokens issued to support acting as a user, for
+// methods only the user must call.
+func denyImpersonated(ctx context.Context, fullMethod string, methods map[string]bool) error {
+	if !methods[fullMethod] {
+		return nil
+	}
+	info, err := TokenInfoFromContext(ctx)
+	if err == nil && info.Impersonated() {
+		return status.Error(codes.PermissionDenied, "not allowed while impersonating")
+	}
+	return nil
+}
+
+// UnaryImpersonationInterceptor goes after UnaryServerInterceptor.
+func UnaryImpersonationInterceptor(deniedMethods ...string) grpc.UnaryServerInterceptor {
+	denied := methodSet(deniedMethods)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := denyImpersonated(ctx, info.FullMethod, denied); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamImpersonationInterceptor goes after StreamServerInterceptor.
+func StreamImpersonationInterceptor(deniedMethods ...string) grpc.StreamServerInterceptor {
+	denied := methodSet(deniedMethods)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := denyImpersonated(ss.Context(), info.FullMethod, denied); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// denyDelegated lets tokens issued to third-party apps call only methods in
+// allowed, whatever their scopes.
+func denyDelegated(ctx context.Context, fullMethod string, allowed map[string]bool) error {
+	if allowed[fullMethod] {
+		return nil
+	}
+	info, err := TokenInfoFromContext(ctx)
+	if err == nil && info.Delegated() {
+		return status.Error(codes.PermissionDenied, "not allowed for third-party apps")
+	}
+	return nil
+}
+
+// UnaryDelegationInterceptor goes after UnaryServerInterceptor.
+func UnaryDelegationInterceptor(allowedMethods ...string) grpc.UnaryServerInterceptor {
+	allowed := methodSet(allowedMethods)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := denyDelegated(ctx, info.FullMethod, allowed); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamDelegationInterceptor goes after StreamServerInterceptor.
+func StreamDelegationInterceptor(allowedMethods ...string) grpc.StreamServerInterceptor {
+	allowed := methodSet(allowedMethods)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := denyDelegated(ss.Context(), info.FullMethod, allowed); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// denyOutOfScope lets tokens issued to third-party apps call only methods in
+// scopes, and only when they were granted the scope listed for the method.
+func denyOutOfScope(ctx context.Context, fullMethod string, scopes map[string]string) error {
+	info, err := TokenInfoFromContext(ctx)
+	if err != nil || !info.Delegated() {
+		return nil
+	}
+	scope, ok := scopes[fullMethod]
+	if !ok {
+		return status.Error(codes.PermissionDenied, "not allowed for third-party apps")
+	}
+	if !info.HasScope(scope) {
+		return status.Errorf(codes.PermissionDenied, "insufficient scope, %s is required", scope)
+	}
+	return nil
+}
+
+// UnaryScopeInterceptor goes after UnaryServerInterceptor. scopes maps the
+// methods third-party apps may call to the scope each of them needs.
+func UnaryScopeInterceptor(scopes map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := denyOutOfScope(ctx, info.FullMethod, scopes); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamScopeInterceptor goes after StreamServerInterceptor.
+func StreamScopeInterceptor(scopes map[string]string) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := denyOutOfScope(ss.Context(), info.FullMethod, scopes); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// SessionChecker tells whether the session a token was issued for is still
+// active, i.e. was neither logged out nor revoked.
+type SessionChecker interface {
+	IsSessionActive(ctx context.Context, sessionID string) (bool, error)
+}
+
+// checkSession refuses tokens of revoked sessions, so that logging out or
+// restricting a user does not wait for their access tokens to expire. Tokens
+// without a session, like those userService issues to itself, are let through.
+func checkSession(ctx context.Context, checker SessionChecker) error {
+	info, err := TokenInfoFromContext(ctx)
+	if err != nil || info.FamilyID == "" {
+		return nil
+	}
+	active, err := checker.IsSessionActive(ctx, info.FamilyID)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "failed to check session: %v", err)
+	}
+	if !active {
+		return status.Error(codes.Unauthenticated, "session revoked")
+	}
+	return nil
+}
+
+// UnarySessionInterceptor goes after UnaryServerInterceptor.
+func UnarySessionInterceptor(checker SessionChecker) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkSession(ctx, checker); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamSessionInterceptor goes after StreamServerInterceptor.
+func StreamSessionInterceptor(checker SessionChecker) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSession(ss.Context(), checker); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
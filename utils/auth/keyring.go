@@ -0,0 +1,294 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	jwtLib "github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	keyRingManifest = "keyring.json"
+	legacyKeyID     = "signature"
+	rsaKeyBits      = 2048
+)
+
+type keyRingFile struct {
+	ActiveKeyID string         `json:"active_kid"`
+	Keys        []keyRingEntry `json:"keys"`
+}
+
+type keyRingEntry struct {
+	ID        string    `json:"kid"`
+	CreatedAt time.Time `json:"created_at"`
+	// ActivateAt is set on a key that is published for verification before
+	// it starts signing, so that every service has loaded it by then.
+	ActivateAt *time.Time `json:"activate_at,omitempty"`
+	RetireAt   *time.Time `json:"retire_at,omitempty"`
+}
+
+// activeKeyID returns the key that signs at now: the latest key whose
+// activation has come, or active_kid when there is none.
+func (m *keyRingFile) activeKeyID(now time.Time) string {
+	activeID := m.ActiveKeyID
+	var activeAt time.Time
+	for _, entry := range m.Keys {
+		if entry.ActivateAt == nil || now.Before(*entry.ActivateAt) {
+			continue
+		}
+		if activeAt.IsZero() || entry.ActivateAt.After(activeAt) {
+			activeID = entry.ID
+			activeAt = *entry.ActivateAt
+		}
+	}
+	return activeID
+}
+
+func privateKeyPath(dir, kid string) string {
+	return filepath.Join(dir, kid+".pem")
+}
+
+func publicKeyPath(dir, kid string) string {
+	return filepath.Join(dir, kid+".pub")
+}
+
+func LoadKeyRing(dir string, withPrivate bool) (*TokenKeys, error) {
+	activeID, keys, err := readKeyRing(dir, withPrivate)
+	if err != nil {
+		return nil, err
+	}
+	return NewTokenKeys(activeID, keys...), nil
+}
+
+func ReloadKeyRing(tk *TokenKeys, dir string, withPrivate bool) error {
+	activeID, keys, err := readKeyRing(dir, withPrivate)
+	if err != nil {
+		return err
+	}
+	tk.SetKeys(activeID, keys...)
+	return nil
+}
+
+func WatchKeyRing(ctx context.Context, tk *TokenKeys, dir string, withPrivate bool, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previous := tk.ActiveKeyID()
+			if err := ReloadKeyRing(tk, dir, withPrivate); err != nil {
+				log.Printf("failed to reload key ring: %v", err)
+				continue
+			}
+			if active := tk.ActiveKeyID(); active != previous {
+				log.Printf("signing key rotated: %s -> %s", previous, active)
+			}
+		}
+	}
+}
+
+func readKeyRing(dir string, withPrivate bool) (string, []*SigningKey, error) {
+	manifest, err := readKeyRingManifest(dir)
+	if err != nil {
+		return "", nil, err
+	}
+
+	activeID := manifest.activeKeyID(time.Now())
+	keys := make([]*SigningKey, 0, len(manifest.Keys))
+	for _, entry := range manifest.Keys {
+		// the previous key has its retirement set already but signs until the
+		// new one activates
+		key, err := readSigningKey(dir, entry.ID, withPrivate && (entry.RetireAt == nil || entry.ID == activeID))
+		if err != nil {
+			return "", nil, err
+		}
+		if entry.RetireAt != nil {
+			key.RetireAt = *entry.RetireAt
+		}
+		keys = append(keys, key)
+	}
+	return activeID, keys, nil
+}
+
+func readKeyRingManifest(dir string) (*keyRingFile, error) {
+	data, err := os.ReadFile(filepath.Join(dir, keyRingManifest))
+	if errors.Is(err, os.ErrNotExist) {
+		// directories created before rotation hold a single signature.pem/signature.pub pair
+		if _, statErr := os.Stat(publicKeyPath(dir, legacyKeyID)); statErr != nil {
+			return nil, fmt.Errorf("no key ring found in %s: %w", dir, err)
+		}
+		return &keyRingFile{
+			ActiveKeyID: legacyKeyID,
+			Keys:        []keyRingEntry{{ID: legacyKeyID}},
+		}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key ring manifest: %w", err)
+	}
+
+	var manifest keyRingFile
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse key ring manifest: %w", err)
+	}
+	return &manifest, nil
+}
+
+func readSigningKey(dir, kid string, withPrivate bool) (*SigningKey, error) {
+	key := &SigningKey{ID: kid}
+
+	publicKeyData, err := os.ReadFile(publicKeyPath(dir, kid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key file: %w", err)
+	}
+	key.PublicKey, err = jwtLib.ParseRSAPublicKeyFromPEM(publicKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA public key %s: %w", kid, err)
+	}
+
+	if !withPrivate {
+		return key, nil
+	}
+
+	privateKeyData, err := os.ReadFile(privateKeyPath(dir, kid))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key file: %w", err)
+	}
+	key.PrivateKey, err = jwtLib.ParseRSAPrivateKeyFromPEM(privateKeyData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse RSA private key %s: %w", kid, err)
+	}
+	return key, nil
+}
+
+// RotateKeyRing generates a new signing key that is published for
+// verification at once but signs only after activateAfter, which must not be
+// shorter than the key ring reload interval of the services. The key active
+// until then stays verifiable for retireAfter past the activation, and keys
+// whose retirement has already passed are removed from the ring and from disk.
+func RotateKeyRing(dir string, activateAfter, retireAfter time.Duration) (string, time.Time, error) {
+	manifest, err := readKeyRingManifest(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		manifest = &keyRingFile{}
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+
+	kid, err := newKeyID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if err := writeSigningKey(dir, kid); err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now().UTC()
+	activeID := manifest.activeKeyID(now)
+	activateAt := now.Add(activateAfter)
+	retireAt := activateAt.Add(retireAfter)
+	var removed []string
+	entries := make([]keyRingEntry, 0, len(manifest.Keys)+1)
+	for _, entry := range manifest.Keys {
+		if entry.RetireAt != nil && !now.Before(*entry.RetireAt) {
+			removed = append(removed, entry.ID)
+			continue
+		}
+		if entry.ID != activeID && entry.ActivateAt != nil && now.Before(*entry.ActivateAt) {
+			// a key still waiting for activation is superseded before it signs
+			removed = append(removed, entry.ID)
+			continue
+		}
+		if entry.ID == activeID {
+			entry.RetireAt = &retireAt
+		}
+		entries = append(entries, entry)
+	}
+	entry := keyRingEntry{ID: kid, CreatedAt: now}
+	if activeID == "" {
+		// a fresh ring has nothing to verify with in the meantime
+		activateAt = now
+	} else {
+		entry.ActivateAt = &activateAt
+	}
+	entries = append(entries, entry)
+
+	manifestActiveID := activeID
+	if manifestActiveID == "" {
+		manifestActiveID = kid
+	}
+	if err := writeKeyRingManifest(dir, &keyRingFile{ActiveKeyID: manifestActiveID, Keys: entries}); err != nil {
+		return "", time.Time{}, err
+	}
+
+	for _, id := range removed {
+		for _, path := range []string{privateKeyPath(dir, id), publicKeyPath(dir, id)} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("failed to remove retired key file %s: %v", path, err)
+			}
+		}
+	}
+	return kid, activateAt, nil
+}
+
+func newKeyID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate key id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+func writeSigningKey(dir, kid string) error {
+	privateKey, err := rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	if err != nil {
+		return fmt.Errorf("failed to generate RSA key: %w", err)
+	}
+
+	privateDER, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode private key: %w", err)
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	privatePEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+	if err := os.WriteFile(privateKeyPath(dir, kid), privatePEM, 0o600); err != nil {
+		return fmt.Errorf("failed to write private key file: %w", err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})
+	if err := os.WriteFile(publicKeyPath(dir, kid), publicPEM, 0o644); err != nil {
+		return fmt.Errorf("failed to write public key file: %w", err)
+	}
+	return nil
+}
+
+func writeKeyRingManifest(dir string, manifest *keyRingFile) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode key ring manifest: %w", err)
+	}
+
+	tmp := filepath.Join(dir, keyRingManifest+".tmp")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write key ring manifest: %w", err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, keyRingManifest)); err != nil {
+		return fmt.Errorf("failed to replace key ring manifest: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"encoding/base64"
+	"math/big"
+	"slices"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Scopes third-party apps may ask for. Tokens issued to apps carry the granted
+// scopes instead of the roles of the user.
+const (
+	ScopeOpenID      = "openid"
+	ScopeProfileRead = "profile:read"
+	ScopePostsRead   = "posts:read"
+	ScopePostsWrite  = "posts:write"
+)
+
+var SupportedScopes = []string{ScopeOpenID, ScopeProfileRead, ScopePostsRead, ScopePostsWrite}
+
+// Delegated tells whether the token was issued to a third-party app.
+func (ti *TokenInfo) Delegated() bool {
+	return ti.ClientID != ""
+}
+
+func (ti *TokenInfo) HasScope(scope string) bool {
+	return slices.Contains(ti.Scopes, scope)
+}
+
+type IDTokenClaims struct {
+	TokenType         TokenType `json:"token_type"`
+	Nonce             string    `json:"nonce,omitempty"`
+	AuthorizedParty   string    `json:"azp,omitempty"`
+	PreferredUsername string    `json:"preferred_username,omitempty"`
+	Name              string    `json:"name,omitempty"`
+	Email             string    `json:"email,omitempty"`
+	EmailVerified     *bool     `json:"email_verified,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// GenerateIDToken signs an OpenID Connect ID token with the active key. The
+// token_type claim keeps it from being accepted as any other token.
+func (tk *TokenKeys) GenerateIDToken(claims IDTokenClaims) (string, error) {
+	key, err := tk.signingKey()
+	if err != nil {
+		return "", err
+	}
+
+	claims.TokenType = IDToken
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.PrivateKey)
+}
+
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
+}
+
+// JWKS publishes the keys tokens are currently verified with, so that apps
+// can check ID and access tokens themselves.
+func (tk *TokenKeys) JWKS() JSONWebKeySet {
+	set := JSONWebKeySet{Keys: []JSONWebKey{}}
+	for _, key := range tk.verificationKeys() {
+		set.Keys = append(set.Keys, JSONWebKey{
+			KeyType:   "RSA",
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: jwt.SigningMethodRS256.Alg(),
+			N:         base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+			E:         base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+		})
+	}
+	slices.SortFunc(set.Keys, func(a, b JSONWebKey) int {
+		return strings.Compare(a.KeyID, b.KeyID)
+	})
+	return set
+}
@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnknownPasswordHash = errors.New("unknown password hash format")
+	ErrMalformedHash       = errors.New("malformed password hash")
+)
+
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	// Verify reports whether password matches encoded, and whether encoded
+	// should be replaced with a fresh Hash because its algorithm or
+	// parameters are outdated.
+	Verify(password, encoded string) (ok bool, needsRehash bool, err error)
+}
+
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 2,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+const argon2idPrefix = "$argon2id$"
+
+// Bounds on argon2id parameters, applied both to the configured parameters
+// and to those parsed from stored hashes so that a corrupt row can neither
+// panic argon2 nor exhaust memory.
+const (
+	maxArgon2Memory     = 1024 * 1024 // KiB
+	maxArgon2Iterations = 64
+	minArgon2SaltLength = 8
+	maxArgon2SaltLength = 64
+	minArgon2KeyLength  = 16
+	maxArgon2KeyLength  = 128
+)
+
+func (p Argon2Params) validate() error {
+	switch {
+	case p.Iterations == 0 || p.Iterations > maxArgon2Iterations:
+		return fmt.Errorf("argon2 iterations %d out of range [1, %d]", p.Iterations, maxArgon2Iterations)
+	case p.Parallelism == 0:
+		return errors.New("argon2 parallelism must be positive")
+	case p.Memory < 8*uint32(p.Parallelism) || p.Memory > maxArgon2Memory:
+		return fmt.Errorf("argon2 memory %d KiB out of range [%d, %d]", p.Memory, 8*uint32(p.Parallelism), maxArgon2Memory)
+	case p.SaltLength < minArgon2SaltLength || p.SaltLength > maxArgon2SaltLength:
+		return fmt.Errorf("argon2 salt length %d out of range [%d, %d]", p.SaltLength, minArgon2SaltLength, maxArgon2SaltLength)
+	case p.KeyLength < minArgon2KeyLength || p.KeyLength > maxArgon2KeyLength:
+		return fmt.Errorf("argon2 key length %d out of range [%d, %d]", p.KeyLength, minArgon2KeyLength, maxArgon2KeyLength)
+	}
+	return nil
+}
+
+type Argon2Hasher struct {
+	params Argon2Params
+}
+
+func NewArgon2Hasher(params Argon2Params) (*Argon2Hasher, error) {
+	if err := params.validate(); err != nil {
+		return nil, err
+	}
+	return &Argon2Hasher{params: params}, nil
+}
+
+// Hash encodes password in PHC string format:
+// $argon2id$v=19$m=<memory>,t=<iterations>,p=<parallelism>$<salt>$<hash>
+func (h *Argon2Hasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("failed to generate salt: %w", err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.params.Iterations, h.params.Memory, h.params.Parallelism, h.params.KeyLength)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version,
+		h.params.Memory, h.params.Iterations, h.params.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+func (h *Argon2Hasher) Verify(password, encoded string) (bool, bool, error) {
+	switch {
+	case strings.HasPrefix(encoded, argon2idPrefix):
+		return h.verifyArgon2id(password, encoded)
+	case isBcryptHash(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, false, nil
+		}
+		if err != nil {
+			return false, false, err
+		}
+		return true, true, nil
+	default:
+		return false, false, ErrUnknownPasswordHash
+	}
+}
+
+func (h *Argon2Hasher) verifyArgon2id(password, encoded string) (bool, bool, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 {
+		return false, false, ErrMalformedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return false, false, ErrMalformedHash
+	}
+	if version != argon2.Version {
+		return false, false, fmt.Errorf("%w: unsupported argon2 version %d", ErrMalformedHash, version)
+	}
+
+	var params Argon2Params
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return false, false, ErrMalformedHash
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, false, ErrMalformedHash
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, false, ErrMalformedHash
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(expected))
+	if err := params.validate(); err != nil {
+		return false, false, fmt.Errorf("%w: %v", ErrMalformedHash, err)
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+	if subtle.ConstantTimeCompare(key, expected) != 1 {
+		return false, false, nil
+	}
+	return true, params != h.params, nil
+}
+
+func isBcryptHash(encoded string) bool {
+	for _, prefix := range []string{"$2a$", "$2b$", "$2y$"} {
+		if strings.HasPrefix(encoded, prefix) {
+			return true
+		}
+	}
+	return false
+}
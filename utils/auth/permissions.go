@@ -0,0 +1,59 @@
+package auth
+
+import (
+	"context"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	PermissionManageRoles   = "roles:manage"
+	PermissionManageUsers   = "users:manage"
+	PermissionEditAnyPost   = "posts:edit_any"
+	PermissionDeleteAnyPost = "posts:delete_any"
+	PermissionReadDocuments = "users:read_documents"
+	PermissionImpersonate   = "users:impersonate"
+
+	// PermissionManageUserPosts lets userService hide and delete all posts of
+	// a deleted account, PermissionExportUserPosts lets it read them for a
+	// data export. They are only granted to its own system tokens.
+	PermissionManageUserPosts = "posts:manage_user_posts"
+	PermissionExportUserPosts = "posts:export_user_posts"
+)
+
+func (ti *TokenInfo) HasPermission(permission string) bool {
+	for _, p := range ti.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+func (ti *TokenInfo) HasRole(role string) bool {
+	for _, r := range ti.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// RequirePermission returns the caller from ctx, or a PermissionDenied status
+// when the caller's token does not grant permission.
+func RequirePermission(ctx context.Context, permission string) (*TokenInfo, error) {
+	info, err := TokenInfoFromContext(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "failed to get token: %v", err)
+	}
+	if !info.HasPermission(permission) {
+		return nil, status.Errorf(codes.PermissionDenied, "missing permission %s", permission)
+	}
+	return info, nil
+}
+
+// Impersonated tells whether the token was issued to Actor to act as the user.
+func (ti *TokenInfo) Impersonated() bool {
+	return ti.Actor != nil
+}
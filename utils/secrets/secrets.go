@@ -0,0 +1,350 @@
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const keySize = 32
+
+var (
+	ErrUnknownKey = errors.New("unknown master key")
+	ErrDecrypt    = errors.New("failed to decrypt")
+	ErrNoIndexKey = errors.New("no blind index key, rotate the master keys to add one")
+)
+
+type keyFile struct {
+	ActiveKeyID string     `json:"active_kid"`
+	Keys        []keyEntry `json:"keys"`
+	IndexKey    []byte     `json:"index_key,omitempty"`
+}
+
+type keyEntry struct {
+	ID        string     `json:"kid"`
+	Key       []byte     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+// MasterKeys wrap the data keys of envelope encrypted records and encrypt
+// small values directly. Only the active key encrypts, the others still
+// decrypt old records. The blind index key is never rotated, as every index
+// would have to be computed again.
+type MasterKeys struct {
+	mu       sync.RWMutex
+	activeID string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+func LoadMasterKeys(path string) (*MasterKeys, error) {
+	k := &MasterKeys{}
+	if err := k.Reload(path); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+func (k *MasterKeys) Reload(path string) error {
+	file, err := readKeyFile(path)
+	if err != nil {
+		return err
+	}
+	keys := make(map[string][]byte, len(file.Keys))
+	for _, entry := range file.Keys {
+		if len(entry.Key) != keySize {
+			return fmt.Errorf("master key %s is not %d bytes long", entry.ID, keySize)
+		}
+		keys[entry.ID] = entry.Key
+	}
+	if _, ok := keys[file.ActiveKeyID]; !ok {
+		return fmt.Errorf("active master key %q is not in %s", file.ActiveKeyID, path)
+	}
+
+	if file.IndexKey != nil && len(file.IndexKey) != keySize {
+		return fmt.Errorf("blind index key is not %d bytes long", keySize)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.activeID, k.keys, k.indexKey = file.ActiveKeyID, keys, file.IndexKey
+	return nil
+}
+
+// WatchMasterKeys reloads the keys every interval until ctx is done, so that
+// a rotation takes effect without a restart.
+func WatchMasterKeys(ctx context.Context, k *MasterKeys, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			previous := k.ActiveKeyID()
+			if err := k.Reload(path); err != nil {
+				log.Printf("failed to reload master keys: %v", err)
+				continue
+			}
+			if active := k.ActiveKeyID(); active != previous {
+				log.Printf("master key rotated: %s -> %s", previous, active)
+			}
+		}
+	}
+}
+
+func (k *MasterKeys) ActiveKeyID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.activeID
+}
+
+// NewDataKey returns a fresh data key and the same key wrapped by the active
+// master key, whose id is returned too. aad binds the wrapped key to its
+// record.
+func (k *MasterKeys) NewDataKey(aad []byte) (key, wrapped []byte, kid string, err error) {
+	key = make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, "", fmt.Errorf("failed to generate data key: %w", err)
+	}
+	wrapped, kid, err = k.wrap(key, aad)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	return key, wrapped, kid, nil
+}
+
+func (k *MasterKeys) UnwrapDataKey(kid string, wrapped, aad []byte) ([]byte, error) {
+	k.mu.RLock()
+	master, ok := k.keys[kid]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return Open(master, wrapped, aad)
+}
+
+// Rewrap wraps a data key again with the active master key. The data it
+// protects stays as it is.
+func (k *MasterKeys) Rewrap(kid string, wrapped, aad []byte) ([]byte, string, error) {
+	key, err := k.UnwrapDataKey(kid, wrapped, aad)
+	if err != nil {
+		return nil, "", err
+	}
+	return k.wrap(key, aad)
+}
+
+func (k *MasterKeys) wrap(key, aad []byte) ([]byte, string, error) {
+	k.mu.RLock()
+	kid, master := k.activeID, k.keys[k.activeID]
+	k.mu.RUnlock()
+
+	wrapped, err := Seal(master, key, aad)
+	if err != nil {
+		return nil, "", err
+	}
+	return wrapped, kid, nil
+}
+
+// Encrypt encrypts plaintext with the active master key. The id of the key is
+// stored in front of the ciphertext, so that Decrypt finds it after a
+// rotation.
+func (k *MasterKeys) Encrypt(plaintext, aad []byte) ([]byte, error) {
+	k.mu.RLock()
+	kid, master := k.activeID, k.keys[k.activeID]
+	k.mu.RUnlock()
+
+	sealed, err := Seal(master, plaintext, aad)
+	if err != nil {
+		return nil, err
+	}
+	ciphertext := make([]byte, 0, 1+len(kid)+len(sealed))
+	ciphertext = append(ciphertext, byte(len(kid)))
+	ciphertext = append(ciphertext, kid...)
+	return append(ciphertext, sealed...), nil
+}
+
+func (k *MasterKeys) Decrypt(ciphertext, aad []byte) ([]byte, error) {
+	kid, sealed, ok := splitKeyID(ciphertext)
+	if !ok {
+		return nil, ErrDecrypt
+	}
+	k.mu.RLock()
+	master, found := k.keys[kid]
+	k.mu.RUnlock()
+	if !found {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return Open(master, sealed, aad)
+}
+
+// KeyIDOf returns the id of the master key ciphertext of Encrypt was
+// encrypted with.
+func KeyIDOf(ciphertext []byte) string {
+	kid, _, _ := splitKeyID(ciphertext)
+	return kid
+}
+
+func splitKeyID(ciphertext []byte) (string, []byte, bool) {
+	if len(ciphertext) == 0 || len(ciphertext) < 1+int(ciphertext[0]) {
+		return "", nil, false
+	}
+	n := 1 + int(ciphertext[0])
+	return string(ciphertext[1:n]), ciphertext[n:], true
+}
+
+// BlindIndex is a keyed HMAC-SHA256 of value, equal for equal values, so that
+// encrypted values can be looked up and kept unique. purpose separates the
+// indexes of different values.
+func (k *MasterKeys) BlindIndex(purpose string, value []byte) ([]byte, error) {
+	k.mu.RLock()
+	indexKey := k.indexKey
+	k.mu.RUnlock()
+	if indexKey == nil {
+		return nil, ErrNoIndexKey
+	}
+
+	mac := hmac.New(sha256.New, indexKey)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write(value)
+	return mac.Sum(nil), nil
+}
+
+// Seal encrypts plaintext with AES-256-GCM and prepends the random nonce.
+func Seal(key, plaintext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+// Open decrypts what Seal returned for the same key and aad.
+func Open(key, ciphertext, aad []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, sealed, aad)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RotateMasterKeys adds a new active master key to the file, creating it if
+// needed, and a blind index key if there is none yet. The previous keys are
+// kept for decryption until prune removes the retired ones, which is only safe
+// once no record uses them.
+func RotateMasterKeys(path string, prune bool) (string, error) {
+	file, err := readKeyFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		file = &keyFile{}
+	} else if err != nil {
+		return "", err
+	}
+
+	kid, err := newKeyID()
+	if err != nil {
+		return "", err
+	}
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate master key: %w", err)
+	}
+
+	now := time.Now().UTC()
+	entries := make([]keyEntry, 0, len(file.Keys)+1)
+	for _, entry := range file.Keys {
+		if entry.RetiredAt == nil {
+			entry.RetiredAt = &now
+		} else if prune {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	entries = append(entries, keyEntry{ID: kid, Key: key, CreatedAt: now})
+
+	indexKey := file.IndexKey
+	if indexKey == nil {
+		indexKey = make([]byte, keySize)
+		if _, err := rand.Read(indexKey); err != nil {
+			return "", fmt.Errorf("failed to generate blind index key: %w", err)
+		}
+	}
+
+	if err := writeKeyFile(path, &keyFile{ActiveKeyID: kid, Keys: entries, IndexKey: indexKey}); err != nil {
+		return "", err
+	}
+	return kid, nil
+}
+
+func readKeyFile(path string) (*keyFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master keys: %w", err)
+	}
+	var file keyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse master keys: %w", err)
+	}
+	return &file, nil
+}
+
+func writeKeyFile(path string, file *keyFile) error {
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode master keys: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("failed to write master keys: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace master keys: %w", err)
+	}
+	return nil
+}
+
+func newKeyID() (string, error) {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate key id: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
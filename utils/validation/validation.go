@@ -0,0 +1,230 @@
+package validation
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	MinPasswordLength = 8
+	MaxPasswordLength = 128
+	MaxEmailLength    = 254
+	MaxURLLength      = 2048
+)
+
+var (
+	e164Pattern  = regexp.MustCompile(`^\+[1-9][0-9]{1,14}$`)
+	loginPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+	MinBirthDate = time.Date(1900, time.January, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// Validator is implemented by request messages that can check themselves.
+type Validator interface {
+	Validate() error
+}
+
+// Violations collects field violations of a single request.
+type Violations struct {
+	fields []*errdetails.BadRequest_FieldViolation
+}
+
+func (v *Violations) Add(field, description string) {
+	v.fields = append(v.fields, &errdetails.BadRequest_FieldViolation{Field: field, Description: description})
+}
+
+func (v *Violations) Addf(field, format string, args ...any) {
+	v.Add(field, fmt.Sprintf(format, args...))
+}
+
+// Err returns nil when nothing was added, otherwise an InvalidArgument status
+// carrying errdetails.BadRequest with every violation.
+func (v *Violations) Err() error {
+	if len(v.fields) == 0 {
+		return nil
+	}
+	st, err := status.New(codes.InvalidArgument, "invalid request").WithDetails(&errdetails.BadRequest{FieldViolations: v.fields})
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "invalid request: %s %s", v.fields[0].Field, v.fields[0].Description)
+	}
+	return st.Err()
+}
+
+func (v *Violations) Required(field, value string) bool {
+	if value == "" {
+		v.Add(field, "is required")
+		return false
+	}
+	return true
+}
+
+func (v *Violations) Length(field, value string, min, max int) {
+	n := utf8.RuneCountInString(value)
+	switch {
+	case n < min && min == 1:
+		v.Add(field, "is required")
+	case n < min:
+		v.Addf(field, "must be at least %d characters long", min)
+	case max > 0 && n > max:
+		v.Addf(field, "must be at most %d characters long", max)
+	}
+}
+
+func (v *Violations) Login(field, login string) {
+	if !v.Required(field, login) {
+		return
+	}
+	if !loginPattern.MatchString(login) {
+		v.Add(field, "must be 3 to 32 characters: latin letters, digits, '_', '.' or '-'")
+	}
+}
+
+func (v *Violations) Email(field, email string) {
+	if !v.Required(field, email) {
+		return
+	}
+	if len(email) > MaxEmailLength {
+		v.Addf(field, "must be at most %d characters long", MaxEmailLength)
+		return
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || addr.Name != "" {
+		v.Add(field, "must be a valid email address")
+	}
+}
+
+// Phone accepts an empty value, otherwise requires E.164 format.
+func (v *Violations) Phone(field, phone string) {
+	if phone != "" && !e164Pattern.MatchString(phone) {
+		v.Add(field, "must be in E.164 format, for example +79991234567")
+	}
+}
+
+// URL accepts an empty value, otherwise requires an absolute http or https
+// URL.
+func (v *Violations) URL(field, value string) {
+	if value == "" {
+		return
+	}
+	if len(value) > MaxURLLength {
+		v.Addf(field, "must be at most %d characters long", MaxURLLength)
+		return
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		v.Add(field, "must be an http or https URL")
+	}
+}
+
+// Password enforces the password policy: length limits and at least one
+// letter and one digit.
+func (v *Violations) Password(field, password string) {
+	if !v.Required(field, password) {
+		return
+	}
+	n := utf8.RuneCountInString(password)
+	if n < MinPasswordLength {
+		v.Addf(field, "must be at least %d characters long", MinPasswordLength)
+		return
+	}
+	if n > MaxPasswordLength {
+		v.Addf(field, "must be at most %d characters long", MaxPasswordLength)
+		return
+	}
+
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		v.Add(field, "must contain at least one letter and one digit")
+	}
+}
+
+func (v *Violations) BirthDate(field string, ts *timestamppb.Timestamp) {
+	if ts == nil {
+		v.Add(field, "is required")
+		return
+	}
+	if err := ts.CheckValid(); err != nil {
+		v.Add(field, "is not a valid timestamp")
+		return
+	}
+	t := ts.AsTime()
+	if t.Before(MinBirthDate) || t.After(time.Now()) {
+		v.Addf(field, "must be between %s and today", MinBirthDate.Format(time.DateOnly))
+	}
+}
+
+func (v *Violations) UUID(field, value string) {
+	if !v.Required(field, value) {
+		return
+	}
+	if _, err := uuid.Parse(value); err != nil {
+		v.Add(field, "must be a UUID")
+	}
+}
+
+func (v *Violations) Positive(field string, value int64) {
+	if value <= 0 {
+		v.Add(field, "must be positive")
+	}
+}
+
+func (v *Violations) Range(field string, value, min, max int64) {
+	if value < min || value > max {
+		v.Addf(field, "must be between %d and %d", min, max)
+	}
+}
+
+// UnaryServerInterceptor rejects requests whose Validate method fails before
+// they reach the handler.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if v, ok := req.(Validator); ok {
+			if err := v.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor validates every message received on the stream.
+func StreamServerInterceptor() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &validatingStream{ServerStream: ss})
+	}
+}
+
+type validatingStream struct {
+	grpc.ServerStream
+}
+
+func (s *validatingStream) RecvMsg(m any) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if v, ok := m.(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}